@@ -0,0 +1,251 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gdotgordon/laff/store"
+	"github.com/gorilla/mux"
+)
+
+// JokeRequest is the body for creating or updating a stored joke.  The
+// text may use {first} and {last} for the name, and {first2} and {last2}
+// for a second person's.  Setting the status approves a joke a user
+// submitted, or holds a joke back.
+type JokeRequest struct {
+	ID         int      `json:"id,omitempty"`
+	Text       string   `json:"joke"`
+	Categories []string `json:"categories,omitempty"`
+	Source     string   `json:"source,omitempty"`
+	Status     string   `json:"status,omitempty"`
+}
+
+// JokesResponse is the JSON returned for a page of the stored jokes.
+type JokesResponse struct {
+	Jokes []store.StoredJoke `json:"jokes"`
+	Page  int                `json:"page"`
+	Limit int                `json:"limit"`
+	Total int                `json:"total"`
+}
+
+// listJokes returns a page of the stored jokes, in ID order, those with
+// the status only if one is given.
+func (a apiImpl) listJokes(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if err := checkStatus(status); err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	a.writeJokes(w, r, status)
+}
+
+// writeJokes writes the page of the stored jokes with the status, or of
+// any status if it is empty, asked for by the limit and page parameters.
+func (a apiImpl) writeJokes(w http.ResponseWriter, r *http.Request, status string) {
+	limit, err := intParam(r, "limit", dfltPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("limit must be between 1 and %d", maxPageSize))
+		return
+	}
+	page, err := intParam(r, "page", 1)
+	if err != nil || page < 1 {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("page must be a positive number"))
+		return
+	}
+
+	jokes, total, err := a.jokes.Jokes(r.Context(), status, (page-1)*limit, limit)
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if jokes == nil {
+		jokes = []store.StoredJoke{}
+	}
+	a.writeJSON(w, http.StatusOK, JokesResponse{Jokes: jokes, Page: page, Limit: limit, Total: total})
+}
+
+// createJoke adds a joke.  Without an ID in the body, one is assigned.
+func (a apiImpl) createJoke(w http.ResponseWriter, r *http.Request) {
+	var req JokeRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	jk, err := jokeFromRequest(req, store.SourceUser)
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if jk.ID < 0 {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, errors.New("id can't be negative"))
+		return
+	}
+
+	jk, err = a.jokes.CreateJoke(r.Context(), jk)
+	if err != nil {
+		if err == store.ErrExists {
+			a.writeErrorResponse(w, r, http.StatusConflict,
+				fmt.Errorf("joke %d already exists", req.ID))
+		} else {
+			a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.Header().Set("Location", adminJokes+"/"+strconv.Itoa(jk.ID))
+	a.writeJSON(w, http.StatusCreated, jk)
+}
+
+// getJoke returns the stored joke in the URL.
+func (a apiImpl) getJoke(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["jokeID"])
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	jk, err := a.jokes.Joke(r.Context(), id)
+	if err != nil {
+		a.writeStoreError(w, r, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, jk)
+}
+
+// updateJoke replaces the stored joke in the URL.
+func (a apiImpl) updateJoke(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["jokeID"])
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var req JokeRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	if req.ID != 0 && req.ID != id {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			errors.New("the id in the body doesn't match the URL"))
+		return
+	}
+	req.ID = id
+	jk, err := jokeFromRequest(req, store.SourceUser)
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	jk, err = a.jokes.UpdateJoke(r.Context(), jk)
+	if err != nil {
+		a.writeStoreError(w, r, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, jk)
+}
+
+// deleteJoke removes the stored joke in the URL.
+func (a apiImpl) deleteJoke(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["jokeID"])
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.jokes.DeleteJoke(r.Context(), id); err != nil {
+		a.writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jokeFromRequest checks a joke request, filling in the default source.
+func jokeFromRequest(req JokeRequest, dfltSource string) (store.StoredJoke, error) {
+	jk := store.StoredJoke{
+		ID:         req.ID,
+		Text:       strings.TrimSpace(req.Text),
+		Categories: req.Categories,
+		Source:     req.Source,
+		Status:     req.Status,
+	}
+	if jk.Text == "" {
+		return jk, errors.New("the joke text is required")
+	}
+	if err := checkStatus(jk.Status); err != nil {
+		return jk, err
+	}
+	switch jk.Source {
+	case "":
+		jk.Source = dfltSource
+	case store.SourceBuiltin, store.SourceSynced, store.SourceUser:
+	default:
+		return jk, fmt.Errorf("source must be %q, %q or %q",
+			store.SourceBuiltin, store.SourceSynced, store.SourceUser)
+	}
+	return jk, nil
+}
+
+// checkStatus checks the status of a joke is one the store knows, if set.
+func checkStatus(status string) error {
+	switch status {
+	case "", store.StatusApproved, store.StatusPending, store.StatusRejected:
+		return nil
+	}
+	return fmt.Errorf("status must be %q, %q or %q",
+		store.StatusApproved, store.StatusPending, store.StatusRejected)
+}
+
+// writeStoreError writes the response for a store error, which is a 404
+// for a joke that doesn't exist.
+func (a apiImpl) writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == store.ErrNotFound {
+		a.writeErrorResponse(w, r, http.StatusNotFound, err)
+	} else {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// bufPool holds the buffers the JSON responses are encoded into, so each
+// response doesn't allocate, and grow, a buffer of its own.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// maxPooled is the size of the largest buffer put back in the pool, so a
+// big response, such as a long history, isn't held on to.
+const maxPooled = 64 << 10
+
+// writeJSON writes the value as an indented JSON response.
+func (a apiImpl) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooled {
+			bufPool.Put(buf)
+		}
+	}()
+	enc := json.NewEncoder(buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		a.log.Errorw("invoke error", "error", err, "code", http.StatusInternalServerError)
+		writeStatus(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+)
+
+const (
+	// alertInterval is how often the burn rates are checked, which is as
+	// often as the SLO tracker's counts change.
+	alertInterval = time.Minute
+
+	// minAlertRequests is the fewest requests to a route in a window its
+	// burn rate is alerted on, so a single failure on a quiet route
+	// doesn't page anyone.
+	minAlertRequests = 20
+
+	// alertTimeout limits each webhook call.
+	alertTimeout = 10 * time.Second
+)
+
+// BurnAlerter posts an alert to webhooks when a route burns through its
+// error budget too fast.  The error budget is the share of the requests
+// the availability objective lets fail, and the burn rate is how many
+// times faster than that they are failing over a window: at a burn rate
+// of 1 the budget lasts exactly as long as the window.  Each window has
+// its own threshold, such as 14.4 over 5 minutes and 6 over an hour.  An
+// alert is resolved when the burn rate falls back under the threshold.
+type BurnAlerter struct {
+	slo    *SLOTracker
+	burn   map[string]float64 // threshold by window
+	urls   []string
+	key    string // PagerDuty routing key, if any
+	secret []byte // the alerts are signed with, if set
+	client *http.Client
+	source string
+	log    logging.Logger
+	firing map[string]bool // by dedup key
+}
+
+// BurnAlert describes the burn rate of a route over a window.
+type BurnAlert struct {
+	Route        string  `json:"route"`
+	Window       string  `json:"window"`
+	BurnRate     float64 `json:"burnRate"`
+	Threshold    float64 `json:"threshold"`
+	Requests     int64   `json:"requests"`
+	Availability float64 `json:"availability"`
+	Objective    float64 `json:"objective"`
+}
+
+// alertPayload is what is posted to the webhooks.  It carries the text
+// a Slack incoming webhook shows, alongside the fields of a PagerDuty
+// event, so the same payload works with either.
+type alertPayload struct {
+	Text        string       `json:"text"`
+	RoutingKey  string       `json:"routing_key,omitempty"`
+	EventAction string       `json:"event_action"` // trigger or resolve
+	DedupKey    string       `json:"dedup_key"`
+	Payload     alertDetails `json:"payload"`
+}
+
+// alertDetails is the PagerDuty event payload.
+type alertDetails struct {
+	Summary       string    `json:"summary"`
+	Source        string    `json:"source"`
+	Severity      string    `json:"severity"`
+	CustomDetails BurnAlert `json:"custom_details"`
+}
+
+// NewBurnAlerter creates an alerter checking the routes tracked against
+// the thresholds, by window, posting to the webhook URLs.  The key is the
+// PagerDuty routing key, which may be empty.
+func NewBurnAlerter(slo *SLOTracker, burn map[string]float64, urls []string, key string,
+	log logging.Logger) (*BurnAlerter, error) {
+	for window, threshold := range burn {
+		known := false
+		for _, w := range sloWindows {
+			known = known || w.name == window
+		}
+		if !known || threshold <= 0 {
+			return nil, fmt.Errorf("invalid burn rate threshold %v over %q", threshold, window)
+		}
+	}
+	source, err := os.Hostname()
+	if err != nil {
+		source = "laff"
+	}
+	return &BurnAlerter{
+		slo:    slo,
+		burn:   burn,
+		urls:   urls,
+		key:    key,
+		client: &http.Client{Timeout: alertTimeout},
+		source: source,
+		log:    log,
+		firing: make(map[string]bool),
+	}, nil
+}
+
+// Sign has the alerts signed with the secret, in the X-Laff-Signature
+// header, as the responses are.  It must be called before Run.
+func (ba *BurnAlerter) Sign(secret []byte) {
+	ba.secret = secret
+}
+
+// Run checks the burn rates every interval, until the context is done.
+func (ba *BurnAlerter) Run(ctx context.Context) {
+	t := time.NewTicker(alertInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			ba.check(ctx)
+		}
+	}
+}
+
+// check alerts on the routes newly over a threshold, and resolves those
+// back under it.
+func (ba *BurnAlerter) check(ctx context.Context) {
+	rep := ba.slo.Report()
+	budget := 1 - rep.Objective
+	routes := make([]string, 0, len(rep.Routes))
+	for route := range rep.Routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		for window, threshold := range ba.burn {
+			sum := rep.Routes[route][window]
+			alert := BurnAlert{
+				Route:        route,
+				Window:       window,
+				BurnRate:     (1 - sum.Availability) / budget,
+				Threshold:    threshold,
+				Requests:     sum.Requests,
+				Availability: sum.Availability,
+				Objective:    rep.Objective,
+			}
+			over := sum.Requests >= minAlertRequests && alert.BurnRate >= threshold
+			dedup := fmt.Sprintf("laff-slo-%s-%s", route, window)
+			if ba.firing[dedup] == over {
+				continue
+			}
+			if over {
+				ba.firing[dedup] = true
+			} else {
+				delete(ba.firing, dedup)
+			}
+			ba.notify(ctx, dedup, over, alert)
+		}
+	}
+}
+
+// notify posts the alert, or its resolution, to each webhook.
+func (ba *BurnAlerter) notify(ctx context.Context, dedup string, firing bool, alert BurnAlert) {
+	p := alertPayload{
+		RoutingKey: ba.key,
+		DedupKey:   dedup,
+		Payload: alertDetails{
+			Source:        ba.source,
+			Severity:      "critical",
+			CustomDetails: alert,
+		},
+	}
+	if firing {
+		p.EventAction = "trigger"
+		p.Payload.Summary = fmt.Sprintf("%s is burning its error budget %.1fx too fast over %s (threshold %.1fx)",
+			alert.Route, alert.BurnRate, alert.Window, alert.Threshold)
+		ba.log.Warnw("Error budget burn rate over threshold", "alert", alert)
+	} else {
+		p.EventAction = "resolve"
+		p.Payload.Summary = fmt.Sprintf("%s error budget burn rate over %s is back under %.1fx",
+			alert.Route, alert.Window, alert.Threshold)
+		ba.log.Infow("Error budget burn rate back under threshold", "alert", alert)
+	}
+	p.Text = fmt.Sprintf("[laff %s] %s", ba.source, p.Payload.Summary)
+	b, err := json.Marshal(p)
+	if err != nil {
+		ba.log.Errorw("Error encoding alert", "error", err)
+		return
+	}
+	for _, url := range ba.urls {
+		if err := ba.post(ctx, url, b); err != nil {
+			ba.log.Errorw("Error posting alert", "url", url, "error", err)
+		}
+	}
+}
+
+// post sends the alert body to a webhook.
+func (ba *BurnAlerter) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(ba.secret) > 0 {
+		req.Header.Set(signatureHeader, signature(ba.secret, body))
+	}
+	resp, err := ba.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got HTTP status %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
@@ -6,119 +6,590 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
-	tollboothV5 "github.com/didip/tollbooth/v5"
+	"github.com/gdotgordon/laff/events"
+	"github.com/gdotgordon/laff/jokefmt"
+	"github.com/gdotgordon/laff/logging"
 	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/store"
+	"github.com/gdotgordon/laff/tenant"
+	"github.com/gdotgordon/laff/translate"
 	"github.com/gorilla/mux"
-	"go.uber.org/zap"
 )
 
 // Definitions for the supported URL endpoints.
 const (
-	jokeURL   = "/v1/joke"
-	statusURL = "/v1/status" // ping
+	jokeURL      = "/v1/joke"
+	todayURL     = "/v1/joke/today"
+	statusURL    = "/v1/status" // ping
+	readyURL     = "/v1/ready"
+	upstreamsURL = "/v1/status/upstreams"
+	statsURL     = "/v1/stats"
+	favoritesURL = "/v1/favorites"
+	favoriteURL  = "/v1/favorites/{jokeID:[0-9]+}"
+	historyURL   = "/v1/history"
+	profileURL   = "/v1/profile"
+	searchURL    = "/v1/jokes/search"
+	batchURL     = "/v1/jokes/batch"
+	submitURL    = "/v1/jokes"
+	schemasURL   = "/v1/schemas"
+	schemaURL    = "/v1/schemas/{name}"
+	adminJokes   = "/v1/admin/jokes"
+	adminJoke    = "/v1/admin/jokes/{jokeID:[0-9]+}"
+	adminSLO     = "/v1/admin/slo"
+	breakersURL  = "/v1/admin/breakers"
+	breakerURL   = "/v1/admin/breakers/{upstream}"
+	tenantsURL   = "/v1/admin/tenants"
+	usageURL     = "/v1/usage"
+	adminUsage   = "/v1/admin/usage"
+	limiterURL   = "/v1/admin/limiter"
+	bansURL      = "/v1/admin/bans"
+	banURL       = "/v1/admin/bans/{client}"
+	drainURL     = "/v1/admin/drain"
+	namesURL     = "/v1/admin/names"
+	submissions  = "/v1/admin/submissions"
+	submission   = "/v1/admin/submissions/{jokeID:[0-9]+}"
+	metricsURL   = "/metrics"
 )
 
+// Config holds the settings for the API layer.
+type Config struct {
+	Limit     int                 // rate limiter requests/second
+	Limiter   *RateLimiter        // rate limiter, created from Limit if nil
+	Shedder   *ConcurrencyLimiter // caps the requests in flight, if set
+	Slow      *LatencyShedder     // sheds requests while they're slow, if set
+	SLO       *SLOTracker         // tracks the requests against the SLOs, if set
+	Metrics   *RouteMetrics       // counts the requests by route for Prometheus, if set
+	Tenants   *tenant.Registry    // the teams served, if set
+	Bans      *BanList            // bans the clients refused too often, if set
+	Recent    *RecentJokes        // keeps the jokes served to a client from repeating, if set
+	CacheCtl  map[string]string   // Cache-Control directives by route template, if set
+	APIKeys   []string            // API keys accepted, auth is disabled if empty
+	AdminKeys []string            // keys for the admin endpoints, disabled if empty
+	Keys      *KeyRing            // replaces APIKeys and AdminKeys, to change them while serving
+	Quota     Quota               // requests allowed each API key, needs APIKeys
+	SignKey   []byte              // secret the response bodies are signed with, if set
+	JokeLink  string              // link to a joke's source in Markdown, {id} replaced by its ID
+	Store     store.Store         // persistence for user data and history
+	Build     BuildInfo           // reported by the status endpoint
+	MaxBody   int64               // limit on request body size in bytes
+	MaxTime   time.Duration       // longest timeout a client may ask for, no limit if 0
+	Ready     *Readiness          // reported by the readiness endpoint
+	DrainWait time.Duration       // from a drain request to the server draining
+	Events    events.Publisher    // stream of the jokes served, if any
+
+	// Translator translates the jokes to the language the caller asks
+	// for.  Without one, the jokes are always in English.
+	Translator translate.Translator
+
+	// Formatter decorates the jokes with the operator's template, if set.
+	Formatter *jokefmt.Formatter
+}
+
 // StatusResponse is the JSON returned for a liveness check as well as
 // for other status notifications such errors.
 type StatusResponse struct {
 	Status string `json:"status"`
 }
 
+// BuildInfo identifies the running binary.  The values are normally set
+// by the linker when building a release.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// CacheStatus is the number of items in each of the service caches.
+type CacheStatus struct {
+	Names    int     `json:"names"`
+	Jokes    int     `json:"jokes"`
+	Size     int     `json:"size"`     // most names, and most jokes, cached
+	JokeHits int64   `json:"jokeHits"` // jokes served from the joke cache
+	NameHits int64   `json:"nameHits"` // jokes made for a cached name
+	Misses   int64   `json:"misses"`   // jokes needing a name fetch
+	HitRatio float64 `json:"hitRatio"` // of the jokes, the hits
+}
+
+// JokeResponse is the JSON returned for a joke to the callers asking for
+// JSON rather than text.
+type JokeResponse struct {
+	ID         int      `json:"id"`
+	Joke       string   `json:"joke"`
+	Lang       string   `json:"lang"`
+	Names      []string `json:"names"` // of the people in the joke, in order
+	Categories []string `json:"categories,omitempty"`
+}
+
+// ServiceStatus is the JSON returned by the status endpoint.
+type ServiceStatus struct {
+	Status string `json:"status"`
+	BuildInfo
+	GoVersion string                   `json:"goVersion"`
+	Uptime    string                   `json:"uptime"`
+	Cache     CacheStatus              `json:"cache"`
+	Upstreams []service.UpstreamStatus `json:"upstreams"`
+
+	// Experiment compares the joke providers of the running experiment.
+	Experiment *service.ExperimentStats `json:"experiment,omitempty"`
+}
+
 // API is the item that dispatches to the endpoint implementations.  It needs a
 // reference to the laff service to be able to inoke the joke retrieval.
 type apiImpl struct {
-	svc *service.LaffService
-	log *zap.SugaredLogger
+	svc       *service.LaffService
+	store     store.Store
+	keys      *KeyRing
+	jokes     store.JokeStore
+	moderated *moderationCounts
+	profiles  store.ProfileStore
+	build     BuildInfo
+	started   time.Time
+	ready     *Readiness
+	drainWait time.Duration
+	events    events.Publisher
+	tr        translate.Translator
+	fmt       *jokefmt.Formatter
+	jokeLink  string
+	slo       *SLOTracker
+	metrics   *RouteMetrics
+	tenantReg *tenant.Registry
+	usage     store.UsageStore
+	limiter   *RateLimiter
+	bans      *BanList
+	recent    *RecentJokes
+	quota     Quota
+	log       logging.Logger
 }
 
 // Init sets up the endpoint processing.  There is nothing returned, other
 // than potential errors, because the endpoint handling is configured in
 // the passed-in muxer.
-func Init(ctx context.Context, r *mux.Router, svc *service.LaffService, limit int, log *zap.SugaredLogger) error {
-	ap := apiImpl{svc: svc, log: log}
+func Init(ctx context.Context, r *mux.Router, svc *service.LaffService, cfg Config, log logging.Logger) error {
+	if cfg.Store == nil {
+		return errors.New("a store is required")
+	}
+	if cfg.Keys == nil {
+		cfg.Keys = NewKeyRing(cfg.APIKeys, cfg.AdminKeys)
+	}
+	cfg.APIKeys, cfg.AdminKeys = cfg.Keys.apiKeys(), cfg.Keys.adminKeys()
+	ap := apiImpl{
+		svc:       svc,
+		store:     cfg.Store,
+		keys:      cfg.Keys,
+		build:     cfg.Build,
+		started:   time.Now(),
+		ready:     cfg.Ready,
+		drainWait: cfg.DrainWait,
+		events:    cfg.Events,
+		tr:        cfg.Translator,
+		fmt:       cfg.Formatter,
+		jokeLink:  cfg.JokeLink,
+		slo:       cfg.SLO,
+		metrics:   cfg.Metrics,
+		tenantReg: cfg.Tenants,
+		bans:      cfg.Bans,
+		recent:    cfg.Recent,
+		quota:     cfg.Quota,
+		log:       log,
+	}
+	// The handlers are bound to copies of ap, so it must be complete
+	// before they are registered.
+	if js, ok := cfg.Store.(store.JokeStore); ok {
+		ap.jokes = js
+		ap.moderated = &moderationCounts{}
+	}
+	if ps, ok := cfg.Store.(store.ProfileStore); ok && len(cfg.APIKeys) > 0 {
+		ap.profiles = ps
+	}
 	r.HandleFunc("/", ap.generateJoke).Methods(http.MethodGet)
 	r.HandleFunc(jokeURL, ap.generateJoke).Methods(http.MethodGet)
+	r.HandleFunc(batchURL, ap.getBatch).Methods(http.MethodGet)
+	r.HandleFunc(todayURL, ap.getToday).Methods(http.MethodGet)
 	r.HandleFunc(statusURL, ap.getStatus).Methods(http.MethodGet)
+	r.HandleFunc(readyURL, ap.getReady).Methods(http.MethodGet)
+	r.HandleFunc(upstreamsURL, ap.getUpstreams).Methods(http.MethodGet)
+	r.HandleFunc(statsURL, ap.getStats).Methods(http.MethodGet)
+	r.HandleFunc(schemasURL, ap.listSchemas).Methods(http.MethodGet)
+	r.HandleFunc(schemaURL, ap.getSchema).Methods(http.MethodGet)
+	if cfg.Metrics != nil {
+		r.HandleFunc(metricsURL, ap.getMetrics).Methods(http.MethodGet)
+	}
+	r.HandleFunc(searchURL, ap.searchJokes).Methods(http.MethodGet)
+
+	// The per-user endpoints only make sense when we can tell the users
+	// apart, so they are only available when auth is enabled.
+	if len(cfg.APIKeys) > 0 {
+		r.Handle(favoritesURL, ap.authenticate(ap.listFavorites)).Methods(http.MethodGet)
+		r.Handle(favoriteURL, ap.authenticate(ap.addFavorite)).Methods(http.MethodPut)
+		r.Handle(favoriteURL, ap.authenticate(ap.removeFavorite)).Methods(http.MethodDelete)
+	}
+	if ap.profiles != nil {
+		r.Handle(profileURL, ap.authenticate(ap.getProfile)).Methods(http.MethodGet)
+		r.Handle(profileURL, ap.authenticate(ap.putProfile)).Methods(http.MethodPut)
+		r.Handle(profileURL, ap.authenticate(ap.deleteProfile)).Methods(http.MethodDelete)
+	}
+
+	// The requests with each API key are counted, if the store can, and
+	// held to the quota.
+	if us, ok := cfg.Store.(store.UsageStore); ok && len(cfg.APIKeys) > 0 {
+		ap.usage = us
+		r.Handle(usageURL, ap.authenticate(ap.getUsage)).Methods(http.MethodGet)
+	} else if cfg.Quota != (Quota{}) {
+		return errors.New("quotas need API keys and a store that counts the usage")
+	}
+
+	// The admin endpoints manage the stored jokes, if the store can hold
+	// them, and the users can submit their own for the admins to approve.
+	if ap.jokes != nil && len(cfg.APIKeys) > 0 {
+		r.Handle(submitURL, ap.authenticate(ap.submitJoke)).Methods(http.MethodPost)
+	}
+	if ap.jokes != nil && len(cfg.AdminKeys) > 0 {
+		r.Handle(adminJokes, ap.requireAdmin(ap.listJokes)).Methods(http.MethodGet)
+		r.Handle(adminJokes, ap.requireAdmin(ap.createJoke)).Methods(http.MethodPost)
+		r.Handle(adminJoke, ap.requireAdmin(ap.getJoke)).Methods(http.MethodGet)
+		r.Handle(adminJoke, ap.requireAdmin(ap.updateJoke)).Methods(http.MethodPut)
+		r.Handle(adminJoke, ap.requireAdmin(ap.deleteJoke)).Methods(http.MethodDelete)
+		r.Handle(submissions, ap.requireAdmin(ap.listSubmissions)).Methods(http.MethodGet)
+		r.Handle(submission, ap.requireAdmin(ap.moderateJoke)).Methods(http.MethodPost)
+	}
+	if cfg.SLO != nil && len(cfg.AdminKeys) > 0 {
+		r.Handle(adminSLO, ap.requireAdmin(ap.getSLO)).Methods(http.MethodGet)
+	}
+	if len(cfg.AdminKeys) > 0 {
+		// The history holds every user's jokes, so only the admins see it.
+		r.Handle(historyURL, ap.requireAdmin(ap.getHistory)).Methods(http.MethodGet)
+		r.Handle(breakersURL, ap.requireAdmin(ap.listBreakers)).Methods(http.MethodGet)
+		r.Handle(breakerURL, ap.requireAdmin(ap.forceBreaker)).Methods(http.MethodPost)
+		r.Handle(namesURL, ap.requireAdmin(ap.seedNames)).Methods(http.MethodPost)
+	}
+	if ap.usage != nil && len(cfg.AdminKeys) > 0 {
+		r.Handle(adminUsage, ap.requireAdmin(ap.exportUsage)).Methods(http.MethodGet)
+	}
+	if cfg.Bans != nil && len(cfg.AdminKeys) > 0 {
+		r.Handle(bansURL, ap.requireAdmin(ap.listBans)).Methods(http.MethodGet)
+		r.Handle(bansURL, ap.requireAdmin(ap.clearBan)).Methods(http.MethodDelete)
+		r.Handle(banURL, ap.requireAdmin(ap.clearBan)).Methods(http.MethodDelete)
+	}
+	if cfg.Ready != nil && len(cfg.AdminKeys) > 0 {
+		r.Handle(drainURL, ap.requireAdmin(ap.drain)).Methods(http.MethodPost)
+	}
+	if cfg.Tenants != nil && len(cfg.AdminKeys) > 0 {
+		r.Handle(tenantsURL, ap.requireAdmin(ap.listTenants)).Methods(http.MethodGet)
+	}
 
 	// As part of making the code "production-ready", we add a rate limiter to
-	// the middleware chain.
-	var limiterMiddleware = func(next http.Handler) http.Handler {
-		return tollboothV5.LimitFuncHandler(tollboothV5.NewLimiter(float64(limit), nil),
-			func(w http.ResponseWriter, r *http.Request) {
-				rc := r.WithContext(ctx)
-				next.ServeHTTP(w, rc)
-			})
+	// the middleware chain.  The middleware is applied to every request, so
+	// the limiter must be created up front to keep its state.
+	rl := cfg.Limiter
+	if rl == nil {
+		rl = NewRateLimiter(float64(cfg.Limit))
+	}
+	ap.limiter = rl
+	if len(cfg.AdminKeys) > 0 {
+		r.Handle(limiterURL, ap.requireAdmin(ap.getLimiter)).Methods(http.MethodGet)
 	}
 
-	// Stick the context that contains the cancel into the request.
+	// Tie the request context to the one that contains the cancel.  We
+	// can't simply replace the request context, as it carries the route
+	// variables.
 	var wrapContext = func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			rc := r.WithContext(ctx)
-			next.ServeHTTP(w, rc)
+			rctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			go func() {
+				select {
+				case <-ctx.Done():
+					cancel()
+				case <-rctx.Done():
+				}
+			}()
+			next.ServeHTTP(w, r.WithContext(rctx))
 		})
 	}
 
-	// Log each request.
+	// Log each request, and give the code handling it a logger carrying
+	// its request ID, and trace ID if the caller is tracing, so all its
+	// log entries can be picked out from the others'.
 	var loggingMiddleware = func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Infow("Handling URL", "url", r.URL)
-			next.ServeHTTP(w, r)
+			rl := log.With("requestID", service.RequestID(r.Context()))
+			if id := traceID(r); id != "" {
+				rl = rl.With("traceID", id)
+			}
+			rl.Infow("Handling URL", "url", r.URL)
+			next.ServeHTTP(w, r.WithContext(logging.NewContext(r.Context(), rl)))
 		})
 	}
-	r.Use(limiterMiddleware)
+	// The responses are signed first, so even those turned away carry
+	// a signature.
+	if len(cfg.SignKey) > 0 {
+		r.Use(sign(cfg.SignKey))
+	}
+	// The requests get their IDs and logger next, so the entries logged
+	// by the middleware turning them away carry the IDs too.
+	r.Use(requestID)
 	r.Use(loggingMiddleware)
+	// The Cache-Control is set next, so the responses turned away get
+	// no-store rather than the route's directives.
+	if len(cfg.CacheCtl) > 0 {
+		if err := checkRoutes(r, cfg.CacheCtl); err != nil {
+			return err
+		}
+		r.Use(cacheControl(cfg.CacheCtl))
+	}
+	// The requests are counted next, so the metrics see those turned
+	// away too.
+	if cfg.Metrics != nil {
+		r.Use(cfg.Metrics.track)
+	}
+	// The SLOs are tracked next, so the requests rate limited or shed
+	// count against them too.
+	if cfg.SLO != nil {
+		r.Use(cfg.SLO.track)
+	}
+	// The bans come next, so they see the requests the rate limits and
+	// the authentication turn away.
+	if cfg.Bans != nil {
+		r.Use(ap.ban(cfg.Bans))
+	}
+	r.Use(rl.middleware)
+	if cfg.Shedder != nil {
+		r.Use(ap.shed(cfg.Shedder))
+	}
+	if cfg.Slow != nil {
+		r.Use(ap.shedSlow(cfg.Slow))
+	}
+	if cfg.Tenants != nil {
+		r.Use(ap.tenants(cfg.Tenants))
+	}
+	if ap.usage != nil {
+		r.Use(ap.limitUsage)
+	}
+	r.Use(ap.limitBody(cfg.MaxBody))
 	r.Use(wrapContext)
+	r.Use(ap.deadline(cfg.MaxTime))
 	return nil
 }
 
 // generateJoke is the HTTP GET call invoked by the user.  It returns a
 // plain text result, and works with utf-8 characters.
 func (a *apiImpl) generateJoke(w http.ResponseWriter, r *http.Request) {
-	if r.Body != nil {
-		defer r.Body.Close()
-
-		ioutil.ReadAll(r.Body)
+	if !a.drainBody(w, r) {
+		return
+	}
+	ctx, prof, ok := a.jokeContext(w, r)
+	if !ok {
+		return
+	}
+	// The client isn't served a joke it was served lately, if we can
+	// help it.
+	var client string
+	if a.recent != nil {
+		client = a.client(w, r)
+		ctx = service.AvoidRepeats(ctx, func(id int) bool { return a.recent.seen(client, id) })
 	}
-	msg, err := a.svc.Joke(r.Context())
+	msg, err := a.svc.Joke(ctx)
 	if err != nil {
-		if _, ok := err.(service.RateLimitError); ok {
-			a.writeErrorResponse(w, http.StatusTooManyRequests, err)
-		} else {
-			a.writeErrorResponse(w, http.StatusInternalServerError, err)
-		}
+		a.writeJokeError(w, r, err)
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(msg + "\n"))
+	if a.tr != nil {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	text, lang := a.localize(r, msg.Text, prof.Lang)
+	w.Header().Add("Vary", "Accept")
+	if a.profiles != nil {
+		w.Header().Add("Vary", "Authorization, X-API-Key")
+	}
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("X-Joke-ID", strconv.Itoa(msg.ID))
+	w.Header().Set("X-Laff-Cache", cacheHeader(msg))
+	a.writeJoke(w, r, msg, text, lang)
+	if a.recent != nil {
+		a.recent.add(client, msg.ID)
+	}
+	a.recordHistory(r, msg)
+	a.publishServed(r, msg)
 }
 
-// Liveness check endpoint
-func (a apiImpl) getStatus(w http.ResponseWriter, r *http.Request) {
-	if r.Body != nil {
-		defer r.Body.Close()
+// writeJoke writes the joke, with its text in the language given, in the
+// media type the request asks for.
+func (a *apiImpl) writeJoke(w http.ResponseWriter, r *http.Request, msg service.Joke, text, lang string) {
+	jr := JokeResponse{
+		ID:         msg.ID,
+		Joke:       text,
+		Lang:       lang,
+		Names:      jokeNames(msg),
+		Categories: msg.Categories,
+	}
+	switch typ := jokeType(r); typ {
+	case jsonType:
+		a.writeJSON(w, http.StatusOK, jr)
+	case protoType:
+		writeProto(w, http.StatusOK, "Joke", jr.marshalProto())
+	case msgpackType, cborType:
+		writeBinary(w, typ, jr)
+	case markdownType:
+		writeText(w, markdownType, a.markdown(msg, text))
+	default:
+		writeText(w, plainType, a.decorate(r, msg, text))
+	}
+}
 
-		ioutil.ReadAll(r.Body)
+// jokeContext returns the request's context carrying the joke options in
+// its query, along with the caller's profile, which fills in what the
+// request doesn't ask for.  A bad option is answered with a 400, and false
+// returned.
+func (a *apiImpl) jokeContext(w http.ResponseWriter, r *http.Request) (context.Context, store.Profile, bool) {
+	ctx := r.Context()
+	fail := func(err error) (context.Context, store.Profile, bool) {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return nil, store.Profile{}, false
+	}
+	if v := r.URL.Query().Get("transliterate"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return fail(fmt.Errorf("invalid transliterate %q", v))
+		}
+		ctx = service.Transliterate(ctx, on)
 	}
+	if v := r.URL.Query().Get("seed"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fail(fmt.Errorf("invalid seed %q", v))
+		}
+		ctx = service.Seed(ctx, seed)
+	}
+	if v := r.URL.Query().Get("maxLength"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fail(fmt.Errorf("invalid maxLength %q", v))
+		}
+		ctx = service.MaxLength(ctx, n)
+	}
+	if first, last := r.URL.Query().Get("first2"), r.URL.Query().Get("last2"); first != "" || last != "" {
+		name, err := a.svc.CheckName(service.NameResp{Name: first, Surname: last})
+		if err != nil {
+			return fail(fmt.Errorf("invalid second name: %v", err))
+		}
+		ctx = service.SecondName(ctx, name)
+	}
+	prof, _ := a.profileFor(r)
+	first, last := r.URL.Query().Get("first"), r.URL.Query().Get("last")
+	if first == "" && last == "" {
+		first, last = prof.First, prof.Last
+	}
+	if first != "" || last != "" {
+		name, err := a.checkOwnName(first, last)
+		if err != nil {
+			return fail(err)
+		}
+		ctx = service.OwnName(ctx, name)
+	}
+	cats := prof.Categories
+	if v := r.URL.Query().Get("categories"); v != "" {
+		var err error
+		if cats, err = categoryList(strings.Split(v, ",")); err != nil {
+			return fail(err)
+		}
+	}
+	return service.AllowCategories(ctx, cats), prof, true
+}
 
-	sr := StatusResponse{Status: "IP verify service is up and running"}
-	b, err := json.MarshalIndent(sr, "", "  ")
-	if err != nil {
-		a.writeErrorResponse(w, http.StatusInternalServerError, err)
+// writeJokeError answers a request that couldn't get a joke, with the
+// status code of the reason.
+func (a *apiImpl) writeJokeError(w http.ResponseWriter, r *http.Request, err error) {
+	var cu service.CacheUnavailable
+	var boe service.BreakerOpenError
+	switch {
+	case errors.As(err, &cu):
+		// Nothing cached, and the name service has us waiting.
+		w.Header().Set("Retry-After", strconv.Itoa(int((cu.Retry+time.Second-1)/time.Second)))
+		a.writeProblem(w, r, http.StatusServiceUnavailable, err.Error())
+	case errors.As(err, &boe):
+		// An upstream service is failing, and isn't being called.
+		w.Header().Set("Retry-After", strconv.Itoa(int((boe.Retry+time.Second-1)/time.Second)))
+		a.writeProblem(w, r, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, service.ErrNoCategory), errors.Is(err, service.ErrTooLong):
+		// None of the jokes tried were in the tenant's categories,
+		// or short enough.
+		a.writeProblem(w, r, http.StatusNotFound, err.Error())
+	case errors.As(err, new(service.RateLimitError)):
+		a.writeErrorResponse(w, r, http.StatusTooManyRequests, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		// Past the deadline the client asked for, see deadline.
+		a.writeErrorResponse(w, r, http.StatusGatewayTimeout, err)
+	default:
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// cacheHeader says which cache the joke was served from, for the
+// X-Laff-Cache header: "joke", "name" or "miss".
+func cacheHeader(jk service.Joke) string {
+	if jk.Cache == "" {
+		return "miss"
+	}
+	return jk.Cache
+}
+
+// Liveness check endpoint.  Besides saying we're up, it reports the build
+// and runtime details plus the state of the caches and upstream services,
+// and how the experiment is going if one is running.
+func (a apiImpl) getStatus(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
 		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write(b)
+
+	st := a.svc.Stats()
+	sr := ServiceStatus{
+		Status:    "laff service is up and running",
+		BuildInfo: a.build,
+		GoVersion: runtime.Version(),
+		Uptime:    time.Since(a.started).Round(time.Second).String(),
+		Cache: CacheStatus{
+			Names:    st.NameCache,
+			Jokes:    st.JokeCache,
+			Size:     st.CacheSize,
+			JokeHits: st.JokeHits,
+			NameHits: st.NameHits,
+			Misses:   st.Misses,
+			HitRatio: st.HitRatio(),
+		},
+		Upstreams:  a.svc.CheckUpstreams(),
+		Experiment: st.Experiment,
+	}
+	w.Header().Add("Vary", "Accept")
+	if jokeType(r) == protoType {
+		writeProto(w, http.StatusOK, "Status", sr.marshalProto())
+		return
+	}
+	a.writeJSON(w, http.StatusOK, sr)
 }
 
 // For HTTP bad request responses, serialize a JSON status message with
 // the cause.
-func (a apiImpl) writeErrorResponse(w http.ResponseWriter, code int, err error) {
-	a.log.Errorw("invoke error", "error", err, "code", code)
+func (a apiImpl) writeErrorResponse(w http.ResponseWriter, r *http.Request, code int, err error) {
+	a.logFor(r).Errorw("invoke error", "error", err, "code", code)
+	writeStatus(w, code, err)
+}
+
+// logFor returns the logger of the request, carrying its request ID and
+// trace ID, see the logging middleware.
+func (a apiImpl) logFor(r *http.Request) logging.Logger {
+	return logging.FromContext(r.Context(), a.log)
+}
+
+// writeStatus writes the JSON status message with the cause.
+func writeStatus(w http.ResponseWriter, code int, err error) {
 	w.WriteHeader(code)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	b, _ := json.MarshalIndent(StatusResponse{Status: err.Error()}, "", "  ")
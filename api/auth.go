@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// userKey is the context key for the authenticated user.
+type userKey struct{}
+
+// authenticate wraps a handler so it is only invoked for requests carrying
+// a valid API key.
+func (a apiImpl) authenticate(next http.HandlerFunc) http.Handler {
+	return a.authenticateWith(a.keys.apiKeys, next)
+}
+
+// requireAdmin is like authenticate, but only accepts the admin keys.
+func (a apiImpl) requireAdmin(next http.HandlerFunc) http.Handler {
+	return a.authenticateWith(a.keys.adminKeys, next)
+}
+
+// authenticateWith wraps a handler so it is only invoked for requests
+// carrying one of the keys the function returns, supplied either in the
+// X-API-Key header or as a bearer token.  The user derived from the key
+// is placed in the request context.
+func (a apiImpl) authenticateWith(keys func() []string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r)
+		if key == "" || !validKey(keys(), key) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="laff"`)
+			a.writeErrorResponse(w, r, http.StatusUnauthorized,
+				errors.New("missing or invalid API key"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), userKey{}, userID(key))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestKey returns the key the request carries, in the X-API-Key header
+// or as a bearer token, if any.
+func requestKey(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		}
+	}
+	return key
+}
+
+// validKey checks the key against the valid ones in constant time.
+func validKey(keys []string, key string) bool {
+	valid := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// userID derives the user identifier from the API key.  We store a hash
+// rather than the key itself, so the persisted data doesn't leak the keys.
+func userID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requestUser returns the authenticated user for the request, if any.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
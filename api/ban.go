@@ -0,0 +1,257 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// banSweep is how often the strikes past the window are swept away.
+const banSweep = time.Minute
+
+// errNoBan is returned when clearing a ban that doesn't exist.
+var errNoBan = errors.New("no such ban")
+
+// BanList bans the clients that keep getting turned away, with a 429 from
+// the rate limits or a 401 for a bad API key, for a cooldown, during which
+// their requests get a 403 without going further.  A client is told apart
+// by its API key or by its address, see ban.  Like the
+// RateLimiter, it is created outside the API layer so its state can be
+// reported elsewhere.
+type BanList struct {
+	strikes  int           // turned away this many times in the window gets a ban
+	window   time.Duration // the strikes are counted over
+	cooldown time.Duration // how long a ban lasts
+	now      func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string][]time.Time // the strikes of each client, oldest first
+	bans      map[string]time.Time   // the end of each ban
+	lastSweep time.Time
+	banned    int64 // bans made
+	blocked   int64 // requests turned away by a ban
+}
+
+// Ban is a client that is banned.
+type Ban struct {
+	Client string    `json:"client"`
+	Until  time.Time `json:"until"`
+}
+
+// BanListState is a snapshot of the ban list settings and activity.
+type BanListState struct {
+	Strikes  int    `json:"strikes"`
+	Window   string `json:"window"`
+	Cooldown string `json:"cooldown"`
+	Active   int    `json:"active"`  // bans in force
+	Banned   int64  `json:"banned"`  // bans made
+	Blocked  int64  `json:"blocked"` // requests turned away by a ban
+}
+
+// NewBanList creates a ban list banning a client for the cooldown once
+// it has been turned away strikes times within the window.
+func NewBanList(strikes int, window, cooldown time.Duration) *BanList {
+	return &BanList{
+		strikes:  strikes,
+		window:   window,
+		cooldown: cooldown,
+		now:      time.Now,
+		clients:  make(map[string][]time.Time),
+		bans:     make(map[string]time.Time),
+	}
+}
+
+// banLeft returns how long the client's ban has left, or 0 if it isn't
+// banned.
+func (bl *BanList) banLeft(client string, now time.Time) time.Duration {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	until, ok := bl.bans[client]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(bl.bans, client)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// strike counts the client being turned away, banning it if that makes
+// too many in the window.  It reports whether the client was banned.
+func (bl *BanList) strike(client string, now time.Time) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if now.Sub(bl.lastSweep) >= banSweep {
+		bl.sweep(now)
+	}
+	strikes := append(recent(bl.clients[client], now.Add(-bl.window)), now)
+	if len(strikes) < bl.strikes {
+		bl.clients[client] = strikes
+		return false
+	}
+	delete(bl.clients, client)
+	bl.bans[client] = now.Add(bl.cooldown)
+	bl.banned++
+	return true
+}
+
+// sweep drops the strikes past the window and the bans that are over.
+// The caller must hold the lock.
+func (bl *BanList) sweep(now time.Time) {
+	for client, strikes := range bl.clients {
+		if strikes = recent(strikes, now.Add(-bl.window)); len(strikes) == 0 {
+			delete(bl.clients, client)
+		} else {
+			bl.clients[client] = strikes
+		}
+	}
+	for client, until := range bl.bans {
+		if !now.Before(until) {
+			delete(bl.bans, client)
+		}
+	}
+	bl.lastSweep = now
+}
+
+// recent returns the strikes after the cutoff.
+func recent(strikes []time.Time, cutoff time.Time) []time.Time {
+	i := sort.Search(len(strikes), func(i int) bool { return strikes[i].After(cutoff) })
+	return strikes[i:]
+}
+
+// Bans returns the bans in force, by client.
+func (bl *BanList) Bans() []Ban {
+	now := bl.now()
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bans := []Ban{}
+	for client, until := range bl.bans {
+		if now.Before(until) {
+			bans = append(bans, Ban{Client: client, Until: until.UTC()})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Client < bans[j].Client })
+	return bans
+}
+
+// Clear lifts the client's ban, and forgets its strikes, or lifts all the
+// bans if the client is empty.
+func (bl *BanList) Clear(client string) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if client == "" {
+		bl.bans = make(map[string]time.Time)
+		bl.clients = make(map[string][]time.Time)
+		return nil
+	}
+	if _, ok := bl.bans[client]; !ok {
+		return errNoBan
+	}
+	delete(bl.bans, client)
+	delete(bl.clients, client)
+	return nil
+}
+
+// State returns the current state of the ban list.
+func (bl *BanList) State() BanListState {
+	active := len(bl.Bans())
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return BanListState{
+		Strikes:  bl.strikes,
+		Window:   bl.window.String(),
+		Cooldown: bl.cooldown.String(),
+		Active:   active,
+		Banned:   bl.banned,
+		Blocked:  atomic.LoadInt64(&bl.blocked),
+	}
+}
+
+// banClients identifies the client of a request for the ban list, by its
+// address, and by the ID of its API key, if it carries a valid one, so
+// the key itself isn't kept.  A made-up key is no client of its own, or
+// a client could dodge a ban by sending a new one each time.
+func (a apiImpl) banClients(r *http.Request) (addr, key string) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if k := requestKey(r); k != "" && validKey(a.keys.apiKeys(), k) {
+		key = "key:" + userID(k)
+	}
+	return "ip:" + host, key
+}
+
+// ban turns away the requests of the banned clients with a 403, and
+// counts those turned away by the rate limits or for a bad API key
+// against the client: a bad key against the address, as the keys tried
+// may all differ, and a rate limit against the key, if it is a valid one,
+// as the clients may share an address.  The probes are left alone.
+func (a apiImpl) ban(bl *BanList) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isProbe(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			addr, key := a.banClients(r)
+			now := bl.now()
+			left := bl.banLeft(addr, now)
+			if key != "" {
+				left = max(left, bl.banLeft(key, now))
+			}
+			if left > 0 {
+				atomic.AddInt64(&bl.blocked, 1)
+				w.Header().Set("Retry-After", strconv.Itoa(int((left+time.Second-1)/time.Second)))
+				a.writeProblem(w, r, http.StatusForbidden,
+					fmt.Sprintf("banned for too many refused requests, for another %v", left.Round(time.Second)))
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			client := addr
+			switch sw.code() {
+			case http.StatusTooManyRequests:
+				if key != "" {
+					client = key
+				}
+			case http.StatusUnauthorized:
+			default:
+				return
+			}
+			if bl.strike(client, bl.now()) {
+				a.logFor(r).Warnw("Banning client, too many refused requests", "client", client,
+					"code", sw.code(), "cooldown", bl.cooldown)
+			}
+		})
+	}
+}
+
+// listBans is the admin endpoint listing the bans in force.
+func (a apiImpl) listBans(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	a.writeJSON(w, http.StatusOK, a.bans.Bans())
+}
+
+// clearBan is the admin endpoint lifting a client's ban, or all of them.
+func (a apiImpl) clearBan(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	if err := a.bans.Clear(mux.Vars(r)["client"]); err != nil {
+		a.writeErrorResponse(w, r, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+)
+
+// TestBanMadeUpKeys verifies the rate limited requests with made-up API
+// keys count against the address, so a new key each time dodges no ban,
+// while those with a valid key count against the key.
+func TestBanMadeUpKeys(t *testing.T) {
+	a := apiImpl{keys: NewKeyRing([]string{"good"}, nil), log: logging.Nop()}
+	bl := NewBanList(2, time.Minute, time.Minute)
+	h := a.ban(bl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	get := func(addr, key string) int {
+		r := httptest.NewRequest(http.MethodGet, jokeURL, nil)
+		r.RemoteAddr = addr + ":1234"
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		get("192.0.2.1", fmt.Sprint("made-up-", i))
+	}
+	if code := get("192.0.2.1", "made-up-2"); code != http.StatusForbidden {
+		t.Fatal("expected the address banned, got:", code)
+	}
+
+	// A valid key is banned on its own, leaving its address alone.
+	for i := 0; i < 2; i++ {
+		get("192.0.2.2", "good")
+	}
+	if code := get("192.0.2.2", "good"); code != http.StatusForbidden {
+		t.Fatal("expected the key banned, got:", code)
+	}
+	if code := get("192.0.2.2", "made-up"); code != http.StatusTooManyRequests {
+		t.Fatal("expected the address not banned, got:", code)
+	}
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gdotgordon/laff/service"
+)
+
+// The number of jokes a batch has by default, and at most.
+const (
+	dfltBatch = 5
+	maxBatch  = 20
+)
+
+// BatchResponse is the JSON returned for a batch of jokes.
+type BatchResponse struct {
+	Jokes []JokeResponse `json:"jokes"`
+}
+
+// getBatch returns the number of jokes in the "count" parameter at once,
+// taking the same options as a single joke.  The jokes are different
+// where the service can help it, see service.AvoidRepeats.  It is always
+// JSON.  If a joke can't be had, the request fails as a single joke's
+// would, rather than returning fewer.
+func (a *apiImpl) getBatch(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	count, err := intParam(r, "count", dfltBatch)
+	if err != nil || count < 1 || count > maxBatch {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("count must be between 1 and %d", maxBatch))
+		return
+	}
+	ctx, prof, ok := a.jokeContext(w, r)
+	if !ok {
+		return
+	}
+	// None of the batch repeats another, or a joke the client was
+	// served lately.
+	var client string
+	if a.recent != nil {
+		client = a.client(w, r)
+	}
+	batch := make(map[int]bool, count)
+	ctx = service.AvoidRepeats(ctx, func(id int) bool {
+		return batch[id] || (a.recent != nil && a.recent.seen(client, id))
+	})
+
+	res := BatchResponse{Jokes: make([]JokeResponse, 0, count)}
+	var jokes []service.Joke
+	for len(jokes) < count {
+		msg, err := a.svc.Joke(ctx)
+		if err != nil {
+			a.writeJokeError(w, r, err)
+			return
+		}
+		batch[msg.ID] = true
+		jokes = append(jokes, msg)
+		text, lang := a.localize(r, msg.Text, prof.Lang)
+		res.Jokes = append(res.Jokes, JokeResponse{
+			ID:         msg.ID,
+			Joke:       text,
+			Lang:       lang,
+			Names:      jokeNames(msg),
+			Categories: msg.Categories,
+		})
+	}
+	if a.tr != nil {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	if a.profiles != nil {
+		w.Header().Add("Vary", "Authorization, X-API-Key")
+	}
+	a.writeJSON(w, http.StatusOK, res)
+	for _, msg := range jokes {
+		if a.recent != nil {
+			a.recent.add(client, msg.ID)
+		}
+		a.recordHistory(r, msg)
+		a.publishServed(r, msg)
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gdotgordon/laff/laffmock"
+	"github.com/gdotgordon/laff/service"
+)
+
+// TestBatch verifies a batch has the jokes asked for, each different,
+// with the names always an array, as the schema says.
+func TestBatch(t *testing.T) {
+	mock := laffmock.New()
+	defer mock.Close()
+	r, _ := newTestRouter(t, Config{},
+		service.WithNameURL(mock.NameURL()), service.WithJokeURL(mock.JokeURL()))
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+	w := get(batchURL + "?count=3")
+	var br BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &br); err != nil || w.Code != http.StatusOK {
+		t.Fatal("error getting batch", w.Code, err)
+	}
+	if len(br.Jokes) != 3 {
+		t.Fatal("expected 3 jokes, got:", br.Jokes)
+	}
+	seen := map[int]bool{}
+	for _, jr := range br.Jokes {
+		if seen[jr.ID] || len(jr.Names) != 1 {
+			t.Fatal("unexpected joke in batch:", jr)
+		}
+		seen[jr.ID] = true
+	}
+	for _, bad := range []string{"?count=0", "?count=x", "?count=1000", "?seed=x"} {
+		if w := get(batchURL + bad); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got: %d", bad, w.Code)
+		}
+	}
+
+	// A joke without names has an empty array of them, not null.
+	b, _ := json.Marshal(JokeResponse{Names: jokeNames(service.Joke{})})
+	var raw map[string]any
+	json.Unmarshal(b, &raw)
+	if names, ok := raw["names"].([]any); !ok || len(names) != 0 {
+		t.Fatalf("expected an empty array of names, got: %s", b)
+	}
+	if w := get(schemasURL + "/batch"); w.Code != http.StatusOK {
+		t.Fatal("expected the batch schema, got:", w.Code)
+	}
+}
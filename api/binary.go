@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/binary"
+	"net/http"
+)
+
+// The media types of the binary jokes, for the consumers for which parsing
+// JSON costs too much.  application/x-msgpack is taken for MessagePack
+// too, as the older clients ask for it.
+const (
+	msgpackType  = "application/msgpack"
+	xMsgpackType = "application/x-msgpack"
+	cborType     = "application/cbor"
+)
+
+// binaryEncoder encodes the values a joke is made of, in MessagePack or
+// CBOR, which both have a map, array, string and integer.
+type binaryEncoder interface {
+	mapHeader(n int)
+	arrayHeader(n int)
+	str(s string)
+	integer(v int64)
+	bytes() []byte
+}
+
+// writeBinary writes the joke in the binary media type, as a map with the
+// members of the JSON joke.
+func writeBinary(w http.ResponseWriter, typ string, jr JokeResponse) {
+	var e binaryEncoder = &cborEncoder{}
+	if typ == msgpackType {
+		e = &msgpackEncoder{}
+	}
+	n := 4
+	if len(jr.Categories) > 0 {
+		n++
+	}
+	e.mapHeader(n)
+	e.str("id")
+	e.integer(int64(jr.ID))
+	e.str("joke")
+	e.str(jr.Joke)
+	e.str("lang")
+	e.str(jr.Lang)
+	e.str("names")
+	strs(e, jr.Names)
+	if len(jr.Categories) > 0 {
+		e.str("categories")
+		strs(e, jr.Categories)
+	}
+	w.Header().Set("Content-Type", typ)
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.bytes())
+}
+
+// strs encodes an array of strings.
+func strs(e binaryEncoder, ss []string) {
+	e.arrayHeader(len(ss))
+	for _, s := range ss {
+		e.str(s)
+	}
+}
+
+// msgpackEncoder encodes in MessagePack, using the shortest form of each
+// value.
+type msgpackEncoder struct {
+	b []byte
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	e.header(n, 0x80, 0xde)
+}
+
+func (e *msgpackEncoder) arrayHeader(n int) {
+	e.header(n, 0x90, 0xdc)
+}
+
+// header encodes the length of a map or array: in the fixed form under 16,
+// and otherwise after the 16 bit code, the 32 bit one following it.
+func (e *msgpackEncoder) header(n int, fix, code byte) {
+	switch {
+	case n < 16:
+		e.b = append(e.b, fix|byte(n))
+	case n <= 0xffff:
+		e.b = binary.BigEndian.AppendUint16(append(e.b, code), uint16(n))
+	default:
+		e.b = binary.BigEndian.AppendUint32(append(e.b, code+1), uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) str(s string) {
+	switch n := len(s); {
+	case n < 32:
+		e.b = append(e.b, 0xa0|byte(n))
+	case n <= 0xff:
+		e.b = append(e.b, 0xd9, byte(n))
+	case n <= 0xffff:
+		e.b = binary.BigEndian.AppendUint16(append(e.b, 0xda), uint16(n))
+	default:
+		e.b = binary.BigEndian.AppendUint32(append(e.b, 0xdb), uint32(n))
+	}
+	e.b = append(e.b, s...)
+}
+
+func (e *msgpackEncoder) integer(v int64) {
+	switch {
+	case v >= 0 && v < 128:
+		e.b = append(e.b, byte(v))
+	case v < 0 && v >= -32:
+		e.b = append(e.b, byte(v))
+	case v >= 0:
+		e.b = binary.BigEndian.AppendUint64(append(e.b, 0xcf), uint64(v))
+	default:
+		e.b = binary.BigEndian.AppendUint64(append(e.b, 0xd3), uint64(v))
+	}
+}
+
+func (e *msgpackEncoder) bytes() []byte {
+	return e.b
+}
+
+// cborEncoder encodes in CBOR, RFC 8949, using the definite lengths and the
+// shortest form of each value, as its core deterministic encoding does.
+type cborEncoder struct {
+	b []byte
+}
+
+// The CBOR major types used.
+const (
+	cborUint  = 0
+	cborNeg   = 1
+	cborText  = 3
+	cborArray = 4
+	cborMap   = 5
+)
+
+// head encodes the major type with its argument.
+func (e *cborEncoder) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		e.b = append(e.b, major|byte(n))
+	case n <= 0xff:
+		e.b = append(e.b, major|24, byte(n))
+	case n <= 0xffff:
+		e.b = binary.BigEndian.AppendUint16(append(e.b, major|25), uint16(n))
+	case n <= 0xffffffff:
+		e.b = binary.BigEndian.AppendUint32(append(e.b, major|26), uint32(n))
+	default:
+		e.b = binary.BigEndian.AppendUint64(append(e.b, major|27), n)
+	}
+}
+
+func (e *cborEncoder) mapHeader(n int) {
+	e.head(cborMap, uint64(n))
+}
+
+func (e *cborEncoder) arrayHeader(n int) {
+	e.head(cborArray, uint64(n))
+}
+
+func (e *cborEncoder) str(s string) {
+	e.head(cborText, uint64(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *cborEncoder) integer(v int64) {
+	if v < 0 {
+		e.head(cborNeg, uint64(-1-v))
+		return
+	}
+	e.head(cborUint, uint64(v))
+}
+
+func (e *cborEncoder) bytes() []byte {
+	return e.b
+}
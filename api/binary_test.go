@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// TestMsgpack verifies the MessagePack jokes decode with a MessagePack
+// library, across the lengths where the encoding changes form.
+func TestMsgpack(t *testing.T) {
+	var h codec.MsgpackHandle
+	h.RawToString = true
+	for _, jr := range binaryJokes() {
+		w := httptest.NewRecorder()
+		writeBinary(w, msgpackType, jr)
+		var got map[string]any
+		if err := codec.NewDecoderBytes(w.Body.Bytes(), &h).Decode(&got); err != nil {
+			t.Fatal("error decoding joke", err)
+		}
+		if want := binaryWant(jr); !reflect.DeepEqual(normalize(got), want) {
+			t.Fatalf("unexpected joke %d: got %.200v, want %.200v", jr.ID, got, want)
+		}
+	}
+}
+
+// TestCBOR verifies the CBOR jokes decode, with a decoder written from
+// RFC 8949 rather than from the encoder, across the lengths where the
+// encoding changes form.
+func TestCBOR(t *testing.T) {
+	for _, jr := range binaryJokes() {
+		w := httptest.NewRecorder()
+		writeBinary(w, cborType, jr)
+		d := cborDecoder{b: w.Body.Bytes()}
+		got, err := d.value()
+		if err == nil && len(d.b) != 0 {
+			err = fmt.Errorf("%d bytes left over", len(d.b))
+		}
+		if err != nil {
+			t.Fatal("error decoding joke", err)
+		}
+		if want := binaryWant(jr); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected joke %d: got %.200v, want %.200v", jr.ID, got, want)
+		}
+	}
+}
+
+// binaryJokes returns jokes with IDs, texts and numbers of names either
+// side of where the MessagePack and CBOR encodings change form.
+func binaryJokes() []JokeResponse {
+	var res []JokeResponse
+	for _, n := range []int{0, 15, 16, 23, 24, 31, 32, 255, 256, 65535, 65536} {
+		res = append(res, JokeResponse{
+			ID:    n,
+			Joke:  strings.Repeat("x", n),
+			Lang:  "en",
+			Names: make([]string, min(n, 300)),
+		})
+	}
+	for _, id := range []int{-1, -32, -33, 127, 128, 1 << 40, -1 << 40} {
+		res = append(res, JokeResponse{ID: id, Joke: "Ann Lee laughs.", Lang: "en",
+			Names: []string{"Ann Lee"}, Categories: []string{"nerdy", "explicit"}})
+	}
+	return res
+}
+
+// binaryWant returns the joke as the decoders give it.
+func binaryWant(jr JokeResponse) map[string]any {
+	m := map[string]any{"id": int64(jr.ID), "joke": jr.Joke, "lang": jr.Lang, "names": strAny(jr.Names)}
+	if len(jr.Categories) > 0 {
+		m["categories"] = strAny(jr.Categories)
+	}
+	return m
+}
+
+func strAny(ss []string) []any {
+	res := make([]any, len(ss))
+	for i, s := range ss {
+		res[i] = s
+	}
+	return res
+}
+
+// normalize makes the integers the MessagePack library decodes int64,
+// whichever size they were encoded in.
+func normalize(m map[string]any) map[string]any {
+	for k, v := range m {
+		if u, ok := v.(uint64); ok {
+			m[k] = int64(u)
+		}
+	}
+	return m
+}
+
+// cborDecoder decodes the CBOR items a joke is made of.
+type cborDecoder struct {
+	b []byte
+}
+
+func (d *cborDecoder) value() (any, error) {
+	if len(d.b) == 0 {
+		return nil, errors.New("unexpected end")
+	}
+	major, info := d.b[0]>>5, d.b[0]&0x1f
+	d.b = d.b[1:]
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(d.b) < size {
+			return nil, errors.New("short argument")
+		}
+		var buf [8]byte
+		copy(buf[8-size:], d.b[:size])
+		n, d.b = binary.BigEndian.Uint64(buf[:]), d.b[size:]
+		// The shortest form must be used.
+		if info == 24 && n < 24 || info > 24 && n < 1<<(8*(size/2)) {
+			return nil, fmt.Errorf("argument %d not in its shortest form", n)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported additional info %d", info)
+	}
+	switch major {
+	case 0:
+		return int64(n), nil
+	case 1:
+		return -1 - int64(n), nil
+	case 3:
+		if uint64(len(d.b)) < n {
+			return nil, errors.New("short text")
+		}
+		s := string(d.b[:n])
+		d.b = d.b[n:]
+		return s, nil
+	case 4:
+		res := make([]any, n)
+		for i := range res {
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			res[i] = v
+		}
+		return res, nil
+	case 5:
+		res := make(map[string]any, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is not text", k)
+			}
+			if res[ks], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unsupported major type %d", major)
+}
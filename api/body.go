@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// limitBody returns middleware that caps the size of request bodies.  A
+// request declaring a body that's too large is rejected up front, and any
+// other body is wrapped so reading past the limit fails.
+func (a apiImpl) limitBody(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				a.writeProblem(w, r, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("request body exceeds the limit of %d bytes", limit))
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// drainBody reads and closes the request body for endpoints that don't use
+// it.  If the body is over the size limit, the problem response is written
+// and false is returned, in which case the handler should simply return.
+func (a apiImpl) drainBody(w http.ResponseWriter, r *http.Request) bool {
+	if r.Body == nil {
+		return true
+	}
+	defer r.Body.Close()
+
+	_, err := io.Copy(io.Discard, r.Body)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		a.writeProblem(w, r, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body exceeds the limit of %d bytes", mbe.Limit))
+		return false
+	}
+	return true
+}
+
+// decodeBody unmarshals the JSON request body into v.  If the body is over
+// the size limit or isn't valid, the error response is written and false
+// is returned, in which case the handler should simply return.
+func (a apiImpl) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Body == nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, errors.New("a request body is required"))
+		return false
+	}
+	defer r.Body.Close()
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &mbe):
+		a.writeProblem(w, r, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body exceeds the limit of %d bytes", mbe.Limit))
+		return false
+	case err != nil:
+		a.writeErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/gorilla/mux"
+)
+
+// BreakerRequest is the body for forcing a circuit breaker open or
+// closed.
+type BreakerRequest struct {
+	State string `json:"state"`
+}
+
+// listBreakers returns the state of each upstream service's circuit
+// breaker, which is empty if they have none.
+func (a apiImpl) listBreakers(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	breakers := a.svc.Breakers()
+	if breakers == nil {
+		breakers = map[string]service.BreakerStatus{}
+	}
+	a.writeJSON(w, http.StatusOK, breakers)
+}
+
+// forceBreaker holds an upstream service's circuit breaker open, or
+// closes it, returning its new state.
+func (a apiImpl) forceBreaker(w http.ResponseWriter, r *http.Request) {
+	var req BreakerRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	st, err := a.svc.ForceBreaker(mux.Vars(r)["upstream"], req.State)
+	switch {
+	case errors.Is(err, service.ErrNoBreaker):
+		a.writeErrorResponse(w, r, http.StatusNotFound, err)
+	case err != nil:
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+	default:
+		a.writeJSON(w, http.StatusOK, st)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// cacheWriter sets the Cache-Control header of a response as it is
+// written, unless the handler has set it: the directives given for the
+// route for a success, or no-store for an error, so a cache doesn't keep
+// serving a 429 or a 503 after it has passed.
+type cacheWriter struct {
+	http.ResponseWriter
+	directives  string
+	wroteHeader bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		if h := cw.Header(); h.Get("Cache-Control") == "" {
+			if code < http.StatusBadRequest {
+				h.Set("Cache-Control", cw.directives)
+			} else {
+				h.Set("Cache-Control", "no-store")
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the ResponseWriter wrapped, for http.ResponseController.
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// cacheControl returns middleware setting the Cache-Control header of the
+// responses of the routes given, by their templates, such as
+// /v1/favorites/{jokeID:[0-9]+}, as metrics counts them.  The other routes
+// are left alone.
+func cacheControl(directives map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cr := mux.CurrentRoute(r)
+			if cr == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			tmpl, err := cr.GetPathTemplate()
+			d, ok := directives[tmpl]
+			if err != nil || !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(&cacheWriter{ResponseWriter: w, directives: d}, r)
+		})
+	}
+}
+
+// checkRoutes checks each of the routes given is one of the router's, by
+// its template, so a typo isn't silently ignored.
+func checkRoutes(r *mux.Router, routes map[string]string) error {
+	known := map[string]bool{}
+	r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			known[tmpl] = true
+		}
+		return nil
+	})
+	var unknown []string
+	for tmpl := range routes {
+		if !known[tmpl] {
+			unknown = append(unknown, tmpl)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("no such routes for the Cache-Control: %q", unknown)
+	}
+	return nil
+}
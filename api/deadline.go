@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requestTimeout reads the timeout a client asks for in the X-Request-Timeout
+// header, or the Request-Timeout one, given in seconds, such as 2.5, or as
+// a duration, such as 500ms.  It returns 0 if there is none.
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	v := r.Header.Get("X-Request-Timeout")
+	if v == "" {
+		v = r.Header.Get("Request-Timeout")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, serr := strconv.ParseFloat(v, 64)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid request timeout %q", v)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("request timeout %q must be positive", v)
+	}
+	return d, nil
+}
+
+// deadline returns middleware giving each request the deadline its client
+// asks for, up to the most given, so an impatient client doesn't leave the
+// upstream calls made for it running once it has gone.  The requests not
+// asking are left alone.
+func (a apiImpl) deadline(most time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d, err := requestTimeout(r)
+			if err != nil {
+				a.writeProblem(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if d == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if most > 0 {
+				d = min(d, most)
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
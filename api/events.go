@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gdotgordon/laff/events"
+	"github.com/gdotgordon/laff/service"
+)
+
+// publishServed sends a served joke to the event stream, if there is one.
+// The caller is identified by a hash, so the stream doesn't carry the
+// addresses of our users.  Like the history, a failure is only logged.
+func (a apiImpl) publishServed(r *http.Request, jk service.Joke) {
+	if a.events == nil {
+		return
+	}
+	ev := events.Event{
+		JokeID: jk.ID,
+		Text:   jk.Text,
+		Name:   jk.Name.Name + " " + jk.Name.Surname,
+		Time:   time.Now().UTC(),
+		Client: userID(clientID(r)),
+	}
+	if jk.Second != nil {
+		ev.Second = jk.Second.Name + " " + jk.Second.Surname
+	}
+	if err := a.events.Publish(r.Context(), ev); err != nil {
+		a.logFor(r).Errorw("error publishing joke event", "error", err)
+	}
+}
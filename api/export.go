@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gdotgordon/laff/store"
+)
+
+// exportDay is the layout of the days of the usage export range.
+const exportDay = "2006-01-02"
+
+// exportUsage streams the requests made with each API key on each day, in
+// order of the day and then the key, as CSV or NDJSON by the format asked
+// for, for billing and reporting.  The keys are given by the same IDs the
+// other user data is kept under, not the keys themselves.  The range of
+// days, from and to, is inclusive, with either end open if not given.
+func (a apiImpl) exportUsage(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	var from, to time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(exportDay, v)
+			if err != nil {
+				a.writeErrorResponse(w, r, http.StatusBadRequest,
+					fmt.Errorf("invalid %s %q, want a date like 2006-01-02", p.name, v))
+				return
+			}
+			*p.t = t
+		}
+	}
+
+	var write func(store.UsageRecord) error
+	var done func() error
+	switch format := q.Get("format"); format {
+	case "", "csv":
+		cw := csv.NewWriter(w)
+		write = func(rec store.UsageRecord) error {
+			return cw.Write([]string{rec.User, rec.Day, strconv.FormatInt(rec.Requests, 10)})
+		}
+		done = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		cw.Write([]string{"user", "day", "requests"})
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		write = func(rec store.UsageRecord) error { return enc.Encode(rec) }
+		done = func() error { return nil }
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	default:
+		a.writeErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("invalid format %q, want csv or ndjson", format))
+		return
+	}
+
+	// The status is sent, so an error can only cut the export short.
+	err := a.usage.UsageRecords(r.Context(), from, to, write)
+	if err == nil {
+		err = done()
+	}
+	if err != nil {
+		a.logFor(r).Errorw("Usage export cut short", "error", err)
+	}
+}
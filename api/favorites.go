@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gdotgordon/laff/store"
+	"github.com/gorilla/mux"
+)
+
+// FavoritesResponse is the JSON returned when listing a user's favorites.
+type FavoritesResponse struct {
+	Favorites []store.Favorite `json:"favorites"`
+}
+
+// listFavorites returns the favorite jokes of the authenticated user.
+func (a apiImpl) listFavorites(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+
+	favs, err := a.store.Favorites(r.Context(), requestUser(r))
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, FavoritesResponse{Favorites: favs})
+}
+
+// addFavorite adds the joke in the URL to the user's favorites.  Since it is
+// a PUT, adding the same joke twice is fine.
+func (a apiImpl) addFavorite(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["jokeID"])
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.store.AddFavorite(r.Context(), requestUser(r), id); err != nil {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeFavorite removes the joke in the URL from the user's favorites.
+func (a apiImpl) removeFavorite(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["jokeID"])
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.store.RemoveFavorite(r.Context(), requestUser(r), id); err != nil {
+		if err == store.ErrNotFound {
+			a.writeErrorResponse(w, r, http.StatusNotFound, err)
+		} else {
+			a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
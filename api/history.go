@@ -0,0 +1,96 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/store"
+)
+
+// Limits on the page size for the history endpoint.
+const (
+	dfltPageSize = 20
+	maxPageSize  = 100
+)
+
+// HistoryResponse is the JSON returned for a page of the joke history.
+type HistoryResponse struct {
+	Entries []store.HistoryEntry `json:"entries"`
+	Page    int                  `json:"page"`
+	Limit   int                  `json:"limit"`
+	Total   int                  `json:"total"`
+}
+
+// getHistory returns a page of the served jokes, newest first.  The page
+// numbers start at 1.
+func (a apiImpl) getHistory(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+
+	limit, err := intParam(r, "limit", dfltPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("limit must be between 1 and %d", maxPageSize))
+		return
+	}
+	page, err := intParam(r, "page", 1)
+	if err != nil || page < 1 {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("page must be a positive number"))
+		return
+	}
+
+	entries, total, err := a.store.History(r.Context(), (page-1)*limit, limit)
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []store.HistoryEntry{}
+	}
+	hr := HistoryResponse{Entries: entries, Page: page, Limit: limit, Total: total}
+	a.writeJSON(w, http.StatusOK, hr)
+}
+
+// recordHistory adds a served joke to the history.  A failure here shouldn't
+// fail the request, so it is only logged.  The caller is only recorded by
+// the ID of their API key, if they gave one, never by their address.
+func (a apiImpl) recordHistory(r *http.Request, jk service.Joke) {
+	entry := store.HistoryEntry{
+		JokeID: jk.ID,
+		Text:   jk.Text,
+		Name:   jk.Name.Name + " " + jk.Name.Surname,
+		Time:   time.Now().UTC(),
+		Client: requestUser(r),
+	}
+	if err := a.store.AddHistory(r.Context(), entry); err != nil {
+		a.logFor(r).Errorw("error recording history", "error", err)
+	}
+}
+
+// clientID identifies the caller, as the authenticated user if there is
+// one, otherwise by the remote address.
+func clientID(r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		return user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// intParam parses an optional integer query parameter.
+func intParam(r *http.Request, name string, dflt int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return dflt, nil
+	}
+	return strconv.Atoi(v)
+}
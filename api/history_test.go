@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/store"
+	"github.com/gorilla/mux"
+)
+
+// newTestRouter sets up the API on a router, with a file store kept in
+// memory and the config and service options given.
+func newTestRouter(t *testing.T, cfg Config, opts ...service.Option) (*mux.Router, store.Store) {
+	t.Helper()
+	svc, err := service.New(1, 2, logging.Nop(), opts...)
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	st, err := store.NewFileStore("", store.FileOptions{HistorySize: 10})
+	if err != nil {
+		t.Fatal("error creating store", err)
+	}
+	cfg.Store, cfg.Limit, cfg.MaxBody = st, 100, 1<<16
+	r := mux.NewRouter()
+	if err := Init(context.Background(), r, svc, cfg, logging.Nop()); err != nil {
+		t.Fatal("error initializing API", err)
+	}
+	return r, st
+}
+
+// TestHistoryAdminOnly verifies the history of everyone's jokes is only
+// served to the admins, and doesn't keep the callers' addresses.
+func TestHistoryAdminOnly(t *testing.T) {
+	get := func(r *mux.Router, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, historyURL, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	r, _ := newTestRouter(t, Config{})
+	if w := get(r, ""); w.Code != http.StatusNotFound {
+		t.Fatal("expected no history without admin keys, got:", w.Code)
+	}
+
+	r, st := newTestRouter(t, Config{APIKeys: []string{"user"}, AdminKeys: []string{"admin"}})
+	if w := get(r, "user"); w.Code != http.StatusUnauthorized {
+		t.Fatal("expected a user turned away, got:", w.Code)
+	}
+	a := apiImpl{store: st, log: logging.Nop()}
+	req := httptest.NewRequest(http.MethodGet, jokeURL, nil)
+	a.recordHistory(req, service.Joke{ID: 1, Text: "ha"})
+	w := get(r, "admin")
+	var hr HistoryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &hr); err != nil || w.Code != http.StatusOK {
+		t.Fatal("error getting history", w.Code, err)
+	}
+	if len(hr.Entries) != 1 || hr.Entries[0].Client != "" || hr.Entries[0].Time.After(time.Now()) {
+		t.Fatal("expected the entry without the caller's address, got:", hr.Entries)
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"errors"
+	"sync"
+)
+
+// KeyRing holds the API keys and the admin keys, which can be replaced
+// while we serve, as when they are read again from a secrets manager.
+// Whether auth and the admin endpoints are enabled is settled when the
+// routes are set up, so a new set of keys can't turn either on or off.
+type KeyRing struct {
+	mu    sync.RWMutex
+	keys  []string
+	admin []string
+}
+
+// NewKeyRing creates a key ring holding the API keys and admin keys.
+func NewKeyRing(keys, admin []string) *KeyRing {
+	return &KeyRing{keys: keys, admin: admin}
+}
+
+// Set replaces the keys.  Either list may only be empty if it was before.
+func (kr *KeyRing) Set(keys, admin []string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if (len(keys) == 0) != (len(kr.keys) == 0) {
+		return errors.New("the API keys can't enable or disable auth while serving")
+	}
+	if (len(admin) == 0) != (len(kr.admin) == 0) {
+		return errors.New("the admin keys can't enable or disable the admin endpoints while serving")
+	}
+	kr.keys, kr.admin = keys, admin
+	return nil
+}
+
+// apiKeys returns the API keys accepted.
+func (kr *KeyRing) apiKeys() []string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys
+}
+
+// adminKeys returns the keys accepted by the admin endpoints.
+func (kr *KeyRing) adminKeys() []string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.admin
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	tollboothV5 "github.com/didip/tollbooth/v5"
+	"github.com/didip/tollbooth/v5/limiter"
+)
+
+// RateLimiter limits the rate of requests from each client.  It is created
+// outside the API layer so its state can be reported elsewhere.
+type RateLimiter struct {
+	lmt      *limiter.Limiter
+	keys     []string     // API keys exempt from the limit
+	nets     []*net.IPNet // client networks exempt from the limit
+	allowed  int64
+	rejected int64
+	exempted int64
+}
+
+// RateLimiterState is a snapshot of the rate limiter settings and activity.
+// The exempt keys are only counted, so they aren't given away.
+type RateLimiterState struct {
+	Max         float64  `json:"max"`
+	Burst       int      `json:"burst"`
+	Allowed     int64    `json:"allowed"`
+	Rejected    int64    `json:"rejected"`
+	Exempted    int64    `json:"exempted"` // requests let through by the allowlist
+	ExemptKeys  int      `json:"exemptKeys"`
+	ExemptCIDRs []string `json:"exemptCIDRs,omitempty"`
+}
+
+// NewRateLimiter creates a limiter allowing the given requests/second per
+// client.
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	rl := &RateLimiter{lmt: tollboothV5.NewLimiter(perSecond, nil)}
+	rl.lmt.SetOnLimitReached(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&rl.rejected, 1)
+	})
+	return rl
+}
+
+// Exempt lets the requests carrying one of the API keys, or coming from
+// one of the networks, bypass the limiter, such as those of dashboards and
+// smoke tests.  Each entry of the allowlist is a network in CIDR notation,
+// an IP address, or else an API key.  An entry with a slash, or that looks
+// like an IP address, that doesn't parse is an error, rather than being
+// taken for a key no client has, so a mistake such as 10.0.0.0/33 isn't
+// missed.  The entries are only named by their position, in case one is
+// a key.  It must be called before the limiter is in use.
+func (rl *RateLimiter) Exempt(allowlist []string) error {
+	var errs []error
+	for i, entry := range allowlist {
+		if !strings.Contains(entry, "/") && net.ParseIP(entry) != nil {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			rl.nets = append(rl.nets, ipnet)
+		} else if strings.Contains(entry, "/") || looksLikeIP(entry) {
+			errs = append(errs, fmt.Errorf("entry %d is not a valid IP address or CIDR", i+1))
+		} else {
+			rl.keys = append(rl.keys, entry)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// looksLikeIP reports whether the entry is made of what an IP address is,
+// digits and dots, or hex digits and colons, so it was meant as one.
+func looksLikeIP(entry string) bool {
+	v4 := strings.Trim(entry, "0123456789.") == "" && strings.Contains(entry, ".")
+	v6 := strings.Trim(entry, "0123456789abcdefABCDEF:.") == "" && strings.Count(entry, ":") >= 2
+	return v4 || v6
+}
+
+// State returns the current state of the limiter.
+func (rl *RateLimiter) State() RateLimiterState {
+	st := RateLimiterState{
+		Max:        rl.lmt.GetMax(),
+		Burst:      rl.lmt.GetBurst(),
+		Allowed:    atomic.LoadInt64(&rl.allowed),
+		Rejected:   atomic.LoadInt64(&rl.rejected),
+		Exempted:   atomic.LoadInt64(&rl.exempted),
+		ExemptKeys: len(rl.keys),
+	}
+	for _, n := range rl.nets {
+		st.ExemptCIDRs = append(st.ExemptCIDRs, n.String())
+	}
+	return st
+}
+
+// exempt reports whether the request bypasses the limiter.
+func (rl *RateLimiter) exempt(r *http.Request) bool {
+	if len(rl.nets) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			for _, n := range rl.nets {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	key := requestKey(r)
+	return key != "" && validKey(rl.keys, key)
+}
+
+// middleware applies the limiter to the handler, other than for the
+// requests exempt from it.
+func (rl *RateLimiter) middleware(next http.Handler) http.Handler {
+	limited := tollboothV5.LimitFuncHandler(rl.lmt,
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&rl.allowed, 1)
+			next.ServeHTTP(w, r)
+		})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.exempt(r) {
+			atomic.AddInt64(&rl.exempted, 1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// getLimiter is the admin endpoint reporting the state of the rate
+// limiter, including its allowlist.
+func (a apiImpl) getLimiter(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	a.writeJSON(w, http.StatusOK, a.limiter.State())
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestExempt verifies the allowlist takes keys, addresses and networks,
+// and rejects the addresses and networks that don't parse rather than
+// taking them for keys, without naming the entries.
+func TestExempt(t *testing.T) {
+	rl := NewRateLimiter(1)
+	if err := rl.Exempt([]string{"dashboard-key", "10.0.0.0/8", "192.0.2.1", "2001:db8::1", "deadbeef"}); err != nil {
+		t.Fatal("error exempting", err)
+	}
+	if st := rl.State(); st.ExemptKeys != 2 || len(st.ExemptCIDRs) != 3 {
+		t.Fatal("unexpected exemptions:", st)
+	}
+
+	rl = NewRateLimiter(1)
+	err := rl.Exempt([]string{"10.0.0.0/33", "good-key", "10.0.0.256", "2001:db8::g", "2001:db8:::1", "key/with/slash"})
+	if err == nil {
+		t.Fatal("expected errors for the bad entries")
+	}
+	for _, want := range []string{"entry 1 ", "entry 3 ", "entry 5 ", "entry 6 "} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected an error for %s, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "slash") || strings.Contains(err.Error(), "entry 2 ") {
+		t.Error("unexpected error:", err)
+	}
+	if st := rl.State(); st.ExemptKeys != 2 || len(st.ExemptCIDRs) != 0 {
+		t.Fatal("unexpected exemptions:", st)
+	}
+}
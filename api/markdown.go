@@ -0,0 +1,36 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gdotgordon/laff/service"
+)
+
+// mdEscaper escapes the characters Markdown would take for formatting, so
+// a joke or name with them in is shown as it is.
+var mdEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`, "#", `\#`,
+)
+
+// markdown formats the (possibly translated) joke for chat ops: the names
+// in bold, the joke quoted, and a link to where it came from, if the
+// operator gave one.
+func (a apiImpl) markdown(jk service.Joke, text string) string {
+	var lines []string
+	var names []string
+	for _, name := range jokeNames(jk) {
+		names = append(names, "**"+mdEscaper.Replace(name)+"**")
+	}
+	if len(names) > 0 {
+		lines = append(lines, strings.Join(names, " and "), "")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		lines = append(lines, "> "+mdEscaper.Replace(line))
+	}
+	if a.jokeLink != "" && jk.ID > 0 {
+		link := strings.ReplaceAll(a.jokeLink, "{id}", strconv.Itoa(jk.ID))
+		lines = append(lines, "", "[Source]("+link+")")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// openMetricsType is the media type of the OpenMetrics text format.
+const openMetricsType = "application/openmetrics-text"
+
+// RouteMetrics counts the requests to each route, in the Prometheus text
+// format for scraping: the requests by the class of their status, those
+// in flight, and a histogram of their latency, using the same buckets as
+// the SLOs.  The routes are counted by their templates, such as
+// /v1/favorites/{jokeID:[0-9]+}, rather than their paths, so the routes
+// with IDs in them don't give a series for each ID.  Unlike the SLOs, the
+// counts are since startup, as Prometheus expects.  Each bucket of the
+// histogram keeps the latest request in it with a traceparent header, as
+// an exemplar linking it to the trace, which only the OpenMetrics format
+// can carry.
+type RouteMetrics struct {
+	mu     sync.Mutex
+	routes map[routeKey]*routeCounts
+}
+
+// routeKey is what the requests are counted by.
+type routeKey struct {
+	method string
+	route  string
+}
+
+// routeCounts counts the requests with the method to a route.
+type routeCounts struct {
+	inFlight int64
+	classes  [5]int64 // answered with a 1xx to a 5xx
+	hist     [len(latencyBounds) + 1]int64
+	seconds  float64 // total latency
+	traces   [len(latencyBounds) + 1]exemplar
+}
+
+// exemplar is a traced request that fell in a bucket of the histogram.
+type exemplar struct {
+	traceID string // "" if none yet
+	seconds float64
+	at      time.Time
+}
+
+// NewRouteMetrics creates the metrics, with no requests counted.
+func NewRouteMetrics() *RouteMetrics {
+	return &RouteMetrics{routes: make(map[routeKey]*routeCounts)}
+}
+
+// counts returns the counts for the key.  The caller must hold the lock.
+func (rm *RouteMetrics) counts(key routeKey) *routeCounts {
+	rc, ok := rm.routes[key]
+	if !ok {
+		rc = &routeCounts{}
+		rm.routes[key] = rc
+	}
+	return rc
+}
+
+// start counts a request to the route as in flight.
+func (rm *RouteMetrics) start(key routeKey) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.counts(key).inFlight++
+}
+
+// done counts a request to the route as answered, with its trace ID, if
+// it has one.
+func (rm *RouteMetrics) done(key routeKey, code int, d time.Duration, trace string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rc := rm.counts(key)
+	rc.inFlight--
+	if class := code/100 - 1; class >= 0 && class < len(rc.classes) {
+		rc.classes[class]++
+	}
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	rc.hist[i]++
+	rc.seconds += d.Seconds()
+	if trace != "" {
+		rc.traces[i] = exemplar{traceID: trace, seconds: d.Seconds(), at: time.Now()}
+	}
+}
+
+// track returns middleware counting each request against its route.  The
+// router only runs the middleware for the requests matching a route, so
+// each is counted by a template.
+func (rm *RouteMetrics) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := routeKey{method: r.Method, route: "unmatched"}
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				key.route = tmpl
+			}
+		}
+		rm.start(key)
+		sw := &statusWriter{ResponseWriter: w}
+		start, trace := time.Now(), traceID(r)
+		defer func() {
+			rm.done(key, sw.code(), time.Since(start), trace)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// WriteTo writes the metrics in the Prometheus text format, the routes in
+// order.
+func (rm *RouteMetrics) WriteTo(w io.Writer) (int64, error) {
+	return rm.write(w, false)
+}
+
+// write writes the metrics in the Prometheus text format, or with
+// openMetrics, in the OpenMetrics format, with the exemplars, leaving the
+// # EOF to the caller.
+func (rm *RouteMetrics) write(w io.Writer, openMetrics bool) (int64, error) {
+	rm.mu.Lock()
+	keys := make([]routeKey, 0, len(rm.routes))
+	counts := make(map[routeKey]routeCounts, len(rm.routes))
+	for key, rc := range rm.routes {
+		keys = append(keys, key)
+		counts[key] = *rc
+	}
+	rm.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	var b bytes.Buffer
+	labels := func(key routeKey) string {
+		return fmt.Sprintf("method=%q,route=%q", key.method, key.route)
+	}
+	requests := counterFamily("laff_http_requests_total", openMetrics)
+	fmt.Fprintf(&b, "# HELP %s Requests answered, by route and status class.\n", requests)
+	fmt.Fprintf(&b, "# TYPE %s counter\n", requests)
+	for _, key := range keys {
+		for i, n := range counts[key].classes {
+			fmt.Fprintf(&b, "laff_http_requests_total{%s,status=\"%dxx\"} %d\n", labels(key), i+1, n)
+		}
+	}
+	fmt.Fprintln(&b, "# HELP laff_http_requests_in_flight Requests being handled, by route.")
+	fmt.Fprintln(&b, "# TYPE laff_http_requests_in_flight gauge")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "laff_http_requests_in_flight{%s} %d\n", labels(key), counts[key].inFlight)
+	}
+	fmt.Fprintln(&b, "# HELP laff_http_request_duration_seconds Latency of the requests answered, by route.")
+	fmt.Fprintln(&b, "# TYPE laff_http_request_duration_seconds histogram")
+	for _, key := range keys {
+		rc := counts[key]
+		var n int64
+		for i, bound := range latencyBounds {
+			n += rc.hist[i]
+			fmt.Fprintf(&b, "laff_http_request_duration_seconds_bucket{%s,le=%q} %d%s\n",
+				labels(key), strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), n, rc.traces[i].suffix(openMetrics))
+		}
+		n += rc.hist[len(latencyBounds)]
+		fmt.Fprintf(&b, "laff_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d%s\n",
+			labels(key), n, rc.traces[len(latencyBounds)].suffix(openMetrics))
+		fmt.Fprintf(&b, "laff_http_request_duration_seconds_sum{%s} %g\n", labels(key), rc.seconds)
+		fmt.Fprintf(&b, "laff_http_request_duration_seconds_count{%s} %d\n", labels(key), n)
+	}
+	return b.WriteTo(w)
+}
+
+// suffix returns the exemplar as written after its bucket, in the
+// OpenMetrics format, or "" if there is none or the format isn't that.
+func (e exemplar) suffix(openMetrics bool) string {
+	if !openMetrics || e.traceID == "" {
+		return ""
+	}
+	return fmt.Sprintf(" # {trace_id=%q} %g %.3f", e.traceID, e.seconds,
+		float64(e.at.UnixMilli())/1000)
+}
+
+// counterFamily returns the name of the counter's family, which in the
+// OpenMetrics format leaves off the _total of its samples.
+func counterFamily(name string, openMetrics bool) string {
+	if openMetrics {
+		return strings.TrimSuffix(name, "_total")
+	}
+	return name
+}
+
+// getMetrics is the endpoint Prometheus scrapes, with the moderation
+// metrics too when there are stored jokes.  The metrics are in the
+// OpenMetrics format, with the exemplars, if the scraper accepts it, as
+// Prometheus does with exemplar storage on, and the Prometheus text
+// format otherwise.
+func (a apiImpl) getMetrics(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), openMetricsType)
+	w.Header().Add("Vary", "Accept")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsType+"; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := a.metrics.write(w, openMetrics); err != nil {
+		a.logFor(r).Warnw("Error writing the metrics", "error", err)
+		return
+	}
+	if a.jokes != nil {
+		if err := a.writeModeration(r, w, openMetrics); err != nil {
+			a.logFor(r).Warnw("Error writing the moderation metrics", "error", err)
+			return
+		}
+	}
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+}
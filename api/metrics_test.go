@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMetricsExemplars verifies a traced request is an exemplar of its
+// latency bucket in the OpenMetrics format, and that the Prometheus text
+// format, which can't carry them, is left without.
+func TestMetricsExemplars(t *testing.T) {
+	r, _ := newTestRouter(t, Config{Metrics: NewRouteMetrics()})
+	req := httptest.NewRequest(http.MethodGet, statusURL, nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	scrape := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, metricsURL, nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := scrape(openMetricsType + "; version=1.0.0,text/plain;q=0.5")
+	body := w.Body.String()
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, openMetricsType) {
+		t.Fatal("expected the OpenMetrics format, got:", ct)
+	}
+	if !strings.Contains(body, `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`) {
+		t.Fatal("expected the trace as an exemplar, got:", body)
+	}
+	if !strings.Contains(body, "# TYPE laff_http_requests counter\n") || !strings.HasSuffix(body, "# EOF\n") {
+		t.Fatal("expected the OpenMetrics counter family and # EOF, got:", body)
+	}
+
+	w = scrape("text/plain")
+	body = w.Body.String()
+	if strings.Contains(body, "trace_id") || strings.Contains(body, "# EOF") ||
+		!strings.Contains(body, "# TYPE laff_http_requests_total counter\n") {
+		t.Fatal("expected the Prometheus text format, without exemplars, got:", body)
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gdotgordon/laff/store"
+	"github.com/gorilla/mux"
+)
+
+// The decisions a moderator can make about a submitted joke.
+const (
+	decideApprove = "approve"
+	decideReject  = "reject"
+)
+
+// maxReason is the longest reason a moderator may give, in bytes.
+const maxReason = 500
+
+// ModerationRequest is the body for deciding about a submitted joke.  A
+// rejection needs a reason, which is kept with the joke.
+type ModerationRequest struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// moderationCounts counts the decisions made about the submitted jokes
+// since startup, for the metrics.
+type moderationCounts struct {
+	approved atomic.Int64
+	rejected atomic.Int64
+}
+
+// listSubmissions returns a page of the submitted jokes awaiting a
+// decision, oldest first.
+func (a apiImpl) listSubmissions(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	a.writeJokes(w, r, store.StatusPending)
+}
+
+// moderateJoke approves or rejects the submitted joke in the URL.  Only
+// the approved jokes are served.  A joke that has been decided already
+// is a 409, so two moderators working through the queue don't overrule
+// each other.
+func (a apiImpl) moderateJoke(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["jokeID"])
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var req ModerationRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	var status string
+	switch req.Decision {
+	case decideApprove:
+		status = store.StatusApproved
+	case decideReject:
+		status = store.StatusRejected
+		if req.Reason == "" {
+			a.writeErrorResponse(w, r, http.StatusBadRequest, errors.New("a rejection needs a reason"))
+			return
+		}
+	default:
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("decision must be %q or %q", decideApprove, decideReject))
+		return
+	}
+	if len(req.Reason) > maxReason {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("the reason can't be longer than %d bytes", maxReason))
+		return
+	}
+
+	jk, err := a.jokes.Joke(r.Context(), id)
+	if err != nil {
+		a.writeStoreError(w, r, err)
+		return
+	}
+	if jk.Status != store.StatusPending {
+		a.writeErrorResponse(w, r, http.StatusConflict,
+			fmt.Errorf("joke %d is already %s", id, jk.Status))
+		return
+	}
+	jk, err = a.jokes.ModerateJoke(r.Context(), id, status, req.Reason)
+	if err == store.ErrNotPending {
+		// Another moderator decided in the meantime.
+		a.writeErrorResponse(w, r, http.StatusConflict, fmt.Errorf("joke %d is already decided", id))
+		return
+	}
+	if err != nil {
+		a.writeStoreError(w, r, err)
+		return
+	}
+	if status == store.StatusApproved {
+		a.moderated.approved.Add(1)
+	} else {
+		a.moderated.rejected.Add(1)
+	}
+	a.logFor(r).Infow("Joke moderated", "id", id, "status", status, "reason", req.Reason)
+	a.writeJSON(w, http.StatusOK, jk)
+}
+
+// writeModeration writes the moderation metrics in the Prometheus text
+// format, or with openMetrics, the OpenMetrics one: the jokes awaiting a
+// decision and the decisions made.
+func (a apiImpl) writeModeration(r *http.Request, w io.Writer, openMetrics bool) error {
+	_, pending, err := a.jokes.Jokes(r.Context(), store.StatusPending, 0, 0)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintln(&b, "# HELP laff_moderation_pending Submitted jokes awaiting a decision.")
+	fmt.Fprintln(&b, "# TYPE laff_moderation_pending gauge")
+	fmt.Fprintf(&b, "laff_moderation_pending %d\n", pending)
+	decisions := counterFamily("laff_moderation_decisions_total", openMetrics)
+	fmt.Fprintf(&b, "# HELP %s Decisions made about submitted jokes.\n", decisions)
+	fmt.Fprintf(&b, "# TYPE %s counter\n", decisions)
+	fmt.Fprintf(&b, "laff_moderation_decisions_total{decision=%q} %d\n", decideApprove, a.moderated.approved.Load())
+	fmt.Fprintf(&b, "laff_moderation_decisions_total{decision=%q} %d\n", decideReject, a.moderated.rejected.Load())
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gdotgordon/laff/service"
+)
+
+// NameRequest is a name in the body for seeding the name cache.
+type NameRequest struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+}
+
+// SeedResponse is the JSON returned for seeding the name cache.
+type SeedResponse struct {
+	Added   int `json:"added"`
+	Dropped int `json:"dropped"` // for want of room in the cache
+	Cached  int `json:"cached"`  // names in the cache now
+}
+
+// seedNames adds the names in the body, a JSON array, to the name cache,
+// returning how many fit.
+func (a apiImpl) seedNames(w http.ResponseWriter, r *http.Request) {
+	var req []NameRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	if len(req) == 0 {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, errors.New("no names given"))
+		return
+	}
+	names := make([]service.NameResp, len(req))
+	for i, nr := range req {
+		names[i] = service.NameResp{Name: nr.First, Surname: nr.Last}
+	}
+	added, err := a.svc.SeedNames(names)
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	cached, _ := a.svc.CacheDepths()
+	a.logFor(r).Infow("Seeded the name cache", "added", added, "dropped", len(names)-added)
+	a.writeJSON(w, http.StatusOK, SeedResponse{Added: added, Dropped: len(names) - added, Cached: cached})
+}
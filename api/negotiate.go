@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gdotgordon/laff/service"
+)
+
+// The media types the jokes are served in.
+const (
+	plainType    = "text/plain"
+	markdownType = "text/markdown"
+	jsonType     = "application/json"
+)
+
+// jokeType picks the media type to serve the joke in, going by the quality
+// values in the Accept header.  The status is served as protobuf for the
+// same, and otherwise as JSON.  Among equal values, the first listed wins,
+// and the wildcards get plain text, so the clients that don't say get what
+// they always did.
+func jokeType(r *http.Request) string {
+	best, bestQ := plainType, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(part, ";")
+		typ := strings.ToLower(strings.TrimSpace(fields[0]))
+		switch typ {
+		case plainType, markdownType, jsonType, protoType, msgpackType, cborType:
+		case xMsgpackType:
+			typ = msgpackType
+		default:
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = typ, q
+		}
+	}
+	return best
+}
+
+// jokeNames returns the full names of the people in the joke, in order:
+// the second only in a joke about two.  It is never nil, so the JSON has
+// an array of the names even when there are none, as its schema says.
+func jokeNames(jk service.Joke) []string {
+	names := []string{}
+	for _, n := range []*service.NameResp{&jk.Name, jk.Second} {
+		if n == nil {
+			continue
+		}
+		if name := strings.TrimSpace(n.Name + " " + n.Surname); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// writeText writes the text of the media type as the response, ending it
+// with a newline.
+func writeText(w http.ResponseWriter, typ, text string) {
+	w.Header().Set("Content-Type", typ+"; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(text + "\n"))
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Problem is an RFC 7807 problem details response, used for errors that
+// clients are expected to handle programmatically.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// writeProblem serializes a problem details response for the status code.
+func (a apiImpl) writeProblem(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	a.logFor(r).Errorw("request problem", "code", code, "detail", detail)
+	p := Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(code),
+		Status: code,
+		Detail: detail,
+	}
+	b, _ := json.MarshalIndent(p, "", "  ")
+	w.Header().Set("Content-Type", "application/problem+json; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/store"
+	"github.com/gdotgordon/laff/translate"
+)
+
+// maxCategories is the most categories a profile may prefer.
+const maxCategories = 10
+
+// ProfileRequest is the body for setting the caller's profile: the name
+// the jokes are made out to, the categories they are in and the language
+// they are in, each left to the request when empty.
+type ProfileRequest struct {
+	First      string   `json:"first,omitempty"`
+	Last       string   `json:"last,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+	Lang       string   `json:"lang,omitempty"`
+}
+
+// getProfile returns the caller's profile.
+func (a apiImpl) getProfile(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	p, err := a.profiles.Profile(r.Context(), requestUser(r))
+	if err != nil {
+		a.writeStoreError(w, r, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, p)
+}
+
+// putProfile replaces the caller's profile.
+func (a apiImpl) putProfile(w http.ResponseWriter, r *http.Request) {
+	var req ProfileRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	p, err := a.checkProfile(req)
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if p, err = a.profiles.SetProfile(r.Context(), requestUser(r), p); err != nil {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, p)
+}
+
+// deleteProfile removes the caller's profile.
+func (a apiImpl) deleteProfile(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	if err := a.profiles.DeleteProfile(r.Context(), requestUser(r)); err != nil {
+		a.writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkProfile checks a profile request, tidying the name the same way as
+// the fetched names, and the categories and language.
+func (a apiImpl) checkProfile(req ProfileRequest) (store.Profile, error) {
+	var p store.Profile
+	if req.First != "" || req.Last != "" {
+		name, err := a.checkOwnName(req.First, req.Last)
+		if err != nil {
+			return p, err
+		}
+		p.First, p.Last = name.Name, name.Surname
+	}
+	cats, err := categoryList(req.Categories)
+	if err != nil {
+		return p, err
+	}
+	p.Categories = cats
+	if req.Lang != "" {
+		p.Lang = translate.Language(req.Lang, "")
+		if !validLang(p.Lang) {
+			return p, fmt.Errorf("invalid language %q", req.Lang)
+		}
+	}
+	return p, nil
+}
+
+// checkOwnName checks a name the caller's jokes are to be made out to.
+// Unlike a second name, it needs a surname, as the joke service does.
+func (a apiImpl) checkOwnName(first, last string) (service.NameResp, error) {
+	name, err := a.svc.CheckName(service.NameResp{Name: first, Surname: last})
+	if err == nil && name.Surname == "" {
+		err = errors.New("no last name")
+	}
+	if err != nil {
+		return service.NameResp{}, fmt.Errorf("invalid name: %v", err)
+	}
+	return name, nil
+}
+
+// categoryList tidies the categories asked for, dropping the empty and
+// repeated ones.
+func categoryList(cats []string) ([]string, error) {
+	var res []string
+	for _, c := range cats {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c != "" && !slices.Contains(res, c) {
+			res = append(res, c)
+		}
+	}
+	if len(res) > maxCategories {
+		return nil, fmt.Errorf("no more than %d categories can be given", maxCategories)
+	}
+	return res, nil
+}
+
+// validLang reports whether the language is a two or three letter code.
+func validLang(lang string) bool {
+	if len(lang) < 2 || len(lang) > 3 {
+		return false
+	}
+	for _, c := range lang {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// profileFor returns the profile of the user whose API key the request
+// carries, if the profiles are kept and they have one.  The joke endpoint
+// doesn't need a key, so a missing or invalid one is no profile, and a
+// profile that can't be read is logged and the request served without.
+func (a apiImpl) profileFor(r *http.Request) (store.Profile, bool) {
+	if a.profiles == nil {
+		return store.Profile{}, false
+	}
+	key := requestKey(r)
+	if key == "" || !validKey(a.keys.apiKeys(), key) {
+		return store.Profile{}, false
+	}
+	p, err := a.profiles.Profile(r.Context(), userID(key))
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			a.logFor(r).Warnw("Error getting the profile", "error", err)
+		}
+		return store.Profile{}, false
+	}
+	return p, true
+}
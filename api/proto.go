@@ -0,0 +1,135 @@
+package api
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/gdotgordon/laff/service"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoType is the media type of the protobuf responses, the messages of
+// laff.proto.
+const protoType = "application/x-protobuf"
+
+// writeProto writes the protobuf encoded message, naming its type as the
+// clients decoding it by reflection expect.
+func writeProto(w http.ResponseWriter, code int, message string, b []byte) {
+	w.Header().Set("Content-Type", protoType+"; messageType=laff.v1."+message)
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// marshalProto encodes the joke as a laff.v1.Joke.
+func (jr JokeResponse) marshalProto() []byte {
+	var b []byte
+	b = appendInt(b, 1, int64(jr.ID))
+	b = appendString(b, 2, jr.Joke)
+	b = appendString(b, 3, jr.Lang)
+	for _, n := range jr.Names {
+		b = appendRepeated(b, 4, n)
+	}
+	for _, c := range jr.Categories {
+		b = appendRepeated(b, 5, c)
+	}
+	return b
+}
+
+// marshalProto encodes the status as a laff.v1.Status.
+func (ss ServiceStatus) marshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, ss.Status)
+	b = appendString(b, 2, ss.Version)
+	b = appendString(b, 3, ss.Commit)
+	b = appendString(b, 4, ss.BuildDate)
+	b = appendString(b, 5, ss.GoVersion)
+	b = appendString(b, 6, ss.Uptime)
+	b = appendMessage(b, 7, ss.Cache.marshalProto())
+	for _, u := range ss.Upstreams {
+		b = appendMessage(b, 8, upstreamProto(u))
+	}
+	if ss.Experiment != nil {
+		b = appendMessage(b, 9, experimentProto(*ss.Experiment))
+	}
+	return b
+}
+
+// marshalProto encodes the cache status as a laff.v1.CacheStatus.
+func (cs CacheStatus) marshalProto() []byte {
+	var b []byte
+	b = appendInt(b, 1, int64(cs.Names))
+	b = appendInt(b, 2, int64(cs.Jokes))
+	b = appendInt(b, 3, int64(cs.Size))
+	b = appendInt(b, 4, cs.JokeHits)
+	b = appendInt(b, 5, cs.NameHits)
+	b = appendInt(b, 6, cs.Misses)
+	return appendDouble(b, 7, cs.HitRatio)
+}
+
+// upstreamProto encodes the upstream's status as a laff.v1.Upstream.
+func upstreamProto(u service.UpstreamStatus) []byte {
+	var b []byte
+	b = appendString(b, 1, u.Name)
+	b = appendString(b, 2, u.URL)
+	b = appendBool(b, 3, u.Reachable)
+	b = appendString(b, 4, u.Error)
+	return appendBool(b, 5, u.Checked)
+}
+
+// experimentProto encodes the experiment's stats as a laff.v1.Experiment.
+func experimentProto(es service.ExperimentStats) []byte {
+	var b []byte
+	for i, arm := range []service.ArmStats{es.A, es.B} {
+		var ab []byte
+		ab = appendString(ab, 1, arm.Provider)
+		ab = appendInt(ab, 2, arm.Requests)
+		ab = appendInt(ab, 3, arm.Errors)
+		ab = appendDouble(ab, 4, arm.MeanLatencyMs)
+		b = appendMessage(b, protowire.Number(i+1), ab)
+	}
+	return b
+}
+
+// The append functions encode a field, leaving out the zero values as
+// proto3 does, but for the repeated strings and the messages.
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendRepeated(b, num, s)
+}
+
+func appendRepeated(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/gdotgordon/laff/service"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoFields decodes a protobuf message into its field values, by
+// number, in order: a uint64 for a varint, a float64 for a fixed64 and a
+// string for the bytes, the nested messages being decoded by the caller.
+func protoFields(t *testing.T, b []byte) map[protowire.Number][]any {
+	t.Helper()
+	res := map[protowire.Number][]any{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal("error decoding tag", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var v any
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			var u uint64
+			u, n = protowire.ConsumeFixed64(b)
+			v = math.Float64frombits(u)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeString(b)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", typ, num)
+		}
+		if n < 0 {
+			t.Fatalf("error decoding field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		res[num] = append(res[num], v)
+	}
+	return res
+}
+
+// TestJokeProto verifies the jokes decode as laff.v1.Joke, the zero
+// values left out and the repeated strings kept, empty ones included.
+func TestJokeProto(t *testing.T) {
+	for _, tc := range []struct {
+		jr   JokeResponse
+		want map[protowire.Number][]any
+	}{
+		{JokeResponse{}, map[protowire.Number][]any{}},
+		{JokeResponse{Names: []string{}}, map[protowire.Number][]any{}},
+		{
+			JokeResponse{ID: 42, Joke: "Ann Lee laughs.", Lang: "en", Names: []string{"Ann Lee"}},
+			map[protowire.Number][]any{1: {uint64(42)}, 2: {"Ann Lee laughs."}, 3: {"en"}, 4: {"Ann Lee"}},
+		},
+		{
+			JokeResponse{ID: -1, Joke: "Ann Lee and Bob Ray laugh.", Names: []string{"Ann Lee", "", "Bob Ray"},
+				Categories: []string{"nerdy", "explicit"}},
+			map[protowire.Number][]any{1: {uint64(math.MaxUint64)}, 2: {"Ann Lee and Bob Ray laugh."},
+				4: {"Ann Lee", "", "Bob Ray"}, 5: {"nerdy", "explicit"}},
+		},
+	} {
+		if got := protoFields(t, tc.jr.marshalProto()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("unexpected fields of %+v: got %v, want %v", tc.jr, got, tc.want)
+		}
+	}
+}
+
+// TestStatusProto verifies the status decodes as laff.v1.Status, with
+// its nested and repeated messages.
+func TestStatusProto(t *testing.T) {
+	ss := ServiceStatus{
+		Status:    "up",
+		BuildInfo: BuildInfo{Version: "1.2.3"},
+		Uptime:    "1m0s",
+		Cache:     CacheStatus{Names: 3, JokeHits: 7, HitRatio: 0.5},
+		Upstreams: []service.UpstreamStatus{
+			{Name: "name", URL: "http://names", Checked: true, Reachable: true},
+			{Name: "joke", URL: "http://jokes", Checked: true, Error: "refused"},
+		},
+	}
+	got := protoFields(t, ss.marshalProto())
+	if got[1][0] != "up" || got[2][0] != "1.2.3" || got[6][0] != "1m0s" || got[3] != nil || got[9] != nil {
+		t.Fatal("unexpected status fields:", got)
+	}
+	cache := protoFields(t, []byte(got[7][0].(string)))
+	if want := (map[protowire.Number][]any{1: {uint64(3)}, 4: {uint64(7)}, 7: {0.5}}); !reflect.DeepEqual(cache, want) {
+		t.Fatal("unexpected cache fields:", cache)
+	}
+	if len(got[8]) != 2 {
+		t.Fatal("expected 2 upstreams, got:", got[8])
+	}
+	for i, want := range []map[protowire.Number][]any{
+		{1: {"name"}, 2: {"http://names"}, 3: {uint64(1)}, 5: {uint64(1)}},
+		{1: {"joke"}, 2: {"http://jokes"}, 4: {"refused"}, 5: {uint64(1)}},
+	} {
+		if up := protoFields(t, []byte(got[8][i].(string))); !reflect.DeepEqual(up, want) {
+			t.Errorf("unexpected upstream %d fields: %v", i, up)
+		}
+	}
+
+	// An experiment's arms, the empty one still there.
+	ss.Experiment = &service.ExperimentStats{A: service.ArmStats{Provider: "packs", Requests: 5, MeanLatencyMs: 1.5}}
+	exp := protoFields(t, []byte(protoFields(t, ss.marshalProto())[9][0].(string)))
+	a := protoFields(t, []byte(exp[1][0].(string)))
+	if want := (map[protowire.Number][]any{1: {"packs"}, 2: {uint64(5)}, 4: {1.5}}); !reflect.DeepEqual(a, want) {
+		t.Fatal("unexpected arm fields:", a)
+	}
+	if len(exp[2]) != 1 || exp[2][0] != "" {
+		t.Fatal("expected an empty second arm, got:", exp[2])
+	}
+}
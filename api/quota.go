@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gdotgordon/laff/store"
+)
+
+// Quota limits the requests of each API key over a day and over a month,
+// by UTC.
+type Quota struct {
+	Daily   int64 // requests a day, no limit if 0
+	Monthly int64 // requests a month, no limit if 0
+}
+
+// QuotaStatus is an API key's use of the requests it has over a period.
+// The limit and remaining requests are only given if there is a limit.
+type QuotaStatus struct {
+	Period    string    `json:"period"` // "daily" or "monthly"
+	Used      int64     `json:"used"`
+	Limit     int64     `json:"limit,omitempty"`
+	Remaining *int64    `json:"remaining,omitempty"`
+	Reset     time.Time `json:"reset"`
+}
+
+// UsageResponse is the JSON returned by the usage endpoint.
+type UsageResponse struct {
+	Daily   QuotaStatus `json:"daily"`
+	Monthly QuotaStatus `json:"monthly"`
+}
+
+// quotaStatus returns the use of the requests over the period, given the
+// requests used and the limit, where the period ends at reset.
+func quotaStatus(period string, used, limit int64, reset time.Time) QuotaStatus {
+	qs := QuotaStatus{Period: period, Used: used, Limit: limit, Reset: reset}
+	if limit > 0 {
+		left := max(limit-used, 0)
+		qs.Remaining = &left
+	}
+	return qs
+}
+
+// usageAt returns the use of the user's quotas at the time.
+func (a apiImpl) usageAt(r *http.Request, user string, now time.Time) (UsageResponse, error) {
+	u, err := a.usage.Usage(r.Context(), user, now)
+	if err != nil {
+		return UsageResponse{}, err
+	}
+	return usageFor(u, a.quota, now), nil
+}
+
+// usageFor returns the use of the quota, given the usage at the time.
+func usageFor(u store.Usage, quota Quota, now time.Time) UsageResponse {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return UsageResponse{
+		Daily:   quotaStatus("daily", u.Day, quota.Daily, day.AddDate(0, 0, 1)),
+		Monthly: quotaStatus("monthly", u.Month, quota.Monthly, month.AddDate(0, 1, 0)),
+	}
+}
+
+// limitUsage counts the requests made with each API key, turning them
+// away with a 429 once the key is out of its daily or monthly requests,
+// until the quota resets.  A request is only counted if it is let
+// through, the store deciding both at once, so concurrent requests can't
+// go over the quota.  The requests without a valid key are left to the
+// authentication, and the probes and the usage endpoint itself aren't
+// counted.  If the usage can't be counted, the request goes ahead.
+func (a apiImpl) limitUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r)
+		if isProbe(r) || r.URL.Path == usageURL || key == "" || !validKey(a.keys.apiKeys(), key) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, now := userID(key), time.Now()
+		limit := store.Usage{Day: a.quota.Daily, Month: a.quota.Monthly}
+		u, ok, err := a.usage.AddUsage(r.Context(), user, now, limit)
+		if err != nil {
+			a.logFor(r).Warnw("Can't count the usage, not enforcing the quota", "user", user, "error", err)
+		} else if !ok {
+			usage := usageFor(u, a.quota, now)
+			qs := usage.Monthly
+			if limit.Day > 0 && u.Day >= limit.Day {
+				qs = usage.Daily
+			}
+			a.quotaExceeded(w, r, qs, now)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// quotaExceeded writes the 429 problem response for a request over the
+// quota, with the quota's details.
+func (a apiImpl) quotaExceeded(w http.ResponseWriter, r *http.Request, qs QuotaStatus, now time.Time) {
+	a.logFor(r).Errorw("request problem", "code", http.StatusTooManyRequests, "quota", qs.Period)
+	p := struct {
+		Problem
+		Quota QuotaStatus `json:"quota"`
+	}{
+		Problem: Problem{
+			Type:   "about:blank",
+			Title:  http.StatusText(http.StatusTooManyRequests),
+			Status: http.StatusTooManyRequests,
+			Detail: fmt.Sprintf("%s quota of %d requests used up", qs.Period, qs.Limit),
+		},
+		Quota: qs,
+	}
+	b, _ := json.MarshalIndent(p, "", "  ")
+	w.Header().Set("Retry-After", strconv.Itoa(int(qs.Reset.Sub(now).Seconds())+1))
+	w.Header().Set("Content-Type", "application/problem+json; charset=UTF-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(b)
+}
+
+// getUsage returns the caller's use of its quotas.
+func (a apiImpl) getUsage(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	usage, err := a.usageAt(r, requestUser(r), time.Now())
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, usage)
+}
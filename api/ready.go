@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Readiness reports whether the instance should be sent traffic.  It starts
+// out ready, and is failed at the start of shutdown so load balancers stop
+// routing requests here while the in-flight ones complete.  It is also
+// failed by a drain request, which the server waits on to shut down.
+type Readiness struct {
+	failed  int32
+	drained int32
+	once    sync.Once
+	drain   chan struct{}
+}
+
+// DrainResponse is the JSON returned by the drain endpoint.
+type DrainResponse struct {
+	Status string `json:"status"`
+	Delay  string `json:"delay"` // until the connections are drained
+}
+
+// Fail marks the instance as no longer ready.
+func (rd *Readiness) Fail() {
+	atomic.StoreInt32(&rd.failed, 1)
+}
+
+// Drain marks the instance as no longer ready, and as to be drained.
+func (rd *Readiness) Drain() {
+	rd.Fail()
+	if atomic.CompareAndSwapInt32(&rd.drained, 0, 1) {
+		close(rd.draining())
+	}
+}
+
+// Draining returns a channel closed once a drain is asked for.
+func (rd *Readiness) Draining() <-chan struct{} {
+	return rd.draining()
+}
+
+func (rd *Readiness) draining() chan struct{} {
+	rd.once.Do(func() { rd.drain = make(chan struct{}) })
+	return rd.drain
+}
+
+// Ready reports whether the instance is ready.  A nil Readiness is always
+// ready.
+func (rd *Readiness) Ready() bool {
+	return rd == nil || atomic.LoadInt32(&rd.failed) == 0
+}
+
+// getReady is the readiness check endpoint.  It returns 503 once the
+// instance is no longer accepting traffic, or while it can't serve a
+// joke, as an upstream service is failing its probes and no joke is
+// cached.
+func (a apiImpl) getReady(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+
+	code, sr := http.StatusOK, StatusResponse{Status: "ready"}
+	if !a.ready.Ready() {
+		code, sr = http.StatusServiceUnavailable, StatusResponse{Status: "not ready"}
+	} else if down := a.svc.Down(); len(down) > 0 {
+		if _, jokes := a.svc.CacheDepths(); jokes == 0 {
+			a.logFor(r).Warnw("Not ready, upstream down and nothing cached", "down", down)
+			code, sr = http.StatusServiceUnavailable, StatusResponse{Status: "not ready"}
+		}
+	}
+	a.writeJSON(w, code, sr)
+}
+
+// drain is the admin endpoint taking the instance out of rotation ahead of
+// a restart.  The readiness check fails at once, and after the drain delay,
+// which gives the load balancers time to notice, the server shuts down as
+// on SIGTERM, finishing the requests in flight.
+func (a apiImpl) drain(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	a.logFor(r).Warnw("Draining the instance", "delay", a.drainWait)
+	a.ready.Drain()
+	a.writeJSON(w, http.StatusAccepted, DrainResponse{Status: "draining", Delay: a.drainWait.String()})
+}
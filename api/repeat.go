@@ -0,0 +1,155 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionCookie is the cookie telling apart the clients without an API
+// key, so they aren't served the same joke twice either.
+const sessionCookie = "laff_session"
+
+// recentSweep is how often the clients not served a joke within the
+// window are swept away.
+const recentSweep = time.Minute
+
+// maxRecent is the most jokes remembered for each client, the oldest
+// being forgotten first.
+const maxRecent = 500
+
+// RecentJokes remembers the jokes served to each client within a window,
+// so a client isn't served the same joke twice within it.  A client is
+// told apart by its API key, or else by a session cookie signed with a
+// secret of the process, as the jokes served are only remembered by the
+// process.  Like the BanList, it is created outside the API layer.
+type RecentJokes struct {
+	window time.Duration
+	secret []byte
+	now    func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string][]served // the jokes served to each client, oldest first
+	lastSweep time.Time
+}
+
+// served is a joke served to a client.
+type served struct {
+	id int
+	at time.Time
+}
+
+// NewRecentJokes creates the memory of the jokes served to each client
+// within the window.
+func NewRecentJokes(window time.Duration) (*RecentJokes, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &RecentJokes{
+		window:  window,
+		secret:  secret,
+		now:     time.Now,
+		clients: make(map[string][]served),
+	}, nil
+}
+
+// seen reports whether the joke was served to the client within the
+// window.
+func (rj *RecentJokes) seen(client string, id int) bool {
+	cutoff := rj.now().Add(-rj.window)
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	for _, s := range rj.clients[client] {
+		if s.id == id && s.at.After(cutoff) {
+			return true
+		}
+	}
+	return false
+}
+
+// add remembers the joke was served to the client.
+func (rj *RecentJokes) add(client string, id int) {
+	now := rj.now()
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	if now.Sub(rj.lastSweep) >= recentSweep {
+		rj.sweep(now)
+	}
+	jokes := append(rj.current(rj.clients[client], now), served{id: id, at: now})
+	if extra := len(jokes) - maxRecent; extra > 0 {
+		jokes = jokes[extra:]
+	}
+	rj.clients[client] = jokes
+}
+
+// current drops the jokes served before the window.
+func (rj *RecentJokes) current(jokes []served, now time.Time) []served {
+	cutoff := now.Add(-rj.window)
+	i := 0
+	for i < len(jokes) && !jokes[i].at.After(cutoff) {
+		i++
+	}
+	return jokes[i:]
+}
+
+// sweep forgets the clients not served a joke within the window.  The
+// caller must hold the lock.
+func (rj *RecentJokes) sweep(now time.Time) {
+	for client, jokes := range rj.clients {
+		if jokes = rj.current(jokes, now); len(jokes) == 0 {
+			delete(rj.clients, client)
+		} else {
+			rj.clients[client] = jokes
+		}
+	}
+	rj.lastSweep = now
+}
+
+// client returns the client making the request: the user of its API key,
+// if it is valid, or else its session.  A request without a session is
+// given one, but is taken to be from its address until the cookie comes
+// back, so the clients that never keep cookies can't each add a session
+// to remember.  The session cookie is set again on each response, so it
+// lasts as long as the client keeps asking within the window.
+func (a apiImpl) client(w http.ResponseWriter, r *http.Request) string {
+	rj := a.recent
+	if key := requestKey(r); key != "" && validKey(a.keys.apiKeys(), key) {
+		return "key:" + userID(key)
+	}
+	var id string
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if i := strings.IndexByte(c.Value, '.'); i > 0 && hmac.Equal([]byte(c.Value[i+1:]), []byte(rj.sign(c.Value[:i]))) {
+			id = c.Value[:i]
+		}
+	}
+	client := "session:" + id
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		client = "addr:" + clientID(r)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id + "." + rj.sign(id),
+		Path:     "/",
+		MaxAge:   int((rj.window + time.Second - 1) / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return client
+}
+
+// sign returns the signature of the session ID, in hex.
+func (rj *RecentJokes) sign(id string) string {
+	mac := hmac.New(sha256.New, rj.secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestClientSessions verifies the requests without a session cookie are
+// told apart by their address, so they don't each add a session, and
+// that the session is used once its cookie comes back.
+func TestClientSessions(t *testing.T) {
+	rj, err := NewRecentJokes(time.Hour)
+	if err != nil {
+		t.Fatal("error creating recent jokes", err)
+	}
+	a := apiImpl{recent: rj, keys: NewKeyRing(nil, nil)}
+	var cookie *http.Cookie
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, jokeURL, nil)
+		rj.add(a.client(w, r), i)
+		cookie = w.Result().Cookies()[0]
+	}
+	if len(rj.clients) != 1 || !rj.seen("addr:192.0.2.1", 99) {
+		t.Fatal("expected only the address remembered, got:", len(rj.clients))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, jokeURL, nil)
+	r.AddCookie(cookie)
+	client := a.client(httptest.NewRecorder(), r)
+	if client != "session:"+cookie.Value[:32] {
+		t.Fatal("expected the session of the cookie, got:", client)
+	}
+	forged := byte('a')
+	if cookie.Value[len(cookie.Value)-1] == forged {
+		forged = 'b'
+	}
+	cookie.Value = cookie.Value[:len(cookie.Value)-1] + string(forged)
+	r = httptest.NewRequest(http.MethodGet, jokeURL, nil)
+	r.AddCookie(cookie)
+	if client := a.client(httptest.NewRecorder(), r); client != "addr:192.0.2.1" {
+		t.Fatal("expected a forged cookie ignored, got:", client)
+	}
+}
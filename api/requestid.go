@@ -0,0 +1,53 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gdotgordon/laff/service"
+)
+
+// maxRequestID bounds the length of a request ID supplied by the caller.
+const maxRequestID = 128
+
+// requestID is the middleware that gives each request an ID, taken from
+// the X-Request-ID header if the caller sent one, so a request can be
+// followed through the logs.  The ID is returned in the response header,
+// and put in the request context for the service.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > maxRequestID {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(service.WithRequestID(r.Context(), id)))
+	})
+}
+
+// traceID returns the trace ID of the W3C traceparent header, such as
+// 4bf92f3577b34da6a3ce929d0e0e4736 in
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, or "" if the
+// request has no valid one, so a request traced by the caller, or a
+// proxy, can be found in our logs.
+func traceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 {
+		return ""
+	}
+	id := parts[1]
+	if _, err := hex.DecodeString(id); err != nil || id != strings.ToLower(id) ||
+		id == strings.Repeat("0", 32) {
+		return ""
+	}
+	return id
+}
+
+// newRequestID makes a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// schemaDialect is the JSON Schema draft the schemas are written in.
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaTypes are the response bodies described by the schemas, by the
+// name they are served under.  The schemas are made from the types, so
+// they change with them, and are versioned with the API by their URL.
+var schemaTypes = map[string]any{
+	"joke":    JokeResponse{},
+	"batch":   BatchResponse{},
+	"status":  ServiceStatus{},
+	"error":   StatusResponse{},
+	"problem": Problem{},
+}
+
+// SchemaLink is an entry of the schema index.
+type SchemaLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// SchemasResponse is the JSON returned by the schema index.
+type SchemasResponse struct {
+	Schemas []SchemaLink `json:"schemas"`
+}
+
+// listSchemas returns the names and URLs of the schemas served.
+func (a apiImpl) listSchemas(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	names := make([]string, 0, len(schemaTypes))
+	for name := range schemaTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := SchemasResponse{Schemas: []SchemaLink{}}
+	for _, name := range names {
+		res.Schemas = append(res.Schemas, SchemaLink{Name: name, URL: schemasURL + "/" + name})
+	}
+	a.writeJSON(w, http.StatusOK, res)
+}
+
+// getSchema returns the JSON Schema of the response body named in the
+// URL.
+func (a apiImpl) getSchema(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	v, ok := schemaTypes[name]
+	if !ok {
+		a.writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("no schema %q", name))
+		return
+	}
+	doc := schemaOf(reflect.TypeOf(v))
+	doc["$schema"] = schemaDialect
+	doc["$id"] = schemasURL + "/" + name
+	doc["title"] = reflect.TypeOf(v).Name()
+	b, _ := json.MarshalIndent(doc, "", "  ")
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(append(b, '\n'))
+}
+
+// schemaOf returns the JSON Schema of the values of the type, as
+// encoding/json marshals them.
+func schemaOf(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(time.Duration(0)):
+		return map[string]any{"type": "integer", "description": "nanoseconds"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		required := []string{}
+		addFields(t, props, &required)
+		sort.Strings(required)
+		return map[string]any{"type": "object", "properties": props, "required": required}
+	}
+	return map[string]any{}
+}
+
+// addFields adds the properties of the struct's fields, those of the
+// embedded structs included as encoding/json flattens them.  The fields
+// left out when empty aren't required.
+func addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addFields(f.Type, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gdotgordon/laff/store"
+)
+
+// SearchResponse is the JSON returned for a joke search.
+type SearchResponse struct {
+	Query string       `json:"query"`
+	Jokes []store.Joke `json:"jokes"`
+}
+
+// searchJokes finds the known jokes containing all the keywords in the
+// "q" parameter.
+func (a apiImpl) searchJokes(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			errors.New("the search query 'q' is required"))
+		return
+	}
+	limit, err := intParam(r, "limit", dfltPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("limit must be between 1 and %d", maxPageSize))
+		return
+	}
+
+	jokes, err := a.store.SearchJokes(r.Context(), query, limit)
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if jokes == nil {
+		jokes = []store.Joke{}
+	}
+	a.writeJSON(w, http.StatusOK, SearchResponse{Query: query, Jokes: jokes})
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimiter caps the requests being handled at once, shedding
+// those over the cap with a 503 at once, rather than letting a stampede
+// of cache misses through to the rate limited upstream services.  Like
+// the RateLimiter, it is created outside the API layer so its state can
+// be reported elsewhere.
+type ConcurrencyLimiter struct {
+	max      int64
+	inFlight int64
+	shed     int64
+}
+
+// ConcurrencyLimiterState is a snapshot of the concurrency limiter.
+type ConcurrencyLimiterState struct {
+	Max      int64 `json:"max"`
+	InFlight int64 `json:"inFlight"`
+	Shed     int64 `json:"shed"`
+}
+
+// NewConcurrencyLimiter creates a limiter allowing max requests at once,
+// or any number if max is 0, in which case they are only counted.
+func NewConcurrencyLimiter(max int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{max: int64(max)}
+}
+
+// State returns the current state of the limiter.
+func (cl *ConcurrencyLimiter) State() ConcurrencyLimiterState {
+	return ConcurrencyLimiterState{
+		Max:      cl.max,
+		InFlight: atomic.LoadInt64(&cl.inFlight),
+		Shed:     atomic.LoadInt64(&cl.shed),
+	}
+}
+
+// shed returns middleware applying the limiter to the handlers.  The
+// liveness and readiness checks are let through, so an instance that is
+// merely busy isn't taken for a dead one.
+func (a apiImpl) shed(cl *ConcurrencyLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isProbe(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			n := atomic.AddInt64(&cl.inFlight, 1)
+			defer atomic.AddInt64(&cl.inFlight, -1)
+			if cl.max > 0 && n > cl.max {
+				atomic.AddInt64(&cl.shed, 1)
+				w.Header().Set("Retry-After", "1")
+				a.writeProblem(w, r, http.StatusServiceUnavailable,
+					fmt.Sprintf("over %d requests in flight, try again shortly", cl.max))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isProbe reports whether the request is a liveness or readiness check,
+// which isn't shed.
+func isProbe(r *http.Request) bool {
+	return r.URL.Path == statusURL || r.URL.Path == readyURL
+}
+
+const (
+	// latencySamples is the number of the latest latencies the p99 is
+	// taken over.
+	latencySamples = 1000
+
+	// shedInterval is how often the share of the requests shed is set.
+	shedInterval = time.Second
+
+	// maxDrop is the most of the requests shed, so some still get through
+	// to show when the latency has recovered.
+	maxDrop = 0.9
+)
+
+// LatencyShedder sheds a share of the requests while the p99 latency of
+// the requests it lets through is over the target, keeping the service
+// responsive while an upstream service is slow.  The share grows with how
+// far over the target the p99 is: at twice the target, half are shed.
+// It is created outside the API layer so its state can be reported
+// elsewhere.
+type LatencyShedder struct {
+	target time.Duration
+
+	mu      sync.Mutex
+	samples []time.Duration // the latest latencies, a ring
+	next    int             // where the next latency goes in samples
+	p99     time.Duration   // of the samples, when drop was last set
+	drop    float64         // share of the requests shed
+	updated time.Time       // when drop was last set
+	shed    int64
+}
+
+// LatencyShedderState is a snapshot of the latency shedder.
+type LatencyShedderState struct {
+	Target   string  `json:"target"`
+	P99      string  `json:"p99"`
+	DropRate float64 `json:"dropRate"`
+	Shed     int64   `json:"shed"`
+}
+
+// NewLatencyShedder creates a shedder keeping the p99 latency near the
+// target.
+func NewLatencyShedder(target time.Duration) *LatencyShedder {
+	return &LatencyShedder{target: target, samples: make([]time.Duration, 0, latencySamples)}
+}
+
+// State returns the current state of the shedder.
+func (ls *LatencyShedder) State() LatencyShedderState {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return LatencyShedderState{
+		Target:   ls.target.String(),
+		P99:      ls.p99.String(),
+		DropRate: ls.drop,
+		Shed:     ls.shed,
+	}
+}
+
+// admit reports whether a request is let through, counting those shed.
+func (ls *LatencyShedder) admit() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.drop > 0 && rand.Float64() < ls.drop {
+		ls.shed++
+		return false
+	}
+	return true
+}
+
+// record notes the latency of a request, and every interval sets the
+// share of the requests shed from the p99 latency.  The share moves
+// halfway to where the latest p99 puts it, so one slow second doesn't
+// shed much.
+func (ls *LatencyShedder) record(d time.Duration, now time.Time) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if len(ls.samples) < cap(ls.samples) {
+		ls.samples = append(ls.samples, d)
+	} else {
+		ls.samples[ls.next] = d
+	}
+	ls.next = (ls.next + 1) % cap(ls.samples)
+	if now.Sub(ls.updated) < shedInterval {
+		return
+	}
+	ls.updated = now
+	sorted := append([]time.Duration(nil), ls.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ls.p99 = sorted[(len(sorted)*99+99)/100-1]
+	var want float64
+	if ls.p99 > ls.target {
+		want = min(1-float64(ls.target)/float64(ls.p99), maxDrop)
+	}
+	ls.drop = (ls.drop + want) / 2
+	if ls.drop < 0.01 {
+		ls.drop = 0
+	}
+}
+
+// shedSlow returns middleware applying the latency shedder to the
+// handlers, other than the liveness and readiness checks.
+func (a apiImpl) shedSlow(ls *LatencyShedder) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isProbe(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !ls.admit() {
+				w.Header().Set("Retry-After", "1")
+				a.writeProblem(w, r, http.StatusServiceUnavailable,
+					fmt.Sprintf("responses are slower than the %v target, try again shortly", ls.target))
+				return
+			}
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			ls.record(time.Since(start), time.Now())
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// signatureHeader carries the signature of a response body, or of an
+// alert posted to a webhook.
+const signatureHeader = "X-Laff-Signature"
+
+// signature returns the signature of the body with the secret, an
+// HMAC-SHA256 in hex, prefixed with "sha256=" so another algorithm can
+// follow it.
+func signature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signWriter holds back the response, so its body can be signed before
+// the headers are sent.
+type signWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (sw *signWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+}
+
+func (sw *signWriter) Write(b []byte) (int, error) {
+	return sw.body.Write(b)
+}
+
+// sign signs the body of each response with the secret, in the
+// X-Laff-Signature header, so the consumers can check it is the one sent.
+// The responses are held back until they are done to be signed, and so
+// can't be flushed early.
+func sign(secret []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &signWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			w.Header().Set(signatureHeader, signature(secret, sw.body.Bytes()))
+			if sw.status != 0 {
+				w.WriteHeader(sw.status)
+			}
+			w.Write(sw.body.Bytes())
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sloMinutes is the longest window the SLOs are reported over, in the
+// minutes the requests are counted in.
+const sloMinutes = 60
+
+// sloWindows are the windows the SLOs are reported over.
+var sloWindows = []struct {
+	name    string
+	minutes int
+}{{"5m", 5}, {"1h", sloMinutes}}
+
+// latencyBounds are the upper bounds of the latency histogram buckets,
+// the last bucket holding the slower requests.
+var latencyBounds = [...]time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second,
+}
+
+// SLOTracker tracks the latency and availability of the requests to each
+// route against the service level objectives: that the objective share
+// of the requests succeed, and are answered within the target latency,
+// such as 99.9% within 200ms.  A request fails if it gets a 5xx.  Like
+// the RateLimiter, it is created outside the API layer so its state can
+// be reported elsewhere.
+type SLOTracker struct {
+	target    time.Duration
+	objective float64
+	now       func() time.Time
+
+	mu     sync.Mutex
+	routes map[string]*[sloMinutes]sloMinute
+	total  int64 // requests since the tracker was created
+}
+
+// sloMinute counts the requests to a route in a minute.
+type sloMinute struct {
+	minute   int64 // since the epoch
+	requests int64
+	failed   int64 // answered with a 5xx
+	slow     int64 // answered after the target latency
+	hist     [len(latencyBounds) + 1]int64
+}
+
+// SLOReport is how each route has done against the SLOs, over each
+// window.
+type SLOReport struct {
+	Target    string                           `json:"target"`
+	Objective float64                          `json:"objective"`
+	Routes    map[string]map[string]SLOSummary `json:"routes"` // by route, then window
+}
+
+// SLOSummary is how a route has done against the SLOs over a window.
+// The percentiles are the upper bounds of the histogram buckets they
+// fall in.
+type SLOSummary struct {
+	Requests     int64   `json:"requests"`
+	Availability float64 `json:"availability"` // share not failed
+	WithinTarget float64 `json:"withinTarget"` // share within the target latency
+	P50          string  `json:"p50"`
+	P90          string  `json:"p90"`
+	P99          string  `json:"p99"`
+	Met          bool    `json:"met"`
+}
+
+// NewSLOTracker creates a tracker for the target latency, met by the
+// objective share of the requests, such as 0.999.
+func NewSLOTracker(target time.Duration, objective float64) *SLOTracker {
+	return &SLOTracker{
+		target:    target,
+		objective: objective,
+		now:       time.Now,
+		routes:    make(map[string]*[sloMinutes]sloMinute),
+	}
+}
+
+// record counts a request to the route.
+func (st *SLOTracker) record(route string, code int, d time.Duration) {
+	minute := st.now().Unix() / 60
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	mins, ok := st.routes[route]
+	if !ok {
+		mins = new([sloMinutes]sloMinute)
+		st.routes[route] = mins
+	}
+	m := &mins[minute%sloMinutes]
+	if m.minute != minute {
+		*m = sloMinute{minute: minute}
+	}
+	m.requests++
+	st.total++
+	if code >= 500 {
+		m.failed++
+	}
+	if d > st.target {
+		m.slow++
+	}
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	m.hist[i]++
+}
+
+// Report returns how each route has done over each window.
+func (st *SLOTracker) Report() SLOReport {
+	minute := st.now().Unix() / 60
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rep := SLOReport{
+		Target:    st.target.String(),
+		Objective: st.objective,
+		Routes:    make(map[string]map[string]SLOSummary, len(st.routes)),
+	}
+	for route, mins := range st.routes {
+		windows := make(map[string]SLOSummary, len(sloWindows))
+		for _, w := range sloWindows {
+			var sum sloMinute
+			for _, m := range mins {
+				if m.requests == 0 || minute-m.minute >= int64(w.minutes) {
+					continue
+				}
+				sum.requests += m.requests
+				sum.failed += m.failed
+				sum.slow += m.slow
+				for i, n := range m.hist {
+					sum.hist[i] += n
+				}
+			}
+			windows[w.name] = st.summarize(&sum)
+		}
+		rep.Routes[route] = windows
+	}
+	return rep
+}
+
+// Recent returns the requests counted since the tracker was created, and
+// how all the routes together have done over the shortest window.
+func (st *SLOTracker) Recent() (int64, SLOSummary) {
+	minute := st.now().Unix() / 60
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var sum sloMinute
+	for _, mins := range st.routes {
+		for _, m := range mins {
+			if m.requests == 0 || minute-m.minute >= int64(sloWindows[0].minutes) {
+				continue
+			}
+			sum.requests += m.requests
+			sum.failed += m.failed
+			sum.slow += m.slow
+			for i, n := range m.hist {
+				sum.hist[i] += n
+			}
+		}
+	}
+	return st.total, st.summarize(&sum)
+}
+
+// summarize returns the summary of the requests counted.
+func (st *SLOTracker) summarize(m *sloMinute) SLOSummary {
+	s := SLOSummary{Requests: m.requests, Availability: 1, WithinTarget: 1}
+	if m.requests > 0 {
+		s.Availability = 1 - float64(m.failed)/float64(m.requests)
+		s.WithinTarget = 1 - float64(m.slow)/float64(m.requests)
+	}
+	s.P50 = percentileBound(&m.hist, m.requests, 0.5)
+	s.P90 = percentileBound(&m.hist, m.requests, 0.9)
+	s.P99 = percentileBound(&m.hist, m.requests, 0.99)
+	s.Met = s.Availability >= st.objective && s.WithinTarget >= st.objective
+	return s
+}
+
+// percentileBound returns the upper bound of the histogram bucket the
+// percentile falls in, or "" if there are no requests.
+func percentileBound(hist *[len(latencyBounds) + 1]int64, total int64, p float64) string {
+	if total == 0 {
+		return ""
+	}
+	rank := max(int64(p*float64(total)+0.5), 1)
+	var n int64
+	for i, bound := range latencyBounds {
+		n += hist[i]
+		if n >= rank {
+			return bound.String()
+		}
+	}
+	return ">" + latencyBounds[len(latencyBounds)-1].String()
+}
+
+// track returns middleware recording the latency and status of each
+// request against its route, by the route's template so the routes with
+// IDs in them are counted together.
+func (st *SLOTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		st.record(route, sw.code(), time.Since(start))
+	})
+}
+
+// getSLO is the admin endpoint reporting the SLOs.
+func (a apiImpl) getSLO(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	a.writeJSON(w, http.StatusOK, a.slo.Report())
+}
+
+// statusWriter is a ResponseWriter noting the status code written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the ResponseWriter wrapped, for http.ResponseController.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// code returns the status code written, which is 200 if none was.
+func (sw *statusWriter) code() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gdotgordon/laff/service"
+)
+
+// StatsResponse is the JSON returned by the stats endpoint: a snapshot of
+// the activity for dashboards, such as laff top, to poll.  The counts are
+// since startup, so the rates are the change between two snapshots.
+type StatsResponse struct {
+	Time     time.Time `json:"time"`
+	Uptime   string    `json:"uptime"`
+	Requests int64     `json:"requests"` // served, if the SLOs are tracked
+
+	// Latency is how all the requests have done over the last five
+	// minutes, if the SLOs are tracked.
+	Latency *SLOSummary `json:"latency,omitempty"`
+
+	Service   service.Stats                     `json:"service"`
+	Upstreams map[string]service.UpstreamReport `json:"upstreams"`
+}
+
+// getStats reports the counts of the requests, their latency, and how the
+// caches and upstream services are doing.  Nothing is called to make it,
+// so it is cheap enough to poll every second.
+func (a apiImpl) getStats(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	now := time.Now()
+	sr := StatsResponse{
+		Time:      now.UTC(),
+		Uptime:    now.Sub(a.started).Round(time.Second).String(),
+		Service:   a.svc.Stats(),
+		Upstreams: a.svc.Upstreams(),
+	}
+	if a.slo != nil {
+		total, recent := a.slo.Recent()
+		sr.Requests, sr.Latency = total, &recent
+	}
+	a.writeJSON(w, http.StatusOK, sr)
+}
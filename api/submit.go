@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdotgordon/laff/store"
+)
+
+// maxSubmission is the longest joke a user may submit, in characters.
+const maxSubmission = 1000
+
+// SubmissionRequest is the body for submitting a joke.  The text must
+// make the joke out to someone, with {first} and {last} for the name,
+// and may use {first2} and {last2} for a second person's.
+type SubmissionRequest struct {
+	Text       string   `json:"joke"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// submitJoke stores the user's joke, pending until an admin approves it,
+// after which it is served alongside the others.
+func (a apiImpl) submitJoke(w http.ResponseWriter, r *http.Request) {
+	var req SubmissionRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	text := strings.TrimSpace(req.Text)
+	switch {
+	case text == "":
+		a.writeErrorResponse(w, r, http.StatusBadRequest, errors.New("the joke text is required"))
+		return
+	case utf8.RuneCountInString(text) > maxSubmission:
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			fmt.Errorf("the joke can't be longer than %d characters", maxSubmission))
+		return
+	case !strings.Contains(text, "{first}") && !strings.Contains(text, "{last}"):
+		a.writeErrorResponse(w, r, http.StatusBadRequest,
+			errors.New("the joke must contain {first} or {last} for the name"))
+		return
+	}
+
+	jk, err := a.jokes.CreateJoke(r.Context(), store.StoredJoke{
+		Text:       text,
+		Categories: req.Categories,
+		Source:     store.SourceUser,
+		Status:     store.StatusPending,
+		Submitter:  requestUser(r),
+	})
+	if err != nil {
+		a.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	a.logFor(r).Infow("Joke submitted", "id", jk.ID)
+	a.writeJSON(w, http.StatusAccepted, jk)
+}
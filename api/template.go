@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gdotgordon/laff/jokefmt"
+	"github.com/gdotgordon/laff/service"
+)
+
+// decorate applies the operator's template to the (possibly translated)
+// joke text.  If the template fails, the plain text is served.
+func (a apiImpl) decorate(r *http.Request, jk service.Joke, text string) string {
+	if a.fmt == nil {
+		return text
+	}
+	res, err := a.fmt.Format(jokefmt.Data{
+		ID:    jk.ID,
+		First: jk.Name.Name,
+		Last:  jk.Name.Surname,
+		Joke:  text,
+	})
+	if err != nil {
+		a.logFor(r).Warnw("error applying joke template", "error", err)
+		return text
+	}
+	return res
+}
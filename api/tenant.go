@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gdotgordon/laff/tenant"
+)
+
+// tenantHeader names the tenant a request is from, for the tenants
+// without keys.
+const tenantHeader = "X-Laff-Tenant"
+
+// tenants identifies the tenant each request is from, if any, holding it
+// to the tenant's rate limit and counting its usage.  The request context
+// carries the tenant's joke categories and packs to the service.
+func (a apiImpl) tenants(reg *tenant.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, err := reg.Identify(requestKey(r), r.Header.Get(tenantHeader))
+			if err != nil {
+				a.writeProblem(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if t == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ok, wait := t.Allow(time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+				a.writeProblem(w, r, http.StatusTooManyRequests, "rate limit of tenant "+t.Name()+" exceeded")
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r.WithContext(t.Context(r.Context())))
+			t.Done(sw.code())
+		})
+	}
+}
+
+// listTenants is the admin endpoint reporting the settings and usage of
+// each tenant, less their keys.
+func (a apiImpl) listTenants(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	a.writeJSON(w, http.StatusOK, a.tenantReg.Reports())
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getToday returns the joke of the day, the same for every caller until
+// the day, in UTC, is over, see service.JokeOfTheDay.  It has an ETag and
+// Last-Modified, so a client or cache checking again gets a 304 until the
+// next day's joke is picked.  The ETag is weak, as the representations of
+// the joke, by the Accept and Accept-Language headers, are alike.
+func (a *apiImpl) getToday(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	msg, day, picked, err := a.svc.JokeOfTheDay(r.Context())
+	if err != nil {
+		a.writeJokeError(w, r, err)
+		return
+	}
+	etag := fmt.Sprintf(`W/"%s-%d"`, day, msg.ID)
+	modified := picked.Truncate(time.Second)
+	w.Header().Add("Vary", "Accept")
+	if a.tr != nil {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	text, lang := a.localize(r, msg.Text, "")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("X-Joke-ID", strconv.Itoa(msg.ID))
+	a.writeJoke(w, r, msg, text, lang)
+	a.recordHistory(r, msg)
+	a.publishServed(r, msg)
+}
+
+// notModified reports whether the client has the representation already:
+// the If-None-Match header has the ETag, compared weakly, or else, without
+// it, the If-Modified-Since header is no earlier than the modification.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.After(since)
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/laffmock"
+	"github.com/gdotgordon/laff/service"
+)
+
+// TestToday verifies the joke of the day is the same on each request, and
+// that a client having it already gets a 304.
+func TestToday(t *testing.T) {
+	mock := laffmock.New()
+	defer mock.Close()
+	r, _ := newTestRouter(t, Config{},
+		service.WithNameURL(mock.NameURL()), service.WithJokeURL(mock.JokeURL()))
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, todayURL, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	first := get("", "")
+	etag, modified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+	if first.Code != http.StatusOK || etag == "" || modified == "" || first.Body.Len() == 0 {
+		t.Fatal("unexpected joke of the day:", first.Code, first.Header())
+	}
+	if w := get("", ""); w.Body.String() != first.Body.String() || w.Header().Get("ETag") != etag {
+		t.Fatal("expected the same joke again, got:", w.Body.String())
+	}
+
+	for _, tc := range []struct {
+		header, value string
+		code          int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other", ` + etag[2:], http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `W/"1999-01-01-1"`, http.StatusOK},
+		{"If-Modified-Since", modified, http.StatusNotModified},
+		{"If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK},
+	} {
+		w := get(tc.header, tc.value)
+		if w.Code != tc.code || w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s %s: got %d %q, want %d", tc.header, tc.value, w.Code, w.Body.String(), tc.code)
+		}
+	}
+}
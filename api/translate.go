@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gdotgordon/laff/translate"
+)
+
+// localize translates a joke to the language asked for with the lang
+// parameter, or else the default, such as the caller's profile's, or the
+// Accept-Language header.  If there is no translator, or
+// the translation fails, the caller gets the English joke rather than an
+// error.  It returns the text and its language.  With a translator, the
+// response varies by Accept-Language, which the caller says.
+func (a apiImpl) localize(r *http.Request, text, dflt string) (string, string) {
+	if a.tr == nil {
+		return text, translate.Source
+	}
+	param := r.URL.Query().Get("lang")
+	if param == "" {
+		param = dflt
+	}
+	lang := translate.Language(param, r.Header.Get("Accept-Language"))
+	if lang == translate.Source {
+		return text, lang
+	}
+	res, err := a.tr.Translate(r.Context(), text, lang)
+	if err != nil {
+		a.logFor(r).Warnw("error translating joke", "lang", lang, "error", err)
+		return text, translate.Source
+	}
+	return res, lang
+}
@@ -0,0 +1,12 @@
+package api
+
+import "net/http"
+
+// getUpstreams reports how each upstream service and joke provider is
+// doing, so it is plain which dependency is misbehaving.
+func (a apiImpl) getUpstreams(w http.ResponseWriter, r *http.Request) {
+	if !a.drainBody(w, r) {
+		return
+	}
+	a.writeJSON(w, http.StatusOK, a.svc.Upstreams())
+}
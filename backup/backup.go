@@ -0,0 +1,180 @@
+// Package backup keeps compressed snapshots of the laff store in a bucket,
+// such as on S3, on a schedule, and restores the latest one, so the data
+// outlives the storage of a container.
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/store"
+)
+
+// keyTime is the layout of the times in the keys of the snapshots, which
+// sort in the order they were taken.
+const keyTime = "20060102T150405Z"
+
+// Bucket holds the snapshots by key.
+type Bucket interface {
+	// Put stores the object under the key.
+	Put(ctx context.Context, key string, body io.ReadSeeker) error
+
+	// Get returns the object with the key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// List returns the keys starting with the prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Delete removes the object with the key.
+	Delete(ctx context.Context, key string) error
+}
+
+// Exporter uploads gzipped snapshots of a store to a bucket, under the
+// prefix, keeping the latest few.  The snapshots are named by the time
+// they were taken and the extension of the store's file, such as .json
+// or .db, so a store restores only its own kind.
+type Exporter struct {
+	snap   store.Snapshotter
+	bucket Bucket
+	prefix string
+	ext    string
+	keep   int
+	log    logging.Logger
+	now    func() time.Time
+}
+
+// NewExporter creates an exporter of the store's snapshots, keeping keep
+// of them, or all of them if keep is 0.
+func NewExporter(snap store.Snapshotter, bucket Bucket, prefix, ext string, keep int, log logging.Logger) *Exporter {
+	return &Exporter{snap: snap, bucket: bucket, prefix: prefix, ext: ext, keep: keep, log: log, now: time.Now}
+}
+
+// Run takes a snapshot every interval until the context is done.  The
+// errors are logged, and the next snapshot tried on time.
+func (e *Exporter) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if _, err := e.Backup(ctx); err != nil && ctx.Err() == nil {
+			e.log.Errorw("Error backing up the store", "error", err)
+		}
+	}
+}
+
+// Shutdown takes a last snapshot, of the data written since the last one.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	_, err := e.Backup(ctx)
+	return err
+}
+
+// Backup uploads a snapshot, then deletes the oldest beyond those kept,
+// returning the key of the snapshot.  The snapshot is spooled to a
+// temporary file, as a database needn't fit in memory.
+func (e *Exporter) Backup(ctx context.Context) (string, error) {
+	tmp, err := os.CreateTemp("", "laff-backup")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	zw := gzip.NewWriter(tmp)
+	if err := e.snap.Snapshot(ctx, zw); err != nil {
+		return "", fmt.Errorf("taking snapshot: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	key := e.prefix + "laff-" + e.now().UTC().Format(keyTime) + e.ext + ".gz"
+	if err := e.bucket.Put(ctx, key, tmp); err != nil {
+		return "", fmt.Errorf("uploading %s: %v", key, err)
+	}
+	e.log.Infow("Backed up the store", "key", key)
+	return key, e.prune(ctx)
+}
+
+// prune deletes the oldest snapshots beyond those kept.
+func (e *Exporter) prune(ctx context.Context) error {
+	if e.keep <= 0 {
+		return nil
+	}
+	keys, err := snapshots(ctx, e.bucket, e.prefix, e.ext)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for len(keys) > e.keep {
+		if err := e.bucket.Delete(ctx, keys[0]); err != nil {
+			errs = append(errs, fmt.Errorf("deleting %s: %v", keys[0], err))
+		}
+		keys = keys[1:]
+	}
+	return errors.Join(errs...)
+}
+
+// Restore downloads the latest snapshot under the prefix with the
+// extension to the path, returning its key, or "" if there is none.  It
+// is written to a temporary file in the same directory and renamed over
+// the path, so a failed download leaves no partial file behind.
+func Restore(ctx context.Context, bucket Bucket, prefix, ext, path string) (string, error) {
+	keys, err := snapshots(ctx, bucket, prefix, ext)
+	if err != nil || len(keys) == 0 {
+		return "", err
+	}
+	key := keys[len(keys)-1]
+	body, err := bucket.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %v", key, err)
+	}
+	defer body.Close()
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", key, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, zr); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("reading %s: %v", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return key, os.Rename(tmp.Name(), path)
+}
+
+// snapshots returns the keys of the snapshots under the prefix with the
+// extension, oldest first.
+func snapshots(ctx context.Context, bucket Bucket, prefix, ext string) ([]string, error) {
+	all, err := bucket.List(ctx, prefix+"laff-")
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshots: %v", err)
+	}
+	var keys []string
+	for _, k := range all {
+		if strings.HasSuffix(k, ext+".gz") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/store"
+)
+
+// fakeS3 is an S3-compatible store of one bucket, addressed by path.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (fs *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/laff/")
+	switch {
+	case r.URL.Path == "/laff" && r.URL.Query().Get("list-type") == "2":
+		type content struct{ Key string }
+		var res struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		for k := range fs.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				res.Contents = append(res.Contents, content{k})
+			}
+		}
+		sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+		xml.NewEncoder(w).Encode(res)
+	case !ok:
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+	case r.Method == http.MethodPut:
+		fs.objects[key], _ = io.ReadAll(r.Body)
+	case r.Method == http.MethodGet && fs.objects[key] != nil:
+		w.Write(fs.objects[key])
+	case r.Method == http.MethodDelete:
+		delete(fs.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+	}
+}
+
+// TestBackupRestore verifies the snapshots are uploaded, the oldest
+// pruned, and the latest restored.
+func TestBackupRestore(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{"backups/laff-20260101T000000Z.db.gz": []byte("other")}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	bucket := NewS3(aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		HTTPClient:  srv.Client(),
+	}, "laff", srv.URL)
+
+	ctx := context.Background()
+	st, _ := store.NewFileStore("", store.FileOptions{})
+	e := NewExporter(st, bucket, "backups/", ".json", 2, logging.Nop())
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	e.now = func() time.Time { return now }
+	for i, user := range []string{"alice", "bob", "carol"} {
+		st.AddFavorite(ctx, user, 5)
+		now = now.Add(time.Hour)
+		if _, err := e.Backup(ctx); err != nil {
+			t.Fatal("error backing up", i, err)
+		}
+	}
+	keys, _ := bucket.List(ctx, "backups/")
+	exp := []string{"backups/laff-20260101T000000Z.db.gz",
+		"backups/laff-20261017T140000Z.json.gz", "backups/laff-20261017T150000Z.json.gz"}
+	if strings.Join(keys, " ") != strings.Join(exp, " ") {
+		t.Fatal("expected", exp, "got:", keys)
+	}
+
+	path := filepath.Join(t.TempDir(), "laff.json")
+	key, err := Restore(ctx, bucket, "backups/", ".json", path)
+	if err != nil || key != exp[2] {
+		t.Fatal("expected the latest restored, got:", key, err)
+	}
+	restored, err := store.NewFileStore(path, store.FileOptions{})
+	if err != nil {
+		t.Fatal("error opening the restored store", err)
+	}
+	if favs, _ := restored.Favorites(ctx, "carol"); len(favs) != 1 {
+		t.Fatal("expected carol's favorite restored, got:", favs)
+	}
+
+	if key, err := Restore(ctx, bucket, "none/", ".json", path+".none"); key != "" || err != nil {
+		t.Fatal("expected nothing restored, got:", key, err)
+	}
+	if _, err := os.Stat(path + ".none"); !os.IsNotExist(err) {
+		t.Fatal("expected no file written, got:", err)
+	}
+}
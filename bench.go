@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchConfig holds the settings for the bench command.
+type benchConfig struct {
+	clientConfig
+	rps      float64       // requests started per second
+	duration time.Duration // how long to keep starting requests
+	inFlight int           // most requests outstanding at once
+}
+
+// benchResult is what a bench run saw.
+type benchResult struct {
+	elapsed   time.Duration
+	latencies []time.Duration // of the successful requests
+	statuses  map[int]int     // responses by HTTP status
+	errors    map[string]int  // requests that got no response, by error
+	caches    map[string]int  // successful responses by X-Laff-Cache
+	dropped   int             // requests not started as too many were in flight
+}
+
+// runBench drives the joke endpoint of a running server at the rate
+// asked, and prints how it did.
+func runBench(args []string) error {
+	var cfg benchConfig
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	cfg.register(fs)
+	fs.Float64Var(&cfg.rps, "rps", 10, "joke requests started per second")
+	fs.DurationVar(&cfg.duration, "duration", 10*time.Second, "how long to run")
+	fs.IntVar(&cfg.inFlight, "max-in-flight", 100,
+		"most requests outstanding at once, the ones over it are dropped and counted")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if cfg.rps <= 0 || cfg.duration <= 0 || cfg.inFlight <= 0 {
+		return errors.New("rps, duration and max-in-flight must be positive")
+	}
+
+	fmt.Fprintf(os.Stderr, "Sending %g requests/second to %s for %v\n", cfg.rps, cfg.addr, cfg.duration)
+	res := bench(context.Background(), &cfg)
+	return res.print(os.Stdout)
+}
+
+// bench starts the requests at a steady rate, whether or not the earlier
+// ones are done, as clients would, and waits for them to finish.
+func bench(ctx context.Context, cfg *benchConfig) *benchResult {
+	res := &benchResult{
+		statuses: make(map[int]int),
+		errors:   make(map[string]int),
+		caches:   make(map[string]int),
+	}
+	client := &http.Client{
+		Timeout:   time.Duration(cfg.timeout) * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: cfg.inFlight},
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, cfg.inFlight)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.rps))
+	defer ticker.Stop()
+	start := time.Now()
+	stop := time.NewTimer(cfg.duration)
+	defer stop.Stop()
+Loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break Loop
+		case <-stop.C:
+			break Loop
+		case <-ticker.C:
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			mu.Lock()
+			res.dropped++
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			lat, status, cache, err := benchRequest(ctx, client, cfg)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				res.errors[err.Error()]++
+			case status != http.StatusOK:
+				res.statuses[status]++
+			default:
+				res.statuses[status]++
+				res.caches[cache]++
+				res.latencies = append(res.latencies, lat)
+			}
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	return res
+}
+
+// benchRequest gets a joke, returning how long it took, the status and
+// the cache it was served from.
+func benchRequest(ctx context.Context, client *http.Client, cfg *benchConfig) (time.Duration, int, string, error) {
+	req, err := cfg.newRequest(ctx, "/v1/joke")
+	if err != nil {
+		return 0, 0, "", err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return 0, 0, "", err
+	}
+	cache := resp.Header.Get("X-Laff-Cache")
+	if cache == "" {
+		cache = "unknown"
+	}
+	return time.Since(start), resp.StatusCode, cache, nil
+}
+
+// percentile returns the latency below which the fraction p of the sorted
+// latencies fall.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// print writes the results in a readable form.
+func (res *benchResult) print(w io.Writer) error {
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	var sent int
+	for _, n := range res.statuses {
+		sent += n
+	}
+	for _, n := range res.errors {
+		sent += n
+	}
+	ok := len(res.latencies)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Requests:\t%d in %v (%.1f/s), %d dropped\n",
+		sent, res.elapsed.Round(time.Millisecond), float64(sent)/res.elapsed.Seconds(), res.dropped)
+	fmt.Fprintf(tw, "Succeeded:\t%d\n", ok)
+	if ok > 0 {
+		fmt.Fprintf(tw, "Latency:\tp50 %v, p90 %v, p99 %v, max %v\n",
+			percentile(res.latencies, 0.5), percentile(res.latencies, 0.9),
+			percentile(res.latencies, 0.99), res.latencies[ok-1])
+		fmt.Fprintf(tw, "Cache:\t%s\n", ratios(res.caches, ok))
+	}
+	for _, status := range sortedKeys(res.statuses) {
+		if status != http.StatusOK {
+			fmt.Fprintf(tw, "HTTP %d:\t%d\n", status, res.statuses[status])
+		}
+	}
+	for _, msg := range sortedKeys(res.errors) {
+		fmt.Fprintf(tw, "Error:\t%s (%d)\n", msg, res.errors[msg])
+	}
+	return tw.Flush()
+}
+
+// ratios lists the share of the successful responses from each cache.
+func ratios(caches map[string]int, total int) string {
+	var s string
+	for i, c := range sortedKeys(caches) {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s %.1f%%", c, 100*float64(caches[c])/float64(total))
+	}
+	return s
+}
+
+func sortedKeys[K int | string](m map[K]int) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
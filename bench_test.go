@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBench verifies the requests are made at about the rate asked, and
+// the responses are counted by status and cache.
+func TestBench(t *testing.T) {
+	var calls int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&calls, 1) % 4 {
+		case 0:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 1:
+			w.Header().Set("X-Laff-Cache", "joke")
+		default:
+			w.Header().Set("X-Laff-Cache", "miss")
+		}
+		w.Write([]byte("a joke\n"))
+	}))
+	defer srv.Close()
+
+	cfg := benchConfig{clientConfig: clientConfig{addr: srv.URL, timeout: 5},
+		rps: 100, duration: 200 * time.Millisecond, inFlight: 10}
+	res := bench(context.Background(), &cfg)
+	sent := res.statuses[http.StatusOK] + res.statuses[http.StatusTooManyRequests]
+	if sent < 10 || sent > 25 || int64(sent) != calls || len(res.errors) != 0 {
+		t.Fatalf("expected about 20 requests, got: %+v", res)
+	}
+	if res.caches["joke"] == 0 || res.caches["miss"] <= res.caches["joke"] ||
+		res.caches["joke"]+res.caches["miss"] != len(res.latencies) {
+		t.Fatal("unexpected cache counts:", res.caches)
+	}
+
+	var out bytes.Buffer
+	if err := res.print(&out); err != nil {
+		t.Fatal("error printing results", err)
+	}
+	for _, want := range []string{"Latency:", "Cache:", "joke ", "HTTP 429:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in the results, got:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestPercentile verifies the percentiles are picked from the sorted
+// latencies.
+func TestPercentile(t *testing.T) {
+	var lats []time.Duration
+	for i := 1; i <= 100; i++ {
+		lats = append(lats, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{0.5: 50 * time.Millisecond,
+		0.99: 99 * time.Millisecond, 1: 100 * time.Millisecond, 0: time.Millisecond} {
+		if got := percentile(lats, p); got != want {
+			t.Errorf("expected %v for p%v, got: %v", want, p*100, got)
+		}
+	}
+	if percentile(nil, 0.5) != 0 {
+		t.Error("expected 0 with no latencies")
+	}
+}
@@ -0,0 +1,125 @@
+// Package catalog keeps a local copy of the joke service's jokes in a
+// joke store, so random jokes can be served without calling the joke
+// service for each one.  The copy is taken by paging through the whole
+// catalog once, then refreshed now and then to pick up the changes.
+package catalog
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/store"
+	pkgerr "github.com/pkg/errors"
+)
+
+// pageSize is the number of stored jokes read at a time when looking for
+// the ones that have gone from the catalog.
+const pageSize = 500
+
+// Source lists all the jokes of the joke service.  It is implemented by
+// the laff service.
+type Source interface {
+	Catalog(ctx context.Context) ([]service.JokeValue, error)
+}
+
+// Result counts the changes made by a sync.
+type Result struct {
+	Added   int
+	Updated int
+	Removed int
+}
+
+// Sync copies the catalog into the store.  The jokes keep the IDs given
+// by the joke service and are marked as synced, and the synced jokes no
+// longer in the catalog are removed.  Jokes added by other means are
+// left alone, even if they have the ID of a catalog joke.
+func Sync(ctx context.Context, src Source, js store.JokeStore) (Result, error) {
+	var res Result
+	jokes, err := src.Catalog(ctx)
+	if err != nil {
+		return res, pkgerr.Wrap(err, "fetching catalog")
+	}
+
+	// An empty catalog is much more likely to be a broken joke service
+	// than a real one, so we keep what we have.
+	if len(jokes) == 0 {
+		return res, errors.New("joke catalog is empty")
+	}
+
+	seen := make(map[int]bool, len(jokes))
+	for _, jv := range jokes {
+		seen[jv.ID] = true
+		sj := store.StoredJoke{
+			ID:         jv.ID,
+			Text:       jv.Joke,
+			Categories: jv.Categories,
+			Source:     store.SourceSynced,
+		}
+		old, err := js.Joke(ctx, jv.ID)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			if _, err := js.CreateJoke(ctx, sj); err != nil {
+				return res, pkgerr.Wrapf(err, "adding joke %d", jv.ID)
+			}
+			res.Added++
+		case err != nil:
+			return res, pkgerr.Wrapf(err, "reading joke %d", jv.ID)
+		case old.Source != store.SourceSynced:
+		case old.Text != sj.Text || !slices.Equal(old.Categories, sj.Categories):
+			if _, err := js.UpdateJoke(ctx, sj); err != nil {
+				return res, pkgerr.Wrapf(err, "updating joke %d", jv.ID)
+			}
+			res.Updated++
+		}
+	}
+
+	var stale []int
+	for offset := 0; ; offset += pageSize {
+		page, total, err := js.Jokes(ctx, "", offset, pageSize)
+		if err != nil {
+			return res, pkgerr.Wrap(err, "listing jokes")
+		}
+		for _, sj := range page {
+			if sj.Source == store.SourceSynced && !seen[sj.ID] {
+				stale = append(stale, sj.ID)
+			}
+		}
+		if len(page) == 0 || offset+len(page) >= total {
+			break
+		}
+	}
+	for _, id := range stale {
+		if err := js.DeleteJoke(ctx, id); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return res, pkgerr.Wrapf(err, "removing joke %d", id)
+		}
+		res.Removed++
+	}
+	return res, nil
+}
+
+// Run syncs the catalog right away, then every interval until the
+// context is done.  The errors are logged, and the jokes already copied
+// are kept serving until the next sync succeeds.
+func Run(ctx context.Context, src Source, js store.JokeStore, interval time.Duration, log logging.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		res, err := Sync(ctx, src, js)
+		if err != nil {
+			log.Errorw("Error syncing joke catalog", "error", err)
+		} else {
+			log.Infow("Synced joke catalog", "added", res.Added, "updated", res.Updated,
+				"removed", res.Removed, "took", time.Since(start).Round(time.Millisecond))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/store"
+)
+
+// fakeSource is a catalog that can be changed between syncs.
+type fakeSource struct {
+	jokes []service.JokeValue
+	err   error
+}
+
+func (fs *fakeSource) Catalog(ctx context.Context) ([]service.JokeValue, error) {
+	return fs.jokes, fs.err
+}
+
+// TestSync copies a catalog, then follows the changes to it, leaving the
+// jokes that weren't synced alone.
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	js, err := store.NewSQLiteStore(filepath.Join(t.TempDir(), "laff.db"), 0)
+	if err != nil {
+		t.Fatal("error creating store", err)
+	}
+	defer js.Close()
+	if _, err := js.CreateJoke(ctx, store.StoredJoke{
+		ID: 3, Text: "{first} wrote this one.", Source: store.SourceUser,
+	}); err != nil {
+		t.Fatal("error creating joke", err)
+	}
+
+	src := &fakeSource{jokes: []service.JokeValue{
+		{ID: 1, Joke: "{first} {last} counted to infinity."},
+		{ID: 2, Joke: "{last} can divide by zero.", Categories: []string{"nerdy"}},
+		{ID: 3, Joke: "Not ours to replace."},
+	}}
+	res, err := Sync(ctx, src, js)
+	if err != nil {
+		t.Fatal("error syncing", err)
+	}
+	if res != (Result{Added: 2}) {
+		t.Fatal("unexpected first sync:", res)
+	}
+	if sj, _ := js.Joke(ctx, 3); sj.Source != store.SourceUser || sj.Text != "{first} wrote this one." {
+		t.Fatal("user joke was changed:", sj)
+	}
+
+	// Nothing changed, so nothing to do.
+	if res, err = Sync(ctx, src, js); err != nil || res != (Result{}) {
+		t.Fatal("unexpected unchanged sync:", res, err)
+	}
+
+	src.jokes = []service.JokeValue{
+		{ID: 2, Joke: "{last} can divide by zero, twice.", Categories: []string{"nerdy"}},
+		{ID: 4, Joke: "{first} makes onions cry."},
+	}
+	if res, err = Sync(ctx, src, js); err != nil {
+		t.Fatal("error syncing", err)
+	}
+	if res != (Result{Added: 1, Updated: 1, Removed: 1}) {
+		t.Fatal("unexpected second sync:", res)
+	}
+	if _, err := js.Joke(ctx, 1); !errors.Is(err, store.ErrNotFound) {
+		t.Fatal("expected removed joke to be gone, got:", err)
+	}
+	if sj, _ := js.Joke(ctx, 2); sj.Text != "{last} can divide by zero, twice." {
+		t.Fatal("joke not updated:", sj)
+	}
+	if _, err := js.Joke(ctx, 3); err != nil {
+		t.Fatal("user joke was removed:", err)
+	}
+
+	// A broken upstream keeps the copy we have.
+	src.err = errors.New("down")
+	if _, err = Sync(ctx, src, js); err == nil {
+		t.Fatal("expected error from failed fetch")
+	}
+	src.jokes, src.err = nil, nil
+	if _, err = Sync(ctx, src, js); err == nil {
+		t.Fatal("expected error from empty catalog")
+	}
+	if _, total, _ := js.Jokes(ctx, "", 0, 10); total != 3 {
+		t.Fatal("expected jokes to be kept, got:", total)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gdotgordon/laff/api"
+)
+
+// clientConfig holds the settings for the commands that call a running
+// server.
+type clientConfig struct {
+	addr    string // base URL of the server
+	apiKey  string // API key, if the server requires one
+	timeout int    // request timeout in seconds
+}
+
+// register defines the flags for the settings.
+func (c *clientConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.addr, "addr", "http://localhost:5000", "address of the laff server")
+	fs.StringVar(&c.apiKey, "apikey", "", "API key to send to the server")
+	fs.IntVar(&c.timeout, "timeout", 10, "request timeout (seconds)")
+}
+
+// newRequest creates a GET request for the endpoint on the server, with
+// the API key if there is one.
+func (c *clientConfig) newRequest(ctx context.Context, path string) (*http.Request, error) {
+	addr := c.addr
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(addr, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	return req, nil
+}
+
+// get invokes the endpoint on the server, returning the body of a
+// successful response.
+func (c *clientConfig) get(path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(c.timeout)*time.Second)
+	defer cancel()
+
+	req, err := c.newRequest(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, b)
+	}
+	return b, nil
+}
+
+// statusError is the error for an unsuccessful response with the body.
+func statusError(code int, b []byte) error {
+	// Our errors carry the cause in a JSON status.
+	var sr api.StatusResponse
+	if json.Unmarshal(b, &sr) == nil && sr.Status != "" {
+		return fmt.Errorf("server returned HTTP status %d: %s", code, sr.Status)
+	}
+	return fmt.Errorf("server returned HTTP status %d (%s)", code, http.StatusText(code))
+}
+
+// runJoke gets a joke from a running server and prints it.
+func runJoke(args []string) error {
+	var cfg clientConfig
+	fs := flag.NewFlagSet("joke", flag.ExitOnError)
+	cfg.register(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	b, err := cfg.get("/v1/joke")
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(b)
+	return nil
+}
+
+// runStatus gets the status of a running server and prints it in a
+// readable form, or as the raw JSON if asked.
+func runStatus(args []string) error {
+	var cfg clientConfig
+	var raw bool
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	cfg.register(fs)
+	fs.BoolVar(&raw, "json", false, "print the status as JSON")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	b, err := cfg.get("/v1/status")
+	if err != nil {
+		return err
+	}
+	if raw {
+		fmt.Println(string(b))
+		return nil
+	}
+	var ss api.ServiceStatus
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return fmt.Errorf("invalid status response: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Status:\t%s\n", ss.Status)
+	fmt.Fprintf(tw, "Version:\t%s (commit %s, built %s)\n",
+		ss.Version, ss.Commit, ss.BuildDate)
+	fmt.Fprintf(tw, "Go version:\t%s\n", ss.GoVersion)
+	fmt.Fprintf(tw, "Uptime:\t%s\n", ss.Uptime)
+	fmt.Fprintf(tw, "Cache:\t%d names, %d jokes, of %d each\n", ss.Cache.Names, ss.Cache.Jokes, ss.Cache.Size)
+	fmt.Fprintf(tw, "Cache hits:\t%.1f%% (%d jokes, %d names, %d misses)\n",
+		100*ss.Cache.HitRatio, ss.Cache.JokeHits, ss.Cache.NameHits, ss.Cache.Misses)
+	fmt.Fprintf(tw, "Upstreams:\t\n")
+	for _, us := range ss.Upstreams {
+		state := "reachable"
+		switch {
+		case !us.Checked:
+			state = "not checked yet"
+		case !us.Reachable:
+			state = "unreachable: " + us.Error
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", us.Name, us.URL, state)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,913 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdotgordon/laff/api"
+	"github.com/gdotgordon/laff/gossip"
+	"github.com/gdotgordon/laff/mailer"
+	"github.com/gdotgordon/laff/service"
+)
+
+// serveConfig holds the settings for the serve command.
+type serveConfig struct {
+	portNum   int    // listen port
+	logLevel  string // zap log level
+	logFile   string // file to log to, rather than the console
+	logSize   int    // megabytes in a log file before it is rotated
+	logAge    int    // days to keep rotated log files
+	logFiles  int    // number of rotated log files to keep
+	logBoth   bool   // log to stdout as well as the file
+	timeout   int    // server timeout in seconds
+	cache     int    // length of cache
+	cacheMin  int    // least the cache is tuned to
+	cacheMax  int    // most the cache is tuned to, 0 to keep it fixed
+	workers   int    // number of cache worker goroutines
+	limit     int    // rate limiter requests/second
+	exempt    string // comma-separated API keys and CIDRs the rate limiter lets through
+	banStrike int    // requests refused in the ban window that ban a client, 0 for none
+	inFlight  int    // most requests handled at once, 0 for no limit
+	warmup    int    // jokes cached before we report ready
+	names     string // built-in name service: uinames or randomuser
+	nameURL   string // URL of the name service, replacing the built-in one
+	jokeURL   string // URL of a random joke from the joke service
+	catURL    string // URL of the joke service's catalog
+	agent     string // User-Agent sent to the upstream services
+	nameHdrs  string // comma-separated "Header: value" for the name service
+	jokeHdrs  string // comma-separated "Header: value" for the joke service
+	nameTok   string // API key or token for the name service
+	nameTokF  string // file holding the name service token
+	nameAuth  string // header carrying the name service token
+	jokeTok   string // API key or token for the joke service
+	jokeTokF  string // file holding the joke service token
+	jokeAuth  string // header carrying the joke service token
+	nameCan   string // URL of the name service canary
+	nameCanS  string // name service format of the canary
+	nameCanH  string // headers of the name service canary
+	jokeCan   string // URL of the joke service canary
+	jokeCanH  string // headers of the joke service canary
+	canPct    int    // share of the requests sent to the canaries
+	canErrs   int    // error percentage at which a canary is rolled back
+	nameConc  int    // calls in flight to the name service
+	jokeConc  int    // calls in flight to the joke service
+	nameRate  string // calls to the name service per interval, e.g. 6/1m
+	nameBurst int    // calls to the name service at once within the rate
+	jokeRate  string // calls to the joke service per interval
+	jokeBurst int    // calls to the joke service at once within the rate
+	nameProxy string // proxy for the name service, replacing the environment's
+	jokeProxy string // proxy for the joke service, replacing the environment's
+	vcrRecord string // cassette file recording the upstream calls
+	vcrReplay string // cassette file replaying the upstream calls
+	chaos     bool   // inject faults into the upstream calls, for testing
+	chaosSlow int    // percent of the upstream calls delayed by chaosLat
+	chaos429  int    // percent of the upstream calls answered 429
+	chaos5xx  int    // percent of the upstream calls answered 500
+	chaosBad  int    // percent of the upstream calls with a garbled body
+	idleConns int    // idle upstream connections kept
+	idleHost  int    // idle upstream connections kept per host
+	http2     bool   // whether to try HTTP/2 with the upstream services
+	retryPct  int    // most of the upstream calls that may be retries, in percent
+	retryMin  int    // retries always allowed in the retry window
+	brkFails  int    // failures in a row that open a circuit breaker, 0 for none
+	strict    bool   // reject and refetch malformed upstream responses
+	translit  bool   // spell the names in ASCII for the joke service
+	maxName   int    // most characters in each part of a name
+	seed      int64  // seed for the random choices, 0 for none
+	apiKeys   string // comma-separated API keys, enables auth
+	adminKeys string // comma-separated API keys for the admin endpoints
+	quotaDay  int64  // requests a day allowed each API key, 0 for no limit
+	quotaMon  int64  // requests a month allowed each API key, 0 for no limit
+	tenants   string // JSON or YAML file of the tenants
+	alertURLs string // comma-separated webhooks for the error budget alerts
+	alertBurn string // comma-separated window=rate burn rate alert thresholds
+	alertKey  string // PagerDuty routing key of the alerts
+	cacheCtl  string // semicolon-separated route=directives Cache-Control headers
+	vaultAddr string // Vault server, VAULT_ADDR if empty
+	vaultTok  string // Vault token, VAULT_TOKEN if empty
+	vaultRole string // Vault role to log in as by Kubernetes auth
+	vaultAuth string // mount path of Vault's Kubernetes auth method
+	vaultRefs string // comma-separated setting=path#field read from Vault
+	awsRefs   string // comma-separated setting=reference read from AWS
+	awsRegion string // AWS region, from the AWS config if empty
+	signKey   string // secret the responses and alerts are signed with
+	storeType string // file or sqlite
+	dataFile  string // file for persisted data
+	history   int    // number of served jokes to retain
+	persist   bool   // whether to persist the history
+	bakBucket string // S3 bucket the store is backed up to, none if empty
+	bakPrefix string // prefix of the keys of the backups
+	bakURL    string // URL of an S3-compatible store, S3 if empty
+	bakRegion string // region of the bucket, from the AWS config if empty
+	bakKeep   int    // backups kept, 0 for all
+	restore   bool   // restore the latest backup if there is no store file
+	maxBody   int64  // limit on request body size
+	confFile  string // JSON file with settings
+	cpuProf   string // file for the CPU profile
+	memProf   string // file for the heap profile
+	redis     string // Redis address for the shared name budget
+	redisPwd  string // Redis password
+	redisKey  string // prefix of the Redis budget keys
+	dynTable  string // DynamoDB table shared by the replicas, instead of Redis
+	dynRegion string // region of the table, from the AWS config if empty
+	dynURL    string // DynamoDB endpoint, the region's if empty
+	memcached string // comma-separated Memcached servers for the shared names
+	memcKey   string // prefix of the Memcached keys of the shared names
+	gosBind   string // host:port gossiped on to share the cached jokes, off if empty
+	gosJoin   string // comma-separated replicas joined through
+	gosAddr   string // host:port advertised to the peers, that bound if empty
+	gosName   string // this replica in the gossip, the hostname if empty
+	gosKey    string // base64 key encrypting the gossip, none if empty
+	budget    int    // name fetches/minute shared by all replicas
+	elect     string // how the prefetch leader is elected: kubernetes, redis or dynamodb
+	leaseName string // Kubernetes Lease, Redis key or DynamoDB item of the leader lock
+	leaseNS   string // namespace of the Lease, the pod's if empty
+	leaderID  string // this replica in the election, the hostname if empty
+	nameShare int    // names the leader keeps in Redis, DynamoDB or Memcached for the followers
+	natsURL   string // NATS server for the joke events
+	kafka     string // comma-separated Kafka brokers for the joke events
+	topic     string // NATS subject or Kafka topic for the joke events
+	queueURL  string // NATS server to take joke requests from
+	queueSub  string // subject of the joke requests
+	queueRep  string // subject for replies when the request has none
+	queueCon  int    // joke requests handled at once
+	regType   string // service registry: consul or etcd
+	regURL    string // URL of the service registry
+	regName   string // service name registered
+	regHost   string // address registered, the hostname if empty
+	regTags   string // comma-separated tags registered
+	regToken  string // Consul ACL token
+	regPrefix string // etcd key prefix
+	trans     string // translation service: libretranslate or deepl
+	transURL  string // base URL of the translation service
+	transKey  string // API key for the translation service
+	transLen  int    // number of translations cached
+	filter    bool   // discard jokes with words on the denylist
+	words     string // file with the denylist, replacing the default one
+	template  string // template decorating the jokes
+	tmplFile  string // file with the template, reloaded on SIGHUP
+	jokeLink  string // link to a joke's source in Markdown, {id} for its ID
+	smtpAddr  string // host:port of the SMTP server of the joke of the day emails
+	smtpUser  string // user to authenticate to the SMTP server as
+	smtpPass  string // password of the SMTP user
+	mailFrom  string // address the joke of the day is sent from
+	mailTo    string // comma-separated addresses the joke of the day is sent to
+	mailAt    string // time of day, in UTC, the joke of the day is sent at
+	mailSubj  string // subject of the joke of the day emails
+	mailText  string // file with the template of the plain text email body
+	mailHTML  string // file with the template of the HTML email body
+	packs     string // directory of joke packs
+	plugins   string // directory of provider plugins
+	weights   string // comma-separated name=weight shares of the joke providers
+	exper     string // the two joke providers compared, comma-separated
+
+	catalogSync time.Duration // interval between syncs of the joke catalog
+	dnsTTL      time.Duration // longest upstream addresses are cached, 0 for no cache
+	dnsNegTTL   time.Duration // how long a missing upstream host is remembered
+	idleTime    time.Duration // how long an idle upstream connection is kept
+	tlsTime     time.Duration // limit on the TLS handshake with an upstream
+	retryWin    time.Duration // window over which the retries are counted
+	chaosLat    time.Duration // delay added to the upstream calls by chaos
+	cacheWin    time.Duration // demand kept cached when the cache is tuned
+	jokeAge     time.Duration // longest a joke is cached, 0 for no limit
+	shedP99     time.Duration // p99 latency over which requests are shed, 0 for none
+	cacheWait   time.Duration // longest a request waits for a joke to be cached
+	sloLat      time.Duration // latency the SLO holds the requests to
+	sloPct      float64       // percent of the requests meeting the SLO
+	brkCool     time.Duration // how long a circuit breaker stays open
+	probeInt    time.Duration // between the upstream probes, 0 for none
+	probeTime   time.Duration // limit on each upstream probe
+	banWin      time.Duration // window the refused requests of a client are counted over
+	banCool     time.Duration // how long a ban lasts
+	drainWait   time.Duration // from a drain request to draining the connections
+	regTTL      time.Duration // Consul health check interval, or etcd lease
+	leaseTerm   time.Duration // how long the leader lock is held without renewal
+	bakEvery    time.Duration // interval between backups of the store
+	dynTTL      time.Duration // how long the shared names last in DynamoDB
+	memcTTL     time.Duration // how long the shared names last in Memcached
+	gosWait     time.Duration // longest a fresh replica waits for the peers' jokes
+	noRepeat    time.Duration // window a client isn't served the same joke twice in, 0 for off
+}
+
+// register defines the flags for the settings.
+func (c *serveConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.confFile, "config", "",
+		"JSON file of settings keyed by flag name (flags and env take precedence)")
+	fs.IntVar(&c.portNum, "port", 5000, "HTTP port number")
+	fs.StringVar(&c.logLevel, "log", "production",
+		"log level: 'production', 'development'")
+	fs.StringVar(&c.logFile, "log-file", "",
+		"file to write logs to, rotated by size and age (console if empty)")
+	fs.IntVar(&c.logSize, "log-max-size", 100, "size of a log file before rotation (MB)")
+	fs.IntVar(&c.logAge, "log-max-age", 28, "days to keep rotated log files (0 keeps all)")
+	fs.IntVar(&c.logFiles, "log-max-backups", 5, "rotated log files to keep (0 keeps all)")
+	fs.BoolVar(&c.logBoth, "log-stdout", false, "log to stdout as well as the log file")
+	fs.IntVar(&c.timeout, "timeout", 30, "server timeout (seconds)")
+	fs.DurationVar(&c.drainWait, "drain-delay", 15*time.Second,
+		"how long after a drain request the readiness fails before the connections are drained")
+	fs.IntVar(&c.cache, "cache", 10, "length of name and joke caches, or where they start if tuned")
+	fs.IntVar(&c.cacheMin, "cache-min", 1, "least the caches are tuned to, with -cache-max")
+	fs.IntVar(&c.cacheMax, "cache-max", 0,
+		"tune the cache length to the demand, up to this (fixed at -cache if 0)")
+	fs.DurationVar(&c.cacheWin, "cache-window", 5*time.Minute,
+		"how much of the demand the tuned caches hold")
+	fs.DurationVar(&c.cacheWait, "cache-wait", 0,
+		"longest a request finding the caches empty waits for a joke to be cached, before fetching one")
+	fs.DurationVar(&c.jokeAge, "joke-max-age", time.Hour,
+		"serve the newest cached joke first, and replace those cached longer than this (oldest first, kept, if 0)")
+	fs.IntVar(&c.workers, "workers", 2, "number of cache worker goroutines")
+	fs.IntVar(&c.limit, "limit", 10, "rate limiter requests/second")
+	fs.StringVar(&c.exempt, "limit-exempt", "",
+		"comma-separated API keys, IP addresses and CIDRs, such as 10.0.0.0/8, that bypass the rate limiter")
+	fs.IntVar(&c.banStrike, "ban-strikes", 0,
+		"ban a client refused with a 429 or 401 this many times within -ban-window (off if 0)")
+	fs.DurationVar(&c.banWin, "ban-window", time.Minute, "window the refused requests of a client are counted over")
+	fs.DurationVar(&c.banCool, "ban-cooldown", 10*time.Minute, "how long a banned client gets a 403")
+	fs.DurationVar(&c.noRepeat, "no-repeat", 0,
+		"don't serve a client, told apart by API key or session cookie, the same joke twice within this (off if 0)")
+	fs.StringVar(&c.cacheCtl, "cache-control", "/=no-store;/v1/joke=no-store",
+		"semicolon-separated route=directives Cache-Control headers, such as /v1/stats=public, max-age=60, by route template (none if empty)")
+	fs.IntVar(&c.inFlight, "max-in-flight", 0,
+		"most requests handled at once, the rest get a 503 (no limit if 0)")
+	fs.DurationVar(&c.shedP99, "shed-latency", 0,
+		"shed a share of the requests with a 503 while their p99 latency is over this (off if 0)")
+	fs.DurationVar(&c.sloLat, "slo-latency", 200*time.Millisecond,
+		"latency objective of each route, reported by /v1/admin/slo")
+	fs.Float64Var(&c.sloPct, "slo-target", 99.9,
+		"percent of the requests to each route to succeed within -slo-latency")
+	fs.StringVar(&c.alertURLs, "slo-alert-urls", "",
+		"comma-separated webhook URLs, such as Slack or PagerDuty, to alert when the error budget burns too fast (off if empty)")
+	fs.StringVar(&c.alertBurn, "slo-alert-burn", "5m=14.4,1h=6",
+		"comma-separated window=rate burn rates of the error budget alerted on, over a window of 5m or 1h")
+	fs.StringVar(&c.alertKey, "slo-alert-key", "",
+		"PagerDuty routing key sent with the alerts")
+	fs.StringVar(&c.vaultAddr, "vault-addr", "", "URL of the Vault server (VAULT_ADDR if empty)")
+	fs.StringVar(&c.vaultTok, "vault-token", "", "Vault token (VAULT_TOKEN if empty)")
+	fs.StringVar(&c.vaultRole, "vault-role", "",
+		"Vault role to log in as with the pod's service account, rather than a token")
+	fs.StringVar(&c.vaultAuth, "vault-auth-path", "kubernetes", "mount path of Vault's Kubernetes auth method")
+	fs.StringVar(&c.vaultRefs, "vault-secrets", "",
+		"comma-separated setting=path#field read from Vault, such as apikeys=secret/data/laff#apikeys")
+	fs.StringVar(&c.awsRefs, "aws-secrets", "",
+		"comma-separated setting=reference read from AWS, such as apikeys=secretsmanager:laff#apikeys or name-token=ssm:/laff/name-token")
+	fs.StringVar(&c.awsRegion, "aws-region", "", "AWS region of the secrets (from AWS_REGION or the AWS config if empty)")
+	fs.StringVar(&c.signKey, "sign-secret", "",
+		"secret the response bodies and alerts are signed with, in the X-Laff-Signature header (unsigned if empty)")
+	fs.IntVar(&c.warmup, "warmup", 1,
+		"jokes cached before notifying systemd we are ready")
+	fs.StringVar(&c.names, "name-service", "uinames",
+		"built-in name service: 'uinames', 'randomuser' (randomuser.me)")
+	fs.StringVar(&c.nameURL, "name-url", "",
+		"URL of the name service, e.g. a staging or mock one (the built-in one if empty)")
+	fs.StringVar(&c.jokeURL, "joke-url", "",
+		"URL of a random joke from the joke service (icndb if empty)")
+	fs.StringVar(&c.catURL, "catalog-url", "",
+		"URL of the joke service's catalog, for -catalog-sync (icndb if empty)")
+	fs.StringVar(&c.agent, "user-agent", "laff/"+version,
+		"User-Agent sent to the upstream services")
+	fs.StringVar(&c.nameHdrs, "name-headers", "",
+		"comma-separated 'Header: value' pairs added to the name service requests")
+	fs.StringVar(&c.jokeHdrs, "joke-headers", "",
+		"comma-separated 'Header: value' pairs added to the joke service requests")
+	fs.StringVar(&c.nameTok, "name-token", "", "API key or token for the name service")
+	fs.StringVar(&c.nameTokF, "name-token-file", "",
+		"file holding the API key or token for the name service, e.g. a mounted secret")
+	fs.StringVar(&c.nameAuth, "name-auth-header", "Authorization",
+		"header carrying the name service token (as a bearer token for Authorization)")
+	fs.StringVar(&c.jokeTok, "joke-token", "", "API key or token for the joke service")
+	fs.StringVar(&c.jokeTokF, "joke-token-file", "",
+		"file holding the API key or token for the joke service, e.g. a mounted secret")
+	fs.StringVar(&c.jokeAuth, "joke-auth-header", "Authorization",
+		"header carrying the joke service token (as a bearer token for Authorization)")
+	fs.StringVar(&c.nameCan, "name-canary-url", "",
+		"URL of a name service canary, tried on -canary-percent of the requests")
+	fs.StringVar(&c.nameCanS, "name-canary-service", "",
+		"name service format of the canary: 'uinames', 'randomuser' (-name-service if empty)")
+	fs.StringVar(&c.nameCanH, "name-canary-headers", "",
+		"comma-separated 'Header: value' pairs for the name service canary (-name-headers if empty)")
+	fs.StringVar(&c.jokeCan, "joke-canary-url", "",
+		"URL of a joke service canary, tried on -canary-percent of the requests")
+	fs.StringVar(&c.jokeCanH, "joke-canary-headers", "",
+		"comma-separated 'Header: value' pairs for the joke service canary (-joke-headers if empty)")
+	fs.IntVar(&c.canPct, "canary-percent", 5, "percent of the upstream requests sent to the canaries")
+	fs.IntVar(&c.canErrs, "canary-max-errors", 20,
+		"percent of a canary's requests failing, above which it is rolled back")
+	fs.IntVar(&c.nameConc, "name-concurrency", 8,
+		"calls to the name service in flight at once, the others wait (0 for no limit)")
+	fs.IntVar(&c.jokeConc, "joke-concurrency", 8,
+		"calls to the joke service in flight at once, the others wait (0 for no limit)")
+	fs.StringVar(&c.nameRate, "name-rate", "6/1m",
+		"calls allowed to the name service, as count/interval (no limit if empty)")
+	fs.IntVar(&c.nameBurst, "name-burst", 3, "calls to the name service allowed at once within -name-rate")
+	fs.StringVar(&c.jokeRate, "joke-rate", "",
+		"calls allowed to the joke service, as count/interval, e.g. '100/1s' (no limit if empty)")
+	fs.IntVar(&c.jokeBurst, "joke-burst", 1, "calls to the joke service allowed at once within -joke-rate")
+	fs.StringVar(&c.nameProxy, "name-proxy", "",
+		"proxy URL for the name service (from HTTP_PROXY, HTTPS_PROXY and NO_PROXY if empty)")
+	fs.StringVar(&c.jokeProxy, "joke-proxy", "",
+		"proxy URL for the joke service (from HTTP_PROXY, HTTPS_PROXY and NO_PROXY if empty)")
+	fs.StringVar(&c.vcrRecord, "vcr-record", "",
+		"record the upstream responses to this cassette file, adding to it, for -vcr-replay")
+	fs.StringVar(&c.vcrReplay, "vcr-replay", "",
+		"answer the upstream calls from this cassette file rather than the network")
+	fs.BoolVar(&c.chaos, "chaos", false,
+		"for testing only: inject the -chaos-* faults into the upstream calls")
+	fs.DurationVar(&c.chaosLat, "chaos-latency", time.Second, "delay added to the upstream calls by -chaos")
+	fs.IntVar(&c.chaosSlow, "chaos-latency-pct", 0, "percent of the upstream calls delayed by -chaos-latency")
+	fs.IntVar(&c.chaos429, "chaos-429-pct", 0, "percent of the upstream calls answered 429 by -chaos")
+	fs.IntVar(&c.chaos5xx, "chaos-5xx-pct", 0, "percent of the upstream calls answered 500 by -chaos")
+	fs.IntVar(&c.chaosBad, "chaos-malformed-pct", 0, "percent of the upstream calls given a garbled body by -chaos")
+	fs.IntVar(&c.idleConns, "max-idle-conns", 100, "idle upstream connections kept for reuse (0 for no limit)")
+	fs.IntVar(&c.idleHost, "max-idle-conns-per-host", 100, "idle connections kept for reuse with each upstream host")
+	fs.DurationVar(&c.idleTime, "idle-conn-timeout", 90*time.Second,
+		"how long an idle upstream connection is kept (0 for ever)")
+	fs.DurationVar(&c.tlsTime, "tls-handshake-timeout", 10*time.Second,
+		"limit on the TLS handshake with an upstream service (0 for none)")
+	fs.BoolVar(&c.http2, "http2", true, "try HTTP/2 with the upstream services")
+	fs.IntVar(&c.retryPct, "retry-budget", 20,
+		"percent of the calls to each upstream service that may be retries, after which the cache workers hold off")
+	fs.DurationVar(&c.retryWin, "retry-window", time.Minute, "window over which -retry-budget is counted")
+	fs.IntVar(&c.retryMin, "retry-min", 10, "retries always allowed in the -retry-window, whatever the budget")
+	fs.IntVar(&c.brkFails, "breaker-failures", 5,
+		"failed calls in a row after which an upstream service isn't called for -breaker-cooldown (no breaker if 0)")
+	fs.DurationVar(&c.brkCool, "breaker-cooldown", 30*time.Second,
+		"how long an upstream service's circuit breaker stays open before a call is let through to probe it")
+	fs.DurationVar(&c.probeInt, "probe-interval", 0,
+		"send a HEAD request to each upstream service this often, even while idle, to track its health (off if 0)")
+	fs.DurationVar(&c.probeTime, "probe-timeout", 5*time.Second, "limit on each upstream probe")
+	fs.BoolVar(&c.strict, "strict-upstream", false,
+		"reject and refetch names and jokes missing their text, rather than serving them")
+	fs.BoolVar(&c.translit, "transliterate", false,
+		"spell the names sent to the joke service in ASCII, e.g. 'Łukasz' as 'Lukasz'")
+	fs.Int64Var(&c.seed, "seed", 0,
+		"seed the choice of joke and name sources and of the local jokes, so runs can be repeated (0 for random)")
+	fs.IntVar(&c.maxName, "max-name-length", 50, "most characters in each part of a name, such as the surname, longer ones are rejected")
+	fs.DurationVar(&c.dnsTTL, "dns-cache-ttl", 0,
+		"cache the upstream host addresses for their DNS TTL, up to this long (off if 0)")
+	fs.DurationVar(&c.dnsNegTTL, "dns-negative-ttl", 30*time.Second,
+		"how long an upstream host that doesn't exist is remembered by the DNS cache")
+	fs.StringVar(&c.apiKeys, "apikeys", "",
+		"comma-separated API keys, enables the authenticated endpoints")
+	fs.Int64Var(&c.quotaDay, "quota-daily", 0,
+		"requests each API key may make a day, by UTC (no limit if 0)")
+	fs.Int64Var(&c.quotaMon, "quota-monthly", 0,
+		"requests each API key may make a month, by UTC (no limit if 0)")
+	fs.StringVar(&c.adminKeys, "admin-keys", "",
+		"comma-separated API keys for the admin endpoints (the stored jokes need -store-type=sqlite)")
+	fs.StringVar(&c.tenants, "tenants", "",
+		"JSON or YAML file of the tenants, each with its own keys, rate limit, categories and joke packs")
+	fs.StringVar(&c.storeType, "store-type", "file",
+		"store for user data: 'file' (JSON), 'sqlite' (also holds jokes)")
+	fs.StringVar(&c.dataFile, "store", "",
+		"file in which to persist user data (in-memory if empty)")
+	fs.IntVar(&c.history, "history", 100, "number of served jokes to retain")
+	fs.BoolVar(&c.persist, "history-persist", false,
+		"persist the joke history in the store file")
+	fs.StringVar(&c.bakBucket, "backup-bucket", "",
+		"S3 bucket the store is backed up to, as gzipped snapshots (off if empty)")
+	fs.StringVar(&c.bakPrefix, "backup-prefix", "laff/", "prefix of the keys of the backups in the bucket")
+	fs.StringVar(&c.bakURL, "backup-endpoint", "",
+		"URL of an S3-compatible store, such as MinIO, to back up to instead of S3")
+	fs.StringVar(&c.bakRegion, "backup-region", "",
+		"region of the backup bucket (from AWS_REGION or the AWS config if empty)")
+	fs.DurationVar(&c.bakEvery, "backup-interval", time.Hour, "interval between backups of the store")
+	fs.IntVar(&c.bakKeep, "backup-keep", 24, "backups kept in the bucket, the oldest deleted first (all if 0)")
+	fs.BoolVar(&c.restore, "backup-restore", true,
+		"restore the latest backup on startup if the store file doesn't exist")
+	fs.Int64Var(&c.maxBody, "max-body", 1<<20, "maximum request body size (bytes)")
+	fs.StringVar(&c.cpuProf, "cpuprofile", "",
+		"write a CPU profile to the file at shutdown and on SIGUSR2")
+	fs.StringVar(&c.memProf, "memprofile", "",
+		"write a heap profile to the file at shutdown and on SIGUSR2")
+	fs.StringVar(&c.redis, "redis-addr", "",
+		"Redis host:port used to share the name budget among replicas (off if empty)")
+	fs.StringVar(&c.redisPwd, "redis-password", "", "Redis password")
+	fs.StringVar(&c.redisKey, "redis-key", "laff:names",
+		"prefix of the Redis keys for the name budget, shared by the replicas")
+	fs.StringVar(&c.dynTable, "dynamodb-table", "",
+		"DynamoDB table used instead of Redis to share the name budget, leader lock and shared names (off if empty)")
+	fs.StringVar(&c.dynRegion, "dynamodb-region", "",
+		"region of the DynamoDB table (from AWS_REGION or the AWS config if empty)")
+	fs.StringVar(&c.dynURL, "dynamodb-endpoint", "",
+		"URL of DynamoDB, such as DynamoDB Local, instead of the region's")
+	fs.DurationVar(&c.dynTTL, "dynamodb-ttl", 10*time.Minute,
+		"how long the shared names are kept in DynamoDB before they are stale")
+	fs.StringVar(&c.memcached, "memcached", "",
+		"comma-separated Memcached servers, hashed consistently, to keep the shared names in rather than Redis or DynamoDB")
+	fs.StringVar(&c.memcKey, "memcached-key", "laff:shared", "prefix of the Memcached keys of the shared names")
+	fs.DurationVar(&c.memcTTL, "memcached-ttl", 10*time.Minute,
+		"how long the shared names are kept in Memcached before they are stale")
+	fs.StringVar(&c.gosBind, "gossip-bind", "",
+		"host:port to gossip with the other replicas on, sharing the cached jokes, such as :7946 (off if empty)")
+	fs.StringVar(&c.gosJoin, "gossip-join", "",
+		"comma-separated host:port of replicas to join the gossip through, any one being enough")
+	fs.StringVar(&c.gosAddr, "gossip-advertise", "",
+		"host:port the other replicas reach this one's gossip at (that bound if empty)")
+	fs.StringVar(&c.gosName, "gossip-name", "", "name of this replica in the gossip (the hostname if empty)")
+	fs.StringVar(&c.gosKey, "gossip-key", "",
+		"base64 key of 16, 24 or 32 bytes encrypting the gossip, the same for all replicas (required unless gossip-bind is a loopback address)")
+	fs.DurationVar(&c.gosWait, "gossip-wait", 5*time.Second,
+		"longest a replica starting with an empty cache waits for the jokes of its peers before fetching its own")
+	fs.IntVar(&c.budget, "name-budget", 6,
+		"name fetches per minute shared by all replicas (needs -redis-addr or -dynamodb-table)")
+	fs.StringVar(&c.elect, "leader-elect", "",
+		"elect the one replica prefetching names by 'kubernetes' Lease, 'redis' or 'dynamodb' lock (all prefetch if empty)")
+	fs.StringVar(&c.leaseName, "leader-lease", "laff-prefetch",
+		"name of the Kubernetes Lease, or suffix of the Redis key, or DynamoDB item, of the leader lock")
+	fs.StringVar(&c.leaseNS, "leader-namespace", "", "namespace of the Kubernetes Lease (the pod's if empty)")
+	fs.StringVar(&c.leaderID, "leader-id", "", "identity of this replica in the election (the hostname if empty)")
+	fs.DurationVar(&c.leaseTerm, "leader-term", 15*time.Second,
+		"how long the leader lock is held without being renewed")
+	fs.IntVar(&c.nameShare, "shared-names", 0,
+		"names the leader keeps in Redis, DynamoDB or Memcached for the followers to cache (0 for none, needs -leader-elect)")
+	fs.StringVar(&c.natsURL, "events-nats", "",
+		"NATS server URL to publish the served jokes to (off if empty)")
+	fs.StringVar(&c.kafka, "events-kafka", "",
+		"comma-separated Kafka brokers to publish the served jokes to (off if empty)")
+	fs.StringVar(&c.topic, "events-topic", "laff.jokes",
+		"NATS subject or Kafka topic for the served jokes")
+	fs.StringVar(&c.queueURL, "queue-nats", "",
+		"NATS server URL to take joke requests from (off if empty)")
+	fs.StringVar(&c.queueSub, "queue-subject", "laff.requests", "subject of the joke requests")
+	fs.StringVar(&c.queueRep, "queue-reply", "",
+		"subject for the replies to requests without a reply subject")
+	fs.IntVar(&c.queueCon, "queue-concurrency", 4, "joke requests from the queue handled at once")
+	fs.StringVar(&c.regType, "register", "",
+		"service registry to register the instance with: 'consul', 'etcd' (off if empty)")
+	fs.StringVar(&c.regURL, "register-url", "",
+		"URL of the Consul agent or etcd server (http://127.0.0.1:8500 or http://127.0.0.1:2379 if empty)")
+	fs.StringVar(&c.regName, "register-name", "laff", "service name the instance is registered under")
+	fs.StringVar(&c.regHost, "register-address", "",
+		"address the instance is registered at (the hostname if empty)")
+	fs.StringVar(&c.regTags, "register-tags", "", "comma-separated tags the instance is registered with")
+	fs.StringVar(&c.regToken, "register-token", "", "Consul ACL token")
+	fs.StringVar(&c.regPrefix, "register-prefix", "/services",
+		"etcd key prefix the instance is registered under, as <prefix>/<name>/<id>")
+	fs.DurationVar(&c.regTTL, "register-ttl", 10*time.Second,
+		"how often Consul checks the instance's health, or how long the etcd lease lasts")
+	fs.StringVar(&c.trans, "translate", "",
+		"translation service for the lang parameter: 'libretranslate', 'deepl' (off if empty)")
+	fs.StringVar(&c.transURL, "translate-url", "",
+		"base URL of the translation service (the public one if empty)")
+	fs.StringVar(&c.transKey, "translate-key", "", "API key for the translation service")
+	fs.IntVar(&c.transLen, "translate-cache", 1000, "number of translations cached")
+	fs.BoolVar(&c.filter, "filter", true, "discard jokes containing profanity and refetch them")
+	fs.StringVar(&c.words, "filter-words", "",
+		"file of words for the filter, one per line (the built-in list if empty)")
+	fs.StringVar(&c.template, "template", "",
+		"Go template for the jokes served, e.g. '{{.First}} {{.Last}} says: {{.Joke}}'")
+	fs.StringVar(&c.tmplFile, "template-file", "",
+		"file with the template for the jokes served, reloaded on SIGHUP")
+	fs.StringVar(&c.jokeLink, "joke-link", "http://api.icndb.com/jokes/{id}",
+		"link to a joke's source in the Markdown jokes, {id} replaced by its ID (none if empty)")
+	fs.StringVar(&c.smtpAddr, "smtp-addr", "",
+		"host:port of the SMTP server to email the joke of the day with (off if empty)")
+	fs.StringVar(&c.smtpUser, "smtp-user", "", "user to authenticate to the SMTP server as (none if empty)")
+	fs.StringVar(&c.smtpPass, "smtp-password", "", "password of the SMTP user")
+	fs.StringVar(&c.mailFrom, "mail-from", "", "address the joke of the day is sent from")
+	fs.StringVar(&c.mailTo, "mail-to", "", "comma-separated addresses the joke of the day is sent to")
+	fs.StringVar(&c.mailAt, "mail-at", "08:00", "time of day, in UTC, the joke of the day is sent at")
+	fs.StringVar(&c.mailSubj, "mail-subject", "Your joke of the day", "subject of the joke of the day emails")
+	fs.StringVar(&c.mailText, "mail-template", "",
+		"file with the Go template of the plain text email body (the built-in one if empty)")
+	fs.StringVar(&c.mailHTML, "mail-html-template", "",
+		"file with the Go HTML template of the HTML email body (the built-in one if empty)")
+	fs.StringVar(&c.packs, "joke-packs", "",
+		"directory of JSON or YAML joke packs served alongside the upstream jokes")
+	fs.StringVar(&c.plugins, "plugins", "",
+		"directory of name and joke provider plugins to run")
+	fs.StringVar(&c.exper, "experiment", "",
+		"two joke providers to compare on the requests, e.g. 'joke-service,packs' (off if empty)")
+	fs.StringVar(&c.weights, "joke-weights", "",
+		"comma-separated name=weight shares of the jokes for the providers: joke-service, store, packs or a plugin name (1 each if not given)")
+	fs.DurationVar(&c.catalogSync, "catalog-sync", 0,
+		"copy the joke service's catalog to the store, refreshing it at this interval (off if 0, needs -store-type=sqlite)")
+}
+
+// validate checks the settings are sane, reporting all the problems found.
+func (c *serveConfig) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.portNum > 0 && c.portNum < 65536, "port must be between 1 and 65535")
+	level := strings.ToLower(c.logLevel)
+	check(strings.HasPrefix(level, "dev") || strings.HasPrefix(level, "prod"),
+		"log must be 'production' or 'development'")
+	check(c.logSize > 0, "log-max-size must be positive")
+	check(c.logAge >= 0, "log-max-age can't be negative")
+	check(c.logFiles >= 0, "log-max-backups can't be negative")
+	check(c.timeout > 0 && c.timeout <= 3600, "timeout must be between 1 and 3600 seconds")
+	check(c.cache > 0, "cache must be positive")
+	check(c.jokeAge >= 0, "joke-max-age can't be negative")
+	check(c.cacheWait >= 0, "cache-wait can't be negative")
+	if c.cacheMax != 0 {
+		check(c.cacheMin > 0 && c.cacheMin <= c.cache && c.cache <= c.cacheMax,
+			"cache must be between cache-min and cache-max, and cache-min positive")
+		check(c.cacheWin > 0, "cache-window must be positive")
+	}
+
+	check(c.workers > 0, "workers must be positive")
+	check(c.limit > 0, "limit must be positive")
+	check(c.inFlight >= 0, "max-in-flight can't be negative")
+	check(c.shedP99 >= 0, "shed-latency can't be negative")
+	check(c.sloLat > 0, "slo-latency must be positive")
+	check(c.sloPct > 0 && c.sloPct < 100, "slo-target must be between 0 and 100 percent")
+	for _, u := range splitList(c.alertURLs) {
+		check(isURL(u), "slo-alert-urls must be http or https URLs")
+	}
+	check(c.warmup >= 0 && c.warmup <= c.cache, "warmup must be between 0 and the cache size")
+	check(c.names == "uinames" || c.names == "randomuser",
+		"name-service must be 'uinames' or 'randomuser'")
+	for _, u := range []struct{ name, val string }{
+		{"name-url", c.nameURL}, {"joke-url", c.jokeURL}, {"catalog-url", c.catURL},
+		{"name-canary-url", c.nameCan}, {"joke-canary-url", c.jokeCan},
+	} {
+		check(u.val == "" || isURL(u.val), "%s must be an http or https URL", u.name)
+	}
+	for _, h := range []struct{ name, val string }{
+		{"name-headers", c.nameHdrs}, {"joke-headers", c.jokeHdrs},
+		{"name-canary-headers", c.nameCanH}, {"joke-canary-headers", c.jokeCanH},
+	} {
+		_, err := parseHeaders(h.val)
+		check(err == nil, "%s: %v", h.name, err)
+	}
+	check(c.nameCanS == "" || c.nameCanS == "uinames" || c.nameCanS == "randomuser",
+		"name-canary-service must be 'uinames' or 'randomuser'")
+	check(c.canPct >= 0 && c.canPct <= 100, "canary-percent must be between 0 and 100")
+	check(c.canErrs >= 0 && c.canErrs <= 100, "canary-max-errors must be between 0 and 100")
+	check(c.nameConc >= 0, "name-concurrency can't be negative")
+	check(c.jokeConc >= 0, "joke-concurrency can't be negative")
+	for _, r := range []struct {
+		name, val string
+		burst     int
+	}{
+		{"name-rate", c.nameRate, c.nameBurst}, {"joke-rate", c.jokeRate, c.jokeBurst},
+	} {
+		_, err := parseRate(r.val, r.burst)
+		check(err == nil, "%s: %v", r.name, err)
+	}
+	for _, p := range []struct{ name, val string }{
+		{"name-proxy", c.nameProxy}, {"joke-proxy", c.jokeProxy},
+	} {
+		check(p.val == "" || isProxyURL(p.val), "%s must be an http, https or socks5 URL", p.name)
+	}
+	check(c.vcrRecord == "" || c.vcrReplay == "", "vcr-record and vcr-replay can't be used together")
+	for _, p := range []struct {
+		name string
+		val  int
+	}{
+		{"chaos-latency-pct", c.chaosSlow}, {"chaos-429-pct", c.chaos429},
+		{"chaos-5xx-pct", c.chaos5xx}, {"chaos-malformed-pct", c.chaosBad},
+	} {
+		check(p.val >= 0 && p.val <= 100, "%s must be between 0 and 100", p.name)
+	}
+	check(c.chaos429+c.chaos5xx+c.chaosBad <= 100,
+		"chaos-429-pct, chaos-5xx-pct and chaos-malformed-pct can't add up to more than 100")
+	check(c.chaosLat >= 0, "chaos-latency can't be negative")
+	check(c.idleConns >= 0, "max-idle-conns can't be negative")
+	check(c.idleHost > 0, "max-idle-conns-per-host must be positive")
+	check(c.idleTime >= 0, "idle-conn-timeout can't be negative")
+	check(c.tlsTime >= 0, "tls-handshake-timeout can't be negative")
+	check(c.retryPct >= 0 && c.retryPct <= 100, "retry-budget must be between 0 and 100")
+	check(c.retryWin > 0, "retry-window must be positive")
+	check(c.retryMin >= 0, "retry-min can't be negative")
+	check(c.brkFails >= 0, "breaker-failures can't be negative")
+	check(c.brkCool > 0, "breaker-cooldown must be positive")
+	check(c.probeInt >= 0, "probe-interval can't be negative")
+	check(c.probeTime > 0, "probe-timeout must be positive")
+	check(c.banStrike >= 0, "ban-strikes can't be negative")
+	check(c.banWin > 0 && c.banCool > 0, "ban-window and ban-cooldown must be positive")
+	check(c.noRepeat >= 0, "no-repeat can't be negative")
+	check(c.drainWait >= 0, "drain-delay can't be negative")
+	check(c.maxName > 0, "max-name-length must be positive")
+	check(c.dnsTTL >= 0, "dns-cache-ttl can't be negative")
+	check(c.dnsNegTTL > 0, "dns-negative-ttl must be positive")
+	check(c.nameTok == "" || c.nameTokF == "", "only one of name-token and name-token-file can be set")
+	check(c.jokeTok == "" || c.jokeTokF == "", "only one of joke-token and joke-token-file can be set")
+	check(c.nameAuth != "" && !strings.ContainsAny(c.nameAuth, " :"), "name-auth-header must be a header name")
+	check(c.jokeAuth != "" && !strings.ContainsAny(c.jokeAuth, " :"), "joke-auth-header must be a header name")
+	check(c.history >= 0, "history can't be negative")
+	check(c.storeType == "file" || c.storeType == "sqlite", "store-type must be 'file' or 'sqlite'")
+	check(c.storeType != "sqlite" || c.dataFile != "", "store is required for sqlite")
+	check(c.bakBucket == "" || c.dataFile != "", "backup-bucket needs store")
+	check(c.bakEvery >= time.Minute, "backup-interval must be at least a minute")
+	check(c.bakKeep >= 0, "backup-keep can't be negative")
+	check(c.quotaDay >= 0 && c.quotaMon >= 0, "quota-daily and quota-monthly can't be negative")
+	check(c.quotaDay+c.quotaMon == 0 || c.apiKeys != "", "quota-daily and quota-monthly need apikeys")
+	check(c.maxBody > 0, "max-body must be positive")
+	check(c.budget > 0, "name-budget must be positive")
+	check(c.redis == "" || c.dynTable == "", "only one of redis-addr and dynamodb-table can be set")
+	check(c.dynTTL >= time.Second, "dynamodb-ttl must be at least a second")
+	check(c.elect == "" || c.elect == "kubernetes" || c.elect == "redis" || c.elect == "dynamodb",
+		"leader-elect must be 'kubernetes', 'redis' or 'dynamodb'")
+	check(c.elect != "redis" || c.redis != "", "leader-elect=redis needs redis-addr")
+	check(c.elect != "dynamodb" || c.dynTable != "", "leader-elect=dynamodb needs dynamodb-table")
+	check(c.leaseName != "", "leader-lease can't be empty")
+	check(c.leaseTerm >= 3*time.Second, "leader-term must be at least 3s")
+	check(c.nameShare >= 0, "shared-names can't be negative")
+	check(c.nameShare == 0 || (c.elect != "" && (c.redis != "" || c.dynTable != "" || c.memcached != "")),
+		"shared-names needs leader-elect, and redis-addr, dynamodb-table or memcached")
+	check(c.memcTTL >= time.Second, "memcached-ttl must be at least a second")
+	check(c.memcKey != "", "memcached-key can't be empty")
+	check(c.redisKey != "", "redis-key can't be empty")
+	check(c.gosBind == "" || isHostPort(c.gosBind), "gossip-bind must be a host:port")
+	check(c.gosBind == "" || c.gosKey != "" || !gossip.RequiresKey(c.gosBind),
+		"gossip-key is required unless gossip-bind is a loopback address")
+	check(c.gosAddr == "" || isHostPort(c.gosAddr), "gossip-advertise must be a host:port")
+	check(c.gosBind != "" || c.gosJoin == "" && c.gosAddr == "", "gossip-join and gossip-advertise need gossip-bind")
+	check(c.gosWait >= 0, "gossip-wait can't be negative")
+	check(c.natsURL == "" || c.kafka == "", "only one of events-nats and events-kafka can be set")
+	check(c.topic != "", "events-topic can't be empty")
+	check(c.queueSub != "", "queue-subject can't be empty")
+	check(c.regType == "" || c.regType == "consul" || c.regType == "etcd", "register must be 'consul' or 'etcd'")
+	check(c.regURL == "" || isURL(c.regURL), "register-url must be an http or https URL")
+	check(c.regName != "", "register-name can't be empty")
+	check(c.regTTL >= time.Second, "register-ttl must be at least a second")
+	check(c.queueCon > 0, "queue-concurrency must be positive")
+	check(c.trans == "" || c.trans == "libretranslate" || c.trans == "deepl",
+		"translate must be 'libretranslate' or 'deepl'")
+	check(c.trans != "deepl" || c.transKey != "", "translate-key is required for deepl")
+	check(c.transLen > 0, "translate-cache must be positive")
+	check(c.template == "" || c.tmplFile == "", "only one of template and template-file can be set")
+	check(c.jokeLink == "" || isURL(strings.ReplaceAll(c.jokeLink, "{id}", "1")), "joke-link must be an http or https URL")
+	_, err := parseWeights(c.weights)
+	check(err == nil, "joke-weights: %v", err)
+	_, err = parseBurn(c.alertBurn)
+	check(err == nil, "slo-alert-burn: %v", err)
+	_, err = parseCacheControl(c.cacheCtl)
+	check(err == nil, "cache-control: %v", err)
+	if c.smtpAddr != "" {
+		check(c.mailFrom != "" && len(splitList(c.mailTo)) > 0, "mail-from and mail-to are required with smtp-addr")
+		_, err = mailer.ParseTime(c.mailAt)
+		check(err == nil, "mail-at: %v", err)
+	}
+	err = api.NewRateLimiter(1).Exempt(splitList(c.exempt))
+	check(err == nil, "limit-exempt: %v", err)
+	_, err = gossipKey(c.gosKey)
+	check(err == nil, "gossip-key: %v", err)
+	if c.exper != "" {
+		arms := splitList(c.exper)
+		check(len(arms) == 2 && arms[0] != arms[1], "experiment must name two different joke providers")
+	}
+	check(c.catalogSync >= 0, "catalog-sync can't be negative")
+	check(c.catalogSync == 0 || c.storeType == "sqlite", "catalog-sync needs store-type sqlite")
+	return errors.Join(errs...)
+}
+
+// Where the value of a flag came from, in order of precedence.
+const (
+	fromFlag    = "flag"
+	fromEnv     = "env"
+	fromFile    = "file"
+	fromVault   = "vault"
+	fromAWS     = "aws"
+	fromDefault = "default"
+)
+
+// parseFlags parses the command's arguments, then fills in the flags not
+// given from the environment, and then from the config file if the
+// command has a -config flag and one is given.  It returns where each
+// flag's value came from.
+func parseFlags(fs *flag.FlagSet, args []string) (map[string]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	sources := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = fromDefault
+	})
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = fromFlag
+	})
+	if err := applyEnv(fs, sources); err != nil {
+		return nil, fmt.Errorf("error in environment: %v", err)
+	}
+	if f := fs.Lookup("config"); f != nil && f.Value.String() != "" {
+		if err := applyFile(fs, f.Value.String(), sources); err != nil {
+			return nil, fmt.Errorf("error in config file: %v", err)
+		}
+	}
+	return sources, nil
+}
+
+// applyEnv sets each flag still at its default from its LAFF_* environment
+// variable, if present.  The variable name is the flag name in upper case
+// with dashes changed to underscores, so -max-body is set by LAFF_MAX_BODY.
+func applyEnv(fs *flag.FlagSet, sources map[string]string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] != fromDefault || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, name, serr)
+				return
+			}
+			sources[f.Name] = fromEnv
+		}
+	})
+	return err
+}
+
+// applyFile sets each flag still at its default from the JSON config file.
+// The file is an object keyed by flag name, for example
+// {"port": 8080, "apikeys": ["key1", "key2"]}.  Lists are joined with
+// commas, for the flags taking comma-separated values.
+func applyFile(fs *flag.FlagSet, path string, sources map[string]string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var settings map[string]interface{}
+	if err := dec.Decode(&settings); err != nil {
+		return err
+	}
+
+	for name, val := range settings {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if sources[name] != fromDefault {
+			continue
+		}
+		var v string
+		switch tv := val.(type) {
+		case []interface{}:
+			items := make([]string, len(tv))
+			for i, item := range tv {
+				items[i] = fmt.Sprint(item)
+			}
+			v = strings.Join(items, ",")
+		default:
+			v = fmt.Sprint(tv)
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", v, name, err)
+		}
+		sources[name] = fromFile
+	}
+	return nil
+}
+
+// envName returns the environment variable for a flag.
+func envName(flagName string) string {
+	return "LAFF_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// isURL reports whether the string is an absolute http or https URL.
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// isHostPort reports whether the string is a host:port, the host being
+// optional.
+func isHostPort(s string) bool {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	return err == nil
+}
+
+// gossipKey decodes the base64 key encrypting the gossip, nil if there is
+// none.
+func gossipKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(key); n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("%d bytes, not 16, 24 or 32", n)
+	}
+	return key, nil
+}
+
+// isProxyURL reports whether the string is an http, https or socks5 URL,
+// as proxies are given.
+func isProxyURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "socks5") && u.Host != ""
+}
+
+// parseHeaders reads a comma-separated list of "Header: value" pairs.
+func parseHeaders(s string) (http.Header, error) {
+	h := http.Header{}
+	for _, item := range splitList(s) {
+		k, v, ok := strings.Cut(item, ":")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			return nil, fmt.Errorf("%q is not a 'Header: value' pair", item)
+		}
+		h.Add(k, strings.TrimSpace(v))
+	}
+	return h, nil
+}
+
+// parseWeights reads a comma-separated list of name=weight pairs.
+func parseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, item := range splitList(s) {
+		name, val, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		w, err := strconv.Atoi(strings.TrimSpace(val))
+		if !ok || name == "" || err != nil || w < 0 {
+			return nil, fmt.Errorf("%q is not a name=weight pair with a weight of 0 or more", item)
+		}
+		weights[name] = w
+	}
+	return weights, nil
+}
+
+// parseBurn reads a comma-separated list of window=rate burn rate
+// thresholds.
+func parseBurn(s string) (map[string]float64, error) {
+	burn := make(map[string]float64)
+	for _, item := range splitList(s) {
+		window, val, ok := strings.Cut(item, "=")
+		window = strings.TrimSpace(window)
+		rate, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if !ok || window == "" || err != nil || rate <= 0 {
+			return nil, fmt.Errorf("%q is not a window=rate pair with a positive rate", item)
+		}
+		burn[window] = rate
+	}
+	return burn, nil
+}
+
+// parseCacheControl reads a semicolon-separated list of route=directives
+// Cache-Control headers, the routes given by their templates.  The
+// directives are separated by commas, hence the semicolons.
+func parseCacheControl(s string) (map[string]string, error) {
+	cc := make(map[string]string)
+	for _, item := range strings.Split(s, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		route, dirs, ok := strings.Cut(item, "=")
+		route, dirs = strings.TrimSpace(route), strings.TrimSpace(dirs)
+		if !ok || !strings.HasPrefix(route, "/") || dirs == "" {
+			return nil, fmt.Errorf("%q is not a route=directives pair", item)
+		}
+		if _, dup := cc[route]; dup {
+			return nil, fmt.Errorf("route %s is given twice", route)
+		}
+		cc[route] = dirs
+	}
+	return cc, nil
+}
+
+// parseRate reads a rate given as count/interval, such as "6/1m", with
+// the burst allowed.  The empty string is no limit.
+func parseRate(s string, burst int) (service.Rate, error) {
+	if s == "" {
+		return service.Rate{}, nil
+	}
+	count, interval, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if !ok || err != nil || n <= 0 {
+		return service.Rate{}, fmt.Errorf("%q is not a count/interval rate with a positive count", s)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(interval))
+	if err != nil || d <= 0 {
+		return service.Rate{}, fmt.Errorf("%q is not a count/interval rate with a positive interval", s)
+	}
+	if burst <= 0 {
+		return service.Rate{}, fmt.Errorf("burst must be positive")
+	}
+	return service.Rate{Requests: n, Interval: d, Burst: burst}, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/api"
+	"github.com/gdotgordon/laff/service"
+	"go.uber.org/zap"
+)
+
+// TestParseFlagsPrecedence verifies flags take precedence over the
+// environment, which takes precedence over the config file.
+func TestParseFlagsPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "laff.json")
+	conf := `{"port": 7000, "cache": 20, "workers": 3, "max-body": 2097152, "apikeys": ["a", "b"]}`
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal("error writing config", err)
+	}
+	t.Setenv("LAFF_CACHE", "30")
+	t.Setenv("LAFF_WORKERS", "4")
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.register(fs)
+	sources, err := parseFlags(fs, []string{"-config", path, "-workers", "5"})
+	if err != nil {
+		t.Fatal("error parsing flags", err)
+	}
+
+	if cfg.portNum != 7000 || sources["port"] != fromFile {
+		t.Error("expected port from file, got:", cfg.portNum, sources["port"])
+	}
+	if cfg.cache != 30 || sources["cache"] != fromEnv {
+		t.Error("expected cache from env, got:", cfg.cache, sources["cache"])
+	}
+	if cfg.workers != 5 || sources["workers"] != fromFlag {
+		t.Error("expected workers from flag, got:", cfg.workers, sources["workers"])
+	}
+	if cfg.maxBody != 2097152 || cfg.apiKeys != "a,b" {
+		t.Error("unexpected values from file:", cfg.maxBody, cfg.apiKeys)
+	}
+	if cfg.timeout != 30 || sources["timeout"] != fromDefault {
+		t.Error("expected default timeout, got:", cfg.timeout, sources["timeout"])
+	}
+
+	// Unknown settings in the file are errors.
+	os.WriteFile(path, []byte(`{"prot": 7000}`), 0600)
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.register(fs)
+	if _, err := parseFlags(fs, []string{"-config", path}); err == nil {
+		t.Error("expected error for unknown setting")
+	}
+}
+
+// TestLoadSecrets verifies the settings read from Vault come after the
+// flags and environment, and before the config file.
+func TestLoadSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("X-Vault-Token") != "tok":
+			http.Error(w, "permission denied", http.StatusForbidden)
+		case r.URL.Path == "/v1/auth/token/lookup-self":
+			fmt.Fprint(w, `{"data": {"ttl": 0}}`)
+		case r.URL.Path == "/v1/secret/data/laff":
+			fmt.Fprint(w, `{"data": {"data": {"apikeys": "v1,v2", "sign": "s3cret", "port": "8000"}, "metadata": {}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "laff.json")
+	if err := os.WriteFile(path, []byte(`{"apikeys": "f1", "sign-secret": "file"}`), 0600); err != nil {
+		t.Fatal("error writing config", err)
+	}
+	t.Setenv("VAULT_TOKEN", "tok")
+	t.Setenv("LAFF_SIGN_SECRET", "env")
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.register(fs)
+	sources, err := parseFlags(fs, []string{"-config", path, "-port", "7000", "-vault-addr", srv.URL,
+		"-vault-secrets", "apikeys=secret/data/laff#apikeys,sign-secret=secret/data/laff#sign,port=secret/data/laff#port"})
+	if err != nil {
+		t.Fatal("error parsing flags", err)
+	}
+	if _, err := loadSecrets(context.Background(), &cfg, fs, sources); err != nil {
+		t.Fatal("error loading secrets", err)
+	}
+	if cfg.apiKeys != "v1,v2" || sources["apikeys"] != fromVault {
+		t.Error("expected apikeys from Vault, got:", cfg.apiKeys, sources["apikeys"])
+	}
+	if cfg.signKey != "env" || cfg.portNum != 7000 {
+		t.Error("expected the env and flag to win, got:", cfg.signKey, cfg.portNum)
+	}
+
+	cfg.vaultRefs = "vault-token=secret/data/laff#sign"
+	if _, err := loadSecrets(context.Background(), &cfg, fs, sources); err == nil {
+		t.Error("expected an error reading a Vault setting from Vault")
+	}
+}
+
+// TestReloadSecrets verifies the settings are read from AWS, and read
+// again on SIGHUP, with the new API keys taking effect.
+func TestReloadSecrets(t *testing.T) {
+	var mu sync.Mutex
+	secret := `{"apikeys": "a1", "admin": "x1", "sign": "s1"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+			http.Error(w, `{"__type": "ResourceNotFoundException"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"Name": "laff", "SecretString": %q}`, secret)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.register(fs)
+	sources, err := parseFlags(fs, []string{"-aws-region", "us-east-1", "-aws-secrets",
+		"apikeys=secretsmanager:laff#apikeys,admin-keys=secretsmanager:laff#admin,sign-secret=secretsmanager:laff#sign"})
+	if err != nil {
+		t.Fatal("error parsing flags", err)
+	}
+	sl, err := loadSecrets(context.Background(), &cfg, fs, sources)
+	if err != nil {
+		t.Fatal("error loading secrets", err)
+	}
+	if cfg.apiKeys != "a1" || cfg.signKey != "s1" || sources["apikeys"] != fromAWS {
+		t.Fatal("expected the settings from AWS, got:", cfg.apiKeys, cfg.signKey, sources["apikeys"])
+	}
+
+	keys := api.NewKeyRing(splitList(cfg.apiKeys), splitList(cfg.adminKeys))
+	log := zap.NewNop().Sugar()
+	mu.Lock()
+	secret = `{"apikeys": "a1,a2", "admin": "x2", "sign": "s2"}`
+	mu.Unlock()
+	if err := reloadSecrets(context.Background(), sl, &cfg, keys, log); err != nil {
+		t.Fatal("error reloading", err)
+	}
+	if cfg.apiKeys != "a1,a2" || cfg.adminKeys != "x2" || cfg.signKey != "s1" {
+		t.Fatal("expected only the keys changed, got:", cfg.apiKeys, cfg.adminKeys, cfg.signKey)
+	}
+	mu.Lock()
+	secret = `{"apikeys": "", "admin": "x2", "sign": "s2"}`
+	mu.Unlock()
+	if err := reloadSecrets(context.Background(), sl, &cfg, keys, log); err == nil || cfg.apiKeys != "a1,a2" {
+		t.Fatal("expected disabling auth refused, got:", err, cfg.apiKeys)
+	}
+
+	cfg.vaultRefs = "apikeys=secret/laff"
+	if _, err := loadSecrets(context.Background(), &cfg, fs, sources); err == nil {
+		t.Error("expected an error reading a setting from both Vault and AWS")
+	}
+}
+
+// TestValidate checks the defaults are valid, and bad values are all
+// reported.
+func TestValidate(t *testing.T) {
+	var cfg serveConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.register(fs)
+	if _, err := parseFlags(fs, nil); err != nil {
+		t.Fatal("error parsing flags", err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal("defaults should be valid, got:", err)
+	}
+	cfg.adminKeys = "admin"
+	if err := cfg.validate(); err != nil {
+		t.Fatal("admin keys should be valid with the file store, got:", err)
+	}
+
+	cfg.workers = 0
+	cfg.cache = -1
+	cfg.timeout = 0
+	cfg.jokeURL = "api.icndb.com/jokes/random"
+	cfg.nameRate = "6 a minute"
+	cfg.gosKey = "c2hvcnQ="
+	cfg.exempt = "dashboard-key,10.0.0.0/33"
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, name := range []string{"workers", "cache", "timeout", "joke-url", "name-rate", "gossip-key", "limit-exempt"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected error for %s, got: %v", name, err)
+		}
+	}
+}
+
+// TestParseHeaders reads header lists, and rejects the malformed ones.
+func TestParseHeaders(t *testing.T) {
+	h, err := parseHeaders("X-Api-Key: abc, user-agent:laff/1.0 ,")
+	if err != nil {
+		t.Fatal("error parsing headers", err)
+	}
+	if h.Get("X-Api-Key") != "abc" || h.Get("User-Agent") != "laff/1.0" || len(h) != 2 {
+		t.Fatal("unexpected headers:", h)
+	}
+	for _, bad := range []string{"X-Api-Key", ": abc", "X Api: abc"} {
+		if _, err := parseHeaders(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+// TestParseRate reads count/interval rates, and rejects the malformed ones.
+func TestParseRate(t *testing.T) {
+	r, err := parseRate("100/ 1s", 5)
+	if err != nil {
+		t.Fatal("error parsing rate", err)
+	}
+	if r != (service.Rate{Requests: 100, Interval: time.Second, Burst: 5}) {
+		t.Fatal("unexpected rate:", r)
+	}
+	if r, err := parseRate("", 0); err != nil || r.Requests != 0 {
+		t.Fatal("expected no limit for empty rate, got:", r, err)
+	}
+	for _, bad := range []string{"6", "0/1m", "6/0s", "six/1m", "6/minute"} {
+		if _, err := parseRate(bad, 1); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	if _, err := parseRate("6/1m", 0); err == nil {
+		t.Error("expected error for burst of 0")
+	}
+}
+
+// TestParseCacheControl reads route=directives Cache-Control headers,
+// keeping the commas of the directives, and rejects the malformed ones.
+func TestParseCacheControl(t *testing.T) {
+	cc, err := parseCacheControl("/v1/joke=no-store; /v1/stats = public, max-age=60;")
+	if err != nil {
+		t.Fatal("error parsing Cache-Control", err)
+	}
+	if len(cc) != 2 || cc["/v1/joke"] != "no-store" || cc["/v1/stats"] != "public, max-age=60" {
+		t.Fatal("unexpected Cache-Control:", cc)
+	}
+	if cc, err := parseCacheControl(""); err != nil || len(cc) != 0 {
+		t.Fatal("expected none for empty Cache-Control, got:", cc, err)
+	}
+	for _, bad := range []string{"/v1/joke", "/v1/joke=", "v1/joke=no-store", "/=no-store;/=public"} {
+		if _, err := parseCacheControl(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+// TestParseBurn reads window=rate burn rate thresholds, and rejects the
+// malformed ones.
+func TestParseBurn(t *testing.T) {
+	burn, err := parseBurn("5m=14.4, 1h = 6")
+	if err != nil {
+		t.Fatal("error parsing burn rates", err)
+	}
+	if len(burn) != 2 || burn["5m"] != 14.4 || burn["1h"] != 6 {
+		t.Fatal("unexpected burn rates:", burn)
+	}
+	for _, bad := range []string{"5m", "5m=0", "=2", "1h=fast"} {
+		if _, err := parseBurn(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Command hello is an example laff plugin, providing names and jokes of
+// its own.  Build it into laff's plugin directory to try it out:
+//
+//	go build -o plugins/hello ./contrib/plugins/hello
+//	./laff -plugins=plugins
+package main
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/gdotgordon/laff/laffplugin"
+	"github.com/gdotgordon/laff/service"
+)
+
+var names = []service.NameResp{
+	{Name: "Grace", Surname: "Hopper", Gender: "female"},
+	{Name: "Ken", Surname: "Thompson", Gender: "male"},
+	{Name: "Barbara", Surname: "Liskov", Gender: "female"},
+}
+
+var jokes = []string{
+	"%s %s's code compiles before it is written.",
+	"%s %s doesn't need a debugger; the bugs confess.",
+}
+
+type hello struct{}
+
+func (hello) Info() (laffplugin.Info, error) {
+	return laffplugin.Info{Name: "hello", Names: true, Jokes: true}, nil
+}
+
+func (hello) Name() (service.NameResp, error) {
+	return names[rand.Intn(len(names))], nil
+}
+
+func (hello) Joke(name service.NameResp) (service.Joke, error) {
+	n := rand.Intn(len(jokes))
+	return service.Joke{
+		// Keep clear of the IDs of the joke service and the joke packs.
+		ID:   1<<30 + n,
+		Text: fmt.Sprintf(jokes[n], name.Name, name.Surname),
+		Name: name,
+	}, nil
+}
+
+func main() {
+	laffplugin.Serve(hello{})
+}
@@ -0,0 +1,78 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+// Consul registers the instance with the local Consul agent, which checks
+// its health and takes it out of the catalog once it has been failing for
+// a while, should the instance die without deregistering.
+type Consul struct {
+	client   *http.Client
+	url      string
+	token    string
+	inst     Instance
+	interval time.Duration
+}
+
+// NewConsul creates a registrar for the instance with the Consul agent at
+// baseURL, such as http://127.0.0.1:8500, checking its health every
+// interval.  The ACL token is only needed by the agents that require one.
+func NewConsul(client *http.Client, baseURL, token string, inst Instance, interval time.Duration) *Consul {
+	return &Consul{
+		client:   client,
+		url:      strings.TrimSuffix(baseURL, "/"),
+		token:    token,
+		inst:     inst,
+		interval: interval,
+	}
+}
+
+// Register implements Registrar.  The agent keeps the registration, so
+// there is nothing to keep alive.
+func (c *Consul) Register(ctx context.Context) error {
+	type check struct {
+		HTTP                           string
+		Interval                       string
+		Timeout                        string
+		DeregisterCriticalServiceAfter string
+	}
+	req := struct {
+		ID      string
+		Name    string
+		Address string
+		Port    int
+		Tags    []string
+		Check   check
+	}{
+		c.inst.ID, c.inst.Name, c.inst.Address, c.inst.Port, c.inst.Tags,
+		check{
+			HTTP:                           c.inst.Health,
+			Interval:                       c.interval.String(),
+			Timeout:                        (c.interval / 2).String(),
+			DeregisterCriticalServiceAfter: (10 * c.interval).String(),
+		},
+	}
+	err := doJSON(ctx, c.client, http.MethodPut, c.url+"/v1/agent/service/register", c.header(), req, nil)
+	return pkgerr.Wrap(err, "registering with Consul")
+}
+
+// Deregister implements Registrar.
+func (c *Consul) Deregister(ctx context.Context) error {
+	err := doJSON(ctx, c.client, http.MethodPut,
+		c.url+"/v1/agent/service/deregister/"+url.PathEscape(c.inst.ID), c.header(), nil, nil)
+	return pkgerr.Wrap(err, "deregistering from Consul")
+}
+
+func (c *Consul) header() http.Header {
+	if c.token == "" {
+		return nil
+	}
+	return http.Header{"X-Consul-Token": {c.token}}
+}
@@ -0,0 +1,91 @@
+// Package discovery registers the instance with a service registry, Consul
+// or etcd, so the other services can find it without static
+// configuration.  The registries are called over their HTTP APIs.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Instance is what is registered of a running instance.
+type Instance struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	Port    int      `json:"port"`
+	Health  string   `json:"health"` // URL of the health check
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// NewInstance returns the instance of the service with the name at the
+// address and port, checked at the path.  Its ID tells it apart from the
+// other instances of the service.
+func NewInstance(name, address string, port int, healthPath string, tags []string) Instance {
+	host := address
+	if host == "" {
+		host = "localhost"
+	}
+	return Instance{
+		ID:      name + "-" + host + "-" + strconv.Itoa(port),
+		Name:    name,
+		Address: address,
+		Port:    port,
+		Health:  fmt.Sprintf("http://%s:%d%s", host, port, healthPath),
+		Tags:    tags,
+	}
+}
+
+// Registrar registers an instance with a registry, and deregisters it.
+type Registrar interface {
+	// Register registers the instance, keeping the registration alive
+	// until the context is done or it is deregistered, for the
+	// registries that need it.
+	Register(ctx context.Context) error
+	Deregister(ctx context.Context) error
+}
+
+// doJSON sends the request body, if any, as JSON, and decodes the JSON
+// response into res, if given.
+func doJSON(ctx context.Context, client *http.Client, method, url string, hdr http.Header, body, res interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, rd)
+	if err != nil {
+		return err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP status %d (%s): %s",
+			resp.StatusCode, http.StatusText(resp.StatusCode), bytes.TrimSpace(rb))
+	}
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(rb, res)
+}
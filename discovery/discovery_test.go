@@ -0,0 +1,132 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConsul verifies the registration and deregistration with the Consul
+// agent.
+func TestConsul(t *testing.T) {
+	var mu sync.Mutex
+	services := map[string]map[string]interface{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodPut || r.Header.Get("X-Consul-Token") != "tok" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v1/agent/service/register":
+			var svc map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&svc); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			services[svc["ID"].(string)] = svc
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+			delete(services, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	inst := NewInstance("laff", "10.0.0.5", 5000, "/v1/ready", []string{"v1"})
+	c := NewConsul(srv.Client(), srv.URL+"/", "tok", inst, 10*time.Second)
+	if err := c.Register(context.Background()); err != nil {
+		t.Fatal("error registering", err)
+	}
+	svc := services["laff-10.0.0.5-5000"]
+	check, _ := svc["Check"].(map[string]interface{})
+	if svc["Port"] != float64(5000) || check["HTTP"] != "http://10.0.0.5:5000/v1/ready" || check["Interval"] != "10s" {
+		t.Fatal("unexpected registration:", svc)
+	}
+	if err := c.Deregister(context.Background()); err != nil || len(services) != 0 {
+		t.Fatal("expected deregistered, got:", services, err)
+	}
+	if err := NewConsul(srv.Client(), srv.URL, "", inst, time.Second).Register(context.Background()); err == nil {
+		t.Fatal("expected an error without the token")
+	}
+}
+
+// TestEtcd verifies the key is put with a lease, which is kept alive,
+// granted again when lost, and revoked on deregistering.
+func TestEtcd(t *testing.T) {
+	var mu sync.Mutex
+	leases, keepAlives := 0, 0
+	keys := map[string]string{} // by lease
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v3/lease/grant":
+			leases++
+			json.NewEncoder(w).Encode(map[string]string{"ID": string(rune('0' + leases)), "TTL": "3"})
+		case "/v3/kv/put":
+			key, _ := base64.StdEncoding.DecodeString(req["key"].(string))
+			keys[req["lease"].(string)] = string(key)
+			w.Write([]byte("{}"))
+		case "/v3/lease/keepalive":
+			keepAlives++
+			ttl := "3"
+			if keepAlives == 1 {
+				// The first lease is lost.
+				delete(keys, req["ID"].(string))
+				ttl = "0"
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]string{"ID": req["ID"].(string), "TTL": ttl}})
+		case "/v3/lease/revoke":
+			delete(keys, req["ID"].(string))
+			w.Write([]byte("{}"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	inst := NewInstance("laff", "", 5000, "/v1/ready", nil)
+	e := NewEtcd(srv.Client(), srv.URL, "/services/", inst, 30*time.Millisecond, func(err error) {
+		t.Error("unexpected error:", err)
+	})
+	if err := e.Register(context.Background()); err != nil {
+		t.Fatal("error registering", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n, key := keepAlives, keys["2"]
+		mu.Unlock()
+		if n >= 2 {
+			if key != "/services/laff/laff-localhost-5000" {
+				t.Fatal("expected the key put with a new lease, got:", keys)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lease kept alive")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := e.Deregister(context.Background()); err != nil {
+		t.Fatal("error deregistering", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(keys) != 0 {
+		t.Fatal("expected the key deleted, got:", keys)
+	}
+}
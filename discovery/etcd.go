@@ -0,0 +1,145 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+// Etcd registers the instance in etcd, as a key under the prefix holding
+// the instance as JSON.  The key is bound to a lease, which is kept alive
+// while the instance runs, so the key goes away on its own should the
+// instance die without deregistering.
+type Etcd struct {
+	client  *http.Client
+	url     string
+	key     string
+	inst    Instance
+	ttl     time.Duration
+	onError func(error)
+
+	mu     sync.Mutex
+	lease  string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewEtcd creates a registrar for the instance with the etcd server at
+// baseURL, such as http://127.0.0.1:2379, under the key
+// <prefix>/<name>/<id>, with a lease of the ttl.  The errors keeping the
+// lease alive are passed to onError.
+func NewEtcd(client *http.Client, baseURL, prefix string, inst Instance, ttl time.Duration,
+	onError func(error)) *Etcd {
+	return &Etcd{
+		client:  client,
+		url:     strings.TrimSuffix(baseURL, "/"),
+		key:     strings.TrimSuffix(prefix, "/") + "/" + inst.Name + "/" + inst.ID,
+		inst:    inst,
+		ttl:     ttl,
+		onError: onError,
+	}
+}
+
+// Register implements Registrar.  The lease is kept alive until the
+// context is done or the instance is deregistered.
+func (e *Etcd) Register(ctx context.Context) error {
+	if err := e.put(ctx); err != nil {
+		return err
+	}
+	kctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	e.mu.Lock()
+	e.cancel, e.done = cancel, done
+	e.mu.Unlock()
+	go func() {
+		defer close(done)
+		e.keepAlive(kctx)
+	}()
+	return nil
+}
+
+// put grants a lease and puts the key with it.
+func (e *Etcd) put(ctx context.Context) error {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := e.call(ctx, "/v3/lease/grant", map[string]int64{"TTL": int64(e.ttl / time.Second)}, &grant); err != nil {
+		return pkgerr.Wrap(err, "granting an etcd lease")
+	}
+	val, err := json.Marshal(e.inst)
+	if err != nil {
+		return err
+	}
+	put := map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(e.key)),
+		"value": base64.StdEncoding.EncodeToString(val),
+		"lease": grant.ID,
+	}
+	if err := e.call(ctx, "/v3/kv/put", put, nil); err != nil {
+		return pkgerr.Wrap(err, "registering with etcd")
+	}
+	e.mu.Lock()
+	e.lease = grant.ID
+	e.mu.Unlock()
+	return nil
+}
+
+// keepAlive renews the lease three times a lease, registering again if
+// the lease was lost, say while etcd was unreachable.
+func (e *Etcd) keepAlive(ctx context.Context) {
+	t := time.NewTicker(e.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		e.mu.Lock()
+		lease := e.lease
+		e.mu.Unlock()
+		var resp struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		err := e.call(ctx, "/v3/lease/keepalive", map[string]string{"ID": lease}, &resp)
+		if ttl, _ := strconv.ParseInt(resp.Result.TTL, 10, 64); err == nil && ttl <= 0 {
+			err = e.put(ctx)
+		}
+		if err != nil && ctx.Err() == nil && e.onError != nil {
+			e.onError(pkgerr.Wrap(err, "keeping the etcd registration alive"))
+		}
+	}
+}
+
+// Deregister implements Registrar.  Revoking the lease deletes the key.
+func (e *Etcd) Deregister(ctx context.Context) error {
+	e.mu.Lock()
+	cancel, done := e.cancel, e.done
+	e.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	e.mu.Lock()
+	lease := e.lease
+	e.mu.Unlock()
+	if lease == "" {
+		return nil
+	}
+	err := e.call(ctx, "/v3/lease/revoke", map[string]string{"ID": lease}, nil)
+	return pkgerr.Wrap(err, "deregistering from etcd")
+}
+
+// call posts to the etcd JSON gateway.
+func (e *Etcd) call(ctx context.Context, path string, body, res interface{}) error {
+	return doJSON(ctx, e.client, http.MethodPost, e.url+path, nil, body, res)
+}
@@ -0,0 +1,118 @@
+// Package dynamo keeps the state the replicas of the laff service share in
+// a DynamoDB table, for deployments on AWS that would rather not run
+// Redis: the budget of name fetches, the lock of the prefetch leader and
+// the queue of shared names.
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Table is the DynamoDB table holding the shared state.  Its key is the
+// string partition key pk, naming the kind of item, and the string sort
+// key sk.  The items expire at the time in their number attribute
+// expires, in Unix seconds, which the table's TTL should be set to so
+// DynamoDB deletes them.  As it does so in its own time, up to days
+// later, the items are also checked for expiry as they are read.
+type Table struct {
+	client *dynamodb.Client
+	name   string
+	now    func() time.Time
+}
+
+// NewTable creates the table with the name, using the AWS config.  The
+// endpoint, if given, is the URL of DynamoDB to use instead of the
+// region's, such as that of DynamoDB Local.
+func NewTable(cfg aws.Config, name, endpoint string) *Table {
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return &Table{client: client, name: name, now: time.Now}
+}
+
+// key is the key of the item of the kind with the sort key.
+func key(kind, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: kind},
+		"sk": &types.AttributeValueMemberS{Value: sk},
+	}
+}
+
+// number is a number attribute.
+func number(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+// numberOf returns the number attribute, or zero if it isn't one.
+func numberOf(av types.AttributeValue) int64 {
+	if n, ok := av.(*types.AttributeValueMemberN); ok {
+		v, _ := strconv.ParseInt(n.Value, 10, 64)
+		return v
+	}
+	return 0
+}
+
+// stringOf returns the string attribute, or "" if it isn't one.
+func stringOf(av types.AttributeValue) string {
+	if s, ok := av.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+// conditionFailed reports whether the error is a write refused by its
+// condition.
+func conditionFailed(err error) bool {
+	var ccf *types.ConditionalCheckFailedException
+	return errors.As(err, &ccf)
+}
+
+// Limiter is a fixed window limiter, like the Redis one, with an item for
+// each window counting the calls the replicas want to make in it.  It
+// implements service.Limiter.
+type Limiter struct {
+	t      *Table
+	limit  int64
+	window time.Duration
+}
+
+// NewLimiter creates a limiter allowing limit calls per window among the
+// users of the table.
+func NewLimiter(t *Table, limit int, window time.Duration) *Limiter {
+	return &Limiter{t: t, limit: int64(limit), window: window}
+}
+
+// Reserve takes a slot for a call in the current window if one is left,
+// returning zero.  Otherwise it returns the time until the next window.
+func (l *Limiter) Reserve(ctx context.Context) (time.Duration, error) {
+	now := l.t.now()
+	start := now.Truncate(l.window)
+	out, err := l.t.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(l.t.name),
+		Key:              key("budget", strconv.FormatInt(start.Unix(), 10)),
+		UpdateExpression: aws.String("ADD calls :one SET expires = :exp"),
+		// Keep the item a little past the end of the window, to allow
+		// for clock differences between the replicas.
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": number(1),
+			":exp": number(start.Add(2 * l.window).Unix()),
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if numberOf(out.Attributes["calls"]) <= l.limit {
+		return 0, nil
+	}
+	return start.Add(l.window).Sub(now), nil
+}
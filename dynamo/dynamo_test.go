@@ -0,0 +1,210 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/gdotgordon/laff/service"
+)
+
+// attrs is an item, or a set of values, as sent by the DynamoDB JSON
+// protocol, such as {"pk": {"S": "lock"}}.
+type attrs map[string]map[string]string
+
+// request is the part of the DynamoDB requests the fake uses.
+type request struct {
+	TableName                 string
+	Key, Item                 attrs
+	UpdateExpression          string
+	ConditionExpression       string
+	KeyConditionExpression    string
+	FilterExpression          string
+	ExpressionAttributeValues attrs
+	ReturnValues, Select      string
+	Limit                     int
+}
+
+// fakeDynamo is a DynamoDB table, understanding just the expressions we
+// use.
+type fakeDynamo struct {
+	mu    sync.Mutex
+	items map[string]attrs // by pk and sk
+}
+
+func (fd *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	fail := func(kind string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.dynamodb.v20120810#" + kind})
+	}
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TableName != "laff" {
+		fail("ResourceNotFoundException")
+		return
+	}
+	vals := req.ExpressionAttributeValues
+	num := func(a attrs, name string) int64 {
+		n, _ := strconv.ParseInt(a[name]["N"], 10, 64)
+		return n
+	}
+	id := func(a attrs) string { return a["pk"]["S"] + "/" + a["sk"]["S"] }
+	reply := map[string]interface{}{}
+	switch op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."); {
+	case op == "UpdateItem" && req.UpdateExpression == "ADD calls :one SET expires = :exp":
+		item := fd.items[id(req.Key)]
+		if item == nil {
+			item = attrs{"pk": req.Key["pk"], "sk": req.Key["sk"]}
+			fd.items[id(req.Key)] = item
+		}
+		item["calls"] = map[string]string{"N": strconv.FormatInt(num(item, "calls")+num(vals, ":one"), 10)}
+		item["expires"] = vals[":exp"]
+		reply["Attributes"] = attrs{"calls": item["calls"], "expires": item["expires"]}
+	case op == "PutItem" && req.ConditionExpression == "":
+		fd.items[id(req.Item)] = req.Item
+	case op == "PutItem" && req.ConditionExpression == "attribute_not_exists(pk) OR holder = :id OR #until < :now":
+		cur := fd.items[id(req.Item)]
+		if cur != nil && cur["holder"]["S"] != vals[":id"]["S"] && num(cur, "until") >= num(vals, ":now") {
+			fail("ConditionalCheckFailedException")
+			return
+		}
+		fd.items[id(req.Item)] = req.Item
+	case op == "DeleteItem":
+		cur := fd.items[id(req.Key)]
+		switch req.ConditionExpression {
+		case "holder = :id":
+			if cur == nil || cur["holder"]["S"] != vals[":id"]["S"] {
+				fail("ConditionalCheckFailedException")
+				return
+			}
+		case "attribute_exists(pk)":
+			if cur == nil {
+				fail("ConditionalCheckFailedException")
+				return
+			}
+		default:
+			fail("ValidationException")
+			return
+		}
+		delete(fd.items, id(req.Key))
+		if req.ReturnValues == "ALL_OLD" {
+			reply["Attributes"] = cur
+		}
+	case op == "Query" && req.KeyConditionExpression == "pk = :pk":
+		var found []attrs
+		for _, item := range fd.items {
+			if item["pk"]["S"] == vals[":pk"]["S"] &&
+				(req.FilterExpression == "" || num(item, "expires") > num(vals, ":now")) {
+				found = append(found, item)
+			}
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i]["sk"]["S"] < found[j]["sk"]["S"] })
+		if req.Limit > 0 && len(found) > req.Limit {
+			found = found[:req.Limit]
+		}
+		reply["Count"] = len(found)
+		if req.Select != "COUNT" {
+			reply["Items"] = found
+		}
+	default:
+		fail("ValidationException")
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+// newTestTable creates a table in a fake DynamoDB, with a clock the test
+// moves.
+func newTestTable(t *testing.T) (*Table, *fakeDynamo, *time.Time) {
+	fd := &fakeDynamo{items: map[string]attrs{}}
+	srv := httptest.NewServer(fd)
+	t.Cleanup(srv.Close)
+	tbl := NewTable(aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		HTTPClient:  srv.Client(),
+	}, "laff", srv.URL)
+	now := time.Date(2026, 10, 17, 12, 0, 10, 0, time.UTC)
+	tbl.now = func() time.Time { return now }
+	return tbl, fd, &now
+}
+
+// TestLimiter verifies the calls beyond the limit wait for the next
+// window.
+func TestLimiter(t *testing.T) {
+	tbl, _, now := newTestTable(t)
+	ctx := context.Background()
+	l := NewLimiter(tbl, 2, time.Minute)
+	for i, exp := range []time.Duration{0, 0, 50 * time.Second} {
+		if wait, err := l.Reserve(ctx); err != nil || wait != exp {
+			t.Fatal("expected", exp, "for call", i, "got:", wait, err)
+		}
+	}
+	*now = now.Add(time.Minute)
+	if wait, err := l.Reserve(ctx); err != nil || wait != 0 {
+		t.Fatal("expected a call in the next window, got:", wait, err)
+	}
+}
+
+// TestLock verifies only one holder has the lock, until its term is over
+// or it is released.
+func TestLock(t *testing.T) {
+	tbl, fd, now := newTestTable(t)
+	ctx := context.Background()
+	a := NewLock(tbl, "prefetch", "a", 10*time.Second)
+	b := NewLock(tbl, "prefetch", "b", 10*time.Second)
+	for _, tc := range []struct {
+		lock *Lock
+		exp  bool
+	}{{a, true}, {b, false}, {a, true}} {
+		if ok, err := tc.lock.Acquire(ctx); err != nil || ok != tc.exp {
+			t.Fatal("expected", tc.exp, "for", tc.lock.id, "got:", ok, err)
+		}
+	}
+	*now = now.Add(11 * time.Second)
+	if ok, err := b.Acquire(ctx); err != nil || !ok {
+		t.Fatal("expected b to take the expired lock, got:", ok, err)
+	}
+	if err := a.Release(ctx); err != nil || len(fd.items) != 1 {
+		t.Fatal("expected a not to release b's lock", err)
+	}
+	if err := b.Release(ctx); err != nil || len(fd.items) != 0 {
+		t.Fatal("expected b to release its lock", err)
+	}
+}
+
+// TestNameQueue verifies the names are taken in order, the queue holds
+// no more than its size, and the stale names are dropped.
+func TestNameQueue(t *testing.T) {
+	tbl, fd, now := newTestTable(t)
+	ctx := context.Background()
+	q := NewNameQueue(tbl, 2, time.Minute)
+	for i, first := range []string{"Ann", "Bob", "Cat"} {
+		*now = now.Add(time.Millisecond)
+		ok, err := q.Offer(ctx, service.NameResp{Name: first, Surname: "Lee"})
+		if err != nil || ok != (i < 2) {
+			t.Fatal("unexpected offer of", first, ok, err)
+		}
+	}
+	if name, err := q.Take(ctx); err != nil || name == nil || name.Name != "Ann" || name.Surname != "Lee" {
+		t.Fatal("expected Ann, got:", name, err)
+	}
+	*now = now.Add(2 * time.Minute)
+	if name, err := q.Take(ctx); err != nil || name != nil || len(fd.items) != 0 {
+		t.Fatal("expected the stale name dropped, got:", name, err, len(fd.items))
+	}
+	if ok, err := q.Offer(ctx, service.NameResp{Name: "Dan"}); err != nil || !ok {
+		t.Fatal("expected room for Dan, got:", ok, err)
+	}
+}
@@ -0,0 +1,70 @@
+package dynamo
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Lock is a lock held in an item naming its holder and when its term
+// ends, in Unix milliseconds.  It is taken by a conditional write, which
+// only succeeds if the item is free, already ours, or its term is over.
+// It implements leader.Lock.
+type Lock struct {
+	t    *Table
+	name string
+	id   string
+	term time.Duration
+}
+
+// NewLock creates the lock with the name, held by the ID for the term.
+func NewLock(t *Table, name, id string, term time.Duration) *Lock {
+	return &Lock{t: t, name: name, id: id, term: term}
+}
+
+// Acquire implements leader.Lock.
+func (l *Lock) Acquire(ctx context.Context) (bool, error) {
+	now := l.t.now()
+	until := now.Add(l.term)
+	item := key("lock", l.name)
+	item["holder"] = &types.AttributeValueMemberS{Value: l.id}
+	item["until"] = number(until.UnixMilli())
+	item["expires"] = number(until.Unix() + 1)
+	_, err := l.t.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(l.t.name),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(pk) OR holder = :id OR #until < :now"),
+		ExpressionAttributeNames: map[string]string{"#until": "until"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":  &types.AttributeValueMemberS{Value: l.id},
+			":now": number(now.UnixMilli()),
+		},
+	})
+	switch {
+	case err == nil:
+		return true, nil
+	case conditionFailed(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Release implements leader.Lock.
+func (l *Lock) Release(ctx context.Context) error {
+	_, err := l.t.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(l.t.name),
+		Key:                 key("lock", l.name),
+		ConditionExpression: aws.String("holder = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: l.id},
+		},
+	})
+	if conditionFailed(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gdotgordon/laff/service"
+)
+
+// takeBatch is how many of the oldest names are read at a time, to take
+// one of them.
+const takeBatch = 10
+
+// NameQueue is a queue of names, each an item sorted by the time it was
+// offered, holding up to its size.  The names expire once they have been
+// queued for their time to live, so the followers don't take stale ones
+// after the leader is gone.  It implements service.NameQueue.
+type NameQueue struct {
+	t    *Table
+	size int
+	ttl  time.Duration
+}
+
+// NewNameQueue creates a queue holding up to size names, each for the
+// time to live.
+func NewNameQueue(t *Table, size int, ttl time.Duration) *NameQueue {
+	return &NameQueue{t: t, size: size, ttl: ttl}
+}
+
+// Offer implements service.NameQueue.  Only the leader offers names, so
+// the queue isn't filled past its size by writers racing each other.
+func (q *NameQueue) Offer(ctx context.Context, name service.NameResp) (bool, error) {
+	now := q.t.now()
+	n, err := q.count(ctx, now)
+	if err != nil || n >= q.size {
+		return false, err
+	}
+	b, err := json.Marshal(name)
+	if err != nil {
+		return false, err
+	}
+	item := key("names", fmt.Sprintf("%020d-%08x", now.UnixNano(), rand.Uint32()))
+	item["name"] = &types.AttributeValueMemberS{Value: string(b)}
+	item["expires"] = number(now.Add(q.ttl).Unix())
+	_, err = q.t.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(q.t.name), Item: item})
+	return err == nil, err
+}
+
+// count returns the number of names queued that haven't expired.
+func (q *NameQueue) count(ctx context.Context, now time.Time) (int, error) {
+	pages := dynamodb.NewQueryPaginator(q.t.client, &dynamodb.QueryInput{
+		TableName:              aws.String(q.t.name),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		FilterExpression:       aws.String("expires > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":  &types.AttributeValueMemberS{Value: "names"},
+			":now": number(now.Unix()),
+		},
+		Select: types.SelectCount,
+	})
+	n := 0
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n += int(page.Count)
+	}
+	return n, nil
+}
+
+// Take implements service.NameQueue.  A name is taken by deleting it,
+// which only one of the followers racing for it manages, and the others
+// move on to the next.  The expired names found are deleted on the way.
+func (q *NameQueue) Take(ctx context.Context) (*service.NameResp, error) {
+	now := q.t.now()
+	out, err := q.t.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(q.t.name),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: "names"},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            aws.Int32(takeBatch),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range out.Items {
+		del, err := q.t.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:           aws.String(q.t.name),
+			Key:                 key("names", stringOf(item["sk"])),
+			ConditionExpression: aws.String("attribute_exists(pk)"),
+			ReturnValues:        types.ReturnValueAllOld,
+		})
+		if conditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if numberOf(del.Attributes["expires"]) <= now.Unix() {
+			continue
+		}
+		var name service.NameResp
+		if err := json.Unmarshal([]byte(stringOf(del.Attributes["name"])), &name); err != nil {
+			return nil, err
+		}
+		return &name, nil
+	}
+	return nil, nil
+}
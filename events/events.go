@@ -0,0 +1,33 @@
+// Package events publishes a stream of the jokes served, so downstream
+// analytics can consume it without going through the API.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Event is the message published for each joke served.
+type Event struct {
+	JokeID int       `json:"jokeId"`
+	Text   string    `json:"joke"`
+	Name   string    `json:"name"`
+	Second string    `json:"second,omitempty"` // in a joke about two people
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"` // hash identifying the caller
+}
+
+// Publisher sends the events to a message broker.  Publish shouldn't hold
+// up the request for long, so the implementations buffer the messages,
+// and Close flushes any still buffered.
+type Publisher interface {
+	Publish(ctx context.Context, ev Event) error
+	Close() error
+}
+
+// encode gives the wire form of an event, which is the same for all the
+// brokers.
+func encode(ev Event) ([]byte, error) {
+	return json.Marshal(ev)
+}
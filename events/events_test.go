@@ -0,0 +1,42 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestEncode verifies the fields the consumers rely on.
+func TestEncode(t *testing.T) {
+	ev := Event{
+		JokeID: 42,
+		Text:   "Ryan Gonzalez can divide by zero.",
+		Name:   "Ryan Gonzalez",
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Client: "0123abcd",
+	}
+	b, err := encode(ev)
+	if err != nil {
+		t.Fatal("error encoding", err)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal("error decoding", err)
+	}
+	exp := map[string]interface{}{
+		"jokeId": 42.0,
+		"joke":   ev.Text,
+		"name":   ev.Name,
+		"time":   "2020-01-02T03:04:05Z",
+		"client": ev.Client,
+	}
+	if len(m) != len(exp) {
+		t.Fatal("expected fields:", exp, ", got:", m)
+	}
+	for k, v := range exp {
+		if m[k] != v {
+			t.Fatalf("expected %s: %v, got: %v", k, v, m[k])
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package events
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes the events to a Kafka topic.
+type Kafka struct {
+	w *kafka.Writer
+}
+
+// NewKafka creates a publisher to the topic on the brokers.  The messages
+// are written in batches in the background, so a slow broker doesn't slow
+// down the requests.  The ones that can't be written are logged by onError.
+func NewKafka(brokers []string, topic string, onError func(error)) *Kafka {
+	return &Kafka{w: &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.Hash{},
+		Async:    true,
+		Completion: func(_ []kafka.Message, err error) {
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		},
+	}}
+}
+
+// Publish implements Publisher.  The messages are keyed by the client, so
+// each client's jokes stay in order.
+func (k *Kafka) Publish(ctx context.Context, ev Event) error {
+	b, err := encode(ev)
+	if err != nil {
+		return err
+	}
+	return k.w.WriteMessages(ctx, kafka.Message{Key: []byte(ev.Client), Value: b})
+}
+
+// Close implements Publisher, writing the buffered messages first.
+func (k *Kafka) Close() error {
+	return k.w.Close()
+}
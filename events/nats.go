@@ -0,0 +1,39 @@
+package events
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+	pkgerr "github.com/pkg/errors"
+)
+
+// NATS publishes the events to a NATS subject.
+type NATS struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATS connects to the NATS server at url.  The client reconnects on
+// its own if the connection drops, buffering the messages meanwhile.
+func NewNATS(url, subject string) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("laff"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "connecting to NATS")
+	}
+	return &NATS{conn: conn, subject: subject}, nil
+}
+
+// Publish implements Publisher.
+func (n *NATS) Publish(ctx context.Context, ev Event) error {
+	b, err := encode(ev)
+	if err != nil {
+		return err
+	}
+	return n.conn.Publish(n.subject, b)
+}
+
+// Close implements Publisher, flushing the buffered messages first.
+func (n *NATS) Close() error {
+	defer n.conn.Close()
+	return n.conn.Flush()
+}
@@ -0,0 +1,95 @@
+// Package filter screens the joke text for words we don't want to serve.
+package filter
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+//go:embed words.txt
+var defaultWords string
+
+// Denylist rejects any text containing one of its words.  The words are
+// matched whole and regardless of case, so "Scunthorpe" doesn't trip it.
+type Denylist struct {
+	words map[string]bool
+}
+
+// Default returns the denylist of the words shipped with laff.
+func Default() *Denylist {
+	d, err := parse(strings.NewReader(defaultWords))
+	if err != nil {
+		panic("invalid default word list: " + err.Error())
+	}
+	return d
+}
+
+// Load reads a denylist from a file with one word per line.  Blank lines
+// and those starting with # are ignored.
+func Load(path string) (*Denylist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "opening word list")
+	}
+	defer f.Close()
+	d, err := parse(f)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "reading word list")
+	}
+	return d, nil
+}
+
+// New creates a denylist of the words.
+func New(words []string) *Denylist {
+	d := &Denylist{words: make(map[string]bool, len(words))}
+	for _, w := range words {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			d.words[w] = true
+		}
+	}
+	return d
+}
+
+// parse reads the word list format.
+func parse(r io.Reader) (*Denylist, error) {
+	var words []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return New(words), nil
+}
+
+// Len returns the number of words in the list.
+func (d *Denylist) Len() int {
+	return len(d.words)
+}
+
+// Allowed reports whether the text contains none of the words.
+func (d *Denylist) Allowed(text string) bool {
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), notWordChar) {
+		if d.words[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// notWordChar splits the text into words.  Apostrophes are kept, for
+// contractions.
+func notWordChar(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+}
@@ -0,0 +1,44 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestAllowed verifies the words are matched whole and regardless of case.
+func TestAllowed(t *testing.T) {
+	d := New([]string{"darn", " Heck "})
+	for text, exp := range map[string]bool{
+		"Chuck Norris can divide by zero.":      true,
+		"Darn, Chuck Norris did it again":       false,
+		"what the heck?":                        false,
+		"Chuck Norris visited Darnley Heckmans": true,
+	} {
+		if got := d.Allowed(text); got != exp {
+			t.Errorf("Allowed(%q): expected %v, got %v", text, exp, got)
+		}
+	}
+}
+
+// TestLoad reads a word list, and the default one.
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte("# comment\n\nfoo\nBar\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Load(path)
+	if err != nil {
+		t.Fatal("error loading", err)
+	}
+	if d.Len() != 2 || d.Allowed("a bar b") || !d.Allowed("comment") {
+		t.Fatal("unexpected word list:", d.words)
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+	if def := Default(); def.Len() == 0 || def.Allowed("oh shit") {
+		t.Fatal("expected default list to reject profanity")
+	}
+}
@@ -0,0 +1,402 @@
+// Package gossip lets the replicas of the laff service warm each other's
+// joke caches, for deployments without Redis or the like.  The replicas
+// find each other by gossip, each advertising how many of its cached
+// jokes it can spare, and a replica starting with an empty cache asks the
+// peers with the most to spare for theirs, rather than fetching them all
+// from the rate-limited upstream services.
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+	"github.com/hashicorp/memberlist"
+)
+
+// The kinds of message the replicas send each other, in the first byte.
+const (
+	msgWant  = 'w' // a request for jokes
+	msgJokes = 'j' // the jokes given for a request
+)
+
+// Cache is the joke cache the replica shares, see service.LaffService.
+type Cache interface {
+	// Surplus returns how many cached jokes can be spared.
+	Surplus() int
+	// GiveJokes takes up to n of the spare jokes, for a peer.
+	GiveJokes(n int) []service.Joke
+	// WarmJokes caches the jokes from a peer, returning how many were.
+	WarmJokes(jokes []service.Joke) int
+}
+
+// Config is where the replica gossips, and who with.
+type Config struct {
+	// Name is the replica's name, unique among the replicas.
+	Name string
+	// Bind is the host:port gossiped on, over both UDP and TCP.  An empty
+	// host is every interface.
+	Bind string
+	// Advertise is the host:port the peers reach us at, if it isn't that
+	// bound, such as behind NAT.
+	Advertise string
+	// Key encrypts the gossip: 16, 24 or 32 bytes, the same for all the
+	// replicas.  Only the replicas with the key can ask for jokes or give
+	// them, so it is required unless gossiping on the loopback interface,
+	// see RequiresKey.
+	Key []byte
+}
+
+// meta is what each replica advertises to the others.
+type meta struct {
+	Surplus int `json:"surplus"`
+}
+
+// request asks a peer for jokes.  They are sent to the replica asking at
+// the address the gossip knows it by, never one given in the message.
+type request struct {
+	From string `json:"from"` // name of the replica asking
+	N    int    `json:"n"`
+}
+
+// gift is the jokes given for a request.  They are only taken from the
+// peers asked, while waiting for them, see Warm.
+type gift struct {
+	From  string         `json:"from"` // name of the replica giving
+	Jokes []service.Joke `json:"jokes"`
+}
+
+// Node is this replica's member of the gossip.
+type Node struct {
+	ml    *memberlist.Memberlist
+	cache Cache
+	log   logging.Logger
+	given chan int // jokes received for each request, see Warm
+
+	mu      sync.Mutex
+	surplus int             // advertised
+	asked   map[string]bool // peers asked for jokes and not yet heard from
+}
+
+// New starts gossiping with the config, sharing the cache.  The replica
+// is alone until it joins the others, see Join.
+func New(cfg Config, cache Cache, log logging.Logger) (*Node, error) {
+	n := &Node{cache: cache, log: log, given: make(chan int, 16)}
+	mc := memberlist.DefaultLANConfig()
+	if cfg.Name != "" {
+		mc.Name = cfg.Name
+	}
+	var err error
+	if mc.BindAddr, mc.BindPort, err = hostPort(cfg.Bind, "0.0.0.0"); err != nil {
+		return nil, fmt.Errorf("gossip address: %w", err)
+	}
+	if len(cfg.Key) == 0 && RequiresKey(cfg.Bind) {
+		return nil, fmt.Errorf("a key is required to gossip on %s, which isn't a loopback address", cfg.Bind)
+	}
+	if cfg.Advertise != "" {
+		if mc.AdvertiseAddr, mc.AdvertisePort, err = hostPort(cfg.Advertise, ""); err != nil {
+			return nil, fmt.Errorf("gossip advertised address: %w", err)
+		}
+	}
+	mc.SecretKey = cfg.Key
+	mc.Delegate = delegate{n}
+	mc.Logger = newStdLogger(log)
+	if n.ml, err = memberlist.Create(mc); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// hostPort splits the host:port, with the default host if it has none.
+func hostPort(addr, defHost string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("port %q: %w", p, err)
+	}
+	if host == "" {
+		host = defHost
+	}
+	return host, port, nil
+}
+
+// RequiresKey reports whether gossiping on the host:port needs a key, as
+// it isn't on the loopback interface, where only this host can reach it.
+func RequiresKey(bind string) bool {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		return true
+	}
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// Join joins the gossip through the peers, each a host:port, or a host
+// name resolving to several, returning how many were reached.  Any one
+// of the replicas introduces us to the rest, so it is an error only if
+// none is reached.
+func (n *Node) Join(peers []string) (int, error) {
+	return n.ml.Join(peers)
+}
+
+// Members returns the number of replicas in the gossip, including us.
+func (n *Node) Members() int {
+	return n.ml.NumMembers()
+}
+
+// Warm asks the peers for up to want jokes, starting with those with the
+// most to spare, and waits for them to be cached, or for the context to
+// be done, returning how many were.  It is meant for a replica starting
+// with an empty cache, before the cache workers start fetching their
+// own.
+func (n *Node) Warm(ctx context.Context, want int) int {
+	type peer struct {
+		node    *memberlist.Node
+		surplus int
+	}
+	var peers []peer
+	self := n.ml.LocalNode()
+	for _, m := range n.ml.Members() {
+		var md meta
+		if m.Name == self.Name || json.Unmarshal(m.Meta, &md) != nil || md.Surplus <= 0 {
+			continue
+		}
+		peers = append(peers, peer{m, md.Surplus})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].surplus > peers[j].surplus })
+
+	// The peers are marked as asked before they are, as they may answer
+	// at once, and the jokes of the others are turned away.
+	n.mu.Lock()
+	n.asked = make(map[string]bool)
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		n.asked = nil
+		n.mu.Unlock()
+	}()
+	asked, requests := 0, 0
+	for _, p := range peers {
+		if asked >= want {
+			break
+		}
+		k := min(p.surplus, want-asked)
+		n.mu.Lock()
+		n.asked[p.node.Name] = true
+		n.mu.Unlock()
+		if err := n.send(p.node, msgWant, request{From: self.Name, N: k}); err != nil {
+			n.log.Warnw("Error asking a peer for jokes", "peer", p.node.Name, "error", err)
+			n.mu.Lock()
+			delete(n.asked, p.node.Name)
+			n.mu.Unlock()
+			continue
+		}
+		asked += k
+		requests++
+	}
+
+	got := 0
+	for ; requests > 0; requests-- {
+		select {
+		case k := <-n.given:
+			got += k
+		case <-ctx.Done():
+			return got
+		}
+	}
+	return got
+}
+
+// Run advertises the cache's surplus to the peers as it changes, checking
+// at the interval until the context is done.
+func (n *Node) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	members := n.Members()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if m := n.Members(); m != members {
+			n.log.Infow("Gossip members changed", "members", m, "was", members)
+			members = m
+		}
+		n.mu.Lock()
+		changed := n.cache.Surplus() != n.surplus
+		n.mu.Unlock()
+		if changed {
+			if err := n.ml.UpdateNode(interval); err != nil {
+				n.log.Warnw("Error advertising the cache surplus", "error", err)
+			}
+		}
+	}
+}
+
+// Shutdown leaves the gossip, telling the peers we are going, and stops
+// gossiping.
+func (n *Node) Shutdown(ctx context.Context) error {
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if err := n.ml.Leave(timeout); err != nil {
+		n.ml.Shutdown()
+		return err
+	}
+	return n.ml.Shutdown()
+}
+
+// send sends the message of the kind to the peer, over TCP as the jokes
+// may not fit a UDP packet.
+func (n *Node) send(to *memberlist.Node, kind byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return n.ml.SendReliable(to, append([]byte{kind}, b...))
+}
+
+// memberWait is how long a request from a replica we haven't heard of
+// waits for the gossip to tell us of it, as a replica joining through
+// another asks for jokes at once.
+const memberWait = 2 * time.Second
+
+// member returns the replica with the name, if it is in the gossip.
+func (n *Node) member(name string) *memberlist.Node {
+	for _, m := range n.ml.Members() {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// awaitMember returns the replica with the name, waiting up to memberWait
+// for the gossip to tell us of it, or nil if it doesn't.
+func (n *Node) awaitMember(name string) *memberlist.Node {
+	deadline := time.Now().Add(memberWait)
+	for {
+		if m := n.member(name); m != nil || time.Now().After(deadline) {
+			return m
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// give answers a peer's request with the jokes we can spare, which may be
+// none.  A request from a replica not in the gossip is ignored, so the
+// jokes only go to the peers, at the address the gossip knows them by.
+func (n *Node) give(w request) {
+	if w.From == n.ml.LocalNode().Name {
+		return
+	}
+	to := n.awaitMember(w.From)
+	if to == nil {
+		n.log.Warnw("Ignoring a request for jokes from outside the gossip", "peer", w.From)
+		return
+	}
+	jokes := n.cache.GiveJokes(w.N)
+	if jokes == nil {
+		jokes = []service.Joke{}
+	}
+	if err := n.send(to, msgJokes, gift{From: n.ml.LocalNode().Name, Jokes: jokes}); err != nil {
+		n.log.Warnw("Error giving jokes to a peer", "peer", w.From, "error", err)
+		return
+	}
+	n.log.Debugw("Gave jokes to a peer", "peer", w.From, "jokes", len(jokes))
+}
+
+// delegate is the Node's hooks into memberlist.
+type delegate struct {
+	n *Node
+}
+
+// NodeMeta advertises the cache's surplus.
+func (d delegate) NodeMeta(limit int) []byte {
+	d.n.mu.Lock()
+	defer d.n.mu.Unlock()
+	d.n.surplus = d.n.cache.Surplus()
+	b, _ := json.Marshal(meta{Surplus: d.n.surplus})
+	return b
+}
+
+// NotifyMsg handles the messages from the peers.  It mustn't block, so
+// the requests are answered in the background.
+func (d delegate) NotifyMsg(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	switch b[0] {
+	case msgWant:
+		var w request
+		if err := json.Unmarshal(b[1:], &w); err == nil && w.N > 0 {
+			go d.n.give(w)
+		}
+	case msgJokes:
+		var g gift
+		if err := json.Unmarshal(b[1:], &g); err != nil {
+			d.n.log.Warnw("Malformed jokes from a peer", "error", err)
+			return
+		}
+		d.n.mu.Lock()
+		asked := d.n.asked[g.From]
+		delete(d.n.asked, g.From)
+		d.n.mu.Unlock()
+		if !asked {
+			d.n.log.Warnw("Ignoring jokes not asked for", "peer", g.From, "jokes", len(g.Jokes))
+			return
+		}
+		k := d.n.cache.WarmJokes(g.Jokes)
+		d.n.log.Debugw("Warmed the cache from a peer", "peer", g.From, "jokes", k)
+		select {
+		case d.n.given <- k:
+		default: // no one is waiting
+		}
+	}
+}
+
+// GetBroadcasts implements memberlist.Delegate.  Nothing is broadcast.
+func (d delegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+
+// LocalState implements memberlist.Delegate.  There is no state to sync.
+func (d delegate) LocalState(join bool) []byte { return nil }
+
+// MergeRemoteState implements memberlist.Delegate.
+func (d delegate) MergeRemoteState(buf []byte, join bool) {}
+
+// newStdLogger returns a standard logger for memberlist writing to the
+// logger, its warnings and errors as warnings and the rest for debugging.
+func newStdLogger(l logging.Logger) *log.Logger {
+	return log.New(logWriter{l}, "", 0)
+}
+
+type logWriter struct {
+	log logging.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.HasPrefix(msg, "[WARN]") || strings.HasPrefix(msg, "[ERR]") {
+		w.log.Warnw("Gossip", "message", msg)
+	} else {
+		w.log.Debugw("Gossip", "message", msg)
+	}
+	return len(p), nil
+}
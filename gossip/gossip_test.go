@@ -0,0 +1,149 @@
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+)
+
+// fakeCache holds the jokes, sparing those beyond keep.
+type fakeCache struct {
+	mu    sync.Mutex
+	jokes []service.Joke
+	keep  int
+}
+
+func (fc *fakeCache) Surplus() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return max(len(fc.jokes)-fc.keep, 0)
+}
+
+func (fc *fakeCache) GiveJokes(n int) []service.Joke {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	n = min(n, max(len(fc.jokes)-fc.keep, 0))
+	given := fc.jokes[:n]
+	fc.jokes = fc.jokes[n:]
+	return given
+}
+
+func (fc *fakeCache) WarmJokes(jokes []service.Joke) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.jokes = append(fc.jokes, jokes...)
+	return len(jokes)
+}
+
+func (fc *fakeCache) len() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return len(fc.jokes)
+}
+
+// newTestNode starts a node on the loopback interface.
+func newTestNode(t *testing.T, name string, cache Cache, key []byte) *Node {
+	n, err := New(Config{Name: name, Bind: "127.0.0.1:0", Key: key}, cache, logging.Nop())
+	if err != nil {
+		t.Fatal("error starting node", err)
+	}
+	t.Cleanup(func() { n.Shutdown(context.Background()) })
+	return n
+}
+
+// addr is where the node gossips.
+func addr(n *Node) string {
+	local := n.ml.LocalNode()
+	return fmt.Sprintf("%s:%d", local.Addr, local.Port)
+}
+
+// TestWarm verifies a fresh replica is given the jokes its peers can
+// spare, those with the most first, and no more than it wants.
+func TestWarm(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	var jokes []service.Joke
+	for i := 0; i < 10; i++ {
+		jokes = append(jokes, service.Joke{ID: i, Text: fmt.Sprint("joke ", i),
+			Name: service.NameResp{Name: "Ann", Surname: "Lee"}})
+	}
+	rich := &fakeCache{jokes: jokes[:8], keep: 4}
+	poor := &fakeCache{jokes: jokes[8:], keep: 1}
+	fresh := &fakeCache{}
+	a := newTestNode(t, "rich", rich, key)
+	b := newTestNode(t, "poor", poor, key)
+	c := newTestNode(t, "fresh", fresh, key)
+	if _, err := b.Join([]string{addr(a)}); err != nil {
+		t.Fatal("error joining", err)
+	}
+	if _, err := c.Join([]string{addr(a)}); err != nil {
+		t.Fatal("error joining", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if got := c.Warm(ctx, 5); got != 5 {
+		t.Fatal("expected 5 jokes, got:", got)
+	}
+	if fresh.len() != 5 || rich.len() != 4 || poor.len() != 1 {
+		t.Fatal("expected all of the surplus taken, got:", fresh.len(), rich.len(), poor.len())
+	}
+	if fresh.jokes[0].Text != "joke 0" || fresh.jokes[0].Name.Surname != "Lee" {
+		t.Fatal("expected the richest peer's oldest joke first, got:", fresh.jokes[0])
+	}
+	if got := c.Warm(ctx, 5); got != 0 {
+		t.Fatal("expected no more to spare, got:", got)
+	}
+	if c.Members() != 3 {
+		t.Fatal("expected 3 members, got:", c.Members())
+	}
+}
+
+// TestWarmAlone verifies a replica without peers isn't kept waiting.
+func TestWarmAlone(t *testing.T) {
+	n := newTestNode(t, "alone", &fakeCache{}, nil)
+	done := make(chan int)
+	go func() { done <- n.Warm(context.Background(), 5) }()
+	select {
+	case got := <-done:
+		if got != 0 {
+			t.Fatal("expected no jokes, got:", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Warm to return at once")
+	}
+	if _, err := New(Config{Bind: "no-port"}, &fakeCache{}, logging.Nop()); err == nil {
+		t.Fatal("expected an error for a bad address")
+	}
+	if _, err := New(Config{Bind: ":0"}, &fakeCache{}, logging.Nop()); err == nil {
+		t.Fatal("expected an error for no key off the loopback interface")
+	}
+}
+
+// TestUnasked verifies a replica only takes the jokes it asked for, from
+// the peers it asked, and only gives jokes to the peers in the gossip.
+func TestUnasked(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	rich := &fakeCache{jokes: []service.Joke{{ID: 1, Text: "one"}, {ID: 2, Text: "two"}}}
+	fresh := &fakeCache{}
+	a := newTestNode(t, "rich", rich, key)
+	c := newTestNode(t, "fresh", fresh, key)
+	if _, err := c.Join([]string{addr(a)}); err != nil {
+		t.Fatal("error joining", err)
+	}
+
+	// Jokes pushed without a Warm are turned away.
+	if err := a.send(c.member("fresh"), msgJokes, gift{From: "rich", Jokes: rich.jokes[:1]}); err != nil {
+		t.Fatal("error sending", err)
+	}
+	// A request from outside the gossip isn't answered.
+	delegate{a}.NotifyMsg(append([]byte{msgWant}, `{"from":"stranger","n":2}`...))
+	time.Sleep(memberWait + 500*time.Millisecond)
+	if fresh.len() != 0 || rich.len() != 2 {
+		t.Fatal("expected no jokes moved, got:", fresh.len(), rich.len())
+	}
+}
@@ -0,0 +1,89 @@
+// Package jokefmt decorates the jokes served with an operator-supplied Go
+// template, for example "{{.First}} {{.Last}} says: {{.Joke}}".
+package jokefmt
+
+import (
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+// Data is what the template has to work with.
+type Data struct {
+	ID    int    // joke ID
+	First string // first name put in the joke
+	Last  string // last name put in the joke
+	Joke  string // the joke text
+}
+
+// Formatter applies the template to the jokes.  The template can be
+// reloaded while in use.
+type Formatter struct {
+	path string
+	tmpl atomic.Pointer[template.Template]
+}
+
+// New creates a formatter from the template text.
+func New(text string) (*Formatter, error) {
+	t, err := parse(text)
+	if err != nil {
+		return nil, err
+	}
+	f := &Formatter{}
+	f.tmpl.Store(t)
+	return f, nil
+}
+
+// Load creates a formatter from the template in the file.  Reload rereads
+// the file.
+func Load(path string) (*Formatter, error) {
+	f := &Formatter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload rereads the template file, if the formatter was loaded from one.
+// If the new template is invalid, the old one is kept.
+func (f *Formatter) Reload() error {
+	if f.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return pkgerr.Wrap(err, "reading template")
+	}
+	// Editors usually leave a newline at the end, which isn't wanted.
+	t, err := parse(strings.TrimRight(string(b), "\r\n"))
+	if err != nil {
+		return err
+	}
+	f.tmpl.Store(t)
+	return nil
+}
+
+// Format applies the template to the joke.
+func (f *Formatter) Format(d Data) (string, error) {
+	var sb strings.Builder
+	if err := f.tmpl.Load().Execute(&sb, d); err != nil {
+		return "", pkgerr.Wrap(err, "executing template")
+	}
+	return sb.String(), nil
+}
+
+// parse parses the template, which must refer to the fields of Data only.
+func parse(text string) (*template.Template, error) {
+	t, err := template.New("joke").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "parsing template")
+	}
+	// Catch references to unknown fields now, rather than on every joke.
+	if err := t.Execute(&strings.Builder{}, Data{}); err != nil {
+		return nil, pkgerr.Wrap(err, "checking template")
+	}
+	return t, nil
+}
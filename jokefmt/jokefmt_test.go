@@ -0,0 +1,66 @@
+package jokefmt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var data = Data{ID: 3, First: "Ann", Last: "Lee", Joke: "Ann Lee counted to infinity."}
+
+// TestFormat applies a template.
+func TestFormat(t *testing.T) {
+	f, err := New("#{{.ID}} {{.First}} {{.Last}} says: {{.Joke}} :)")
+	if err != nil {
+		t.Fatal("error creating formatter", err)
+	}
+	res, err := f.Format(data)
+	if err != nil {
+		t.Fatal("error formatting", err)
+	}
+	exp := "#3 Ann Lee says: Ann Lee counted to infinity. :)"
+	if res != exp {
+		t.Fatal("expected:", exp, ", got:", res)
+	}
+
+	for _, bad := range []string{"{{.Joke", "{{.Punchline}}"} {
+		if _, err := New(bad); err == nil {
+			t.Fatalf("expected error for template %q", bad)
+		}
+	}
+}
+
+// TestReload verifies a changed template file is picked up, and a bad one
+// ignored.
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "joke.tmpl")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("{{.Joke}}\n")
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal("error loading", err)
+	}
+	check := func(exp string) {
+		t.Helper()
+		if res, _ := f.Format(data); res != exp {
+			t.Fatalf("expected %q, got %q", exp, res)
+		}
+	}
+	check(data.Joke)
+
+	write(">> {{.Joke}}")
+	if err := f.Reload(); err != nil {
+		t.Fatal("error reloading", err)
+	}
+	check(">> " + data.Joke)
+
+	write("{{.Nope}}")
+	if err := f.Reload(); err == nil {
+		t.Fatal("expected error reloading bad template")
+	}
+	check(">> " + data.Joke)
+}
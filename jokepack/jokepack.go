@@ -0,0 +1,213 @@
+// Package jokepack serves jokes from a directory of joke pack files, so
+// teams can serve their own collections alongside the upstream jokes.
+//
+// A pack is a JSON or YAML file like this:
+//
+//	name: office
+//	categories: [work]
+//	jokes:
+//	  - text: "{first} {last} replies to all, and everyone is happy."
+//	  - id: 1000001
+//	    text: "{first} {last} can finish a meeting early."
+//	    categories: [work, nerdy]
+//
+// The {first} and {last} placeholders are replaced by the name the joke is
+// for.  A joke about two people uses {first2} and {last2} for the second,
+// which the service fills in.  The categories of the pack apply to the jokes without their own.
+// A joke without an ID is given one from a hash of its text, so it keeps
+// the same ID from one run to the next.
+package jokepack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gdotgordon/laff/service"
+	pkgerr "github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// minHashID is the lowest of the generated joke IDs, which keeps them clear
+// of the IDs of the upstream joke service.
+const minHashID = 1 << 24
+
+// ErrEmpty means there are no jokes in the packs.  The service then gets
+// the joke elsewhere.
+var ErrEmpty = fmt.Errorf("no jokes in the joke packs: %w", service.ErrNoJokes)
+
+// Pack is the contents of a joke pack file.
+type Pack struct {
+	Name       string     `json:"name" yaml:"name"`
+	Categories []string   `json:"categories,omitempty" yaml:"categories,omitempty"`
+	Jokes      []PackJoke `json:"jokes" yaml:"jokes"`
+}
+
+// PackJoke is a joke in a pack.
+type PackJoke struct {
+	ID         int      `json:"id,omitempty" yaml:"id,omitempty"`
+	Text       string   `json:"text" yaml:"text"`
+	Categories []string `json:"categories,omitempty" yaml:"categories,omitempty"`
+}
+
+// Provider serves the jokes in the packs of a directory.  It implements
+// service.JokeProvider.
+type Provider struct {
+	dir   string
+	jokes atomic.Pointer[[]PackJoke]
+}
+
+// Load reads all the packs in the directory, that is the files ending in
+// .json, .yaml or .yml.
+func Load(dir string) (*Provider, error) {
+	jokes, err := loadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{dir: dir}
+	p.jokes.Store(&jokes)
+	return p, nil
+}
+
+// Len returns the number of jokes loaded.
+func (p *Provider) Len() int {
+	return len(p.list())
+}
+
+// list returns the jokes currently loaded.
+func (p *Provider) list() []PackJoke {
+	return *p.jokes.Load()
+}
+
+// Reload rereads the packs, replacing the jokes served all at once.  If
+// any pack is bad, the jokes already loaded are kept.  It returns the
+// numbers of jokes added and removed, by ID, so a changed joke is counted
+// as neither.
+func (p *Provider) Reload() (added, removed int, err error) {
+	jokes, err := loadDir(p.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	old := p.jokes.Swap(&jokes)
+
+	ids := make(map[int]bool, len(*old))
+	for _, pj := range *old {
+		ids[pj.ID] = true
+	}
+	for _, pj := range jokes {
+		if ids[pj.ID] {
+			delete(ids, pj.ID)
+		} else {
+			added++
+		}
+	}
+	return added, len(ids), nil
+}
+
+// Joke implements service.JokeProvider, returning a random joke from the
+// packs made out to the name.  The pick is repeatable for a seeded
+// context, see service.Seed.
+func (p *Provider) Joke(ctx context.Context, name *service.NameResp) (service.Joke, error) {
+	jokes := p.list()
+	if len(jokes) == 0 {
+		return service.Joke{}, ErrEmpty
+	}
+	pj := jokes[service.Intn(ctx, len(jokes))]
+	r := strings.NewReplacer("{first}", name.Name, "{last}", name.Surname)
+	return service.Joke{
+		ID:         pj.ID,
+		Text:       r.Replace(pj.Text),
+		Name:       *name,
+		Categories: pj.Categories,
+	}, nil
+}
+
+// loadDir reads the packs in the directory, in name order.  A joke ID
+// used twice is an error, as the IDs are how users refer to the jokes.
+func loadDir(dir string) ([]PackJoke, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "reading joke pack directory")
+	}
+	var jokes []PackJoke
+	files := make(map[int]string)
+	for _, e := range entries {
+		if e.IsDir() || !isPack(e.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		pack, err := loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, pj := range pack.Jokes {
+			if prev, ok := files[pj.ID]; ok {
+				return nil, fmt.Errorf("joke ID %d in %s is also in %s", pj.ID, path, prev)
+			}
+			files[pj.ID] = path
+			jokes = append(jokes, pj)
+		}
+	}
+	sort.SliceStable(jokes, func(i, j int) bool {
+		return jokes[i].ID < jokes[j].ID
+	})
+	return jokes, nil
+}
+
+// isPack reports whether the file name is that of a joke pack.
+func isPack(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// loadFile reads and checks one pack, filling in the IDs and categories
+// of the jokes.
+func loadFile(path string) (Pack, error) {
+	var pack Pack
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return pack, pkgerr.Wrap(err, "reading joke pack")
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(b, &pack)
+	} else {
+		err = yaml.Unmarshal(b, &pack)
+	}
+	if err != nil {
+		return pack, pkgerr.Wrapf(err, "parsing joke pack %s", path)
+	}
+
+	for i := range pack.Jokes {
+		pj := &pack.Jokes[i]
+		pj.Text = strings.TrimSpace(pj.Text)
+		if pj.Text == "" {
+			return pack, fmt.Errorf("joke %d in %s has no text", i+1, path)
+		}
+		if pj.ID < 0 {
+			return pack, fmt.Errorf("joke %d in %s has a negative ID", i+1, path)
+		}
+		if pj.ID == 0 {
+			pj.ID = hashID(pj.Text)
+		}
+		if len(pj.Categories) == 0 {
+			pj.Categories = pack.Categories
+		}
+	}
+	return pack, nil
+}
+
+// hashID derives a joke ID from its text.
+func hashID(text string) int {
+	h := fnv.New32a()
+	h.Write([]byte(text))
+	return minHashID + int(h.Sum32()%(1<<31-minHashID))
+}
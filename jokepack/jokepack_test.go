@@ -0,0 +1,157 @@
+package jokepack
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+)
+
+const yamlPack = `name: office
+categories: [work]
+jokes:
+  - text: "{first} {last} replies to all, and everyone is happy."
+  - id: 7
+    text: "{first} can finish a meeting early."
+    categories: [nerdy]
+`
+
+const jsonPack = `{"name": "misc", "jokes": [{"id": 8, "text": "{last} wins."}]}`
+
+// writePacks creates a directory with the packs, keyed by file name.
+func writePacks(t *testing.T, packs map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range packs {
+		writeFile(t, filepath.Join(dir, name), body)
+	}
+	return dir
+}
+
+// TestLoad reads JSON and YAML packs, ignoring other files.
+func TestLoad(t *testing.T) {
+	dir := writePacks(t, map[string]string{
+		"office.yaml": yamlPack,
+		"misc.json":   jsonPack,
+		"README.txt":  "not a pack",
+	})
+	p, err := Load(dir)
+	if err != nil {
+		t.Fatal("error loading", err)
+	}
+	if p.Len() != 3 {
+		t.Fatal("expected 3 jokes, got:", p.Len())
+	}
+	jokes := p.list()
+	if jokes[0].ID != 7 || jokes[1].ID != 8 || jokes[2].ID < minHashID {
+		t.Fatal("unexpected IDs:", jokes)
+	}
+	if c := jokes[2].Categories; len(c) != 1 || c[0] != "work" {
+		t.Fatal("expected pack categories, got:", c)
+	}
+	if c := jokes[0].Categories; len(c) != 1 || c[0] != "nerdy" {
+		t.Fatal("expected joke categories, got:", c)
+	}
+
+	// The generated IDs are the same every time.
+	again, err := Load(dir)
+	if err != nil || again.list()[2].ID != jokes[2].ID {
+		t.Fatal("expected stable IDs, got:", again.list(), err)
+	}
+}
+
+// TestLoadErrors verifies bad packs are reported.
+func TestLoadErrors(t *testing.T) {
+	for name, packs := range map[string]map[string]string{
+		"duplicate": {"a.json": jsonPack, "b.json": jsonPack},
+		"no text":   {"a.yml": "jokes:\n  - id: 3\n"},
+		"bad yaml":  {"a.yaml": "jokes: [\n"},
+	} {
+		if _, err := Load(writePacks(t, packs)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
+
+// TestJoke verifies the name is filled in.
+func TestJoke(t *testing.T) {
+	p, err := Load(writePacks(t, map[string]string{"misc.json": jsonPack}))
+	if err != nil {
+		t.Fatal("error loading", err)
+	}
+	jk, err := p.Joke(context.Background(), &service.NameResp{Name: "Ann", Surname: "Lee"})
+	if err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	if jk.ID != 8 || jk.Text != "Lee wins." || jk.Name.Name != "Ann" {
+		t.Fatalf("unexpected joke: %+v", jk)
+	}
+
+	empty, _ := Load(t.TempDir())
+	if _, err := empty.Joke(context.Background(), &service.NameResp{}); err != ErrEmpty {
+		t.Fatal("expected empty error, got:", err)
+	}
+}
+
+// TestReload verifies the counts of jokes added and removed, and that a
+// bad pack leaves the jokes alone.
+func TestReload(t *testing.T) {
+	dir := writePacks(t, map[string]string{"office.yaml": yamlPack})
+	p, err := Load(dir)
+	if err != nil {
+		t.Fatal("error loading", err)
+	}
+
+	os.Remove(filepath.Join(dir, "office.yaml"))
+	writeFile(t, filepath.Join(dir, "misc.json"), jsonPack)
+	added, removed, err := p.Reload()
+	if err != nil {
+		t.Fatal("error reloading", err)
+	}
+	if added != 1 || removed != 2 || p.Len() != 1 {
+		t.Fatal("expected 1 added, 2 removed, got:", added, removed, p.Len())
+	}
+
+	writeFile(t, filepath.Join(dir, "bad.json"), "{")
+	if _, _, err := p.Reload(); err == nil {
+		t.Fatal("expected error reloading bad pack")
+	}
+	if p.Len() != 1 {
+		t.Fatal("expected old jokes kept, got:", p.Len())
+	}
+}
+
+// TestWatch verifies a new pack is picked up.
+func TestWatch(t *testing.T) {
+	dir := writePacks(t, map[string]string{"misc.json": jsonPack})
+	p, err := Load(dir)
+	if err != nil {
+		t.Fatal("error loading", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.Watch(ctx, logging.Nop()); err != nil {
+		t.Fatal("error watching", err)
+	}
+
+	writeFile(t, filepath.Join(dir, "office.yaml"), yamlPack)
+	for start := time.Now(); p.Len() != 3; time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected 3 jokes after adding pack, got:", p.Len())
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
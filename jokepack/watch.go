@@ -0,0 +1,64 @@
+package jokepack
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gdotgordon/laff/logging"
+	pkgerr "github.com/pkg/errors"
+)
+
+// settle is how long the directory must be quiet before we reload, as
+// saving or copying a file makes several events.
+const settle = 500 * time.Millisecond
+
+// Watch reloads the packs whenever the files in the directory change,
+// until the context is done.  It returns an error if the directory can't
+// be watched; the errors reloading are only logged, as the editors will
+// want to fix the pack and carry on.
+func (p *Provider) Watch(ctx context.Context, log logging.Logger) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return pkgerr.Wrap(err, "creating watcher")
+	}
+	if err := w.Add(p.dir); err != nil {
+		w.Close()
+		return pkgerr.Wrap(err, "watching joke pack directory")
+	}
+
+	go func() {
+		defer w.Close()
+		timer := time.NewTimer(settle)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if isPack(ev.Name) && ev.Op != fsnotify.Chmod {
+					timer.Reset(settle)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warnw("error watching joke packs", "error", err)
+			case <-timer.C:
+				added, removed, err := p.Reload()
+				if err != nil {
+					log.Errorw("error reloading joke packs, keeping the old ones",
+						"error", err)
+					continue
+				}
+				log.Infow("reloaded joke packs", "jokes", p.Len(),
+					"added", added, "removed", removed)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,259 @@
+// Package laffmock is a mock of the upstream name and joke services, for
+// testing the laff service, or a program embedding it, without the rate
+// limits and outages of the real ones.
+//
+// The server answers these paths, which are given to the service with
+// service.WithNameURL, service.WithJokeURL and service.WithCatalogURL:
+//
+//	/name        a name, in the uinames format
+//	/randomuser  a name, in the randomuser.me format
+//	/jokes       a joke for the firstName and lastName query parameters
+//	/catalog     the catalog of the jokes, for the same parameters
+//
+// By default the names are Name0 Surname0, Name1 Surname1 and so on, or
+// First0 Last0 for randomuser.me, and the jokes "<first> <last> made joke
+// 0" and so on, so a test can tell which calls were made.  They can be
+// replaced with canned ones, see WithNames and WithJokes.
+package laffmock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name is a name served by the mock name service.
+type Name struct {
+	Name    string `json:"name"`
+	Surname string `json:"surname"`
+	Gender  string `json:"gender,omitempty"`
+	Region  string `json:"region,omitempty"`
+}
+
+// joke is a joke in the format of the joke service.
+type joke struct {
+	ID         int      `json:"id"`
+	Joke       string   `json:"joke"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithLatency delays every response by the duration, like a slow service.
+func WithLatency(d time.Duration) Option {
+	return func(s *Server) {
+		s.latency = d
+	}
+}
+
+// WithRateLimit answers 429, with a Retry-After header, to the calls over
+// the limit in each window, like the uinames name service.  All the calls
+// to the server count.
+func WithRateLimit(calls int, window time.Duration) Option {
+	return func(s *Server) {
+		s.limit = calls
+		s.window = window
+	}
+}
+
+// WithNames serves the names given, in turn, rather than the numbered
+// ones.
+func WithNames(names []Name) Option {
+	return func(s *Server) {
+		s.names = names
+	}
+}
+
+// WithJokes serves the jokes given, in turn, rather than the numbered
+// ones.  The {first} and {last} placeholders are replaced by the name the
+// joke is for.
+func WithJokes(jokes []string) Option {
+	return func(s *Server) {
+		s.jokes = jokes
+	}
+}
+
+// Server is a running mock of the name and joke services.
+type Server struct {
+	// URL is the base URL of the server, such as http://127.0.0.1:1234.
+	URL string
+
+	srv     *httptest.Server
+	latency time.Duration
+	limit   int
+	window  time.Duration
+	names   []Name
+	jokes   []string
+
+	mu       sync.Mutex
+	nextName int
+	nextJoke int
+	calls    int
+	limited  int
+	start    time.Time // of the rate limit window
+	inWindow int       // calls in the rate limit window
+}
+
+// New starts a mock server, to be closed with Close.
+func New(opts ...Option) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// NameURL returns the URL of the uinames style name service.
+func (s *Server) NameURL() string {
+	return s.URL + "/name"
+}
+
+// RandomUserURL returns the URL of the randomuser.me style name service.
+func (s *Server) RandomUserURL() string {
+	return s.URL + "/randomuser"
+}
+
+// JokeURL returns the URL of the joke service.
+func (s *Server) JokeURL() string {
+	return s.URL + "/jokes?"
+}
+
+// CatalogURL returns the URL of the joke service's catalog.
+func (s *Server) CatalogURL() string {
+	return s.URL + "/catalog?"
+}
+
+// Calls returns how many calls the server has had, and how many of them
+// were turned away by the rate limit.
+func (s *Server) Calls() (calls, limited int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls, s.limited
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// ServeHTTP implements http.Handler, so a test can wrap the mock in a
+// server of its own, to break it in other ways.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.latency > 0 {
+		t := time.NewTimer(s.latency)
+		select {
+		case <-r.Context().Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if retry, ok := s.call(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/name":
+		writeJSON(w, s.name(false))
+	case "/randomuser":
+		nm := s.name(true)
+		writeJSON(w, map[string]interface{}{"results": []interface{}{map[string]interface{}{
+			"gender":   nm.Gender,
+			"name":     map[string]string{"first": nm.Name, "last": nm.Surname},
+			"location": map[string]string{"country": nm.Region},
+		}}})
+	case "/jokes":
+		fn, ln := q.Get("firstName"), q.Get("lastName")
+		if fn == "" || ln == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"type": "success", "value": s.joke(fn, ln)})
+	case "/catalog":
+		fn, ln := q.Get("firstName"), q.Get("lastName")
+		var jokes []joke
+		for i := 1; i <= 3; i++ {
+			jokes = append(jokes, joke{ID: i, Joke: fmt.Sprintf("%s %s made catalog joke %d", fn, ln, i)})
+		}
+		writeJSON(w, map[string]interface{}{"type": "success", "value": jokes})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// call counts a call, reporting whether it is within the rate limit, or
+// else how many seconds are left in the window.
+func (s *Server) call() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.limit <= 0 {
+		return 0, true
+	}
+	now := time.Now()
+	if now.Sub(s.start) >= s.window {
+		s.start = now
+		s.inWindow = 0
+	}
+	if s.inWindow >= s.limit {
+		s.limited++
+		left := s.start.Add(s.window).Sub(now)
+		return int((left + time.Second - 1) / time.Second), false
+	}
+	s.inWindow++
+	return 0, true
+}
+
+// name returns the next name.  The numbered randomuser.me names are
+// First0 Last0 and so on, from Norway.
+func (s *Server) name(randomUser bool) Name {
+	s.mu.Lock()
+	n := s.nextName
+	s.nextName++
+	s.mu.Unlock()
+	switch {
+	case len(s.names) > 0:
+		return s.names[n%len(s.names)]
+	case randomUser:
+		return Name{Name: fmt.Sprintf("First%d", n), Surname: fmt.Sprintf("Last%d", n), Gender: "female", Region: "Norway"}
+	}
+	return Name{Name: fmt.Sprintf("Name%d", n), Surname: fmt.Sprintf("Surname%d", n)}
+}
+
+// joke returns the next joke, for the name.
+func (s *Server) joke(first, last string) joke {
+	s.mu.Lock()
+	n := s.nextJoke
+	s.nextJoke++
+	s.mu.Unlock()
+	if len(s.jokes) > 0 {
+		r := strings.NewReplacer("{first}", first, "{last}", last)
+		return joke{ID: n, Joke: r.Replace(s.jokes[n%len(s.jokes)]), Categories: []string{"nerdy"}}
+	}
+	return joke{ID: n, Joke: fmt.Sprintf("%s %s made joke %d", first, last, n), Categories: []string{"nerdy"}}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(b)
+}
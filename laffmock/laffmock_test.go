@@ -0,0 +1,74 @@
+package laffmock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, u string, v interface{}) *http.Response {
+	t.Helper()
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal("error calling mock", err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal("error decoding response", err)
+		}
+	}
+	return resp
+}
+
+// TestCanned verifies the canned names and jokes are served in turn.
+func TestCanned(t *testing.T) {
+	s := New(WithNames([]Name{{Name: "Ann", Surname: "Lee"}, {Name: "Bo", Surname: "Ek"}}),
+		WithJokes([]string{"{first} {last} wins."}))
+	defer s.Close()
+
+	for _, want := range []string{"Ann", "Bo", "Ann"} {
+		var nm Name
+		get(t, s.NameURL(), &nm)
+		if nm.Name != want {
+			t.Fatalf("expected %s, got: %+v", want, nm)
+		}
+	}
+	var jk struct {
+		Type  string
+		Value joke
+	}
+	get(t, s.JokeURL()+url.Values{"firstName": {"Ann"}, "lastName": {"Lee"}}.Encode(), &jk)
+	if jk.Type != "success" || jk.Value.Joke != "Ann Lee wins." {
+		t.Fatal("unexpected joke:", jk)
+	}
+	if resp := get(t, s.JokeURL(), nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected bad request without a name, got:", resp.Status)
+	}
+}
+
+// TestRateLimit verifies the calls over the limit are turned away until
+// the window is over, and the latency is added.
+func TestRateLimit(t *testing.T) {
+	s := New(WithRateLimit(2, time.Hour), WithLatency(10*time.Millisecond))
+	defer s.Close()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if resp := get(t, s.NameURL(), nil); resp.StatusCode != http.StatusOK {
+			t.Fatal("expected call within the limit, got:", resp.Status)
+		}
+	}
+	resp := get(t, s.NameURL(), nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "3600" {
+		t.Fatal("expected 429 for an hour, got:", resp.Status, resp.Header)
+	}
+	if time.Since(start) < 30*time.Millisecond {
+		t.Fatal("expected the calls delayed")
+	}
+	if calls, limited := s.Calls(); calls != 3 || limited != 1 {
+		t.Fatal("unexpected calls:", calls, limited)
+	}
+}
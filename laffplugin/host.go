@@ -0,0 +1,143 @@
+package laffplugin
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	pkgerr "github.com/pkg/errors"
+)
+
+// Plugin is a running provider plugin.  It implements service.NameProvider
+// and service.JokeProvider, though only those it provides should be used.
+type Plugin struct {
+	info   Info
+	path   string
+	client *plugin.Client
+	p      Provider
+}
+
+// Discover starts every executable file in the directory as a plugin.
+// If any fails to start, the ones already started are stopped.
+func Discover(dir string) ([]*Plugin, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "reading plugin directory")
+	}
+	var plugins []*Plugin
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0o111 == 0 {
+			continue
+		}
+		p, err := start(filepath.Join(dir, e.Name()))
+		if err != nil {
+			for _, p := range plugins {
+				p.Close()
+			}
+			return nil, err
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+// start runs the plugin binary and asks what it provides.
+func start(path string) (*Plugin, error) {
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig:  Handshake,
+		Plugins:          pluginMap(nil),
+		Cmd:              exec.Command(path),
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolNetRPC},
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Name:  "plugin",
+			Level: hclog.Warn,
+		}),
+	})
+	cp, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, pkgerr.Wrapf(err, "starting plugin %s", path)
+	}
+	p, err := connect(cp)
+	if err != nil {
+		client.Kill()
+		return nil, pkgerr.Wrapf(err, "starting plugin %s", path)
+	}
+	p.path = path
+	p.client = client
+	return p, nil
+}
+
+// connect gets the provider from a connection to a plugin.
+func connect(cp plugin.ClientProtocol) (*Plugin, error) {
+	raw, err := cp.Dispense(pluginName)
+	if err != nil {
+		return nil, err
+	}
+	prov := raw.(Provider)
+	info, err := prov.Info()
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "getting plugin info")
+	}
+	return &Plugin{info: info, p: prov}, nil
+}
+
+// Info returns what the plugin said about itself.
+func (p *Plugin) Info() Info {
+	return p.info
+}
+
+// Path returns the plugin binary.
+func (p *Plugin) Path() string {
+	return p.path
+}
+
+// Name implements service.NameProvider.
+func (p *Plugin) Name(ctx context.Context) (*service.NameResp, error) {
+	var name service.NameResp
+	err := p.call(ctx, func() (err error) {
+		name, err = p.p.Name()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &name, nil
+}
+
+// Joke implements service.JokeProvider.
+func (p *Plugin) Joke(ctx context.Context, name *service.NameResp) (service.Joke, error) {
+	var jk service.Joke
+	err := p.call(ctx, func() (err error) {
+		jk, err = p.p.Joke(*name)
+		return err
+	})
+	return jk, err
+}
+
+// call makes an RPC call, giving up on it if the context is done first.
+// The RPC protocol has no way to cancel the call in the plugin.
+func (p *Plugin) call(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the plugin.
+func (p *Plugin) Close() {
+	if p.client != nil {
+		p.client.Kill()
+	}
+}
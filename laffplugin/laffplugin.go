@@ -0,0 +1,116 @@
+// Package laffplugin lets third parties ship name and joke providers as
+// separate binaries, which laff finds in its plugin directory at startup.
+// The plugins talk to laff over RPC using hashicorp/go-plugin, so they
+// can be closed source and built without laff's code beyond this package.
+//
+// A plugin implements Provider and calls Serve from its main function:
+//
+//	func main() {
+//		laffplugin.Serve(myProvider{})
+//	}
+package laffplugin
+
+import (
+	"net/rpc"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/hashicorp/go-plugin"
+)
+
+// Handshake is checked by laff and the plugins before they talk, so laff
+// doesn't run a binary that isn't a plugin, or one with another protocol
+// version.
+var Handshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "LAFF_PLUGIN",
+	MagicCookieValue: "7a1c7bd2-laff-provider",
+}
+
+// pluginName is the name of the provider in the plugin map.
+const pluginName = "provider"
+
+// Info describes a plugin, and which of names and jokes it provides.
+type Info struct {
+	Name  string
+	Names bool
+	Jokes bool
+}
+
+// Provider is implemented by the plugins.  Name need only work if the
+// plugin says it provides names, and Joke if it provides jokes.
+type Provider interface {
+	Info() (Info, error)
+	Name() (service.NameResp, error)
+	Joke(name service.NameResp) (service.Joke, error)
+}
+
+// Serve runs the provider as a plugin.  It is called from the plugin's
+// main function, and returns when laff is done with the plugin.
+func Serve(p Provider) {
+	plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         pluginMap(p),
+	})
+}
+
+// pluginMap gives the plugins for go-plugin.  The provider is nil on
+// laff's side.
+func pluginMap(p Provider) map[string]plugin.Plugin {
+	return map[string]plugin.Plugin{pluginName: &rpcPlugin{impl: p}}
+}
+
+// rpcPlugin connects the provider over net/rpc.
+type rpcPlugin struct {
+	impl Provider
+}
+
+func (p *rpcPlugin) Server(*plugin.MuxBroker) (interface{}, error) {
+	return &rpcServer{impl: p.impl}, nil
+}
+
+func (p *rpcPlugin) Client(_ *plugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &rpcClient{c: c}, nil
+}
+
+// rpcServer runs in the plugin, passing the calls to the provider.
+type rpcServer struct {
+	impl Provider
+}
+
+func (s *rpcServer) Info(_ interface{}, res *Info) (err error) {
+	*res, err = s.impl.Info()
+	return err
+}
+
+func (s *rpcServer) Name(_ interface{}, res *service.NameResp) (err error) {
+	*res, err = s.impl.Name()
+	return err
+}
+
+func (s *rpcServer) Joke(name service.NameResp, res *service.Joke) (err error) {
+	*res, err = s.impl.Joke(name)
+	return err
+}
+
+// rpcClient runs in laff, making the calls to the plugin.
+type rpcClient struct {
+	c *rpc.Client
+}
+
+func (c *rpcClient) Info() (Info, error) {
+	var res Info
+	err := c.c.Call("Plugin.Info", new(interface{}), &res)
+	return res, err
+}
+
+func (c *rpcClient) Name() (service.NameResp, error) {
+	var res service.NameResp
+	err := c.c.Call("Plugin.Name", new(interface{}), &res)
+	return res, err
+}
+
+func (c *rpcClient) Joke(name service.NameResp) (service.Joke, error) {
+	var res service.Joke
+	err := c.c.Call("Plugin.Joke", name, &res)
+	return res, err
+}
@@ -0,0 +1,50 @@
+package laffplugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/hashicorp/go-plugin"
+)
+
+// TestProvider makes the calls to a provider over RPC, in process.
+func TestProvider(t *testing.T) {
+	client, _ := plugin.TestPluginRPCConn(t, pluginMap(testProvider{}), nil)
+	defer client.Close()
+
+	p, err := connect(client)
+	if err != nil {
+		t.Fatal("error connecting", err)
+	}
+	if info := p.Info(); info.Name != "test" || !info.Names || info.Jokes {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+
+	ctx := context.Background()
+	name, err := p.Name(ctx)
+	if err != nil {
+		t.Fatal("error getting name", err)
+	}
+	if name.Name != "Ann" || name.Surname != "Lee" {
+		t.Fatalf("unexpected name: %+v", name)
+	}
+	if _, err := p.Joke(ctx, name); err == nil || err.Error() != "no jokes here" {
+		t.Fatal("expected the plugin's error, got:", err)
+	}
+}
+
+type testProvider struct{}
+
+func (testProvider) Info() (Info, error) {
+	return Info{Name: "test", Names: true}, nil
+}
+
+func (testProvider) Name() (service.NameResp, error) {
+	return service.NameResp{Name: "Ann", Surname: "Lee"}, nil
+}
+
+func (testProvider) Joke(name service.NameResp) (service.Joke, error) {
+	return service.Joke{}, errors.New("no jokes here")
+}
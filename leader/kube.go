@@ -0,0 +1,261 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The service account files mounted in each pod.
+const (
+	serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	tokenFile      = serviceAccount + "/token"
+	caFile         = serviceAccount + "/ca.crt"
+	namespaceFile  = serviceAccount + "/namespace"
+)
+
+// microTime is the layout of the Lease times.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// errConflict is a Lease changed by another replica since it was read.
+var errConflict = errors.New("lease conflict")
+
+// KubeLease is a lock held in a Kubernetes Lease object, as the Kubernetes
+// controllers elect their leaders.  The Lease names its holder and when
+// the holder last renewed it, and it is free once the lease duration has
+// passed since then.  The updates are made against the version of the
+// Lease read, so two replicas can't both take it.
+type KubeLease struct {
+	client *http.Client
+	url    string // of the Lease
+	token  func() (string, error)
+	id     string
+	term   time.Duration
+	now    func() time.Time
+}
+
+// lease is the part of a coordination.k8s.io/v1 Lease we use.
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string  `json:"acquireTime,omitempty"`
+	RenewTime            string  `json:"renewTime,omitempty"`
+	LeaseTransitions     int     `json:"leaseTransitions"`
+}
+
+// NewKubeLease creates a lock in the Lease with the name and namespace,
+// held by the ID for the term, using the API server at baseURL with the
+// bearer token the function returns.
+func NewKubeLease(client *http.Client, baseURL string, token func() (string, error),
+	namespace, name, id string, term time.Duration) *KubeLease {
+	return &KubeLease{
+		client: client,
+		url: fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s",
+			strings.TrimSuffix(baseURL, "/"), namespace, name),
+		token: token,
+		id:    id,
+		term:  term,
+		now:   time.Now,
+	}
+}
+
+// NewInClusterLease creates a lock in the Lease with the name, in the
+// namespace or, if empty, the pod's own, using the pod's service account,
+// which needs to get, create and update the Lease.
+func NewInClusterLease(namespace, name, id string, term time.Duration) (*KubeLease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in Kubernetes, KUBERNETES_SERVICE_HOST and _PORT aren't set")
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+	// The token is read for each call, as the kubelet rotates it.
+	token := func() (string, error) {
+		b, err := os.ReadFile(tokenFile)
+		return strings.TrimSpace(string(b)), err
+	}
+	return NewKubeLease(client, "https://"+net.JoinHostPort(host, port), token, namespace, name, id, term), nil
+}
+
+// Acquire implements Lock.
+func (kl *KubeLease) Acquire(ctx context.Context) (bool, error) {
+	now := kl.now()
+	ls, err := kl.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	secs := int((kl.term + time.Second - 1) / time.Second)
+	if ls == nil {
+		ls = &lease{Spec: leaseSpec{AcquireTime: now.Format(microTime)}}
+	} else {
+		holder := ""
+		if ls.Spec.HolderIdentity != nil {
+			holder = *ls.Spec.HolderIdentity
+		}
+		if holder != kl.id {
+			if holder != "" && !kl.expired(ls.Spec, now) {
+				return false, nil
+			}
+			ls.Spec.AcquireTime = now.Format(microTime)
+			ls.Spec.LeaseTransitions++
+		}
+	}
+	ls.Spec.HolderIdentity = &kl.id
+	ls.Spec.LeaseDurationSeconds = &secs
+	ls.Spec.RenewTime = now.Format(microTime)
+	switch err := kl.put(ctx, ls); err {
+	case nil:
+		return true, nil
+	case errConflict:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// expired reports whether the holder's term is over.
+func (kl *KubeLease) expired(spec leaseSpec, now time.Time) bool {
+	renewed, err := time.Parse(time.RFC3339Nano, spec.RenewTime)
+	if err != nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
+
+// Release implements Lock.  The Lease is kept, free for the others.
+func (kl *KubeLease) Release(ctx context.Context) error {
+	ls, err := kl.get(ctx)
+	if err != nil || ls == nil || ls.Spec.HolderIdentity == nil || *ls.Spec.HolderIdentity != kl.id {
+		return err
+	}
+	free, one := "", 1
+	ls.Spec.HolderIdentity = &free
+	ls.Spec.LeaseDurationSeconds = &one
+	ls.Spec.RenewTime = kl.now().Format(microTime)
+	if err := kl.put(ctx, ls); err != errConflict {
+		return err
+	}
+	return nil
+}
+
+// get reads the Lease, returning nil if there is none.
+func (kl *KubeLease) get(ctx context.Context) (*lease, error) {
+	var ls lease
+	code, err := kl.call(ctx, http.MethodGet, kl.url, nil, &ls)
+	if code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ls, nil
+}
+
+// put creates the Lease, if it wasn't read, or else updates the version
+// read, returning errConflict if another replica got there first.
+func (kl *KubeLease) put(ctx context.Context, ls *lease) error {
+	method, url := http.MethodPut, kl.url
+	if ls.Metadata.ResourceVersion == "" {
+		i := strings.LastIndex(kl.url, "/")
+		method, url = http.MethodPost, kl.url[:i]
+		ls.Metadata.Name = kl.url[i+1:]
+		ls.Metadata.Namespace = nsFromURL(kl.url)
+	}
+	ls.APIVersion, ls.Kind = "coordination.k8s.io/v1", "Lease"
+	code, err := kl.call(ctx, method, url, ls, nil)
+	if code == http.StatusConflict {
+		return errConflict
+	}
+	return err
+}
+
+// nsFromURL returns the namespace in the URL of a Lease.
+func nsFromURL(url string) string {
+	parts := strings.Split(url, "/")
+	return parts[len(parts)-3]
+}
+
+// call sends the request to the API server, returning its status code.
+func (kl *KubeLease) call(ctx context.Context, method, url string, body, res interface{}) (int, error) {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, rd)
+	if err != nil {
+		return 0, err
+	}
+	token, err := kl.token()
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := kl.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("got HTTP status %d (%s) from the API server: %s",
+			resp.StatusCode, http.StatusText(resp.StatusCode), bytes.TrimSpace(rb))
+	}
+	if res == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.Unmarshal(rb, res)
+}
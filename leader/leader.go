@@ -0,0 +1,131 @@
+// Package leader elects one of the replicas of the laff service as the
+// leader, by a lock they all try to hold, such as a Kubernetes Lease or a
+// Redis key.  The lock is held for a term at a time, and the leader keeps
+// it by renewing it before the term is over, so should the leader die, the
+// lock is free again once its term runs out.
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+)
+
+// releaseTimeout limits the release of the lock on stopping.
+const releaseTimeout = 5 * time.Second
+
+// Lock is a lock held for a term at a time.
+type Lock interface {
+	// Acquire takes the lock for a term if it is free, or renews it if
+	// it is already held by us, reporting whether we hold it.
+	Acquire(ctx context.Context) (bool, error)
+
+	// Release frees the lock if we hold it.
+	Release(ctx context.Context) error
+}
+
+// Elector tries to take the lock, and renews it while it is held, a few
+// times a term.  The replica holding it is the leader.  A replica that
+// can't tell whether it still holds the lock steps down, so that two
+// replicas are never both leading for long.
+type Elector struct {
+	lock Lock
+	term time.Duration
+	log  logging.Logger
+
+	leading int32
+	mu      sync.Mutex
+	since   time.Time // the leadership last changed
+	elected int64     // times this replica became the leader
+	lastErr string    // the last error taking the lock
+}
+
+// State is a snapshot of the elector.
+type State struct {
+	Leader    bool      `json:"leader"`
+	Since     time.Time `json:"since"`
+	Elected   int64     `json:"elected"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// NewElector creates an elector for the lock, held for the term.
+func NewElector(lock Lock, term time.Duration, log logging.Logger) *Elector {
+	return &Elector{lock: lock, term: term, log: log, since: time.Now()}
+}
+
+// Run takes part in the election until the context is done, then frees
+// the lock if it is held.
+func (e *Elector) Run(ctx context.Context) {
+	t := time.NewTicker(e.term / 3)
+	defer t.Stop()
+	for {
+		ok, err := e.lock.Acquire(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			e.log.Warnw("Error taking the leader lock", "error", err)
+			e.mu.Lock()
+			e.lastErr = err.Error()
+			e.mu.Unlock()
+		}
+		e.set(ok && err == nil)
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+			continue
+		}
+		break
+	}
+
+	if e.IsLeader() {
+		e.set(false)
+		rctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		defer cancel()
+		if err := e.lock.Release(rctx); err != nil {
+			e.log.Warnw("Error releasing the leader lock", "error", err)
+		}
+	}
+}
+
+// set records whether this replica leads.
+func (e *Elector) set(leading bool) {
+	var v int32
+	if leading {
+		v = 1
+	}
+	if atomic.SwapInt32(&e.leading, v) == v {
+		return
+	}
+	e.mu.Lock()
+	e.since = time.Now()
+	if leading {
+		e.elected++
+	}
+	e.mu.Unlock()
+	if leading {
+		e.log.Infow("Elected the leader")
+	} else {
+		e.log.Infow("No longer the leader")
+	}
+}
+
+// IsLeader reports whether this replica is the leader.
+func (e *Elector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leading) == 1
+}
+
+// State returns the current state of the elector.
+func (e *Elector) State() State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return State{
+		Leader:    e.IsLeader(),
+		Since:     e.since.UTC(),
+		Elected:   e.elected,
+		LastError: e.lastErr,
+	}
+}
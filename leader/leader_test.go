@@ -0,0 +1,200 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gdotgordon/laff/logging"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// TestRedisLock verifies only one holder has the lock, until it expires
+// or is released.
+func TestRedisLock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	ctx := context.Background()
+	a := NewRedisLock(client, "lock", "a", time.Minute)
+	b := NewRedisLock(client, "lock", "b", time.Minute)
+	for _, tc := range []struct {
+		lock *RedisLock
+		exp  bool
+	}{{a, true}, {b, false}, {a, true}} {
+		if ok, err := tc.lock.Acquire(ctx); err != nil || ok != tc.exp {
+			t.Fatal("expected", tc.exp, "for", tc.lock.id, "got:", ok, err)
+		}
+	}
+	mr.FastForward(2 * time.Minute)
+	if ok, _ := b.Acquire(ctx); !ok {
+		t.Fatal("expected b to take the expired lock")
+	}
+	if err := a.Release(ctx); err != nil || mr.Exists("lock") == false {
+		t.Fatal("expected a not to release b's lock", err)
+	}
+	if err := b.Release(ctx); err != nil || mr.Exists("lock") {
+		t.Fatal("expected b to release its lock", err)
+	}
+}
+
+// fakeLeases is an API server holding Leases, checking the versions of
+// the updates.
+type fakeLeases struct {
+	mu      sync.Mutex
+	leases  map[string]lease
+	version int
+}
+
+func (fl *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	const prefix = "/apis/coordination.k8s.io/v1/namespaces/ns/leases"
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	var ls lease
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&ls)
+	}
+	cur, ok := fl.leases[name]
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(cur)
+		return
+	case http.MethodPost:
+		name = ls.Metadata.Name
+		if _, ok := fl.leases[name]; ok || ls.Metadata.Namespace != "ns" {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+	case http.MethodPut:
+		if !ok || ls.Metadata.ResourceVersion != cur.Metadata.ResourceVersion {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+	}
+	fl.version++
+	ls.Metadata.ResourceVersion = strconv.Itoa(fl.version)
+	fl.leases[name] = ls
+	json.NewEncoder(w).Encode(ls)
+}
+
+// TestKubeLease verifies the Lease is created, renewed, held against the
+// others until it expires, and released.
+func TestKubeLease(t *testing.T) {
+	fl := &fakeLeases{leases: map[string]lease{}}
+	srv := httptest.NewServer(fl)
+	defer srv.Close()
+
+	token := func() (string, error) { return "tok", nil }
+	now := time.Now()
+	clock := func() time.Time { return now }
+	a := NewKubeLease(srv.Client(), srv.URL, token, "ns", "laff", "a", 10*time.Second)
+	b := NewKubeLease(srv.Client(), srv.URL, token, "ns", "laff", "b", 10*time.Second)
+	a.now, b.now = clock, clock
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		lock *KubeLease
+		exp  bool
+	}{{a, true}, {a, true}, {b, false}} {
+		if ok, err := tc.lock.Acquire(ctx); err != nil || ok != tc.exp {
+			t.Fatal("expected", tc.exp, "for", tc.lock.id, "got:", ok, err)
+		}
+	}
+	now = now.Add(11 * time.Second)
+	if ok, err := b.Acquire(ctx); err != nil || !ok {
+		t.Fatal("expected b to take the expired lease, got:", ok, err)
+	}
+	if ls := fl.leases["laff"]; *ls.Spec.HolderIdentity != "b" || ls.Spec.LeaseTransitions != 1 {
+		t.Fatal("unexpected lease:", ls.Spec)
+	}
+	if ok, _ := a.Acquire(ctx); ok {
+		t.Fatal("expected a to wait for b's term")
+	}
+	if err := b.Release(ctx); err != nil {
+		t.Fatal("error releasing", err)
+	}
+	if ok, err := a.Acquire(ctx); err != nil || !ok {
+		t.Fatal("expected a to take the released lease, got:", ok, err)
+	}
+}
+
+// flakyLock is a lock that fails while asked to.
+type flakyLock struct {
+	mu       sync.Mutex
+	fail     bool
+	released bool
+}
+
+func (fl *flakyLock) Acquire(context.Context) (bool, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.fail {
+		return false, context.DeadlineExceeded
+	}
+	return true, nil
+}
+
+func (fl *flakyLock) Release(context.Context) error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.released = true
+	return nil
+}
+
+// TestElector verifies the elector leads while it holds the lock, steps
+// down when it can't tell, and releases the lock when stopped.
+func TestElector(t *testing.T) {
+	lock := &flakyLock{}
+	e := NewElector(lock, 30*time.Millisecond, logging.NewZap(zap.NewNop().Sugar()))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+
+	waitFor := func(leading bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for e.IsLeader() != leading {
+			if time.Now().After(deadline) {
+				t.Fatal("expected leading:", leading)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(true)
+	lock.mu.Lock()
+	lock.fail = true
+	lock.mu.Unlock()
+	waitFor(false)
+	lock.mu.Lock()
+	lock.fail = false
+	lock.mu.Unlock()
+	waitFor(true)
+
+	cancel()
+	<-done
+	st := e.State()
+	if st.Leader || st.Elected != 2 || st.LastError == "" || !lock.released {
+		t.Fatal("unexpected state:", st, lock.released)
+	}
+}
@@ -0,0 +1,55 @@
+package leader
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// acquireScript takes the lock if it is free, or renews it if it is ours.
+var acquireScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder == false then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+if holder == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseScript frees the lock if it is ours.
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// RedisLock is a lock kept in a Redis key holding the ID of the holder,
+// which expires at the end of the term.
+type RedisLock struct {
+	client *redis.Client
+	key    string
+	id     string
+	term   time.Duration
+}
+
+// NewRedisLock creates a lock in the key, held by the ID for the term.
+func NewRedisLock(client *redis.Client, key, id string, term time.Duration) *RedisLock {
+	return &RedisLock{client: client, key: key, id: id, term: term}
+}
+
+// Acquire implements Lock.
+func (rl *RedisLock) Acquire(ctx context.Context) (bool, error) {
+	n, err := acquireScript.Run(ctx, rl.client, []string{rl.key}, rl.id, rl.term.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// Release implements Lock.
+func (rl *RedisLock) Release(ctx context.Context) error {
+	return releaseScript.Run(ctx, rl.client, []string{rl.key}, rl.id).Err()
+}
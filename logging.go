@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Set up the logger, condsidering any env vars.  The logs go to the console
+// unless a log file is configured, in which case the file is rotated when
+// it gets too big, and the old ones are removed when they get too old.
+func initLogging(cfg *serveConfig) (*zap.SugaredLogger, error) {
+	var lg *zap.Logger
+	var err error
+
+	logLevel := cfg.logLevel
+	pdl := strings.ToLower(os.Getenv("LAFF_LOG_LEVEL"))
+	if strings.HasPrefix(pdl, "dev") {
+		logLevel = "development"
+	} else if strings.HasPrefix(logLevel, "dev") {
+		logLevel = "development"
+	} else {
+		logLevel = "production"
+	}
+
+	var zcfg zap.Config
+	if logLevel == "development" {
+		zcfg = zap.NewDevelopmentConfig()
+	} else {
+		zcfg = zap.NewProductionConfig()
+	}
+	zcfg.DisableStacktrace = true
+	if cfg.logFile == "" {
+		lg, err = zcfg.Build()
+		if err != nil {
+			return nil, err
+		}
+		return lg.Sugar(), nil
+	}
+
+	var ws zapcore.WriteSyncer = zapcore.AddSync(&lumberjack.Logger{
+		Filename:   cfg.logFile,
+		MaxSize:    cfg.logSize,
+		MaxAge:     cfg.logAge,
+		MaxBackups: cfg.logFiles,
+		LocalTime:  true,
+	})
+	if cfg.logBoth {
+		ws = zapcore.NewMultiWriteSyncer(ws, zapcore.Lock(os.Stdout))
+	}
+	enc := zapcore.NewJSONEncoder(zcfg.EncoderConfig)
+	if zcfg.Encoding == "console" {
+		enc = zapcore.NewConsoleEncoder(zcfg.EncoderConfig)
+	}
+	opts := []zap.Option{zap.AddCaller(), zap.ErrorOutput(zapcore.Lock(os.Stderr))}
+	if zcfg.Development {
+		opts = append(opts, zap.Development())
+	}
+	lg = zap.New(zapcore.NewCore(enc, ws, zcfg.Level), opts...)
+	return lg.Sugar(), nil
+}
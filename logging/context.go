@@ -0,0 +1,21 @@
+package logging
+
+import "context"
+
+// loggerKey is the context key for the logger of a request.
+type loggerKey struct{}
+
+// NewContext returns a context carrying the logger, so the code a request
+// or worker runs logs with its fields, such as the request ID, see
+// FromContext.
+func NewContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger in the context, or l if it has none.
+func FromContext(ctx context.Context, l Logger) Logger {
+	if cl, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return cl
+	}
+	return l
+}
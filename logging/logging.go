@@ -0,0 +1,79 @@
+// Package logging defines the small structured logging interface used by
+// the laff packages, so code embedding them can bring its own logger.
+// Adapters are provided for zap and the standard library's log/slog.
+package logging
+
+import (
+	"context"
+	"log/slog"
+
+	"go.uber.org/zap"
+)
+
+// Logger is a leveled, structured logger.  Each method takes a message
+// followed by alternating keys and values.
+type Logger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+
+	// With returns a logger that adds the keys and values to every entry.
+	With(keysAndValues ...interface{}) Logger
+}
+
+// zapLogger adapts a zap sugared logger, which already has the methods
+// apart from With.
+type zapLogger struct {
+	*zap.SugaredLogger
+}
+
+// NewZap returns a Logger that writes to the zap logger.
+func NewZap(l *zap.SugaredLogger) Logger {
+	return zapLogger{l}
+}
+
+// With implements Logger.
+func (z zapLogger) With(keysAndValues ...interface{}) Logger {
+	return zapLogger{z.SugaredLogger.With(keysAndValues...)}
+}
+
+// slogLogger adapts a log/slog logger.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlog returns a Logger that writes to the slog logger.
+func NewSlog(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+// Debugw implements Logger.
+func (s slogLogger) Debugw(msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelDebug, msg, keysAndValues...)
+}
+
+// Infow implements Logger.
+func (s slogLogger) Infow(msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelInfo, msg, keysAndValues...)
+}
+
+// Warnw implements Logger.
+func (s slogLogger) Warnw(msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelWarn, msg, keysAndValues...)
+}
+
+// Errorw implements Logger.
+func (s slogLogger) Errorw(msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelError, msg, keysAndValues...)
+}
+
+// With implements Logger.
+func (s slogLogger) With(keysAndValues ...interface{}) Logger {
+	return slogLogger{s.l.With(keysAndValues...)}
+}
+
+// Nop returns a Logger that discards everything.
+func Nop() Logger {
+	return zapLogger{zap.NewNop().Sugar()}
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestSlog verifies the slog adapter passes through the level, message and
+// fields.
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	log := NewSlog(slog.New(h)).With("component", "test")
+	log.Warnw("careful", "count", 3)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal("error unmarshaling log entry", err)
+	}
+	if entry["level"] != "WARN" || entry["msg"] != "careful" ||
+		entry["component"] != "test" || entry["count"] != float64(3) {
+		t.Fatalf("unexpected log entry: %v", entry)
+	}
+}
+
+// TestZap verifies the zap adapter passes through the level, message and
+// fields.
+func TestZap(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	log := NewZap(zap.New(core).Sugar()).With("component", "test")
+	log.Errorw("broken", "count", 3)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatal("expected 1 entry, got:", len(entries))
+	}
+	e := entries[0]
+	fields := e.ContextMap()
+	if e.Level != zapcore.ErrorLevel || e.Message != "broken" ||
+		fields["component"] != "test" || fields["count"] != int64(3) {
+		t.Fatalf("unexpected log entry: %+v", e)
+	}
+}
+
+// TestContext verifies the logger of a context is found, with its fields,
+// and the fallback is used without one.
+func TestContext(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	base := NewZap(zap.New(core).Sugar())
+	ctx := NewContext(context.Background(), base.With("requestID", "r1"))
+	FromContext(ctx, Nop()).Infow("in request")
+	FromContext(context.Background(), base).Infow("outside")
+
+	entries := logs.All()
+	if len(entries) != 2 || entries[0].ContextMap()["requestID"] != "r1" ||
+		entries[1].ContextMap()["requestID"] != nil {
+		t.Fatalf("unexpected log entries: %v", entries)
+	}
+}
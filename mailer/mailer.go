@@ -0,0 +1,271 @@
+// Package mailer emails a joke of the day to a list of recipients over
+// SMTP, with a plain text and an HTML body made from templates.  Each
+// recipient gets a message of their own, so they don't see the others,
+// and the delivery to each is logged.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+	pkgerr "github.com/pkg/errors"
+)
+
+// DefaultText is the template of the plain text body.
+const DefaultText = `Your joke of the day, {{.Date}}:
+
+{{.Joke}}
+`
+
+// DefaultHTML is the template of the HTML body.
+const DefaultHTML = `<!DOCTYPE html>
+<html>
+<body>
+<p>Your joke of the day, {{.Date}}:</p>
+<blockquote>{{.Joke}}</blockquote>
+</body>
+</html>
+`
+
+// dateLayout is the layout of the date the templates are given.
+const dateLayout = "Monday, January 2, 2006"
+
+// Source gives the joke to send.  It is implemented by the laff service,
+// and by its joke of the day, see service.LaffService.Daily.
+type Source interface {
+	Joke(ctx context.Context) (service.Joke, error)
+}
+
+// Config holds the settings of the emails.
+type Config struct {
+	Addr     string   // host:port of the SMTP server
+	Username string   // to authenticate with, none if empty
+	Password string   // of the user
+	From     string   // address the emails are sent from
+	To       []string // addresses the emails are sent to
+	Subject  string   // of the emails
+	Text     string   // template of the plain text body, DefaultText if empty
+	HTML     string   // template of the HTML body, DefaultHTML if empty
+}
+
+// Data is what the templates are given.
+type Data struct {
+	ID         int
+	Joke       string
+	Names      []string // of the people in the joke, in order
+	Categories []string
+	Date       string // the day the joke is for, such as Monday, January 2, 2006
+}
+
+// Mailer sends the joke of the day.
+type Mailer struct {
+	src  Source
+	cfg  Config
+	auth smtp.Auth
+	text *template.Template
+	html *htmltemplate.Template
+	log  logging.Logger
+	now  func() time.Time
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// New creates a mailer of the source's jokes.  The addresses and templates
+// are checked here, so a mistake in them stops laff starting rather than
+// losing the first email.
+func New(src Source, cfg Config, log logging.Logger) (*Mailer, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "SMTP server")
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return nil, pkgerr.Wrapf(err, "from address %q", cfg.From)
+	}
+	if len(cfg.To) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	for _, to := range cfg.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return nil, pkgerr.Wrapf(err, "recipient %q", to)
+		}
+	}
+	if cfg.Text == "" {
+		cfg.Text = DefaultText
+	}
+	if cfg.HTML == "" {
+		cfg.HTML = DefaultHTML
+	}
+	m := &Mailer{src: src, cfg: cfg, log: log, now: time.Now, send: smtp.SendMail}
+	if m.text, err = template.New("text").Parse(cfg.Text); err != nil {
+		return nil, pkgerr.Wrap(err, "text template")
+	}
+	if m.html, err = htmltemplate.New("html").Parse(cfg.HTML); err != nil {
+		return nil, pkgerr.Wrap(err, "HTML template")
+	}
+	// PlainAuth only sends the password over TLS, or to localhost.
+	if cfg.Username != "" {
+		m.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	return m, nil
+}
+
+// Send emails a joke to each of the recipients.  The deliveries are
+// logged, and the error is that of each failed, the others still being
+// sent.
+func (m *Mailer) Send(ctx context.Context) error {
+	jk, err := m.src.Joke(ctx)
+	if err != nil {
+		return pkgerr.Wrap(err, "getting the joke")
+	}
+	data := Data{
+		ID:         jk.ID,
+		Joke:       jk.Text,
+		Names:      jokeNames(jk),
+		Categories: jk.Categories,
+		Date:       m.now().UTC().Format(dateLayout),
+	}
+	var text, html bytes.Buffer
+	if err := m.text.Execute(&text, data); err != nil {
+		return pkgerr.Wrap(err, "text template")
+	}
+	if err := m.html.Execute(&html, data); err != nil {
+		return pkgerr.Wrap(err, "HTML template")
+	}
+
+	var errs []error
+	sent := 0
+	for _, to := range m.cfg.To {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		msg, err := m.message(to, text.Bytes(), html.Bytes())
+		if err == nil {
+			err = m.send(m.cfg.Addr, m.auth, m.cfg.From, []string{to}, msg)
+		}
+		if err != nil {
+			m.log.Errorw("Error delivering the joke of the day", "to", to, "jokeID", jk.ID, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", to, err))
+			continue
+		}
+		m.log.Infow("Delivered the joke of the day", "to", to, "jokeID", jk.ID)
+		sent++
+	}
+	m.log.Infow("Finished sending the joke of the day", "jokeID", jk.ID, "sent", sent, "failed", len(m.cfg.To)-sent)
+	return errors.Join(errs...)
+}
+
+// message builds the email to the recipient, with the bodies as the
+// alternatives of a multipart message.
+func (m *Mailer) message(to string, text, html []byte) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		typ  string
+		body []byte
+	}{{"text/plain", text}, {"text/html", html}} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.typ + "; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write(part.body); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", m.cfg.From},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("UTF-8", m.cfg.Subject)},
+		{"Date", m.now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	} {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// jokeNames returns the full names of the people in the joke, in order.
+func jokeNames(jk service.Joke) []string {
+	var names []string
+	for _, n := range []*service.NameResp{&jk.Name, jk.Second} {
+		if n == nil {
+			continue
+		}
+		if name := strings.TrimSpace(n.Name + " " + n.Surname); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ParseTime reads the time of day the joke is sent at, in UTC, such as
+// 08:00, as the time since midnight.
+func ParseTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as 08:00", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// next returns when the joke is next sent after now, at the time of day.
+func next(now time.Time, at time.Duration) time.Time {
+	now = now.UTC()
+	t := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(at)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// Run sends the joke each day at the time of day, in UTC, until the
+// context is done.  With replicas, only the leader sends it, if leading
+// is given, so the recipients get one email a day rather than one from
+// each.  The errors are logged, and the next day's joke sent on time.
+func (m *Mailer) Run(ctx context.Context, at time.Duration, leading func() bool) {
+	for {
+		t := time.NewTimer(next(m.now(), at).Sub(m.now()))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if leading != nil && !leading() {
+			m.log.Infow("Not sending the joke of the day, another replica leads")
+			continue
+		}
+		if err := m.Send(ctx); err != nil && ctx.Err() == nil {
+			m.log.Errorw("Error sending the joke of the day", "error", err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+	"go.uber.org/zap"
+)
+
+// fakeSource gives the same joke each time.
+type fakeSource struct {
+	joke service.Joke
+	err  error
+}
+
+func (fs fakeSource) Joke(ctx context.Context) (service.Joke, error) {
+	return fs.joke, fs.err
+}
+
+// TestSend emails the joke to each recipient on their own, with both
+// bodies, carrying on past a recipient that fails.
+func TestSend(t *testing.T) {
+	src := fakeSource{joke: service.Joke{
+		ID:   7,
+		Text: "Ann Lee can divide by zero & <b>back</b>.",
+		Name: service.NameResp{Name: "Ann", Surname: "Lee"},
+	}}
+	m, err := New(src, Config{
+		Addr:    "smtp.example.com:587",
+		From:    "laff@example.com",
+		To:      []string{"ann@example.com", "bad@example.com", "bob@example.com"},
+		Subject: "Your joke of the day",
+		Text:    "{{.Joke}} ({{index .Names 0}}, {{.Date}})",
+	}, logging.NewZap(zap.NewNop().Sugar()))
+	if err != nil {
+		t.Fatal("error creating mailer", err)
+	}
+	m.now = func() time.Time { return time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC) }
+	sent := map[string][]byte{}
+	m.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		if addr != "smtp.example.com:587" || from != "laff@example.com" || len(to) != 1 {
+			t.Fatal("unexpected send:", addr, from, to)
+		}
+		if to[0] == "bad@example.com" {
+			return errors.New("550 no such user")
+		}
+		sent[to[0]] = msg
+		return nil
+	}
+
+	err = m.Send(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "bad@example.com") {
+		t.Fatal("expected the failed recipient's error, got:", err)
+	}
+	if len(sent) != 2 {
+		t.Fatal("unexpected recipients:", len(sent))
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(sent["bob@example.com"]))
+	if err != nil {
+		t.Fatal("error reading message", err)
+	}
+	if to := msg.Header.Get("To"); to != "bob@example.com" {
+		t.Fatal("unexpected To:", to)
+	}
+	typ, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || typ != "multipart/alternative" {
+		t.Fatal("unexpected Content-Type:", typ, err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	want := []struct{ typ, body string }{
+		{"text/plain; charset=UTF-8", "Ann Lee can divide by zero & <b>back</b>. (Ann Lee, Saturday, October 17, 2026)"},
+		{"text/html; charset=UTF-8", "<blockquote>Ann Lee can divide by zero &amp; &lt;b&gt;back&lt;/b&gt;.</blockquote>"},
+	}
+	for _, w := range want {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal("error reading part", err)
+		}
+		b, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Type") != w.typ || !strings.Contains(string(b), w.body) {
+			t.Fatalf("unexpected %s part: %s", p.Header.Get("Content-Type"), b)
+		}
+	}
+
+	// No joke, no emails.
+	m.src = fakeSource{err: errors.New("no joke")}
+	sent = map[string][]byte{}
+	if err := m.Send(context.Background()); err == nil || len(sent) != 0 {
+		t.Fatal("expected an error and no emails, got:", err, len(sent))
+	}
+}
+
+// TestNew rejects the settings that couldn't send an email.
+func TestNew(t *testing.T) {
+	log := logging.NewZap(zap.NewNop().Sugar())
+	good := Config{Addr: "localhost:25", From: "laff@example.com", To: []string{"ann@example.com"}}
+	if _, err := New(fakeSource{}, good, log); err != nil {
+		t.Fatal("error creating mailer", err)
+	}
+	for name, change := range map[string]func(*Config){
+		"no port":       func(c *Config) { c.Addr = "localhost" },
+		"bad from":      func(c *Config) { c.From = "laff" },
+		"no recipients": func(c *Config) { c.To = nil },
+		"bad recipient": func(c *Config) { c.To = []string{"ann@example.com", "bob"} },
+		"bad template":  func(c *Config) { c.HTML = "{{.Joke" },
+	} {
+		cfg := good
+		change(&cfg)
+		if _, err := New(fakeSource{}, cfg, log); err == nil {
+			t.Errorf("expected error for %s", name)
+		}
+	}
+}
+
+// TestNext finds the next time the joke is sent, today or tomorrow.
+func TestNext(t *testing.T) {
+	at, err := ParseTime("08:30")
+	if err != nil {
+		t.Fatal("error parsing time", err)
+	}
+	for _, tc := range []struct{ now, want time.Time }{
+		{time.Date(2026, 10, 17, 6, 0, 0, 0, time.UTC), time.Date(2026, 10, 17, 8, 30, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 17, 8, 30, 0, 0, time.UTC), time.Date(2026, 10, 18, 8, 30, 0, 0, time.UTC)},
+		{time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 8, 30, 0, 0, time.UTC)},
+	} {
+		if got := next(tc.now, at); !got.Equal(tc.want) {
+			t.Errorf("next after %v: got %v, want %v", tc.now, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "8", "25:00", "8am"} {
+		if _, err := ParseTime(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// profiler writes pprof CPU and heap profiles to files.  The CPU profile
+// runs from startup until shutdown, and the heap profile is written at
+// shutdown.  SIGUSR2 writes both out part way through: the CPU profile so
+// far is finished and a new one started, and the heap profile is written.
+// Those files get a sequence number appended to their names.
+type profiler struct {
+	cpuPath string
+	memPath string
+	log     *zap.SugaredLogger
+
+	mu      sync.Mutex
+	cpuFile *os.File
+	seq     int
+}
+
+// startProfiling starts the CPU profile if there is a path for it.
+func startProfiling(cpuPath, memPath string, log *zap.SugaredLogger) (*profiler, error) {
+	p := &profiler{cpuPath: cpuPath, memPath: memPath, log: log}
+	if cpuPath == "" {
+		return p, nil
+	}
+	if err := p.startCPU(cpuPath); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// startCPU starts a CPU profile in the file.  The caller must hold the lock
+// unless the profiler is still being created.
+func (p *profiler) startCPU(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	p.cpuFile = f
+	return nil
+}
+
+// stopCPU finishes the running CPU profile, if any.  The caller must hold
+// the lock.
+func (p *profiler) stopCPU() error {
+	if p.cpuFile == nil {
+		return nil
+	}
+	pprof.StopCPUProfile()
+	err := p.cpuFile.Close()
+	p.cpuFile = nil
+	return err
+}
+
+// writeHeap writes a heap profile to the file.
+func writeHeap(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Get up-to-date statistics.
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// snapshotOnSignal writes the profiles each time we get SIGUSR2, until the
+// context is done.
+func (p *profiler) snapshotOnSignal(ctx context.Context) {
+	if p.cpuPath == "" && p.memPath == "" {
+		return
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+			if err := p.snapshot(); err != nil {
+				p.log.Errorw("Error writing profiles", "error", err)
+			}
+		}
+	}
+}
+
+// snapshot writes out the profiles with the next sequence number.
+func (p *profiler) snapshot() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.seq++
+	if p.cpuFile != nil {
+		name := p.cpuFile.Name()
+		if err := p.stopCPU(); err != nil {
+			return err
+		}
+		p.log.Infow("Wrote CPU profile", "file", name)
+		if err := p.startCPU(fmt.Sprintf("%s.%d", p.cpuPath, p.seq)); err != nil {
+			return err
+		}
+	}
+	if p.memPath != "" {
+		name := fmt.Sprintf("%s.%d", p.memPath, p.seq)
+		if err := writeHeap(name); err != nil {
+			return err
+		}
+		p.log.Infow("Wrote heap profile", "file", name)
+	}
+	return nil
+}
+
+// Shutdown finishes the CPU profile and writes the heap profile.
+func (p *profiler) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.stopCPU(); err != nil {
+		return err
+	}
+	if p.memPath != "" {
+		return writeHeap(p.memPath)
+	}
+	return nil
+}
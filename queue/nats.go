@@ -0,0 +1,135 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/nats-io/nats.go"
+	pkgerr "github.com/pkg/errors"
+)
+
+// NATSConfig holds the settings for a NATS worker.
+type NATSConfig struct {
+	URL         string        // NATS server
+	Subject     string        // subject the requests arrive on
+	Group       string        // queue group, so each request goes to one replica
+	ReplyTo     string        // subject for replies to requests without a reply subject
+	Concurrency int           // requests handled at once
+	Timeout     time.Duration // limit on getting each joke
+}
+
+// NATSWorker takes joke requests from a NATS subject.  The reply goes to
+// the request's reply subject, so callers can use NATS request-reply, or
+// otherwise to the configured reply subject.
+type NATSWorker struct {
+	cfg  NATSConfig
+	src  JokeSource
+	log  logging.Logger
+	conn *nats.Conn
+	sub  *nats.Subscription
+	msgs chan *nats.Msg
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewNATSWorker connects to the NATS server.  Call Run to start taking
+// requests.
+func NewNATSWorker(cfg NATSConfig, src JokeSource, log logging.Logger) (*NATSWorker, error) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	conn, err := nats.Connect(cfg.URL, nats.Name("laff-worker"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "connecting to NATS")
+	}
+	return &NATSWorker{
+		cfg:  cfg,
+		src:  src,
+		log:  log,
+		conn: conn,
+		msgs: make(chan *nats.Msg, cfg.Concurrency),
+		stop: make(chan struct{}),
+	}, nil
+}
+
+// Run subscribes to the request subject and starts the goroutines that
+// handle the requests.  They run until Shutdown, or the context is done.
+func (nw *NATSWorker) Run(ctx context.Context) error {
+	sub, err := nw.conn.ChanQueueSubscribe(nw.cfg.Subject, nw.cfg.Group, nw.msgs)
+	if err != nil {
+		return pkgerr.Wrap(err, "subscribing to requests")
+	}
+	nw.sub = sub
+
+	for i := 0; i < nw.cfg.Concurrency; i++ {
+		nw.wg.Add(1)
+		go func() {
+			defer nw.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-nw.stop:
+					nw.drain(ctx)
+					return
+				case msg := <-nw.msgs:
+					nw.reply(msg, handle(ctx, nw.src, nw.cfg.Timeout, msg.Data, nw.log))
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// drain answers the requests already received when we stop.
+func (nw *NATSWorker) drain(ctx context.Context) {
+	for {
+		select {
+		case msg := <-nw.msgs:
+			nw.reply(msg, handle(ctx, nw.src, nw.cfg.Timeout, msg.Data, nw.log))
+		default:
+			return
+		}
+	}
+}
+
+// reply sends the reply for a request.
+func (nw *NATSWorker) reply(msg *nats.Msg, rep []byte) {
+	subject := msg.Reply
+	if subject == "" {
+		subject = nw.cfg.ReplyTo
+	}
+	if subject == "" {
+		nw.log.Warnw("no reply subject for joke request", "subject", msg.Subject)
+		return
+	}
+	if err := nw.conn.Publish(subject, rep); err != nil {
+		nw.log.Errorw("error replying to joke request", "error", err)
+	}
+}
+
+// Shutdown stops taking requests, and waits for the ones in progress to
+// be answered, or for the context to be done.
+func (nw *NATSWorker) Shutdown(ctx context.Context) error {
+	defer nw.conn.Close()
+	if nw.sub != nil {
+		if err := nw.sub.Unsubscribe(); err != nil {
+			return err
+		}
+	}
+	close(nw.stop)
+
+	done := make(chan struct{})
+	go func() {
+		nw.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nw.conn.Flush()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
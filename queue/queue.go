@@ -0,0 +1,103 @@
+// Package queue serves jokes to callers that ask for them over a message
+// queue, for the integrations that can't make a synchronous HTTP call.
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+)
+
+// JokeSource is where the jokes come from, normally the LaffService.
+type JokeSource interface {
+	Joke(ctx context.Context) (service.Joke, error)
+}
+
+// Request is the (optional) body of a joke request.  The request ID is
+// echoed in the reply, so the caller can match them up.
+type Request struct {
+	RequestID string `json:"requestId,omitempty"`
+
+	// MaxLength limits the joke to that many characters, if set, see
+	// service.MaxLength.
+	MaxLength int `json:"maxLength,omitempty"`
+}
+
+// Reply is sent back for each joke request.  On failure, Error is set
+// instead of the joke.
+type Reply struct {
+	RequestID string `json:"requestId,omitempty"`
+	JokeID    int    `json:"jokeId,omitempty"`
+	Text      string `json:"joke,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Second    string `json:"second,omitempty"` // in a joke about two people
+	Error     string `json:"error,omitempty"`
+	RateLimit bool   `json:"rateLimited,omitempty"`
+
+	// RetryAfter is how many seconds to wait before asking again, when
+	// there were no jokes cached and the name service had us waiting.
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// handle gets a joke for one request message and returns the reply.  A
+// body that isn't a valid request is an error, but an empty one is fine.
+// The entries logged getting the joke carry the request's ID, if it has
+// one.
+func handle(ctx context.Context, src JokeSource, timeout time.Duration, data []byte, log logging.Logger) []byte {
+	var req Request
+	var rep Reply
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			rep.Error = "invalid request: " + err.Error()
+			return encode(rep)
+		}
+	}
+	rep.RequestID = req.RequestID
+	if req.MaxLength < 0 {
+		rep.Error = "invalid request: negative maxLength"
+		return encode(rep)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if req.RequestID != "" {
+		ctx = service.WithRequestID(ctx, req.RequestID)
+		ctx = logging.NewContext(ctx, log.With("requestID", req.RequestID))
+	}
+	if req.MaxLength > 0 {
+		ctx = service.MaxLength(ctx, req.MaxLength)
+	}
+	jk, err := src.Joke(ctx)
+	if err != nil {
+		rep.Error = err.Error()
+		_, rep.RateLimit = err.(service.RateLimitError)
+		var cu service.CacheUnavailable
+		var boe service.BreakerOpenError
+		switch {
+		case errors.As(err, &cu):
+			rep.RateLimit = true
+			rep.RetryAfter = int((cu.Retry + time.Second - 1) / time.Second)
+		case errors.As(err, &boe):
+			rep.RateLimit = true
+			rep.RetryAfter = int((boe.Retry + time.Second - 1) / time.Second)
+		}
+		return encode(rep)
+	}
+	rep.JokeID = jk.ID
+	rep.Text = jk.Text
+	rep.Name = jk.Name.Name + " " + jk.Name.Surname
+	if jk.Second != nil {
+		rep.Second = jk.Second.Name + " " + jk.Second.Surname
+	}
+	return encode(rep)
+}
+
+// encode marshals a reply.  A Reply always marshals, so there is no error.
+func encode(rep Reply) []byte {
+	b, _ := json.Marshal(rep)
+	return b
+}
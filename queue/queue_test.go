@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/service"
+)
+
+// TestHandle verifies the replies for good and bad requests.
+func TestHandle(t *testing.T) {
+	src := &fakeSource{}
+	ctx := context.Background()
+
+	var rep Reply
+	decode(t, handle(ctx, src, time.Second, []byte(`{"requestId":"r1"}`), logging.Nop()), &rep)
+	exp := Reply{RequestID: "r1", JokeID: 7, Text: "Ann Lee made a joke", Name: "Ann Lee"}
+	if rep != exp {
+		t.Fatalf("expected reply: %+v, got: %+v", exp, rep)
+	}
+
+	rep = Reply{}
+	decode(t, handle(ctx, src, time.Second, nil, logging.Nop()), &rep)
+	if rep.JokeID != 7 || rep.RequestID != "" {
+		t.Fatalf("expected joke for empty request, got: %+v", rep)
+	}
+
+	rep = Reply{}
+	decode(t, handle(ctx, src, time.Second, []byte("nope"), logging.Nop()), &rep)
+	if rep.Error == "" || rep.JokeID != 0 {
+		t.Fatalf("expected error for bad request, got: %+v", rep)
+	}
+
+	rep = Reply{}
+	decode(t, handle(ctx, src, time.Second, []byte(`{"requestId":"r3","maxLength":-1}`), logging.Nop()), &rep)
+	if rep.Error == "" || rep.JokeID != 0 || rep.RequestID != "r3" {
+		t.Fatalf("expected error for negative maxLength, got: %+v", rep)
+	}
+
+	src.err = errors.New("upstream down")
+	rep = Reply{}
+	decode(t, handle(ctx, src, time.Second, []byte(`{"requestId":"r2"}`), logging.Nop()), &rep)
+	if rep.Error != "upstream down" || rep.RequestID != "r2" || rep.RateLimit {
+		t.Fatalf("expected upstream error, got: %+v", rep)
+	}
+
+	src.err = service.CacheUnavailable{Retry: 1500 * time.Millisecond}
+	rep = Reply{}
+	decode(t, handle(ctx, src, time.Second, nil, logging.Nop()), &rep)
+	if !rep.RateLimit || rep.RetryAfter != 2 {
+		t.Fatalf("expected to retry in 2 seconds, got: %+v", rep)
+	}
+}
+
+// fakeSource returns the same joke every time, or its error.
+type fakeSource struct {
+	err error
+}
+
+func (fs *fakeSource) Joke(ctx context.Context) (service.Joke, error) {
+	if fs.err != nil {
+		return service.Joke{}, fs.err
+	}
+	return service.Joke{
+		ID:   7,
+		Text: "Ann Lee made a joke",
+		Name: service.NameResp{Name: "Ann", Surname: "Lee"},
+	}, nil
+}
+
+func decode(t *testing.T, b []byte, rep *Reply) {
+	t.Helper()
+	if err := json.Unmarshal(b, rep); err != nil {
+		t.Fatal("error decoding reply", err)
+	}
+}
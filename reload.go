@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// reloader is something that can reread its configuration while we run.
+type reloader struct {
+	name   string
+	reload func() error
+}
+
+// reloadOnSignal reloads each of the reloaders every time we get SIGHUP,
+// until the context is done.  A failed reload is logged, and the old
+// settings stay in effect.
+func reloadOnSignal(ctx context.Context, log *zap.SugaredLogger, reloaders ...reloader) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+			for _, r := range reloaders {
+				if err := r.reload(); err != nil {
+					log.Errorw("Error reloading", "what", r.name, "error", err)
+					continue
+				}
+				log.Infow("Reloaded", "what", r.name)
+			}
+		}
+	}
+}
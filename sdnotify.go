@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/systemd"
+	"go.uber.org/zap"
+)
+
+// superviseSystemd tells systemd we are ready once the cache has warmed up,
+// and keeps the watchdog fed until the context is done.  When not run by
+// systemd, the notifications are simply dropped.
+func superviseSystemd(ctx context.Context, svc *service.LaffService, log *zap.SugaredLogger) {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Errorw("Invalid systemd watchdog setting", "error", err)
+	}
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	warm := svc.Warm()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-warm:
+			warm = nil
+			if sent, err := systemd.Notify(systemd.Ready); err != nil {
+				log.Errorw("Error notifying systemd", "error", err)
+			} else if sent {
+				log.Infow("Notified systemd we are ready")
+			}
+		case <-tick:
+			if _, err := systemd.Notify(systemd.Watchdog); err != nil {
+				log.Errorw("Error pinging systemd watchdog", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/gdotgordon/laff/api"
+	"github.com/gdotgordon/laff/secrets"
+	"go.uber.org/zap"
+)
+
+// serviceAccountToken is the pod's service account token, which Vault's
+// Kubernetes auth method takes.
+const serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// newVault creates the Vault client configured, logged in, or nil if none
+// is.  The address and token default to Vault's own environment
+// variables.
+func newVault(ctx context.Context, cfg *serveConfig) (*secrets.Vault, error) {
+	addr, token := cfg.vaultAddr, cfg.vaultTok
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if addr == "" {
+		if cfg.vaultRefs != "" {
+			return nil, fmt.Errorf("vault-secrets needs vault-addr or VAULT_ADDR")
+		}
+		return nil, nil
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	var v *secrets.Vault
+	switch {
+	case cfg.vaultRole != "":
+		v = secrets.NewVaultKubernetes(client, addr, cfg.vaultAuth, cfg.vaultRole, func() (string, error) {
+			b, err := os.ReadFile(serviceAccountToken)
+			return strings.TrimSpace(string(b)), err
+		})
+	case token != "":
+		v = secrets.NewVault(client, addr, token)
+	default:
+		return nil, fmt.Errorf("Vault needs vault-token, VAULT_TOKEN or vault-role")
+	}
+	if err := v.Login(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// loadAWSConfig loads the AWS config by the usual chain, from the
+// environment, the shared config files and the task or instance role, in
+// the region if one is given.
+func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	ac, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("loading the AWS config: %v", err)
+	}
+	return ac, nil
+}
+
+// secretLoader reads the settings kept in Vault and AWS, at startup and
+// again on SIGHUP.
+type secretLoader struct {
+	vault *secrets.Vault // nil if there is none
+	reads []secretRead
+	vals  map[string]string // by setting, as last read
+}
+
+// secretRead is the settings read from one of the secrets managers.
+type secretRead struct {
+	src  secrets.Source
+	from string // fromVault or fromAWS
+	refs map[string]string
+}
+
+// loadSecrets sets the settings named in -vault-secrets and -aws-secrets
+// from Vault and AWS, unless they were given by flag or in the
+// environment, ahead of the config file.  It returns the loader, to read
+// them again and to keep the Vault token alive.
+func loadSecrets(ctx context.Context, cfg *serveConfig, fs *flag.FlagSet, sources map[string]string) (*secretLoader, error) {
+	vaultRefs, err := secrets.ParseRefs(cfg.vaultRefs)
+	if err != nil {
+		return nil, fmt.Errorf("vault-secrets: %v", err)
+	}
+	awsRefs, err := secrets.ParseRefs(cfg.awsRefs)
+	if err != nil {
+		return nil, fmt.Errorf("aws-secrets: %v", err)
+	}
+	for name := range awsRefs {
+		if _, ok := vaultRefs[name]; ok {
+			return nil, fmt.Errorf("%s is read from both Vault and AWS", name)
+		}
+	}
+	for _, refs := range []map[string]string{vaultRefs, awsRefs} {
+		for name := range refs {
+			if fs.Lookup(name) == nil || strings.HasPrefix(name, "vault-") ||
+				strings.HasPrefix(name, "aws-") || name == "config" {
+				return nil, fmt.Errorf("%s can't be read from a secrets manager", name)
+			}
+			if sources[name] == fromFlag || sources[name] == fromEnv {
+				delete(refs, name)
+			}
+		}
+	}
+
+	sl := &secretLoader{}
+	if sl.vault, err = newVault(ctx, cfg); err != nil {
+		return nil, err
+	}
+	if sl.vault != nil {
+		sl.reads = append(sl.reads, secretRead{sl.vault, fromVault, vaultRefs})
+	}
+	if cfg.awsRefs != "" {
+		ac, err := loadAWSConfig(ctx, cfg.awsRegion)
+		if err != nil {
+			return nil, err
+		}
+		sl.reads = append(sl.reads, secretRead{secrets.NewAWS(ac), fromAWS, awsRefs})
+	}
+	if sl.vals, err = sl.read(ctx); err != nil {
+		return nil, err
+	}
+	for _, rd := range sl.reads {
+		for name := range rd.refs {
+			if err := fs.Set(name, sl.vals[name]); err != nil {
+				return nil, fmt.Errorf("invalid value from %s for %s: %v", rd.from, name, err)
+			}
+			sources[name] = rd.from
+		}
+	}
+	return sl, nil
+}
+
+// read reads all the settings from their secrets managers.
+func (sl *secretLoader) read(ctx context.Context) (map[string]string, error) {
+	all := make(map[string]string)
+	for _, rd := range sl.reads {
+		vals, err := secrets.Resolve(ctx, rd.src, rd.refs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rd.from, err)
+		}
+		maps.Copy(all, vals)
+	}
+	return all, nil
+}
+
+// reload reads the settings again, returning those that changed.
+func (sl *secretLoader) reload(ctx context.Context) (map[string]string, error) {
+	vals, err := sl.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]string)
+	for name, val := range vals {
+		if val != sl.vals[name] {
+			changed[name] = val
+		}
+	}
+	sl.vals = vals
+	return changed, nil
+}
+
+// reloadSecrets is the SIGHUP reloader of the secrets.  The API keys and
+// admin keys take effect at once, and the other settings that changed on
+// the next restart, which is logged.
+func reloadSecrets(ctx context.Context, sl *secretLoader, cfg *serveConfig, keys *api.KeyRing,
+	log *zap.SugaredLogger) error {
+	changed, err := sl.reload(ctx)
+	if err != nil {
+		return err
+	}
+	apiKeys, adminKeys := cfg.apiKeys, cfg.adminKeys
+	for name, val := range changed {
+		switch name {
+		case "apikeys":
+			apiKeys = val
+		case "admin-keys":
+			adminKeys = val
+		default:
+			log.Warnw("Secret changed, it takes effect on restart", "setting", name)
+		}
+	}
+	if apiKeys == cfg.apiKeys && adminKeys == cfg.adminKeys {
+		return nil
+	}
+	if err := keys.Set(splitList(apiKeys), splitList(adminKeys)); err != nil {
+		return err
+	}
+	cfg.apiKeys, cfg.adminKeys = apiKeys, adminKeys
+	return nil
+}
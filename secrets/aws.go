@@ -0,0 +1,77 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// AWS reads secrets from AWS Secrets Manager and SSM Parameter Store,
+// with the credentials of the AWS config, such as an ECS task role or an
+// EKS service account's IAM role.
+type AWS struct {
+	sm  *secretsmanager.Client
+	ssm *ssm.Client
+}
+
+// NewAWS creates a source reading with the AWS config.
+func NewAWS(cfg aws.Config) *AWS {
+	return &AWS{sm: secretsmanager.NewFromConfig(cfg), ssm: ssm.NewFromConfig(cfg)}
+}
+
+// Read implements Source.  The reference is secretsmanager:, then the
+// name or ARN of the secret, and the key of it after a "#" for a secret
+// holding a JSON object, or ssm:, then the name or ARN of the parameter,
+// which is decrypted if it is a SecureString.
+func (a *AWS) Read(ctx context.Context, ref string) (string, error) {
+	kind, id, _ := strings.Cut(ref, ":")
+	switch kind {
+	case "secretsmanager":
+		return a.readSecret(ctx, id)
+	case "ssm":
+		out, err := a.ssm.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(id),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.ToString(out.Parameter.Value), nil
+	default:
+		return "", fmt.Errorf("invalid AWS secret %q, want secretsmanager:id#key or ssm:name", ref)
+	}
+}
+
+// readSecret reads a Secrets Manager secret, or a key of it.
+func (a *AWS) readSecret(ctx context.Context, ref string) (string, error) {
+	id, key, hasKey := strings.Cut(ref, "#")
+	out, err := a.sm.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+	val := aws.ToString(out.SecretString)
+	if out.SecretString == nil {
+		val = string(out.SecretBinary)
+	}
+	if !hasKey {
+		return val, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(val), &fields); err != nil {
+		return "", fmt.Errorf("the secret %s isn't a JSON object: %v", id, err)
+	}
+	field, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("no key %q in the secret %s", key, id)
+	}
+	s, ok := field.(string)
+	if !ok {
+		return "", fmt.Errorf("key %q of the secret %s isn't a string", key, id)
+	}
+	return s, nil
+}
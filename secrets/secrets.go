@@ -0,0 +1,49 @@
+// Package secrets reads the settings of the laff service kept in a secrets
+// manager, such as HashiCorp Vault or AWS Secrets Manager, so the secrets
+// among them need not be given in the environment or kept on disk.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Source reads secrets by reference, in a form of its own.
+type Source interface {
+	Read(ctx context.Context, ref string) (string, error)
+}
+
+// ParseRefs parses a comma-separated list of setting=reference pairs,
+// naming the source of each setting.
+func ParseRefs(s string) (map[string]string, error) {
+	refs := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, ref, ok := strings.Cut(pair, "=")
+		name, ref = strings.TrimSpace(name), strings.TrimSpace(ref)
+		if !ok || name == "" || ref == "" {
+			return nil, fmt.Errorf("invalid secret %q, want setting=reference", pair)
+		}
+		if _, dup := refs[name]; dup {
+			return nil, fmt.Errorf("setting %s given twice", name)
+		}
+		refs[name] = ref
+	}
+	return refs, nil
+}
+
+// Resolve reads the secret for each setting from the source.
+func Resolve(ctx context.Context, src Source, refs map[string]string) (map[string]string, error) {
+	vals := make(map[string]string, len(refs))
+	for name, ref := range refs {
+		v, err := src.Read(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", name, err)
+		}
+		vals[name] = v
+	}
+	return vals, nil
+}
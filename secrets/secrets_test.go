@@ -0,0 +1,171 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// TestParseRefs verifies the setting=reference pairs are parsed.
+func TestParseRefs(t *testing.T) {
+	refs, err := ParseRefs(" apikeys=secret/data/laff#keys, sign-secret = secret/laff ,")
+	exp := map[string]string{"apikeys": "secret/data/laff#keys", "sign-secret": "secret/laff"}
+	if err != nil || !reflect.DeepEqual(refs, exp) {
+		t.Fatal("expected", exp, "got:", refs, err)
+	}
+	for _, s := range []string{"apikeys", "=secret/laff", "a=x,a=y"} {
+		if _, err := ParseRefs(s); err == nil {
+			t.Fatal("expected an error for", s)
+		}
+	}
+}
+
+// fakeVault serves a KV version 1 and 2 secret, and the token endpoints,
+// to the holders of its token.
+type fakeVault struct {
+	mu     sync.Mutex
+	token  string
+	logins int
+	renews int
+}
+
+func (fv *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	if r.URL.Path == "/v1/auth/kubernetes/login" {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["role"] != "laff" || req["jwt"] != "sa-token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		fv.logins++
+		reply(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": fv.token, "lease_duration": 60, "renewable": fv.logins == 1}})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != fv.token {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/auth/token/lookup-self":
+		reply(map[string]interface{}{"data": map[string]interface{}{"ttl": 0, "renewable": false}})
+	case "/v1/auth/token/renew-self":
+		fv.renews++
+		reply(map[string]interface{}{"auth": map[string]interface{}{"lease_duration": 60, "renewable": false}})
+	case "/v1/secret/data/laff":
+		reply(map[string]interface{}{"data": map[string]interface{}{
+			"data": map[string]interface{}{"apikeys": "k1,k2", "port": 5000}, "metadata": map[string]interface{}{}}})
+	case "/v1/kv/laff":
+		reply(map[string]interface{}{"data": map[string]interface{}{"value": "s3cret"}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TestVault verifies the secrets are read with a token, or after logging
+// in by Kubernetes, and the token is renewed, or a new one logged in for.
+func TestVault(t *testing.T) {
+	fv := &fakeVault{token: "tok"}
+	srv := httptest.NewServer(fv)
+	defer srv.Close()
+	ctx := context.Background()
+
+	v := NewVault(srv.Client(), srv.URL+"/", "tok")
+	if err := v.Login(ctx); err != nil {
+		t.Fatal("error looking up the token", err)
+	}
+	vals, err := Resolve(ctx, v, map[string]string{"apikeys": "secret/data/laff#apikeys", "sign-secret": "kv/laff"})
+	exp := map[string]string{"apikeys": "k1,k2", "sign-secret": "s3cret"}
+	if err != nil || !reflect.DeepEqual(vals, exp) {
+		t.Fatal("expected", exp, "got:", vals, err)
+	}
+	for _, ref := range []string{"secret/data/laff#port", "secret/data/laff#missing", "kv/other"} {
+		if _, err := v.Read(ctx, ref); err == nil {
+			t.Fatal("expected an error reading", ref)
+		}
+	}
+	if err := NewVault(srv.Client(), srv.URL, "bad").Login(ctx); err == nil {
+		t.Fatal("expected a bad token refused")
+	}
+
+	fv.token = "k8s-tok"
+	jwt := func() (string, error) { return "sa-token", nil }
+	kv := NewVaultKubernetes(srv.Client(), srv.URL, "/kubernetes/", "laff", jwt)
+	if err := kv.Login(ctx); err != nil {
+		t.Fatal("error logging in", err)
+	}
+	if s, err := kv.Read(ctx, "kv/laff"); err != nil || s != "s3cret" {
+		t.Fatal("expected the secret, got:", s, err)
+	}
+	// The first token is renewed, and the renewed one can't be, so it is
+	// logged in for again.
+	for i := 0; i < 2; i++ {
+		if err := kv.renew(ctx); err != nil {
+			t.Fatal("error renewing", err)
+		}
+	}
+	if fv.renews != 1 || fv.logins != 2 {
+		t.Fatal("expected a renewal then a login, got:", fv.renews, fv.logins)
+	}
+}
+
+// fakeAWS serves Secrets Manager secrets and SSM parameters, by the AWS
+// JSON protocol.
+func fakeAWS(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&req)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	secrets := map[string]string{"laff": `{"apikeys": "k1,k2", "port": 5000}`, "sign": "s3cret"}
+	params := map[string]string{"/laff/name-token": "tok"}
+	switch target := r.Header.Get("X-Amz-Target"); {
+	case !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256"):
+		w.WriteHeader(http.StatusForbidden)
+		reply(map[string]string{"__type": "AccessDeniedException", "message": "unsigned"})
+	case target == "secretsmanager.GetSecretValue" && secrets[req["SecretId"].(string)] != "":
+		reply(map[string]string{"Name": req["SecretId"].(string), "SecretString": secrets[req["SecretId"].(string)]})
+	case target == "AmazonSSM.GetParameter" && params[req["Name"].(string)] != "" && req["WithDecryption"] == true:
+		reply(map[string]interface{}{"Parameter": map[string]string{"Name": req["Name"].(string),
+			"Type": "SecureString", "Value": params[req["Name"].(string)]}})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		reply(map[string]string{"__type": "ResourceNotFoundException", "message": "not found"})
+	}
+}
+
+// TestAWS verifies the secrets and parameters are read, and the keys of
+// the JSON secrets picked out.
+func TestAWS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeAWS))
+	defer srv.Close()
+	a := NewAWS(aws.Config{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		BaseEndpoint: aws.String(srv.URL),
+		HTTPClient:   srv.Client(),
+	})
+	ctx := context.Background()
+	vals, err := Resolve(ctx, a, map[string]string{"apikeys": "secretsmanager:laff#apikeys",
+		"sign-secret": "secretsmanager:sign", "name-token": "ssm:/laff/name-token"})
+	exp := map[string]string{"apikeys": "k1,k2", "sign-secret": "s3cret", "name-token": "tok"}
+	if err != nil || !reflect.DeepEqual(vals, exp) {
+		t.Fatal("expected", exp, "got:", vals, err)
+	}
+	for _, ref := range []string{"secretsmanager:laff#port", "secretsmanager:laff#missing",
+		"secretsmanager:sign#key", "secretsmanager:other", "ssm:/other", "laff"} {
+		if _, err := a.Read(ctx, ref); err == nil {
+			t.Fatal("expected an error reading", ref)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minRenew is the shortest wait between the renewals of the token, so a
+// token about to expire isn't renewed in a tight loop.
+const minRenew = 5 * time.Second
+
+// Vault reads secrets from HashiCorp Vault, from the KV secrets engine,
+// version 1 or 2.  It authenticates with a token, or logs in with the
+// pod's service account by Vault's Kubernetes auth method, and renews its
+// token while it runs, logging in again once it can't.
+type Vault struct {
+	client *http.Client
+	addr   string
+	login  func(ctx context.Context) (vaultAuth, error) // nil for a given token
+
+	mu        sync.Mutex
+	token     string
+	ttl       time.Duration // 0 if the token doesn't expire
+	renewable bool
+}
+
+// vaultAuth is the auth part of Vault's login and renewal responses.
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// NewVault creates a source reading from the Vault server at addr with
+// the token.
+func NewVault(client *http.Client, addr, token string) *Vault {
+	return &Vault{client: client, addr: strings.TrimSuffix(addr, "/"), token: token}
+}
+
+// NewVaultKubernetes creates a source reading from the Vault server at
+// addr, logging in as the role with the Kubernetes auth method mounted
+// at authPath, with the service account token the function returns.
+func NewVaultKubernetes(client *http.Client, addr, authPath, role string, jwt func() (string, error)) *Vault {
+	v := &Vault{client: client, addr: strings.TrimSuffix(addr, "/")}
+	v.login = func(ctx context.Context) (vaultAuth, error) {
+		token, err := jwt()
+		if err != nil {
+			return vaultAuth{}, err
+		}
+		var resp struct {
+			Auth vaultAuth `json:"auth"`
+		}
+		err = v.call(ctx, http.MethodPost, "/v1/auth/"+strings.Trim(authPath, "/")+"/login",
+			map[string]string{"role": role, "jwt": token}, &resp)
+		return resp.Auth, err
+	}
+	return v
+}
+
+// Login logs in, or with a given token, looks it up to learn when it
+// expires.
+func (v *Vault) Login(ctx context.Context) error {
+	if v.login == nil {
+		var resp struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := v.call(ctx, http.MethodGet, "/v1/auth/token/lookup-self", nil, &resp); err != nil {
+			return fmt.Errorf("looking up the Vault token: %v", err)
+		}
+		v.mu.Lock()
+		v.ttl, v.renewable = time.Duration(resp.Data.TTL)*time.Second, resp.Data.Renewable
+		v.mu.Unlock()
+		return nil
+	}
+	auth, err := v.login(ctx)
+	if err != nil {
+		return fmt.Errorf("logging in to Vault: %v", err)
+	}
+	v.setAuth(auth)
+	return nil
+}
+
+func (v *Vault) setAuth(auth vaultAuth) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if auth.ClientToken != "" {
+		v.token = auth.ClientToken
+	}
+	v.ttl, v.renewable = time.Duration(auth.LeaseDuration)*time.Second, auth.Renewable
+}
+
+// Run renews the token when two thirds of its time to live have passed,
+// until the context is done, logging in again when it can't be renewed.
+// The errors are passed to onError.  A token that doesn't expire is left
+// alone.
+func (v *Vault) Run(ctx context.Context, onError func(error)) {
+	for {
+		v.mu.Lock()
+		ttl := v.ttl
+		v.mu.Unlock()
+		if ttl == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(max(ttl*2/3, minRenew)):
+		}
+		if err := v.renew(ctx); err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+	}
+}
+
+// renew renews the token, or logs in again if it can't be renewed.
+func (v *Vault) renew(ctx context.Context) error {
+	v.mu.Lock()
+	renewable := v.renewable
+	v.mu.Unlock()
+	var err error
+	if renewable {
+		var resp struct {
+			Auth vaultAuth `json:"auth"`
+		}
+		if err = v.call(ctx, http.MethodPost, "/v1/auth/token/renew-self", struct{}{}, &resp); err == nil {
+			v.setAuth(resp.Auth)
+			return nil
+		}
+		err = fmt.Errorf("renewing the Vault token: %v", err)
+	}
+	if v.login == nil {
+		if err == nil {
+			err = errors.New("the Vault token can't be renewed, and will expire")
+		}
+		return err
+	}
+	return v.Login(ctx)
+}
+
+// Read implements Source.  The reference is the path of the secret, such
+// as secret/data/laff for KV version 2, and the field of it after a "#",
+// or "value" if there is none.
+func (v *Vault) Read(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok {
+		field = "value"
+	}
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.call(ctx, http.MethodGet, "/v1/"+strings.Trim(path, "/"), nil, &resp); err != nil {
+		return "", err
+	}
+	data := resp.Data
+	// KV version 2 nests the secret, alongside its metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = inner
+	}
+	val, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("no field %q in the Vault secret %s", field, path)
+	}
+	s, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("field %q of the Vault secret %s isn't a string", field, path)
+	}
+	return s, nil
+}
+
+// call makes a request to the Vault API, decoding the JSON response.
+func (v *Vault) call(ctx context.Context, method, path string, body, res interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+path, rd)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	token := v.token
+	v.mu.Unlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP status %d (%s) from Vault: %s",
+			resp.StatusCode, http.StatusText(resp.StatusCode), bytes.TrimSpace(rb))
+	}
+	return json.Unmarshal(rb, res)
+}
@@ -0,0 +1,913 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gdotgordon/laff/api"
+	"github.com/gdotgordon/laff/backup"
+	"github.com/gdotgordon/laff/catalog"
+	"github.com/gdotgordon/laff/discovery"
+	"github.com/gdotgordon/laff/dynamo"
+	"github.com/gdotgordon/laff/events"
+	"github.com/gdotgordon/laff/filter"
+	"github.com/gdotgordon/laff/gossip"
+	"github.com/gdotgordon/laff/jokefmt"
+	"github.com/gdotgordon/laff/jokepack"
+	"github.com/gdotgordon/laff/laffplugin"
+	"github.com/gdotgordon/laff/leader"
+	"github.com/gdotgordon/laff/logging"
+	"github.com/gdotgordon/laff/mailer"
+	"github.com/gdotgordon/laff/queue"
+	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/sharedlimit"
+	"github.com/gdotgordon/laff/sharednames"
+	"github.com/gdotgordon/laff/store"
+	"github.com/gdotgordon/laff/systemd"
+	"github.com/gdotgordon/laff/tenant"
+	"github.com/gdotgordon/laff/translate"
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// runServe runs the laff service until it is signaled to stop.
+func runServe(args []string) error {
+	var cfg serveConfig
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cfg.register(fs)
+	sources, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// We'll propagate the context with cancel thorughout the program,
+	// to be used by various entities, such as http clients, server
+	// methods we implement, and other loops using channels.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secretsLoader, err := loadSecrets(ctx, &cfg, fs, sources)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%v", err)
+	}
+
+	// Set up logging.
+	log, err := initLogging(&cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating logger: %v", err)
+		os.Exit(1)
+	}
+
+	// Start profiling as early as possible.
+	prof, err := startProfiling(cfg.cpuProf, cfg.memProf, log)
+	if err != nil {
+		log.Errorw("Error starting profiling", "error", err)
+		os.Exit(1)
+	}
+	go prof.snapshotOnSignal(ctx)
+
+	// Keep the Vault token alive while we run.
+	if secretsLoader.vault != nil {
+		go secretsLoader.vault.Run(ctx, func(err error) {
+			log.Errorw("Error renewing the Vault token", "error", err)
+		})
+	}
+
+	// Create the server to handle the IP verify service.  The API module will
+	// set up the routes, as we don't need to know the details in the
+	// main program.
+	muxer := mux.NewRouter()
+
+	// Restore the store from its latest backup if its file is gone, as
+	// with a new container.  Starting empty instead would have the
+	// backups of the empty store push out the good ones.
+	bucket, err := newBackupBucket(ctx, &cfg)
+	if err != nil {
+		log.Errorw("Error setting up the backups", "error", err)
+		os.Exit(1)
+	}
+	if bucket != nil && cfg.restore {
+		if _, err := os.Stat(cfg.dataFile); os.IsNotExist(err) {
+			key, err := backup.Restore(ctx, bucket, cfg.bakPrefix, storeExt(&cfg), cfg.dataFile)
+			if err != nil {
+				log.Errorw("Error restoring the store", "error", err)
+				os.Exit(1)
+			}
+			if key != "" {
+				log.Infow("Restored the store", "backup", key)
+			}
+		}
+	}
+
+	// Open the persistence layer.
+	st, err := newStore(&cfg)
+	if err != nil {
+		log.Errorw("Error opening store", "error", err)
+		os.Exit(1)
+	}
+	defer st.Close()
+	var exporter *backup.Exporter
+	if snap, ok := st.(store.Snapshotter); ok && bucket != nil {
+		exporter = backup.NewExporter(snap, bucket, cfg.bakPrefix, storeExt(&cfg), cfg.bakKeep, logging.NewZap(log))
+		go exporter.Run(ctx, cfg.bakEvery)
+	}
+
+	// Build the service.  With Redis or DynamoDB, the name budget is
+	// shared with the other replicas.  A store that holds jokes is one of
+	// the joke providers, or stands in for the joke service if it holds a
+	// copy of its catalog.
+	opts, err := upstreamOptions(&cfg)
+	if err != nil {
+		log.Errorw("Error configuring upstream services", "error", err)
+		os.Exit(1)
+	}
+	if cfg.chaos {
+		log.Warnw("Injecting faults into the upstream calls, for testing only",
+			"latency", cfg.chaosLat, "latencyPct", cfg.chaosSlow, "429Pct", cfg.chaos429,
+			"5xxPct", cfg.chaos5xx, "malformedPct", cfg.chaosBad)
+	}
+	opts = append(opts, service.WithWarmup(cfg.warmup))
+	if cfg.cacheWait > 0 {
+		opts = append(opts, service.WithCacheWait(cfg.cacheWait))
+	}
+	if cfg.jokeAge > 0 {
+		opts = append(opts, service.WithJokeMaxAge(cfg.jokeAge))
+	}
+	if cfg.cacheMax != 0 {
+		opts = append(opts, service.WithAutoSize(service.AutoSize{
+			Min: cfg.cacheMin, Max: cfg.cacheMax, Window: cfg.cacheWin,
+		}))
+	}
+	if cfg.seed != 0 {
+		opts = append(opts, service.WithSeed(cfg.seed))
+	}
+
+	// The joke providers get the share of the jokes configured for them.
+	weights, _ := parseWeights(cfg.weights)
+	if w, ok := weights[service.JokeServiceName]; ok {
+		opts = append(opts, service.WithJokeServiceWeight(w))
+		delete(weights, service.JokeServiceName)
+	}
+	jokeProvider := func(name string, p service.JokeProvider) service.Option {
+		w, ok := weights[name]
+		if !ok {
+			w = 1
+		}
+		delete(weights, name)
+		return service.WithWeightedJokeProvider(name, w, p)
+	}
+	js, hasJokes := st.(store.JokeStore)
+	switch {
+	case hasJokes && cfg.catalogSync > 0:
+		opts = append(opts, service.WithJokeCatalog(store.NewJokeProvider(js)))
+	case hasJokes:
+		opts = append(opts, jokeProvider("store", store.NewJokeProvider(js)))
+	}
+	var rdb *redis.Client
+	if cfg.redis != "" {
+		rdb = redis.NewClient(&redis.Options{Addr: cfg.redis, Password: cfg.redisPwd})
+		opts = append(opts, service.WithNameLimiter(
+			sharedlimit.NewRedis(rdb, cfg.redisKey, cfg.budget, time.Minute)))
+	}
+	// On AWS, the budget can be shared in DynamoDB instead.
+	var table *dynamo.Table
+	if cfg.dynTable != "" {
+		ac, err := loadAWSConfig(ctx, cfg.dynRegion)
+		if err != nil {
+			log.Errorw("Error setting up DynamoDB", "error", err)
+			os.Exit(1)
+		}
+		table = dynamo.NewTable(ac, cfg.dynTable, cfg.dynURL)
+		opts = append(opts, service.WithNameLimiter(dynamo.NewLimiter(table, cfg.budget, time.Minute)))
+	}
+
+	// Only the elected leader prefetches names, if there is an election,
+	// sharing them with the others through Memcached, DynamoDB or Redis if
+	// asked to.
+	elector, err := newElector(&cfg, rdb, table, logging.NewZap(log))
+	if err != nil {
+		log.Errorw("Error setting up the leader election", "error", err)
+		os.Exit(1)
+	}
+	if elector != nil {
+		var queue service.NameQueue
+		switch {
+		case cfg.nameShare > 0 && cfg.memcached != "":
+			ring, err := sharednames.NewRing(splitList(cfg.memcached)...)
+			if err != nil {
+				log.Errorw("Error setting up Memcached", "error", err)
+				os.Exit(1)
+			}
+			queue = sharednames.NewMemcached(memcache.NewFromSelector(ring), cfg.memcKey, cfg.nameShare, cfg.memcTTL)
+		case cfg.nameShare > 0 && table != nil:
+			queue = dynamo.NewNameQueue(table, cfg.nameShare, cfg.dynTTL)
+		case cfg.nameShare > 0:
+			queue = sharednames.NewRedis(rdb, cfg.redisKey+":shared", cfg.nameShare)
+		}
+		opts = append(opts, service.WithLeader(elector, queue))
+	}
+	if cfg.filter {
+		words := filter.Default()
+		if cfg.words != "" {
+			if words, err = filter.Load(cfg.words); err != nil {
+				log.Errorw("Error loading filter words", "error", err)
+				os.Exit(1)
+			}
+		}
+		log.Infow("Filtering jokes", "words", words.Len())
+		opts = append(opts, service.WithFilter(words))
+	}
+	if cfg.packs != "" {
+		packs, err := jokepack.Load(cfg.packs)
+		if err != nil {
+			log.Errorw("Error loading joke packs", "error", err)
+			os.Exit(1)
+		}
+		log.Infow("Loaded joke packs", "dir", cfg.packs, "jokes", packs.Len())
+		if err := packs.Watch(ctx, logging.NewZap(log)); err != nil {
+			log.Warnw("Joke packs won't be reloaded on changes", "error", err)
+		}
+		opts = append(opts, jokeProvider("packs", packs))
+	}
+	var plugins []*laffplugin.Plugin
+	if cfg.plugins != "" {
+		if plugins, err = laffplugin.Discover(cfg.plugins); err != nil {
+			log.Errorw("Error starting plugins", "error", err)
+			os.Exit(1)
+		}
+		for _, p := range plugins {
+			info := p.Info()
+			log.Infow("Started plugin", "name", info.Name, "path", p.Path(),
+				"names", info.Names, "jokes", info.Jokes)
+			if info.Names {
+				opts = append(opts, service.WithNameProvider(p))
+			}
+			if info.Jokes {
+				opts = append(opts, jokeProvider(info.Name, p))
+			}
+		}
+	}
+	if arms := splitList(cfg.exper); len(arms) == 2 {
+		opts = append(opts, service.WithExperiment(arms[0], arms[1]))
+	}
+	if len(weights) > 0 {
+		log.Errorw("Weights given for unknown joke providers", "weights", weights)
+		os.Exit(1)
+	}
+	svc, err := service.New(cfg.workers, cfg.cache, logging.NewZap(log), opts...)
+	if err != nil {
+		log.Errorw("Error creating service", "error", err)
+		os.Exit(1)
+	}
+	// Warm the cache from the other replicas by gossip, if there are any,
+	// before the cache workers fetch jokes of their own.
+	gossiper, err := newGossiper(ctx, &cfg, svc, logging.NewZap(log))
+	if err != nil {
+		log.Errorw("Error starting the gossip", "error", err)
+		os.Exit(1)
+	}
+	go svc.RunCache(ctx)
+	if gossiper != nil {
+		go gossiper.Run(ctx, 5*time.Second)
+	}
+	electCtx, stopElection := context.WithCancel(ctx)
+	elected := make(chan struct{})
+	if elector != nil {
+		go func() {
+			defer close(elected)
+			elector.Run(electCtx)
+		}()
+	} else {
+		close(elected)
+	}
+	if hasJokes && cfg.catalogSync > 0 {
+		go catalog.Run(ctx, svc, js, cfg.catalogSync, logging.NewZap(log))
+	}
+	if cfg.smtpAddr != "" {
+		m, err := newMailer(&cfg, svc, logging.NewZap(log))
+		if err != nil {
+			log.Errorw("Error setting up the joke of the day emails", "error", err)
+			os.Exit(1)
+		}
+		// With replicas electing a leader, only the leader sends it.
+		var leading func() bool
+		if elector != nil {
+			leading = elector.IsLeader
+		}
+		at, _ := mailer.ParseTime(cfg.mailAt)
+		go m.Run(ctx, at, leading)
+	}
+
+	// Take joke requests from the queue as well as over HTTP.
+	var qw *queue.NATSWorker
+	if cfg.queueURL != "" {
+		qw, err = queue.NewNATSWorker(queue.NATSConfig{
+			URL:         cfg.queueURL,
+			Subject:     cfg.queueSub,
+			Group:       "laff",
+			ReplyTo:     cfg.queueRep,
+			Concurrency: cfg.queueCon,
+			Timeout:     time.Duration(cfg.timeout) * time.Second,
+		}, svc, logging.NewZap(log))
+		if err == nil {
+			err = qw.Run(ctx)
+		}
+		if err != nil {
+			log.Errorw("Error starting queue worker", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Connect the event stream of the served jokes.
+	pub, err := newPublisher(&cfg, log)
+	if err != nil {
+		log.Errorw("Error connecting event publisher", "error", err)
+		os.Exit(1)
+	}
+
+	// Set up the template decorating the jokes.
+	var reloaders []reloader
+	var jf *jokefmt.Formatter
+	switch {
+	case cfg.template != "":
+		jf, err = jokefmt.New(cfg.template)
+	case cfg.tmplFile != "":
+		if jf, err = jokefmt.Load(cfg.tmplFile); err == nil {
+			reloaders = append(reloaders, reloader{"template", jf.Reload})
+		}
+	}
+	if err != nil {
+		log.Errorw("Error in joke template", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize the API layer.
+	ready := &api.Readiness{}
+	rl := api.NewRateLimiter(float64(cfg.limit))
+	if err := rl.Exempt(splitList(cfg.exempt)); err != nil {
+		log.Errorw("Error in the rate limiter allowlist", "error", err)
+		os.Exit(1)
+	}
+	var bans *api.BanList
+	if cfg.banStrike > 0 {
+		bans = api.NewBanList(cfg.banStrike, cfg.banWin, cfg.banCool)
+	}
+	var recent *api.RecentJokes
+	if cfg.noRepeat > 0 {
+		if recent, err = api.NewRecentJokes(cfg.noRepeat); err != nil {
+			log.Errorw("Error setting up the no-repeat sessions", "error", err)
+			os.Exit(1)
+		}
+	}
+	shed := api.NewConcurrencyLimiter(cfg.inFlight)
+	var slow *api.LatencyShedder
+	if cfg.shedP99 > 0 {
+		slow = api.NewLatencyShedder(cfg.shedP99)
+	}
+	slo := api.NewSLOTracker(cfg.sloLat, cfg.sloPct/100)
+	var tenants *tenant.Registry
+	if cfg.tenants != "" {
+		if tenants, err = tenant.Load(cfg.tenants); err != nil {
+			log.Errorw("Error loading tenants", "error", err)
+			os.Exit(1)
+		}
+		log.Infow("Loaded tenants", "file", cfg.tenants, "tenants", tenants.Len())
+	}
+	// The keys may be read again from the secrets managers on SIGHUP.
+	keys := api.NewKeyRing(splitList(cfg.apiKeys), splitList(cfg.adminKeys))
+	if len(secretsLoader.reads) > 0 {
+		reloaders = append(reloaders, reloader{"secrets", func() error {
+			return reloadSecrets(ctx, secretsLoader, &cfg, keys, log)
+		}})
+	}
+	cacheCtl, _ := parseCacheControl(cfg.cacheCtl)
+	apiCfg := api.Config{
+		Ready:      ready,
+		DrainWait:  cfg.drainWait,
+		Limiter:    rl,
+		Shedder:    shed,
+		Slow:       slow,
+		SLO:        slo,
+		Metrics:    api.NewRouteMetrics(),
+		Tenants:    tenants,
+		Bans:       bans,
+		Recent:     recent,
+		CacheCtl:   cacheCtl,
+		Keys:       keys,
+		Quota:      api.Quota{Daily: cfg.quotaDay, Monthly: cfg.quotaMon},
+		SignKey:    []byte(cfg.signKey),
+		Store:      st,
+		MaxBody:    cfg.maxBody,
+		MaxTime:    time.Duration(cfg.timeout) * time.Second,
+		Events:     pub,
+		Translator: newTranslator(&cfg),
+		Formatter:  jf,
+		JokeLink:   cfg.jokeLink,
+		Build: api.BuildInfo{
+			Version:   version,
+			Commit:    commit,
+			BuildDate: buildDate,
+		},
+	}
+	if err := api.Init(ctx, muxer, svc, apiCfg, logging.NewZap(log)); err != nil {
+		log.Errorf("Error initializing API layer", "error", err)
+		os.Exit(1)
+	}
+	if urls := splitList(cfg.alertURLs); len(urls) > 0 {
+		burn, _ := parseBurn(cfg.alertBurn)
+		alerter, err := api.NewBurnAlerter(slo, burn, urls, cfg.alertKey, logging.NewZap(log))
+		if err != nil {
+			log.Errorw("Error setting up the SLO alerts", "error", err)
+			os.Exit(1)
+		}
+		if cfg.signKey != "" {
+			alerter.Sign([]byte(cfg.signKey))
+		}
+		go alerter.Run(ctx)
+	}
+
+	srv := &http.Server{
+		Handler:      muxer,
+		Addr:         fmt.Sprintf(":%d", cfg.portNum),
+		ReadTimeout:  time.Duration(cfg.timeout) * time.Second,
+		WriteTimeout: time.Duration(cfg.timeout) * time.Second,
+	}
+
+	// Start server, on the sockets passed in by systemd if we were socket
+	// activated, otherwise on our own port.
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		log.Errorw("Error using systemd sockets", "error", err)
+		os.Exit(1)
+	}
+	if len(listeners) == 0 {
+		go func() {
+			log.Infow("Listening for connections", "port", cfg.portNum)
+			if err := srv.ListenAndServe(); err != nil {
+				log.Infow("Server completed", "err", err)
+			}
+		}()
+	}
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			log.Infow("Listening for connections on systemd socket", "addr", l.Addr())
+			if err := srv.Serve(l); err != nil {
+				log.Infow("Server completed", "err", err)
+			}
+		}(l)
+	}
+
+	// Register with the service registry, now we can take requests.
+	reg := newRegistrar(&cfg, log)
+	if reg != nil {
+		if err := reg.Register(ctx); err != nil {
+			log.Errorw("Error registering the instance", "error", err)
+			os.Exit(1)
+		}
+	}
+	go superviseSystemd(ctx, svc, log)
+	go dumpStatsOnSignal(ctx, svc, rl, shed, slow, slo, bans, tenants, log)
+	go reloadOnSignal(ctx, log, reloaders...)
+
+	// Block until we shutdown, on a signal or a drain request.  The
+	// instance is deregistered and the readiness check fails first, so we
+	// are taken out of rotation, then the cache workers are stopped before
+	// the server drains the in-flight requests.  The store is backed up
+	// once the requests are done with it.  Cleaning up the connections
+	// and logs comes last, as the earlier steps may still use them.
+	waitForShutdown(ctx, log, ready.Draining(), cfg.drainWait,
+		shutdownStep{"registration", ShutdownFunc(func(ctx context.Context) error {
+			if reg == nil {
+				return nil
+			}
+			return reg.Deregister(ctx)
+		})},
+		shutdownStep{"readiness", ShutdownFunc(func(context.Context) error {
+			ready.Fail()
+			_, err := systemd.Notify(systemd.Stopping)
+			return err
+		})},
+		shutdownStep{"cache", svc},
+		shutdownStep{"leadership", ShutdownFunc(func(ctx context.Context) error {
+			// Hand the prefetching over to another replica.
+			stopElection()
+			select {
+			case <-elected:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})},
+		shutdownStep{"gossip", ShutdownFunc(func(ctx context.Context) error {
+			if gossiper == nil {
+				return nil
+			}
+			return gossiper.Shutdown(ctx)
+		})},
+		shutdownStep{"server", srv},
+		shutdownStep{"queue", ShutdownFunc(func(ctx context.Context) error {
+			if qw == nil {
+				return nil
+			}
+			return qw.Shutdown(ctx)
+		})},
+		shutdownStep{"backup", ShutdownFunc(func(ctx context.Context) error {
+			if exporter == nil {
+				return nil
+			}
+			return exporter.Shutdown(ctx)
+		})},
+		shutdownStep{"events", ShutdownFunc(func(context.Context) error {
+			if pub == nil {
+				return nil
+			}
+			return pub.Close()
+		})},
+		shutdownStep{"plugins", ShutdownFunc(func(context.Context) error {
+			for _, p := range plugins {
+				p.Close()
+			}
+			return nil
+		})},
+		shutdownStep{"profiles", prof},
+		shutdownStep{"connections", ShutdownFunc(func(context.Context) error {
+			svc.CloseIdleConnections()
+			if rdb != nil {
+				return rdb.Close()
+			}
+			return nil
+		})},
+		shutdownStep{"logs", ShutdownFunc(func(context.Context) error {
+			log.Infof("Shutting down")
+			return log.Sync()
+		})},
+	)
+	return nil
+}
+
+// newStore opens the store of the type configured.
+func newStore(cfg *serveConfig) (store.Store, error) {
+	if cfg.storeType == "sqlite" {
+		return store.NewSQLiteStore(cfg.dataFile, cfg.history)
+	}
+	return store.NewFileStore(cfg.dataFile, store.FileOptions{
+		HistorySize:    cfg.history,
+		PersistHistory: cfg.persist,
+	})
+}
+
+// newBackupBucket creates the bucket the store is backed up to, or nil if
+// there is none.
+func newBackupBucket(ctx context.Context, cfg *serveConfig) (*backup.S3, error) {
+	if cfg.bakBucket == "" {
+		return nil, nil
+	}
+	ac, err := loadAWSConfig(ctx, cfg.bakRegion)
+	if err != nil {
+		return nil, err
+	}
+	return backup.NewS3(ac, cfg.bakBucket, cfg.bakURL), nil
+}
+
+// storeExt is the extension of the store's file, which the backups of it
+// are named with.
+func storeExt(cfg *serveConfig) string {
+	if cfg.storeType == "sqlite" {
+		return ".db"
+	}
+	return ".json"
+}
+
+// upstreamOptions configures the service for the upstream name and joke
+// services: where they are, and the headers and credentials they get.
+func upstreamOptions(cfg *serveConfig) ([]service.Option, error) {
+	nameHdrs, _ := parseHeaders(cfg.nameHdrs)
+	jokeHdrs, _ := parseHeaders(cfg.jokeHdrs)
+	nameCred, err := credential(cfg.nameAuth, cfg.nameTok, cfg.nameTokF)
+	if err != nil {
+		return nil, fmt.Errorf("name service token: %w", err)
+	}
+	jokeCred, err := credential(cfg.jokeAuth, cfg.jokeTok, cfg.jokeTokF)
+	if err != nil {
+		return nil, fmt.Errorf("joke service token: %w", err)
+	}
+	nameRate, _ := parseRate(cfg.nameRate, cfg.nameBurst)
+	jokeRate, _ := parseRate(cfg.jokeRate, cfg.jokeBurst)
+	opts := []service.Option{
+		service.WithNameService(service.NameService(cfg.names)),
+		service.WithUserAgent(cfg.agent),
+		service.WithNameHeaders(nameHdrs),
+		service.WithJokeHeaders(jokeHdrs),
+		service.WithNameCredential(nameCred),
+		service.WithJokeCredential(jokeCred),
+		service.WithConcurrency(cfg.nameConc, cfg.jokeConc),
+		service.WithNameRate(nameRate),
+		service.WithJokeRate(jokeRate),
+		service.WithTransportConfig(service.TransportConfig{
+			MaxIdleConns:        cfg.idleConns,
+			MaxIdleConnsPerHost: cfg.idleHost,
+			IdleConnTimeout:     cfg.idleTime,
+			TLSHandshakeTimeout: cfg.tlsTime,
+			HTTP2:               cfg.http2,
+		}),
+		service.WithMaxNameLength(cfg.maxName),
+		service.WithRetryBudget(service.RetryBudget{
+			Percent:    cfg.retryPct,
+			Window:     cfg.retryWin,
+			MinRetries: cfg.retryMin,
+		}),
+	}
+	if cfg.brkFails > 0 {
+		opts = append(opts, service.WithBreakers(service.Breaker{
+			Failures: cfg.brkFails,
+			Cooldown: cfg.brkCool,
+		}))
+	}
+	if cfg.probeInt > 0 {
+		opts = append(opts, service.WithProbes(service.Probe{
+			Interval: cfg.probeInt,
+			Timeout:  cfg.probeTime,
+		}))
+	}
+	if cfg.translit {
+		opts = append(opts, service.WithTransliteration())
+	}
+	if cfg.strict {
+		opts = append(opts, service.WithStrictValidation())
+	}
+	if cfg.nameProxy != "" {
+		u, _ := url.Parse(cfg.nameProxy)
+		opts = append(opts, service.WithNameProxy(u))
+	}
+	if cfg.jokeProxy != "" {
+		u, _ := url.Parse(cfg.jokeProxy)
+		opts = append(opts, service.WithJokeProxy(u))
+	}
+	if cfg.vcrRecord != "" {
+		opts = append(opts, service.WithRecording(cfg.vcrRecord))
+	}
+	if cfg.vcrReplay != "" {
+		opts = append(opts, service.WithReplay(cfg.vcrReplay))
+	}
+	if cfg.chaos {
+		opts = append(opts, service.WithChaos(service.Chaos{
+			Latency:      cfg.chaosLat,
+			LatencyPct:   cfg.chaosSlow,
+			RateLimitPct: cfg.chaos429,
+			ErrorPct:     cfg.chaos5xx,
+			MalformedPct: cfg.chaosBad,
+		}))
+	}
+	if cfg.dnsTTL > 0 {
+		opts = append(opts, service.WithDNSCache(service.DNSCache{
+			MaxTTL:      cfg.dnsTTL,
+			NegativeTTL: cfg.dnsNegTTL,
+		}))
+	}
+	if cfg.nameURL != "" {
+		opts = append(opts, service.WithNameURL(cfg.nameURL))
+	}
+	if cfg.jokeURL != "" {
+		opts = append(opts, service.WithJokeURL(cfg.jokeURL))
+	}
+	if cfg.catURL != "" {
+		opts = append(opts, service.WithCatalogURL(cfg.catURL))
+	}
+
+	// The canaries get what they don't set from the stable configuration.
+	if cfg.nameCan != "" || cfg.nameCanS != "" || cfg.nameCanH != "" {
+		hdrs, _ := parseHeaders(cfg.nameCanH)
+		opts = append(opts, service.WithNameCanary(service.Canary{
+			URL:          cfg.nameCan,
+			Headers:      nilIfEmpty(hdrs),
+			NameService:  service.NameService(cfg.nameCanS),
+			Percent:      cfg.canPct,
+			MaxErrorRate: float64(cfg.canErrs) / 100,
+		}))
+	}
+	if cfg.jokeCan != "" || cfg.jokeCanH != "" {
+		hdrs, _ := parseHeaders(cfg.jokeCanH)
+		opts = append(opts, service.WithJokeCanary(service.Canary{
+			URL:          cfg.jokeCan,
+			Headers:      nilIfEmpty(hdrs),
+			Percent:      cfg.canPct,
+			MaxErrorRate: float64(cfg.canErrs) / 100,
+		}))
+	}
+	return opts, nil
+}
+
+// nilIfEmpty returns nil for no headers, so the stable ones are used.
+func nilIfEmpty(h http.Header) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
+
+// credential builds the credential for an upstream service from the token
+// given, or the one in the file, if either is set.
+func credential(header, token, file string) (service.Credential, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return service.Credential{}, err
+		}
+		if token = strings.TrimSpace(string(b)); token == "" {
+			return service.Credential{}, fmt.Errorf("token file %s is empty", file)
+		}
+	}
+	return service.Credential{Header: header, Secret: token}, nil
+}
+
+// newGossiper joins the gossip of the replicas configured, if any, and
+// warms the cache with the jokes the peers can spare.
+func newGossiper(ctx context.Context, cfg *serveConfig, svc *service.LaffService, log logging.Logger) (*gossip.Node, error) {
+	if cfg.gosBind == "" {
+		return nil, nil
+	}
+	key, _ := gossipKey(cfg.gosKey)
+	node, err := gossip.New(gossip.Config{
+		Name:      cfg.gosName,
+		Bind:      cfg.gosBind,
+		Advertise: cfg.gosAddr,
+		Key:       key,
+	}, svc, log)
+	if err != nil {
+		return nil, err
+	}
+	// The first replica up has no one to join, so that's no error.
+	if peers := splitList(cfg.gosJoin); len(peers) > 0 {
+		if _, err := node.Join(peers); err != nil {
+			log.Warnw("Error joining the gossip", "peers", peers, "error", err)
+		}
+	}
+	warmCtx, cancel := context.WithTimeout(ctx, cfg.gosWait)
+	defer cancel()
+	jokes := node.Warm(warmCtx, svc.CacheSize())
+	log.Infow("Joined the gossip", "members", node.Members(), "jokes", jokes)
+	return node, nil
+}
+
+// newMailer creates the mailer of the joke of the day, the one served at
+// /v1/joke/today, with the templates of the bodies read from their files,
+// if given.
+func newMailer(cfg *serveConfig, svc *service.LaffService, log logging.Logger) (*mailer.Mailer, error) {
+	mc := mailer.Config{
+		Addr:     cfg.smtpAddr,
+		Username: cfg.smtpUser,
+		Password: cfg.smtpPass,
+		From:     cfg.mailFrom,
+		To:       splitList(cfg.mailTo),
+		Subject:  cfg.mailSubj,
+	}
+	for _, tf := range []struct {
+		file string
+		tmpl *string
+	}{{cfg.mailText, &mc.Text}, {cfg.mailHTML, &mc.HTML}} {
+		if tf.file == "" {
+			continue
+		}
+		b, err := os.ReadFile(tf.file)
+		if err != nil {
+			return nil, err
+		}
+		*tf.tmpl = string(b)
+	}
+	return mailer.New(svc.Daily(), mc, log)
+}
+
+// newElector creates the election of the replica prefetching names
+// configured, if any.
+func newElector(cfg *serveConfig, rdb *redis.Client, table *dynamo.Table, log logging.Logger) (*leader.Elector, error) {
+	id := cfg.leaderID
+	if id == "" {
+		var err error
+		if id, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	var lock leader.Lock
+	switch cfg.elect {
+	case "kubernetes":
+		kl, err := leader.NewInClusterLease(cfg.leaseNS, cfg.leaseName, id, cfg.leaseTerm)
+		if err != nil {
+			return nil, err
+		}
+		lock = kl
+	case "redis":
+		lock = leader.NewRedisLock(rdb, cfg.redisKey+":"+cfg.leaseName, id, cfg.leaseTerm)
+	case "dynamodb":
+		lock = dynamo.NewLock(table, cfg.leaseName, id, cfg.leaseTerm)
+	default:
+		return nil, nil
+	}
+	return leader.NewElector(lock, cfg.leaseTerm, log.With("leaderID", id)), nil
+}
+
+// newRegistrar creates the registrar with the service registry
+// configured, if any.
+func newRegistrar(cfg *serveConfig, log *zap.SugaredLogger) discovery.Registrar {
+	host := cfg.regHost
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	inst := discovery.NewInstance(cfg.regName, host, cfg.portNum, "/v1/ready", splitList(cfg.regTags))
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch cfg.regType {
+	case "consul":
+		url := cfg.regURL
+		if url == "" {
+			url = "http://127.0.0.1:8500"
+		}
+		return discovery.NewConsul(client, url, cfg.regToken, inst, cfg.regTTL)
+	case "etcd":
+		url := cfg.regURL
+		if url == "" {
+			url = "http://127.0.0.1:2379"
+		}
+		return discovery.NewEtcd(client, url, cfg.regPrefix, inst, cfg.regTTL, func(err error) {
+			log.Errorw("Error keeping the registration alive", "error", err)
+		})
+	}
+	return nil
+}
+
+// newPublisher creates the publisher for the served jokes configured, if
+// any.
+func newPublisher(cfg *serveConfig, log *zap.SugaredLogger) (events.Publisher, error) {
+	switch {
+	case cfg.natsURL != "":
+		return events.NewNATS(cfg.natsURL, cfg.topic)
+	case cfg.kafka != "":
+		return events.NewKafka(splitList(cfg.kafka), cfg.topic, func(err error) {
+			log.Errorw("Error writing joke events to Kafka", "error", err)
+		}), nil
+	}
+	return nil, nil
+}
+
+// newTranslator creates the translator configured, if any, with a cache
+// in front of it.
+func newTranslator(cfg *serveConfig) translate.Translator {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var tr translate.Translator
+	switch cfg.trans {
+	case "libretranslate":
+		url := cfg.transURL
+		if url == "" {
+			url = "https://libretranslate.com"
+		}
+		tr = translate.NewLibreTranslate(client, url, cfg.transKey)
+	case "deepl":
+		url := cfg.transURL
+		if url == "" {
+			url = "https://api-free.deepl.com"
+		}
+		tr = translate.NewDeepL(client, url, cfg.transKey)
+	default:
+		return nil
+	}
+	return translate.NewCached(tr, cfg.transLen)
+}
+
+// Setup for clean shutdown with signal handlers/cancel.  A drain request
+// shuts down too, once the delay has given the load balancers time to see
+// the readiness fail, or at once on a signal in the meantime.
+func waitForShutdown(ctx context.Context, log *zap.SugaredLogger, drain <-chan struct{},
+	delay time.Duration, steps ...shutdownStep) {
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	// Block until we receive our signal, or are drained.
+	select {
+	case sig := <-interruptChan:
+		log.Debugw("Termination signal received", "signal", sig)
+	case <-drain:
+		log.Infow("Drain requested, shutting down after the delay", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case sig := <-interruptChan:
+			log.Debugw("Termination signal received while draining", "signal", sig)
+		}
+	}
+
+	// Create a deadline to wait for.
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	shutdown(ctx, log, steps...)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultSizeWindow is how much of the demand is kept cached, if not
+	// set.
+	defaultSizeWindow = 5 * time.Minute
+
+	// autoSizeInterval is how often the cache size is tuned.
+	autoSizeInterval = 30 * time.Second
+
+	// autoSizeWeight is the weight of the latest interval in the smoothed
+	// request rate, so a short burst doesn't resize the caches.
+	autoSizeWeight = 0.25
+)
+
+// AutoSize bounds the size the caches are tuned to, see WithAutoSize.
+type AutoSize struct {
+	Min int
+	Max int
+
+	// Window is how much of the demand to keep cached, 5 minutes if 0.
+	Window time.Duration
+}
+
+// WithAutoSize has the service size its caches to the demand, between the
+// bounds, rather than keeping the size it was created with.  Every 30
+// seconds the caches are resized to hold the requests expected in the
+// window, going by the recent request rate, but no more than the name
+// service rate lets the workers fill in the window, as they'd never fill.
+// The size the service is created with is where it starts, and must be
+// within the bounds.
+func WithAutoSize(as AutoSize) Option {
+	return func(ls *LaffService) {
+		ls.autoSize = &as
+	}
+}
+
+// setupAutoSize checks the bounds of the cache size, if it is tuned.
+func (ls *LaffService) setupAutoSize() error {
+	as := ls.autoSize
+	if as == nil {
+		return nil
+	}
+	if as.Window == 0 {
+		as.Window = defaultSizeWindow
+	}
+	if as.Min <= 0 || as.Max < as.Min || as.Window < 0 {
+		return fmt.Errorf("invalid cache size bounds: %d to %d over %v", as.Min, as.Max, as.Window)
+	}
+	if size := ls.CacheSize(); size < as.Min || size > as.Max {
+		return fmt.Errorf("cache size %d is not between %d and %d", size, as.Min, as.Max)
+	}
+	return nil
+}
+
+// tuneCache resizes the caches to the demand every interval, until the
+// context is done.
+func (ls *LaffService) tuneCache(ctx context.Context) {
+	served := ls.served()
+	var perSec float64 // smoothed requests per second
+	for i := 0; sleep(ctx, ls.clock, autoSizeInterval); i++ {
+		now := ls.served()
+		latest := float64(now-served) / autoSizeInterval.Seconds()
+		served = now
+		if i == 0 {
+			perSec = latest
+		} else {
+			perSec = autoSizeWeight*latest + (1-autoSizeWeight)*perSec
+		}
+		if size := ls.autoSize.size(perSec, ls.nameBudget(ls.autoSize.Window)); size != ls.CacheSize() {
+			ls.ResizeCaches(size)
+		}
+	}
+}
+
+// size returns the cache size for the request rate: the requests in the
+// window, but no more than the budget of names, if there is one, within
+// the bounds.
+func (as *AutoSize) size(perSec float64, budget int) int {
+	n := int(math.Ceil(perSec * as.Window.Seconds()))
+	if budget > 0 {
+		n = min(n, budget)
+	}
+	return min(max(n, as.Min), as.Max)
+}
+
+// nameBudget returns how many names the name service rate allows over the
+// duration, or 0 if there is no limit to them, as there isn't when names
+// come from other sources too.
+func (ls *LaffService) nameBudget(d time.Duration) int {
+	if ls.nameRate.Requests == 0 || len(ls.names) > 0 {
+		return 0
+	}
+	return int(float64(ls.nameRate.Requests) * d.Seconds() / ls.nameRate.Interval.Seconds())
+}
+
+// served returns the number of jokes served, from the caches or not.
+func (ls *LaffService) served() int64 {
+	return atomic.LoadInt64(&ls.counters.jokeHits) + atomic.LoadInt64(&ls.counters.nameHits) +
+		atomic.LoadInt64(&ls.counters.misses)
+}
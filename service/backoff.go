@@ -0,0 +1,54 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// retryAfter reads how many seconds the Retry-After header of a 429 or 503
+// response asks us to wait.  It can be given in seconds or as an HTTP
+// date, and the default is dfltRetry.
+func retryAfter(h http.Header, now time.Time) int {
+	v := h.Get("Retry-After")
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return secs
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(int((t.Sub(now)+time.Second-1)/time.Second), 0)
+	}
+	return dfltRetry
+}
+
+// backoff keeps an upstream service from being called until the time it
+// asked us to come back, after a 429 or 503.
+type backoff struct {
+	until int64 // unix nanoseconds
+}
+
+// set backs off for the seconds given, from now.
+func (b *backoff) set(now time.Time, secs int) {
+	atomic.StoreInt64(&b.until, now.Add(time.Duration(secs)*time.Second).UnixNano())
+}
+
+// check returns a RateLimitError saying how long is left if we are still
+// backing off at the time given.
+func (b *backoff) check(now time.Time) error {
+	left := b.left(now)
+	if left <= 0 {
+		return nil
+	}
+	return RateLimitError{retry: int((left + time.Second - 1) / time.Second)}
+}
+
+// left returns how long we are still backing off for at the time given,
+// or a negative duration if not.
+func (b *backoff) left(now time.Time) time.Duration {
+	return time.Unix(0, atomic.LoadInt64(&b.until)).Sub(now)
+}
+
+// isBackoffStatus reports whether the status asks us to back off.
+func isBackoffStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+}
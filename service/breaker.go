@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The states of a circuit breaker.
+const (
+	BreakerClosed   = "closed"    // the calls go through
+	BreakerOpen     = "open"      // the calls fail at once
+	BreakerHalfOpen = "half-open" // one call goes through, to probe
+)
+
+// ErrNoBreaker is returned when forcing a breaker that doesn't exist.
+var ErrNoBreaker = errors.New("no such circuit breaker")
+
+// Breaker configures the circuit breakers of the upstream services, see
+// WithBreakers.
+type Breaker struct {
+	Failures int           // failures in a row that open the breaker
+	Cooldown time.Duration // how long it stays open before a probe
+}
+
+// BreakerStatus is a snapshot of a circuit breaker.
+type BreakerStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"` // in a row
+	Trips     int64      `json:"trips"`    // times it has opened
+	NextProbe *time.Time `json:"nextProbe,omitempty"`
+	Forced    bool       `json:"forced,omitempty"` // held open by ForceBreaker
+}
+
+// BreakerOpenError means an upstream service wasn't called, as its
+// circuit breaker is open.  Retry is how long until it is probed.
+type BreakerOpenError struct {
+	Upstream string
+	Retry    time.Duration
+}
+
+func (boe BreakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for the %s service is open, retry in %v",
+		boe.Upstream, boe.Retry.Round(time.Second))
+}
+
+// breaker is the circuit breaker of an upstream service.  After Failures
+// calls in a row fail, it opens, and the calls fail at once without
+// reaching the service, until the cooldown is over.  Then a single call
+// is let through as a probe: if it succeeds the breaker closes, and if
+// not it opens for another cooldown.  Being rate limited isn't a failure,
+// as the backoff handles that, nor is the caller giving up.
+type breaker struct {
+	Breaker
+	upstream string
+	log      func(msg string, keysAndValues ...interface{})
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	trips     int64
+	nextProbe time.Time
+	probing   bool // a probe is in flight, when half-open
+	forced    bool // held open
+}
+
+// WithBreakers gives each upstream service a circuit breaker, so while
+// one is failing it isn't called on every request and cache fill, and
+// the failures are quick.  There are none by default.
+func WithBreakers(b Breaker) Option {
+	return func(ls *LaffService) {
+		ls.nameBreaker = &breaker{Breaker: b, upstream: "name", state: BreakerClosed}
+		ls.jokeBreaker = &breaker{Breaker: b, upstream: "joke", state: BreakerClosed}
+	}
+}
+
+// setupBreakers checks the circuit breakers, if there are any.
+func (ls *LaffService) setupBreakers() error {
+	for _, b := range []*breaker{ls.nameBreaker, ls.jokeBreaker} {
+		if b == nil {
+			continue
+		}
+		if b.Failures <= 0 || b.Cooldown <= 0 {
+			return fmt.Errorf("circuit breaker needs positive failures and cooldown, got %d and %v",
+				b.Failures, b.Cooldown)
+		}
+		b.log = ls.log.Warnw
+	}
+	return nil
+}
+
+// Breakers returns the state of the circuit breaker of each upstream
+// service, keyed by "name" and "joke", or nil if there are none.
+func (ls *LaffService) Breakers() map[string]BreakerStatus {
+	if ls.nameBreaker == nil {
+		return nil
+	}
+	return map[string]BreakerStatus{
+		"name": ls.nameBreaker.status(),
+		"joke": ls.jokeBreaker.status(),
+	}
+}
+
+// ForceBreaker holds the circuit breaker of the upstream service, "name"
+// or "joke", open, or closes it, for taking a service out of use by hand
+// and putting it back.  A breaker that is forced closed works as usual,
+// opening again if the failures go on.
+func (ls *LaffService) ForceBreaker(upstream, state string) (BreakerStatus, error) {
+	b := map[string]*breaker{"name": ls.nameBreaker, "joke": ls.jokeBreaker}[upstream]
+	if b == nil {
+		return BreakerStatus{}, ErrNoBreaker
+	}
+	if state != BreakerOpen && state != BreakerClosed {
+		return BreakerStatus{}, fmt.Errorf("a breaker can only be forced %s or %s, not %q",
+			BreakerOpen, BreakerClosed, state)
+	}
+	b.force(state == BreakerOpen)
+	return b.status(), nil
+}
+
+// allow returns a BreakerOpenError if the call can't go through at the
+// time given.  Otherwise the outcome of the call must be recorded.  It is
+// safe to call on a nil breaker.
+func (b *breaker) allow(now time.Time) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.forced:
+		return BreakerOpenError{Upstream: b.upstream, Retry: b.Cooldown}
+	case b.state == BreakerOpen && now.Before(b.nextProbe):
+		return BreakerOpenError{Upstream: b.upstream, Retry: b.nextProbe.Sub(now)}
+	case b.state == BreakerOpen:
+		b.state, b.probing = BreakerHalfOpen, true
+	case b.state == BreakerHalfOpen && b.probing:
+		return BreakerOpenError{Upstream: b.upstream, Retry: time.Second}
+	case b.state == BreakerHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// record notes the outcome of a call allowed through, at the time given.
+// It is safe to call on a nil breaker.
+func (b *breaker) record(ctx context.Context, err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if b.forced {
+		return
+	}
+	if _, ok := err.(RateLimitError); ok || ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		if b.state != BreakerClosed {
+			b.log("Closing circuit breaker, probe succeeded", "upstream", b.upstream)
+		}
+		b.state, b.failures = BreakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.Failures {
+		if b.state == BreakerClosed {
+			b.log("Opening circuit breaker, too many failures", "upstream", b.upstream,
+				"failures", b.failures, "error", err)
+		}
+		b.state, b.nextProbe = BreakerOpen, now.Add(b.Cooldown)
+		b.trips++
+	}
+}
+
+// left returns how long until the breaker lets a call through at the
+// time given, or 0 if it does now.  It is safe to call on a nil breaker.
+func (b *breaker) left(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.forced {
+		return b.Cooldown
+	}
+	if b.state != BreakerOpen {
+		return 0
+	}
+	return max(b.nextProbe.Sub(now), 0)
+}
+
+// force holds the breaker open, or closes it.
+func (b *breaker) force(open bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forced, b.probing, b.failures = open, false, 0
+	if open {
+		b.state = BreakerOpen
+		b.trips++
+	} else {
+		b.state = BreakerClosed
+	}
+	b.log("Circuit breaker forced", "upstream", b.upstream, "open", open)
+}
+
+// status returns a snapshot of the breaker.
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStatus{State: b.state, Failures: b.failures, Trips: b.trips, Forced: b.forced}
+	if b.state == BreakerOpen && !b.forced {
+		next := b.nextProbe
+		st.NextProbe = &next
+	}
+	return st
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+)
+
+// minCanaryRequests is how many requests a canary must have handled
+// before its error rate is judged.
+const minCanaryRequests = 20
+
+// Canary is another configuration of an upstream service, such as a new
+// URL, headers or name service format, tried out on a share of the
+// requests.  If its error rate goes above the limit, it is rolled back,
+// and all the requests go to the stable configuration again.  The fields
+// left empty are the same as the stable configuration.
+type Canary struct {
+	URL         string
+	Headers     http.Header
+	Credential  Credential
+	NameService NameService // only for the name service
+
+	Percent      int     // share of the requests sent to the canary
+	MaxErrorRate float64 // between 0 and 1
+}
+
+// CanaryStats is how a canary has done.
+type CanaryStats struct {
+	Percent    int   `json:"percent"`
+	Requests   int64 `json:"requests"`
+	Errors     int64 `json:"errors"`
+	RolledBack bool  `json:"rolledBack"`
+}
+
+// canary is a running Canary.
+type canary struct {
+	Canary
+	upstream string
+	decode   func([]byte) (*NameResp, error)
+	log      func(msg string, keysAndValues ...interface{})
+
+	requests   int64
+	errors     int64
+	rolledBack atomic.Bool
+}
+
+// WithNameCanary tries out another configuration of the name service.
+func WithNameCanary(c Canary) Option {
+	return func(ls *LaffService) {
+		ls.nameCanary = &canary{Canary: c, upstream: "name"}
+	}
+}
+
+// WithJokeCanary tries out another configuration of the joke service,
+// apart from its catalog.  Its NameService is not used.
+func WithJokeCanary(c Canary) Option {
+	return func(ls *LaffService) {
+		ls.jokeCanary = &canary{Canary: c, upstream: "joke"}
+	}
+}
+
+// setupCanaries fills in the canaries from the stable configurations.
+func (ls *LaffService) setupCanaries() error {
+	if cn := ls.nameCanary; cn != nil {
+		if err := cn.setup(ls, ls.nameURL, ls.nameHeaders, ls.nameCred); err != nil {
+			return err
+		}
+		cn.decode = ls.nameDecode
+		if cn.NameService != "" {
+			api, ok := nameAPIs[cn.NameService]
+			if !ok {
+				return fmt.Errorf("unknown name service %q in canary", cn.NameService)
+			}
+			cn.decode = api.decode
+		}
+	}
+	if cn := ls.jokeCanary; cn != nil {
+		return cn.setup(ls, ls.jokeURL, ls.jokeHeaders, ls.jokeCred)
+	}
+	return nil
+}
+
+// setup checks the canary, and fills in what it has in common with the
+// stable configuration.
+func (cn *canary) setup(ls *LaffService, url string, headers http.Header, cred Credential) error {
+	if cn.Percent < 0 || cn.Percent > 100 {
+		return fmt.Errorf("%s canary percent must be between 0 and 100", cn.upstream)
+	}
+	if cn.MaxErrorRate < 0 || cn.MaxErrorRate > 1 {
+		return fmt.Errorf("%s canary error rate must be between 0 and 1", cn.upstream)
+	}
+	if cn.URL == "" {
+		cn.URL = url
+	}
+	if cn.Headers == nil {
+		cn.Headers = headers
+	}
+	if cn.Credential.Secret == "" {
+		cn.Credential = cred
+	}
+	cn.log = ls.log.Warnw
+	return nil
+}
+
+// pick decides whether a request goes to the canary, returning it if so.
+// It is safe to call on a nil canary.
+func (cn *canary) pick() *canary {
+	if cn == nil || cn.rolledBack.Load() || rand.Intn(100) >= cn.Percent {
+		return nil
+	}
+	return cn
+}
+
+// note counts the outcome of a request to the canary, and rolls it back
+// if it is failing too often.  Being rate limited or stopped isn't the
+// canary's fault, so those aren't counted.  It is safe to call on a nil
+// canary.
+func (cn *canary) note(ctx context.Context, err error) {
+	if cn == nil || ctx.Err() != nil {
+		return
+	}
+	if _, ok := err.(RateLimitError); ok {
+		return
+	}
+	reqs := atomic.AddInt64(&cn.requests, 1)
+	errs := atomic.LoadInt64(&cn.errors)
+	if err != nil {
+		errs = atomic.AddInt64(&cn.errors, 1)
+	}
+	if reqs >= minCanaryRequests && float64(errs)/float64(reqs) > cn.MaxErrorRate &&
+		cn.rolledBack.CompareAndSwap(false, true) {
+		cn.log("Rolling back canary, too many errors", "upstream", cn.upstream,
+			"requests", reqs, "errors", errs, "url", cn.URL)
+	}
+}
+
+// stats returns how the canary has done.
+func (cn *canary) stats() CanaryStats {
+	return CanaryStats{
+		Percent:    cn.Percent,
+		Requests:   atomic.LoadInt64(&cn.requests),
+		Errors:     atomic.LoadInt64(&cn.errors),
+		RolledBack: cn.rolledBack.Load(),
+	}
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Chaos injects faults into the upstream calls, to see how the retries,
+// backoff and caches stand up to failing services.  It is for testing
+// only.  The percentages are of all the calls, and add up to at most 100.
+type Chaos struct {
+	Latency      time.Duration // delay added to the calls
+	LatencyPct   int           // calls delayed
+	RateLimitPct int           // calls answered 429, asking to retry in a second
+	ErrorPct     int           // calls answered 500
+	MalformedPct int           // calls whose body is garbled
+}
+
+// ChaosStats is how many faults have been injected into the upstream
+// calls.
+type ChaosStats struct {
+	Delayed     int64 `json:"delayed"`
+	RateLimited int64 `json:"rateLimited"`
+	Errors      int64 `json:"errors"`
+	Malformed   int64 `json:"malformed"`
+}
+
+// WithChaos injects the faults into the calls to the upstream services,
+// recorded or replayed ones included.  Don't use it in production.
+func WithChaos(c Chaos) Option {
+	return func(ls *LaffService) {
+		ls.chaos = &injector{Chaos: c}
+	}
+}
+
+// injector is the transport injecting the faults, see WithChaos.
+type injector struct {
+	Chaos
+	next http.RoundTripper
+
+	delayed     int64
+	rateLimited int64
+	errors      int64
+	malformed   int64
+}
+
+// setupChaos puts the fault injection, if any, in front of the transport
+// for the upstream calls.
+func (ls *LaffService) setupChaos() error {
+	ct := ls.chaos
+	if ct == nil {
+		return nil
+	}
+	pcts := []int{ct.LatencyPct, ct.RateLimitPct, ct.ErrorPct, ct.MalformedPct}
+	for _, p := range pcts {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("invalid chaos percentage %d", p)
+		}
+	}
+	if ct.RateLimitPct+ct.ErrorPct+ct.MalformedPct > 100 || ct.Latency < 0 {
+		return fmt.Errorf("invalid chaos settings %+v", ct.Chaos)
+	}
+	ct.next = ls.client.Transport
+	ls.client = &http.Client{Transport: ct}
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper.  The delay comes first, and
+// then at most one of the other faults.
+func (ct *injector) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ct.Latency > 0 && rand.Intn(100) < ct.LatencyPct {
+		atomic.AddInt64(&ct.delayed, 1)
+		t := time.NewTimer(ct.Latency)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+	}
+
+	n := rand.Intn(100)
+	switch {
+	case n < ct.RateLimitPct:
+		atomic.AddInt64(&ct.rateLimited, 1)
+		return chaosResponse(req, http.StatusTooManyRequests, "1"), nil
+	case n < ct.RateLimitPct+ct.ErrorPct:
+		atomic.AddInt64(&ct.errors, 1)
+		return chaosResponse(req, http.StatusInternalServerError, ""), nil
+	}
+	resp, err := ct.next.RoundTrip(req)
+	if err != nil || n >= ct.RateLimitPct+ct.ErrorPct+ct.MalformedPct {
+		return resp, err
+	}
+	atomic.AddInt64(&ct.malformed, 1)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Cutting the body in half leaves the JSON unterminated.
+	garbled := string(body[:len(body)/2]) + "\x00}"
+	resp.Body = io.NopCloser(strings.NewReader(garbled))
+	resp.ContentLength = int64(len(garbled))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// chaosResponse makes up a response with the status, and the Retry-After
+// header if given.
+func chaosResponse(req *http.Request, code int, retry string) *http.Response {
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"X-Chaos": {"injected"}},
+		Body:       io.NopCloser(strings.NewReader("injected fault")),
+		Request:    req,
+	}
+	if retry != "" {
+		resp.Header.Set("Retry-After", retry)
+	}
+	return resp
+}
+
+// stats returns how many faults have been injected.
+func (ct *injector) stats() ChaosStats {
+	return ChaosStats{
+		Delayed:     atomic.LoadInt64(&ct.delayed),
+		RateLimited: atomic.LoadInt64(&ct.rateLimited),
+		Errors:      atomic.LoadInt64(&ct.errors),
+		Malformed:   atomic.LoadInt64(&ct.malformed),
+	}
+}
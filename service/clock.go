@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time and waits for the service.  The cache workers,
+// the retry budget, the backoff after a 429, the waits for the rate
+// limits and the DNS cache all go by it, so tests can move the time on
+// rather than sleeping.
+type Clock interface {
+	Now() time.Time
+
+	// After returns a channel getting the time once the duration has
+	// passed, like time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// WithClock sets the clock of the service, which is the system clock by
+// default.
+func WithClock(c Clock) Option {
+	return func(ls *LaffService) {
+		ls.clock = c
+	}
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// sleep waits for the duration on the clock.  It returns false if the
+// context is done first.
+func sleep(ctx context.Context, c Clock, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-c.After(d):
+		return true
+	}
+}
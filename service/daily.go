@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// dailyTimeout limits picking the joke of the day.
+const dailyTimeout = 30 * time.Second
+
+// dailyJoke is the joke of the day, picked by the first request for it
+// each day, in UTC.
+type dailyJoke struct {
+	mu      sync.Mutex
+	day     string // such as 2006-01-02
+	joke    Joke
+	picked  time.Time
+	picking chan struct{} // closed when the pick under way is done, nil if none
+}
+
+// JokeOfTheDay returns the joke of the day, in UTC, along with the day,
+// such as 2006-01-02, and when it was picked.  The first call each day
+// picks it, like any other joke, and the others get the same one until
+// the day is over.  It is picked with a context of its own, rather than
+// the caller's, so no tenant's categories or experiment arm decide the
+// joke for everyone, and the callers meanwhile wait for it, or their
+// context, without holding the lock.  It is only kept in memory, so each
+// replica, and each run, picks its own.  If no joke can be had, the error
+// is returned, and the next call tries again.
+func (ls *LaffService) JokeOfTheDay(ctx context.Context) (Joke, string, time.Time, error) {
+	d := &ls.daily
+	for {
+		d.mu.Lock()
+		day := ls.clock.Now().UTC().Format(time.DateOnly)
+		if d.day == day {
+			jk, picked := d.joke, d.picked
+			d.mu.Unlock()
+			return jk, day, picked, nil
+		}
+		if picking := d.picking; picking != nil {
+			d.mu.Unlock()
+			select {
+			case <-picking:
+				continue
+			case <-ctx.Done():
+				return Joke{}, "", time.Time{}, ctx.Err()
+			}
+		}
+		picking := make(chan struct{})
+		d.picking = picking
+		d.mu.Unlock()
+
+		jk, err := ls.pickDaily(day)
+		d.mu.Lock()
+		if err == nil {
+			d.day, d.joke, d.picked = day, jk, ls.clock.Now().UTC()
+		}
+		picked := d.picked
+		d.picking = nil
+		close(picking)
+		d.mu.Unlock()
+		if err != nil {
+			return Joke{}, "", time.Time{}, err
+		}
+		return jk, day, picked, nil
+	}
+}
+
+// pickDaily picks the joke of the day.
+func (ls *LaffService) pickDaily(day string) (Joke, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dailyTimeout)
+	defer cancel()
+	jk, err := ls.Joke(ctx)
+	if err != nil {
+		ls.log.Warnw("Error picking the joke of the day", "day", day, "error", err)
+		return Joke{}, err
+	}
+	ls.log.Infow("Picked the joke of the day", "day", day, "jokeID", jk.ID)
+	return jk, nil
+}
+
+// Daily is the joke of the day as a source of jokes, such as for the
+// mailer, so the email has the joke served as the joke of the day.
+type Daily struct {
+	ls *LaffService
+}
+
+// Daily returns the joke of the day as a source of jokes.
+func (ls *LaffService) Daily() Daily {
+	return Daily{ls: ls}
+}
+
+// Joke returns the joke of the day, see JokeOfTheDay.
+func (d Daily) Joke(ctx context.Context) (Joke, error) {
+	jk, _, _, err := d.ls.JokeOfTheDay(ctx)
+	return jk, err
+}
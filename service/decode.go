@@ -0,0 +1,139 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+// The upstream services aren't consistent in their JSON: uinames returns
+// an array of names when asked for several, the joke services differ in
+// giving the IDs as numbers or strings, and they add fields over time.
+// The decoding here takes all of these, so a change upstream doesn't stop
+// the jokes.  Unknown fields are ignored, as always with encoding/json.
+
+// decodeJoke reads a joke from the joke service.
+func decodeJoke(b []byte) (*JokeResp, error) {
+	var jr JokeResp
+	if err := firstOf(b, &jr); err != nil {
+		return nil, pkgerr.Wrap(err, "unmarshaling joke")
+	}
+	return &jr, nil
+}
+
+// decodeCatalog reads the catalog of the joke service, which is usually
+// an array of jokes, but can be a single one.
+func decodeCatalog(b []byte) ([]JokeValue, error) {
+	var catResp struct {
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &catResp); err != nil {
+		return nil, pkgerr.Wrap(err, "unmarshaling catalog")
+	}
+	var jokes []JokeValue
+	if err := manyOf(catResp.Value, &jokes); err != nil {
+		return nil, pkgerr.Wrap(err, "unmarshaling catalog")
+	}
+	return jokes, nil
+}
+
+// UnmarshalJSON reads a joke response, with the value being a joke or an
+// array of them, of which the first is taken.
+func (jr *JokeResp) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	jr.Type = v.Type
+	jr.Value = JokeValue{}
+	if isNull(v.Value) {
+		return nil
+	}
+	return firstOf(v.Value, &jr.Value)
+}
+
+// UnmarshalJSON reads a joke, with the ID given as a number or a string.
+func (jv *JokeValue) UnmarshalJSON(b []byte) error {
+	type plain JokeValue
+	var v struct {
+		plain
+		ID flexInt `json:"id"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*jv = JokeValue(v.plain)
+	jv.ID = int(v.ID)
+	return nil
+}
+
+// flexInt is an integer given in JSON as a number or a string.  An empty
+// string is 0.
+type flexInt int
+
+func (fi *flexInt) UnmarshalJSON(b []byte) error {
+	if isNull(b) {
+		return nil
+	}
+	if b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		if s == "" {
+			*fi = 0
+			return nil
+		}
+		b = []byte(s)
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid id %s", b)
+	}
+	*fi = flexInt(n)
+	return nil
+}
+
+// firstOf reads a JSON value, or the first of an array of them, into v.
+// The array is streamed, so the rest of it isn't decoded.
+func firstOf(b []byte, v interface{}) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] != '[' {
+		return json.Unmarshal(b, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if !dec.More() {
+		return errors.New("empty array")
+	}
+	return dec.Decode(v)
+}
+
+// manyOf reads a JSON array into the slice v points to, or a single value
+// as an array of one.
+func manyOf(b []byte, v interface{}) error {
+	b = bytes.TrimSpace(b)
+	if isNull(b) {
+		return nil
+	}
+	if b[0] != '[' {
+		b = append(append([]byte{'['}, b...), ']')
+	}
+	return json.Unmarshal(b, v)
+}
+
+// isNull reports whether the JSON is missing or null.
+func isNull(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) == 0 || string(b) == "null"
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+// requestIDKey is the context key for the ID of the request a joke is for.
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the ID of the request the joke
+// is for.  It is used to assign the request to an experiment arm.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request in the context, if there is one.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// experiment compares two joke sources on the live requests.  Each
+// request is assigned to one of the arms by the hash of its ID, so a
+// retried request lands on the same arm.
+type experiment struct {
+	names [2]string
+	arms  [2]arm
+}
+
+// arm is one side of an experiment, and how it has done.
+type arm struct {
+	src      *jokeSource
+	requests int64
+	errors   int64
+	latency  int64 // total nanoseconds spent getting the jokes
+}
+
+// ArmStats is how one side of an experiment has done.
+type ArmStats struct {
+	Provider      string  `json:"provider"`
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"`
+	MeanLatencyMs float64 `json:"meanLatencyMs"`
+}
+
+// ExperimentStats compares the two sides of an experiment.
+type ExperimentStats struct {
+	A ArmStats `json:"a"`
+	B ArmStats `json:"b"`
+}
+
+// WithExperiment runs an A/B experiment between two joke sources, named
+// as for WithWeightedJokeProvider or JokeServiceName.  The requests with
+// an ID, see WithRequestID, get their joke straight from the source of
+// their arm rather than the cache, and the outcome is counted in the
+// stats.  The other requests are served as usual.
+func WithExperiment(a, b string) Option {
+	return func(ls *LaffService) {
+		ls.experiment = &experiment{names: [2]string{a, b}}
+	}
+}
+
+// setupExperiment finds the sources of the experiment arms.
+func (ls *LaffService) setupExperiment() error {
+	ex := ls.experiment
+	if ex == nil {
+		return nil
+	}
+	if ex.names[0] == ex.names[1] {
+		return fmt.Errorf("experiment needs two different providers, got %s twice", ex.names[0])
+	}
+	for i, name := range ex.names {
+		ex.arms[i].src = ls.source(name)
+		if ex.arms[i].src == nil {
+			return fmt.Errorf("unknown joke provider %q in experiment", name)
+		}
+	}
+	return nil
+}
+
+// source returns the joke source with the name, or nil.
+func (ls *LaffService) source(name string) *jokeSource {
+	if name == JokeServiceName {
+		return &ls.upstream
+	}
+	for _, src := range ls.providers {
+		if src.name == name {
+			return src
+		}
+	}
+	return nil
+}
+
+// assign picks the arm for a request.
+func (ex *experiment) assign(id string) *arm {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &ex.arms[h.Sum32()%2]
+}
+
+// experimentJoke gets a joke for the request from the source of its arm.
+// The name comes from the caches if possible, even giving up a cached
+// joke for its name, as the name service is the scarce one.  Only getting
+// the joke is timed.
+func (ls *LaffService) experimentJoke(ctx context.Context, id string) (Joke, error) {
+	var name *NameResp
+	if own, ok := ownName(ctx); ok {
+		name = &own
+	} else if jk, ok := ls.jokeCache.TryPop(); ok {
+		name = &jk.Name
+	} else if name, ok = ls.nameCache.TryPop(); !ok {
+		var err error
+		if name, err = ls.nextName(ctx); err != nil {
+			return Joke{}, err
+		}
+	}
+
+	a := ls.experiment.assign(id)
+	start := time.Now()
+	jk, err := ls.nextJokeFrom(ctx, name, a.src)
+	atomic.AddInt64(&a.latency, int64(time.Since(start)))
+	atomic.AddInt64(&a.requests, 1)
+	if err != nil && ctx.Err() == nil {
+		atomic.AddInt64(&a.errors, 1)
+	}
+	return jk, err
+}
+
+// stats returns how the arm has done.
+func (a *arm) stats() ArmStats {
+	st := ArmStats{
+		Provider: a.src.name,
+		Requests: atomic.LoadInt64(&a.requests),
+		Errors:   atomic.LoadInt64(&a.errors),
+	}
+	if st.Requests > 0 {
+		st.MeanLatencyMs = float64(atomic.LoadInt64(&a.latency)) / float64(st.Requests) / 1e6
+	}
+	return st
+}
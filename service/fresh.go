@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// minRefresh is the least time between the checks for stale jokes.
+const minRefresh = time.Second
+
+// WithJokeMaxAge keeps the joke cache fresh: the newest joke is served
+// first, rather than the oldest, and the jokes cached for longer than the
+// age are evicted, so the workers replace them with new ones.  Otherwise,
+// under a light load, the jokes served may have been fetched hours ago.
+// The names of the evicted jokes go back in the name cache, if there's
+// room, as the name service is the scarce one.  It is off by default.
+func WithJokeMaxAge(d time.Duration) Option {
+	return func(ls *LaffService) {
+		ls.maxAge = d
+	}
+}
+
+// popJoke takes a joke from the joke cache, the newest if it is kept
+// fresh, or else the oldest.
+func (ls *LaffService) popJoke() (Joke, bool) {
+	if ls.maxAge > 0 {
+		return ls.jokeCache.TryPopNewest()
+	}
+	return ls.jokeCache.TryPop()
+}
+
+// refreshJokes evicts the stale jokes from the joke cache a few times in
+// each max age, until the context is done.
+func (ls *LaffService) refreshJokes(ctx context.Context) {
+	for sleep(ctx, ls.clock, max(ls.maxAge/4, minRefresh)) {
+		ls.evictStale()
+	}
+}
+
+// evictStale evicts the jokes cached for longer than the max age, putting
+// their names back in the name cache.
+func (ls *LaffService) evictStale() {
+	cutoff := ls.clock.Now().Add(-ls.maxAge)
+	var names []*NameResp
+	n := ls.jokeCache.Evict(func(jk Joke) bool {
+		if !jk.cached.Before(cutoff) {
+			return false
+		}
+		names = append(names, &jk.Name)
+		return true
+	})
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&ls.counters.stale, int64(n))
+	for _, name := range names {
+		if !ls.nameCache.TryPush(name) {
+			break
+		}
+	}
+	ls.log.Debugw("Evicted stale jokes", "count", n)
+}
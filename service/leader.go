@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// followerPoll is how often a follower's cache workers look for names in
+// the shared queue while it is empty, or for the replica to become the
+// leader.
+const followerPoll = time.Second
+
+// Leader tells whether this replica leads the others, see WithLeader.
+type Leader interface {
+	IsLeader() bool
+}
+
+// NameQueue is a queue of names shared by the replicas, see WithLeader.
+type NameQueue interface {
+	// Offer adds the name to the queue unless it is full, reporting
+	// whether it was added.
+	Offer(ctx context.Context, name NameResp) (bool, error)
+
+	// Take removes the oldest name from the queue, returning nil if
+	// there is none.
+	Take(ctx context.Context) (*NameResp, error)
+}
+
+// LeaderStats is how the prefetching of the names has been shared, see
+// WithLeader.
+type LeaderStats struct {
+	Leader bool  `json:"leader"`
+	Shared int64 `json:"shared"` // names fetched for the followers
+	Taken  int64 `json:"taken"`  // names taken from the shared queue
+}
+
+// WithLeader has the cache workers fetch names ahead of demand only while
+// this replica is the leader, so the replicas don't all spend the budget
+// of the rate limited name service on prefetching.  With a shared queue,
+// the leader fetches the names for the followers too, offering each to
+// the queue before caching it itself, and the followers' workers take
+// their names from the queue.  The requests finding nothing cached still
+// fetch a name on any replica.
+func WithLeader(l Leader, q NameQueue) Option {
+	return func(ls *LaffService) {
+		ls.leader = l
+		ls.nameQueue = q
+	}
+}
+
+// prefetchName gets the next name for the cache workers: fetched by the
+// leader, or taken from the shared queue by a follower, waiting while
+// there is none.
+func (ls *LaffService) prefetchName(ctx context.Context) (*NameResp, error) {
+	if ls.leader == nil {
+		return ls.nextName(ctx)
+	}
+	for {
+		if ls.leader.IsLeader() {
+			name, err := ls.nextName(ctx)
+			if err != nil || ls.nameQueue == nil {
+				return name, err
+			}
+			ok, err := ls.nameQueue.Offer(ctx, *name)
+			if err != nil {
+				ls.logFor(ctx).Warnw("Can't share the name, caching it", "error", err)
+			}
+			if !ok {
+				return name, nil
+			}
+			atomic.AddInt64(&ls.counters.shared, 1)
+			continue
+		}
+		if ls.nameQueue != nil {
+			name, err := ls.nameQueue.Take(ctx)
+			if err != nil && ctx.Err() == nil {
+				ls.logFor(ctx).Warnw("Can't take a shared name", "error", err)
+			}
+			if name != nil {
+				atomic.AddInt64(&ls.counters.taken, 1)
+				return name, nil
+			}
+		}
+		if !sleep(ctx, ls.clock, followerPoll) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// leaderStats returns how the prefetching has been shared, or nil if it
+// isn't.
+func (ls *LaffService) leaderStats() *LeaderStats {
+	if ls.leader == nil {
+		return nil
+	}
+	return &LeaderStats{
+		Leader: ls.leader.IsLeader(),
+		Shared: atomic.LoadInt64(&ls.counters.shared),
+		Taken:  atomic.LoadInt64(&ls.counters.taken),
+	}
+}
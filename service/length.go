@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrTooLong means no joke within the length allowed for the request was
+// found, see MaxLength.
+var ErrTooLong = errors.New("no joke found within the length allowed")
+
+// maxLengthKey is the context key for the longest joke allowed.
+type maxLengthKey struct{}
+
+// MaxLength returns a context limiting the jokes served for a request to
+// those of at most n characters, such as for an SMS or a post that can't
+// be cut off before the punchline.  As with AllowCategories, the cached
+// jokes that fit are served, and otherwise jokes are fetched for the name
+// until one fits, up to the attempts made to pass the filter, the others
+// going in the joke cache for the other requests.  If none fits, the
+// error is ErrTooLong.
+func MaxLength(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, maxLengthKey{}, n)
+}
+
+// withinLength reports whether the joke is no longer than allowed for the
+// request, which it is if the length isn't limited.
+func withinLength(ctx context.Context, jk Joke) bool {
+	n, _ := ctx.Value(maxLengthKey{}).(int)
+	return n <= 0 || utf8.RuneCountInString(jk.Text) <= n
+}
+
+// suits reports whether the joke can be served for the request, being in
+// the categories and within the length allowed, made out to the names
+// asked for and not seen by the caller.
+func suits(ctx context.Context, jk Joke) bool {
+	return allowed(ctx, jk) && withinLength(ctx, jk) && isFor(ctx, jk) && isSecondFor(ctx, jk) &&
+		!isRepeat(ctx, jk)
+}
+
+// limitsJokes reports whether the request is limited to some of the
+// jokes, by their categories, length, names or the jokes seen.
+func limitsJokes(ctx context.Context) bool {
+	n, _ := ctx.Value(maxLengthKey{}).(int)
+	_, own := ownName(ctx)
+	_, second := secondName(ctx)
+	return limitsCategories(ctx) || n > 0 || own || second || avoidsRepeats(ctx)
+}
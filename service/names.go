@@ -0,0 +1,85 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+// NameService identifies one of the built-in name services.
+type NameService string
+
+// The name services we know how to call.  uinames.com is the original
+// one, kept for compatibility, but it is mostly down these days.
+const (
+	UINames    NameService = "uinames"
+	RandomUser NameService = "randomuser"
+)
+
+// nameAPI is where a name service is found, and how to read its names.
+type nameAPI struct {
+	url    string
+	decode func(b []byte) (*NameResp, error)
+}
+
+var nameAPIs = map[NameService]nameAPI{
+	UINames:    {url: nameURL, decode: decodeUINames},
+	RandomUser: {url: randomUserURL, decode: decodeRandomUser},
+}
+
+// WithNameService picks the built-in name service, which is uinames.com
+// by default.
+func WithNameService(ns NameService) Option {
+	return func(ls *LaffService) {
+		ls.nameService = ns
+	}
+}
+
+// decodeUINames reads a uinames.com name, which is already in our format.
+// Asked for several, it returns an array of them, of which the first is
+// taken.
+func decodeUINames(b []byte) (*NameResp, error) {
+	var nameResp NameResp
+	if err := firstOf(b, &nameResp); err != nil {
+		return nil, pkgerr.Wrap(err, "unmarshaling request body")
+	}
+	return &nameResp, nil
+}
+
+// randomUserResp is the part of a randomuser.me response we use.
+type randomUserResp struct {
+	Error   string `json:"error"`
+	Results []struct {
+		Gender string `json:"gender"`
+		Name   struct {
+			First string `json:"first"`
+			Last  string `json:"last"`
+		} `json:"name"`
+		Location struct {
+			Country string `json:"country"`
+		} `json:"location"`
+	} `json:"results"`
+}
+
+// decodeRandomUser maps the first randomuser.me user to a name.
+func decodeRandomUser(b []byte) (*NameResp, error) {
+	var ru randomUserResp
+	if err := json.Unmarshal(b, &ru); err != nil {
+		return nil, pkgerr.Wrap(err, "unmarshaling request body")
+	}
+	if ru.Error != "" {
+		return nil, fmt.Errorf("name service error: %s", ru.Error)
+	}
+	if len(ru.Results) == 0 {
+		return nil, errors.New("name service returned no users")
+	}
+	u := ru.Results[0]
+	return &NameResp{
+		Name:    u.Name.First,
+		Surname: u.Name.Last,
+		Gender:  u.Gender,
+		Region:  u.Location.Country,
+	}, nil
+}
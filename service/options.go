@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Option configures optional behavior of the LaffService.
+type Option func(*LaffService)
+
+// WithWarmup sets the number of jokes that must be cached before the cache
+// is considered warm, see Warm.  Zero means the cache starts out warm.  The
+// number is capped at the cache size.
+func WithWarmup(jokes int) Option {
+	return func(ls *LaffService) {
+		ls.warmup = jokes
+	}
+}
+
+// WithNameURL sets the URL of the name service, in place of the one of
+// the built-in name service picked.  It is mostly for pointing at a
+// staging or mock service.
+func WithNameURL(u string) Option {
+	return func(ls *LaffService) {
+		ls.nameURL = u
+	}
+}
+
+// WithJokeURL sets the URL for fetching a random joke from the joke
+// service.  The name is added as the firstName and lastName parameters.
+func WithJokeURL(u string) Option {
+	return func(ls *LaffService) {
+		ls.jokeURL = u
+	}
+}
+
+// WithCatalogURL sets the URL listing all the jokes of the joke service,
+// see Catalog.
+func WithCatalogURL(u string) Option {
+	return func(ls *LaffService) {
+		ls.catalogURL = u
+	}
+}
+
+// WithUserAgent sets the User-Agent sent to the upstream services, as
+// some of them want to know who is calling.
+func WithUserAgent(ua string) Option {
+	return func(ls *LaffService) {
+		ls.userAgent = ua
+	}
+}
+
+// WithNameHeaders adds headers to the requests to the name service.  They
+// take precedence over the User-Agent and the other headers we set.
+func WithNameHeaders(h http.Header) Option {
+	return func(ls *LaffService) {
+		ls.nameHeaders = h
+	}
+}
+
+// WithJokeHeaders adds headers to the requests to the joke service,
+// including those for its catalog, like WithNameHeaders.
+func WithJokeHeaders(h http.Header) Option {
+	return func(ls *LaffService) {
+		ls.jokeHeaders = h
+	}
+}
+
+// Credential authenticates us to an upstream service that wants an API
+// key or token.  The secret is sent in the header, as a bearer token if
+// the header is Authorization.  Printing a Credential hides the secret,
+// so it can be logged safely.
+type Credential struct {
+	Header string
+	Secret string
+}
+
+func (c Credential) String() string {
+	if c.Secret == "" {
+		return "none"
+	}
+	return c.Header + ": <redacted>"
+}
+
+// GoString hides the secret from %#v as well.
+func (c Credential) GoString() string {
+	return c.String()
+}
+
+// set adds the credential to the headers, if there is one.
+func (c Credential) set(h http.Header) {
+	switch {
+	case c.Secret == "":
+	case http.CanonicalHeaderKey(c.Header) == "Authorization":
+		h.Set(c.Header, "Bearer "+c.Secret)
+	default:
+		h.Set(c.Header, c.Secret)
+	}
+}
+
+// WithNameCredential authenticates the requests to the name service.  It
+// takes precedence over the headers from WithNameHeaders.
+func WithNameCredential(c Credential) Option {
+	return func(ls *LaffService) {
+		ls.nameCred = c
+	}
+}
+
+// WithJokeCredential authenticates the requests to the joke service, like
+// WithNameCredential.
+func WithJokeCredential(c Credential) Option {
+	return func(ls *LaffService) {
+		ls.jokeCred = c
+	}
+}
+
+// WithConcurrency bounds the calls in flight to each of the name and joke
+// services, counting both the cache workers and the direct fetches, so a
+// slow upstream can't pile up goroutines and sockets.  The calls over the
+// limit wait their turn.  Zero means no limit, which is the default.
+func WithConcurrency(name, joke int) Option {
+	return func(ls *LaffService) {
+		ls.nameSem = newSemaphore(name)
+		ls.jokeSem = newSemaphore(joke)
+	}
+}
+
+// Limiter hands out the slots of a rate budget.  Reserve takes a slot if
+// one is available, returning zero, or else returns how long until one
+// may be.
+type Limiter interface {
+	Reserve(ctx context.Context) (time.Duration, error)
+}
+
+// WithNameLimiter checks every name fetch against the limiter, on top of
+// the pacing of the cache workers.  It is used to share the name service
+// budget among several replicas.
+func WithNameLimiter(l Limiter) Option {
+	return func(ls *LaffService) {
+		ls.nameLimiter = l
+	}
+}
+
+// Filter screens the text of the jokes.
+type Filter interface {
+	Allowed(text string) bool
+}
+
+// WithFilter discards the jokes the filter doesn't allow, before they are
+// cached or served, and fetches others in their place.
+func WithFilter(f Filter) Option {
+	return func(ls *LaffService) {
+		ls.filter = f
+	}
+}
+
+// JokeProvider is a source of jokes other than the joke service.  The
+// joke should be made out to the name given.
+type JokeProvider interface {
+	Joke(ctx context.Context, name *NameResp) (Joke, error)
+}
+
+// WithJokeProvider adds a source of jokes.  Each joke comes from one of
+// the providers or the joke service, chosen at random, see
+// WithWeightedJokeProvider for giving them different shares.
+func WithJokeProvider(p JokeProvider) Option {
+	return WithWeightedJokeProvider("", 1, p)
+}
+
+// NameProvider is a source of names other than the name service.
+type NameProvider interface {
+	Name(ctx context.Context) (*NameResp, error)
+}
+
+// WithNameProvider adds a source of names.  Each name comes from one of
+// the providers or the name service, chosen at random.
+func WithNameProvider(p NameProvider) Option {
+	return func(ls *LaffService) {
+		ls.names = append(ls.names, p)
+	}
+}
+
+// WithJokeCatalog serves the jokes of the joke service from a local copy
+// of its catalog, so we don't depend on it for every joke.  The joke
+// service is still used while the copy is empty.
+func WithJokeCatalog(p JokeProvider) Option {
+	return func(ls *LaffService) {
+		ls.catalog = p
+	}
+}
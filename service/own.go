@@ -0,0 +1,28 @@
+package service
+
+import "context"
+
+// ownKey is the context key for the caller's own name.
+type ownKey struct{}
+
+// OwnName returns a context having the jokes for a request made out to
+// the name, such as the caller's own, rather than one from the name cache
+// or the name service.  The cached jokes made out to someone else aren't
+// served for it, and the jokes fetched for it aren't cached for the
+// others.
+func OwnName(ctx context.Context, name NameResp) context.Context {
+	return context.WithValue(ctx, ownKey{}, name)
+}
+
+// ownName returns the name asked for with the request, if any.
+func ownName(ctx context.Context) (NameResp, bool) {
+	name, ok := ctx.Value(ownKey{}).(NameResp)
+	return name, ok
+}
+
+// isFor reports whether the joke is made out to the name asked for with
+// the request, if any.
+func isFor(ctx context.Context, jk Joke) bool {
+	name, ok := ownName(ctx)
+	return !ok || jk.Name == name
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooled is the size of the largest buffer put back in the pool.  The
+// responses are small, so a big one, such as a catalog, is left to the
+// garbage collector rather than held on to.
+const maxPooled = 64 << 10
+
+// bufPool holds the buffers the upstream responses are read into, so each
+// fetch doesn't allocate, and grow, a buffer of its own.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// readBody reads the body into a buffer from the pool, which is to be
+// given back with releaseBody once the body is decoded.  Nothing decoded
+// may refer to the bytes of the buffer, which encoding/json ensures.
+func readBody(r io.Reader) (*bytes.Buffer, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if _, err := buf.ReadFrom(r); err != nil {
+		releaseBody(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// releaseBody gives the buffer back to the pool.
+func releaseBody(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooled {
+		return
+	}
+	bufPool.Put(buf)
+}
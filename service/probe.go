@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// probeWindow is the number of the latest probes the availability of
+	// an upstream service is taken over.
+	probeWindow = 20
+
+	// probeDownAfter is the number of probes in a row that must fail for
+	// an upstream service to be taken as down.
+	probeDownAfter = 3
+
+	// defaultProbeTimeout limits each probe, if not set.
+	defaultProbeTimeout = 5 * time.Second
+)
+
+// Probe configures the synthetic probes of the upstream services, see
+// WithProbes.
+type Probe struct {
+	Interval time.Duration // between the probes of each service
+	Timeout  time.Duration // limit on each probe, 5 seconds if 0
+}
+
+// ProbeStats is how the probes of an upstream service have done.
+type ProbeStats struct {
+	Probes       int64      `json:"probes"`
+	Failures     int64      `json:"failures"`
+	Availability float64    `json:"availability"` // of the latest 20
+	Latency      string     `json:"latency"`      // of the latest
+	LastSuccess  *time.Time `json:"lastSuccess,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	Down         bool       `json:"down"` // the latest 3 failed
+}
+
+// prober probes an upstream service, keeping the latest results.
+type prober struct {
+	upstream string
+
+	mu          sync.Mutex
+	probes      int64
+	failures    int64
+	results     [probeWindow]bool // whether each of the latest succeeded, a ring
+	inRow       int               // failures in a row
+	latency     time.Duration
+	lastSuccess time.Time
+	lastError   string
+}
+
+// WithProbes has the service probe each upstream service every interval,
+// whether or not there are requests, so its health is known even while
+// the instance is idle.  A probe is a HEAD request to the service's URL,
+// and any response short of a 5xx means it is up.  The probes go through
+// the circuit breakers, so an open breaker is probed as soon as its
+// cooldown is over, and a service failing its probes trips its breaker.
+// The readiness check fails while a service is down and nothing is
+// cached.  The probes are off by default, as the name service may count
+// them against its rate limit.
+func WithProbes(p Probe) Option {
+	return func(ls *LaffService) {
+		ls.probe = &p
+		ls.nameProber = &prober{upstream: "name"}
+		ls.jokeProber = &prober{upstream: "joke"}
+	}
+}
+
+// setupProbes checks the probe settings, if the services are probed.
+func (ls *LaffService) setupProbes() error {
+	p := ls.probe
+	if p == nil {
+		return nil
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultProbeTimeout
+	}
+	if p.Interval <= 0 || p.Timeout < 0 {
+		return fmt.Errorf("invalid probe interval %v or timeout %v", p.Interval, p.Timeout)
+	}
+	return nil
+}
+
+// runProbes probes the upstream services every interval, until the
+// context is done.
+func (ls *LaffService) runProbes(ctx context.Context) {
+	for sleep(ctx, ls.clock, ls.probe.Interval) {
+		ls.probeOnce(ctx, ls.nameProber, ls.nameURL, ls.nameHeaders, ls.nameCred, ls.nameBreaker)
+		ls.probeOnce(ctx, ls.jokeProber, ls.jokeURL, ls.jokeHeaders, ls.jokeCred, ls.jokeBreaker)
+	}
+}
+
+// probeOnce probes an upstream service, unless its breaker is open, and
+// records the result.
+func (ls *LaffService) probeOnce(ctx context.Context, p *prober, rawURL string, headers http.Header,
+	cred Credential, brk *breaker) {
+	if brk.allow(ls.clock.Now()) != nil {
+		return
+	}
+	start := ls.clock.Now()
+	err := ls.sendProbe(ctx, p.upstream, rawURL, headers, cred)
+	brk.record(ctx, err, ls.clock.Now())
+	if ctx.Err() != nil {
+		return
+	}
+	p.record(err, ls.clock.Now(), ls.clock.Now().Sub(start))
+	if err != nil {
+		ls.log.Warnw("Upstream probe failed", "upstream", p.upstream, "error", err)
+	}
+}
+
+// sendProbe makes a HEAD request to the service, without the query, so
+// the joke service isn't asked for a joke.
+func (ls *LaffService) sendProbe(ctx context.Context, upstream, rawURL string, headers http.Header,
+	cred Credential) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = ""
+	ctx, cancel := context.WithTimeout(ctx, ls.probe.Timeout)
+	defer cancel()
+	proxy, conns := ls.nameProxy, &ls.nameConns
+	if upstream == "joke" {
+		proxy, conns = ls.jokeProxy, &ls.jokeConns
+	}
+	req, err := ls.newRequest(conns.trace(withProxy(ctx, proxy)), u.String(), headers, cred)
+	if err != nil {
+		return err
+	}
+	req.Method = http.MethodHead
+	resp, err := ls.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("probe got HTTP status %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+// record notes the result of a probe.
+func (p *prober) record(err error, now time.Time, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.results[p.probes%probeWindow] = err == nil
+	p.probes++
+	p.latency = latency
+	if err != nil {
+		p.failures++
+		p.inRow++
+		p.lastError = err.Error()
+		return
+	}
+	p.inRow = 0
+	p.lastSuccess = now
+}
+
+// stats returns how the probes have done.
+func (p *prober) stats() ProbeStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := ProbeStats{
+		Probes:    p.probes,
+		Failures:  p.failures,
+		Latency:   p.latency.String(),
+		LastError: p.lastError,
+		Down:      p.inRow >= probeDownAfter,
+	}
+	if n := min(p.probes, probeWindow); n > 0 {
+		var ok int
+		for _, r := range p.results[:n] {
+			if r {
+				ok++
+			}
+		}
+		st.Availability = float64(ok) / float64(n)
+	}
+	if !p.lastSuccess.IsZero() {
+		last := p.lastSuccess
+		st.LastSuccess = &last
+	}
+	return st
+}
+
+// Probes returns how the probes of each upstream service, keyed by "name"
+// and "joke", have done, or nil if they aren't probed.
+func (ls *LaffService) Probes() map[string]ProbeStats {
+	if ls.probe == nil {
+		return nil
+	}
+	return map[string]ProbeStats{"name": ls.nameProber.stats(), "joke": ls.jokeProber.stats()}
+}
+
+// Down returns the upstream services the latest probes have all failed
+// for, which is none if they aren't probed.
+func (ls *LaffService) Down() []string {
+	var down []string
+	for name, st := range ls.Probes() {
+		if st.Down {
+			down = append(down, name)
+		}
+	}
+	sort.Strings(down)
+	return down
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultNameRate is what the name service has always allowed us, with a
+// few names at once so the cache fills quickly at startup.
+var defaultNameRate = Rate{Requests: 6, Interval: time.Minute, Burst: 3}
+
+// Rate is how often we may call an upstream service: a number of requests
+// per interval, with up to Burst of them at once.  The zero Rate means no
+// limit.
+type Rate struct {
+	Requests int
+	Interval time.Duration
+	Burst    int
+}
+
+func (r Rate) String() string {
+	if r.Requests == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d per %v, burst %d", r.Requests, r.Interval, r.Burst)
+}
+
+// limiter creates the token bucket for the rate, or nil for no limit.
+func (r Rate) limiter() (*rate.Limiter, error) {
+	if r.Requests == 0 {
+		return nil, nil
+	}
+	if r.Requests < 0 || r.Interval <= 0 || r.Burst <= 0 {
+		return nil, fmt.Errorf("invalid rate: %d per %v, burst %d", r.Requests, r.Interval, r.Burst)
+	}
+	return rate.NewLimiter(rate.Limit(float64(r.Requests)/r.Interval.Seconds()), r.Burst), nil
+}
+
+// WithNameRate sets how often the name service may be called, which is
+// 6 times a minute by default.  It applies to the cache workers and the
+// requests fetching a name directly alike.  With several replicas, see
+// WithNameLimiter as well.
+func WithNameRate(r Rate) Option {
+	return func(ls *LaffService) {
+		ls.nameRate = r
+	}
+}
+
+// WithJokeRate sets how often the joke service may be called, like
+// WithNameRate.  There is no limit by default.
+func WithJokeRate(r Rate) Option {
+	return func(ls *LaffService) {
+		ls.jokeRate = r
+	}
+}
+
+// waitKey is the context key marking callers that wait for the rate.
+type waitKey struct{}
+
+// waitForRate marks the context of a caller that would rather wait its
+// turn than be refused, which is what the cache workers want.
+func waitForRate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, waitKey{}, true)
+}
+
+// takeRate takes a turn to call an upstream service.  The cache workers
+// wait for it, while the requests are refused with a RateLimitError
+// saying how long to wait, as the caller is better off knowing.
+func takeRate(ctx context.Context, clock Clock, lim *rate.Limiter) error {
+	if lim == nil {
+		return nil
+	}
+	now := clock.Now()
+	res := lim.ReserveN(now, 1)
+	d := res.DelayFrom(now)
+	if d <= 0 {
+		return nil
+	}
+	if wait, _ := ctx.Value(waitKey{}).(bool); wait {
+		if !sleep(ctx, clock, d) {
+			res.CancelAt(clock.Now())
+			return ctx.Err()
+		}
+		return nil
+	}
+	res.CancelAt(now)
+	return RateLimitError{retry: int((d + time.Second - 1) / time.Second)}
+}
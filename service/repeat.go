@@ -0,0 +1,30 @@
+package service
+
+import "context"
+
+// repeatKey is the context key for the jokes the caller has seen.
+type repeatKey struct{}
+
+// AvoidRepeats returns a context having the jokes served for a request
+// skip those the caller has seen, as told by the function, such as those
+// served to the same client lately.  The cached jokes not seen are
+// served, and otherwise jokes are fetched for the name until one isn't,
+// up to the attempts made to pass the filter, the others going in the
+// joke cache for the other requests.  If every joke tried was seen, the
+// last is served after all, as a repeat is better than no joke.  The
+// function must be safe to call with the caches locked.
+func AvoidRepeats(ctx context.Context, seen func(id int) bool) context.Context {
+	return context.WithValue(ctx, repeatKey{}, seen)
+}
+
+// isRepeat reports whether the caller has seen the joke.
+func isRepeat(ctx context.Context, jk Joke) bool {
+	seen, ok := ctx.Value(repeatKey{}).(func(int) bool)
+	return ok && seen(jk.ID)
+}
+
+// avoidsRepeats reports whether the request avoids the jokes seen.
+func avoidsRepeats(ctx context.Context) bool {
+	_, ok := ctx.Value(repeatKey{}).(func(int) bool)
+	return ok
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSTTL = 5 * time.Minute  // longest addresses are kept by default
+	defaultNegTTL = 30 * time.Second // how long a missing host is remembered
+	minDNSTTL     = time.Second      // shortest addresses are kept
+	minDNSBackoff = time.Second      // first wait after a failed lookup
+	maxDNSBackoff = time.Minute      // longest wait between failed lookups
+)
+
+// DNSCache configures the caching of the upstream host addresses, see
+// WithDNSCache.  The zero values are the defaults.
+type DNSCache struct {
+	MaxTTL      time.Duration // longest addresses are kept, whatever their TTL
+	NegativeTTL time.Duration // how long a host that doesn't exist is remembered
+}
+
+// DNSStats is how the DNS cache has done.
+type DNSStats struct {
+	Hosts    int   `json:"hosts"`
+	Hits     int64 `json:"hits"`
+	Lookups  int64 `json:"lookups"`
+	Failures int64 `json:"failures"`
+}
+
+// WithDNSCache caches the addresses of the upstream hosts, so they aren't
+// looked up on every call.  The addresses are kept for the TTL of their
+// DNS records, up to MaxTTL, and a host that doesn't exist is remembered
+// for NegativeTTL.  When a lookup fails for another reason, it isn't
+// tried again for a while, backing off up to a minute, and the addresses
+// we had are used in the meantime.  The cache workers wait out the pause.
+func WithDNSCache(c DNSCache) Option {
+	return func(ls *LaffService) {
+		ls.dns = &resolver{DNSCache: c}
+	}
+}
+
+// resolver is the DNS cache behind the dialer of the upstream calls.
+type resolver struct {
+	DNSCache
+	log    func(msg string, keysAndValues ...interface{})
+	dialer net.Dialer
+	clock  Clock
+
+	// lookup finds the addresses of the host, and how long they can be
+	// kept, or 0 if not known.
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+
+	mu    sync.Mutex
+	hosts map[string]dnsEntry
+
+	hits     int64
+	lookups  int64
+	failures int64
+}
+
+// dnsEntry is what we know of a host.
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time     // when the addresses are due to be looked up again
+	err     error         // why the last lookup failed, if it did
+	retry   time.Time     // when to look up the host again after a failure
+	backoff time.Duration // how long we waited after the last failure
+}
+
+// setup fills in the defaults.
+func (r *resolver) setup(ls *LaffService) {
+	if r.MaxTTL <= 0 {
+		r.MaxTTL = defaultDNSTTL
+	}
+	if r.NegativeTTL <= 0 {
+		r.NegativeTTL = defaultNegTTL
+	}
+	r.log = ls.log.Warnw
+	r.clock = ls.clock
+	r.dialer = net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if r.lookup == nil {
+		r.lookup = r.lookupTTL
+	}
+	r.hosts = make(map[string]dnsEntry)
+}
+
+// dialContext dials the address, looking up its host in the cache.  The
+// addresses of the host are tried in turn.
+func (r *resolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := r.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, ip := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// resolve returns the addresses of the host, from the cache if they are
+// still fresh, or if the host is backing off after a failure.
+func (r *resolver) resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := r.clock.Now()
+	r.mu.Lock()
+	e := r.hosts[host]
+	r.mu.Unlock()
+	switch {
+	case e.err == nil && now.Before(e.expires):
+		atomic.AddInt64(&r.hits, 1)
+		return e.addrs, nil
+	case e.err != nil && now.Before(e.retry):
+		atomic.AddInt64(&r.hits, 1)
+		if len(e.addrs) > 0 {
+			return e.addrs, nil
+		}
+		return nil, &lookupError{err: e.err, retry: e.retry}
+	}
+
+	atomic.AddInt64(&r.lookups, 1)
+	addrs, ttl, err := r.lookup(ctx, host)
+	if err != nil {
+		// Being stopped isn't the host's fault.
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&r.failures, 1)
+		e = r.failed(host, e, now, err)
+		if len(e.addrs) > 0 {
+			return e.addrs, nil
+		}
+		return nil, &lookupError{err: err, retry: e.retry}
+	}
+	if ttl <= 0 || ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	r.store(host, dnsEntry{addrs: addrs, expires: now.Add(ttl)})
+	return addrs, nil
+}
+
+// failed notes a failed lookup of the host.  A host that doesn't exist
+// is remembered for the negative TTL, while the other failures back off,
+// keeping the addresses we had.
+func (r *resolver) failed(host string, e dnsEntry, now time.Time, err error) dnsEntry {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		e = dnsEntry{err: err, retry: now.Add(r.NegativeTTL)}
+	} else {
+		e.backoff = min(max(2*e.backoff, minDNSBackoff), maxDNSBackoff)
+		e.err, e.retry = err, now.Add(e.backoff)
+		r.log("Looking up upstream host failed, backing off", "host", host,
+			"backoff", e.backoff, "error", err)
+	}
+	r.store(host, e)
+	return e
+}
+
+// lookupError is a failed lookup of an upstream host, which won't be
+// tried again until the retry time.
+type lookupError struct {
+	err   error
+	retry time.Time
+}
+
+func (le *lookupError) Error() string {
+	return le.err.Error()
+}
+
+func (le *lookupError) Unwrap() error {
+	return le.err
+}
+
+// waitToRetry waits until the host of a failed lookup can be looked up
+// again, so the cache workers don't spin on the cached failure.  It
+// returns false if the context is done first.  Other errors don't wait.
+func (ls *LaffService) waitToRetry(ctx context.Context, err error) bool {
+	var le *lookupError
+	if !errors.As(err, &le) {
+		return true
+	}
+	return sleep(ctx, ls.clock, le.retry.Sub(ls.clock.Now()))
+}
+
+// store caches what we know of the host.
+func (r *resolver) store(host string, e dnsEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts[host] = e
+}
+
+// stats returns how the cache has done.
+func (r *resolver) stats() DNSStats {
+	r.mu.Lock()
+	hosts := len(r.hosts)
+	r.mu.Unlock()
+	return DNSStats{
+		Hosts:    hosts,
+		Hits:     atomic.LoadInt64(&r.hits),
+		Lookups:  atomic.LoadInt64(&r.lookups),
+		Failures: atomic.LoadInt64(&r.failures),
+	}
+}
+
+// lookupTTL looks up the host with the Go resolver, watching the answers
+// go by for their TTLs, which the resolver doesn't tell us.  The TTL isn't
+// known for the hosts in /etc/hosts, or the answers too big for UDP.
+func (r *resolver) lookupTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	var ttls ttlRecorder
+	res := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := r.dialer.DialContext(ctx, network, address)
+			if uc, ok := conn.(*net.UDPConn); ok {
+				return &ttlConn{UDPConn: uc, ttls: &ttls}, nil
+			}
+			return conn, err
+		},
+	}
+	addrs, err := res.LookupIPAddr(ctx, host)
+	return addrs, ttls.ttl(), err
+}
+
+// ttlRecorder keeps the lowest TTL of the answers seen.
+type ttlRecorder struct {
+	mu   sync.Mutex
+	min  uint32
+	seen bool
+}
+
+// note records the TTLs of the answers in the DNS message.
+func (tr *ttlRecorder) note(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		if h.Type == dnsmessage.TypeA || h.Type == dnsmessage.TypeAAAA || h.Type == dnsmessage.TypeCNAME {
+			tr.mu.Lock()
+			if !tr.seen || h.TTL < tr.min {
+				tr.min, tr.seen = h.TTL, true
+			}
+			tr.mu.Unlock()
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// ttl returns the lowest TTL seen, or 0 if there were none.
+func (tr *ttlRecorder) ttl() time.Duration {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if !tr.seen {
+		return 0
+	}
+	return max(time.Duration(tr.min)*time.Second, minDNSTTL)
+}
+
+// ttlConn is a connection to a DNS server that shows the answers to a
+// ttlRecorder.  It is still a net.PacketConn, so the Go resolver reads
+// whole packets from it.
+type ttlConn struct {
+	*net.UDPConn
+	ttls *ttlRecorder
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.ttls.note(b[:n])
+	}
+	return n, err
+}
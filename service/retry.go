@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retryBuckets is how many parts the retry budget window is kept in, as it
+// slides along.
+const retryBuckets = 10
+
+// defaultRetryBudget lets a fifth of the calls be retries.
+var defaultRetryBudget = RetryBudget{Percent: 20, Window: time.Minute, MinRetries: 10}
+
+// RetryBudget caps the share of the calls to an upstream service that are
+// retries of failed ones, over a sliding window.  A few retries are always
+// allowed, so a quiet service can still retry.
+type RetryBudget struct {
+	Percent    int           // most of the calls that may be retries
+	Window     time.Duration // how far back the calls are counted
+	MinRetries int           // retries allowed in the window whatever the calls
+}
+
+// RetryStats is how the retry budget of an upstream service has been used.
+type RetryStats struct {
+	Retries int64 `json:"retries"`
+	Denied  int64 `json:"denied"`
+}
+
+// WithRetryBudget sets the retry budget of each upstream service, which
+// is 20% over a minute by default.  Once the cache workers have spent it,
+// they hold off retrying until the calls that succeed make room, so they
+// don't add to the load of a failing service.
+func WithRetryBudget(rb RetryBudget) Option {
+	return func(ls *LaffService) {
+		ls.nameRetries.RetryBudget = rb
+		ls.jokeRetries.RetryBudget = rb
+	}
+}
+
+// retryBudget is the running budget of an upstream service.
+type retryBudget struct {
+	RetryBudget
+	upstream string
+	clock    Clock
+
+	mu      sync.Mutex
+	buckets [retryBuckets]retryCount
+	cur     int       // the bucket being filled
+	start   time.Time // when the current bucket started
+
+	retries int64
+	denied  int64
+}
+
+// retryCount is the calls and retries in a part of the window.
+type retryCount struct {
+	calls   int
+	retries int
+}
+
+// check makes sure the budget makes sense.
+func (b *retryBudget) check() error {
+	if b.Percent < 0 || b.Percent > 100 || b.Window <= 0 || b.MinRetries < 0 {
+		return fmt.Errorf("invalid %s retry budget: %d%% over %v, at least %d",
+			b.upstream, b.Percent, b.Window, b.MinRetries)
+	}
+	return nil
+}
+
+// rotate moves the window along to now.  It must be called with the lock
+// held.
+func (b *retryBudget) rotate(now time.Time) {
+	width := max(b.Window/retryBuckets, 1)
+	if now.Sub(b.start) >= b.Window {
+		b.buckets = [retryBuckets]retryCount{}
+		b.start = now
+		return
+	}
+	for now.Sub(b.start) >= width {
+		b.cur = (b.cur + 1) % retryBuckets
+		b.buckets[b.cur] = retryCount{}
+		b.start = b.start.Add(width)
+	}
+}
+
+// call counts a call to the upstream service, retried or not.
+func (b *retryBudget) call() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rotate(b.clock.Now())
+	b.buckets[b.cur].calls++
+}
+
+// take takes a retry from the budget, reporting whether there was one.
+func (b *retryBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rotate(b.clock.Now())
+	var calls, retries int
+	for _, bk := range b.buckets {
+		calls += bk.calls
+		retries += bk.retries
+	}
+	if retries >= b.MinRetries && (retries+1)*100 > b.Percent*calls {
+		atomic.AddInt64(&b.denied, 1)
+		return false
+	}
+	b.buckets[b.cur].retries++
+	atomic.AddInt64(&b.retries, 1)
+	return true
+}
+
+// wait waits for a retry from the budget, so a cache worker doesn't pile
+// on a failing service.  It returns false if the context is done first.
+func (b *retryBudget) wait(ctx context.Context, log func(msg string, keysAndValues ...interface{})) bool {
+	for i := 0; !b.take(); i++ {
+		if i == 0 {
+			log("Retry budget spent, holding off", "upstream", b.upstream)
+		}
+		if !sleep(ctx, b.clock, b.Window/retryBuckets) {
+			return false
+		}
+	}
+	return true
+}
+
+// stats returns how the budget has been used.
+func (b *retryBudget) stats() RetryStats {
+	return RetryStats{
+		Retries: atomic.LoadInt64(&b.retries),
+		Denied:  atomic.LoadInt64(&b.denied),
+	}
+}
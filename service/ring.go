@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// ring is a bounded cache, used for the names and jokes rather than
+// buffered channels, as unlike a channel it can be looked into, have its
+// stale entries evicted and be resized while in use.  The workers block
+// on it with Push and Pop, as they would on a channel, while the requests
+// take from it with TryPop, or TryPopNewest, never waiting.
+type ring[T any] struct {
+	mu      sync.Mutex
+	buf     []T
+	head    int           // index of the oldest entry
+	n       int           // number of entries
+	changed chan struct{} // closed, and replaced, when the ring changes
+}
+
+// newRing returns an empty ring holding up to capacity entries, and at
+// least one.
+func newRing[T any](capacity int) *ring[T] {
+	return &ring[T]{
+		buf:     make([]T, max(capacity, 1)),
+		changed: make(chan struct{}),
+	}
+}
+
+// Len returns the number of entries.
+func (r *ring[T]) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
+
+// Cap returns the most entries the ring holds.
+func (r *ring[T]) Cap() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buf)
+}
+
+// Peek returns the oldest entry, without removing it.
+func (r *ring[T]) Peek() (T, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n == 0 {
+		var zero T
+		return zero, false
+	}
+	return r.buf[r.head], true
+}
+
+// TryPop removes and returns the oldest entry, if there is one.
+func (r *ring[T]) TryPop() (T, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pop()
+}
+
+// TryPopNewest removes and returns the newest entry, if there is one.
+func (r *ring[T]) TryPopNewest() (T, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var zero T
+	if r.n == 0 {
+		return zero, false
+	}
+	i := (r.head + r.n - 1) % len(r.buf)
+	v := r.buf[i]
+	r.buf[i] = zero
+	r.n--
+	r.notify()
+	return v, true
+}
+
+// TryPopMatch removes and returns the oldest entry match reports true
+// for, or the newest if asked, keeping the order of the rest.
+func (r *ring[T]) TryPopMatch(match func(T) bool, newest bool) (T, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var zero T
+	for j := range r.n {
+		i := j
+		if newest {
+			i = r.n - 1 - j
+		}
+		v := r.buf[(r.head+i)%len(r.buf)]
+		if !match(v) {
+			continue
+		}
+		for k := i; k < r.n-1; k++ {
+			r.buf[(r.head+k)%len(r.buf)] = r.buf[(r.head+k+1)%len(r.buf)]
+		}
+		r.buf[(r.head+r.n-1)%len(r.buf)] = zero
+		r.n--
+		r.notify()
+		return v, true
+	}
+	return zero, false
+}
+
+// TryPush adds the entry, if the ring isn't full.
+func (r *ring[T]) TryPush(v T) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.push(v)
+}
+
+// Pop removes and returns the oldest entry, waiting for one if the ring
+// is empty.  It fails only if the context is done first.
+func (r *ring[T]) Pop(ctx context.Context) (T, error) {
+	for {
+		r.mu.Lock()
+		v, ok := r.pop()
+		changed := r.changed
+		r.mu.Unlock()
+		if ok {
+			return v, nil
+		}
+		select {
+		case <-ctx.Done():
+			return v, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Push adds the entry, waiting for room if the ring is full.  It fails
+// only if the context is done first.
+func (r *ring[T]) Push(ctx context.Context, v T) error {
+	for {
+		r.mu.Lock()
+		ok := r.push(v)
+		changed := r.changed
+		r.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Resize changes the most entries the ring holds, to at least one.  When
+// it shrinks below the number of entries, the oldest are dropped, and the
+// number dropped is returned.
+func (r *ring[T]) Resize(capacity int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	capacity = max(capacity, 1)
+	dropped := max(r.n-capacity, 0)
+	buf := make([]T, capacity)
+	for i := range r.n - dropped {
+		buf[i] = r.buf[(r.head+dropped+i)%len(r.buf)]
+	}
+	r.buf, r.head, r.n = buf, 0, r.n-dropped
+	r.notify()
+	return dropped
+}
+
+// Evict removes the entries stale reports true for, keeping the order of
+// the rest, and returns the number removed.
+func (r *ring[T]) Evict(stale func(T) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kept int
+	for i := range r.n {
+		v := r.buf[(r.head+i)%len(r.buf)]
+		if !stale(v) {
+			r.buf[(r.head+kept)%len(r.buf)] = v
+			kept++
+		}
+	}
+	evicted := r.n - kept
+	var zero T
+	for i := kept; i < r.n; i++ {
+		r.buf[(r.head+i)%len(r.buf)] = zero
+	}
+	r.n = kept
+	if evicted > 0 {
+		r.notify()
+	}
+	return evicted
+}
+
+// pop removes the oldest entry, with the lock held.
+func (r *ring[T]) pop() (T, bool) {
+	var zero T
+	if r.n == 0 {
+		return zero, false
+	}
+	v := r.buf[r.head]
+	r.buf[r.head] = zero
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	r.notify()
+	return v, true
+}
+
+// push adds an entry, if there's room, with the lock held.
+func (r *ring[T]) push(v T) bool {
+	if r.n == len(r.buf) {
+		return false
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = v
+	r.n++
+	r.notify()
+	return true
+}
+
+// notify wakes those waiting on the ring, with the lock held.
+func (r *ring[T]) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// SeedNames adds names given by the operator, such as the team's roster,
+// to the name cache while it has room, returning how many were added.
+// The cache workers make jokes for them like the fetched names, so they
+// spare the name service as many calls.  The names are tidied like the
+// fetched ones, and if one can't be, none are added.
+func (ls *LaffService) SeedNames(names []NameResp) (int, error) {
+	tidied := make([]NameResp, len(names))
+	for i, name := range names {
+		var err error
+		if tidied[i], err = ls.CheckName(name); err != nil {
+			return 0, fmt.Errorf("name %d: %w", i, err)
+		}
+	}
+	added := 0
+	for i := range tidied {
+		if !ls.nameCache.TryPush(&tidied[i]) {
+			break
+		}
+		added++
+	}
+	atomic.AddInt64(&ls.counters.seeded, int64(added))
+	return added, nil
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// The placeholders for a second person's name in the jokes about two, as
+// {first} and {last} are for the first.
+const (
+	first2 = "{first2}"
+	last2  = "{last2}"
+)
+
+// secondKey is the context key for the caller's second name.
+type secondKey struct{}
+
+// SecondName returns a context having the jokes about two people served
+// for a request made out to the name as the second person, rather than
+// one from the name cache or the name service.  The cached jokes made out
+// to someone else aren't served for it.
+func SecondName(ctx context.Context, name NameResp) context.Context {
+	return context.WithValue(ctx, secondKey{}, name)
+}
+
+// CheckName tidies a name given by a caller, such as for SecondName, the
+// same way as the fetched names, failing if it has control characters or
+// a part longer than the names allowed, or no first name.
+func (ls *LaffService) CheckName(name NameResp) (NameResp, error) {
+	if err := tidyName(&name, ls.maxName); err != nil {
+		return NameResp{}, err
+	}
+	if name.Name == "" {
+		return NameResp{}, errors.New("no first name")
+	}
+	return name, nil
+}
+
+// secondName returns the caller's second name, if any.
+func secondName(ctx context.Context) (NameResp, bool) {
+	name, ok := ctx.Value(secondKey{}).(NameResp)
+	return name, ok
+}
+
+// isSecondFor reports whether the joke's second person, if it has one, is
+// the one asked for with the request, if any.
+func isSecondFor(ctx context.Context, jk Joke) bool {
+	name, ok := secondName(ctx)
+	return !ok || jk.Second == nil || *jk.Second == name
+}
+
+// fillSecond fills in the second person's name in a joke about two, with
+// the caller's, or else a cached or fetched name, noting it in the joke.
+// The jokes about one are left as they are.
+func (ls *LaffService) fillSecond(ctx context.Context, jk Joke) (Joke, error) {
+	if !strings.Contains(jk.Text, first2) && !strings.Contains(jk.Text, last2) {
+		return jk, nil
+	}
+	name, ok := secondName(ctx)
+	if !ok {
+		nm, cached := ls.nameCache.TryPop()
+		if !cached {
+			var err error
+			if nm, err = ls.nextName(ctx); err != nil {
+				return Joke{}, err
+			}
+		}
+		name = *nm
+	}
+	first, last := name.Name, name.Surname
+	if ls.transliterates(ctx) {
+		first, last = transliterate(first), transliterate(last)
+	}
+	// A name without a surname leaves no gap where it would have been.
+	full := strings.TrimSpace(first + " " + last)
+	jk.Text = strings.NewReplacer(first2+" "+last2, full, first2, first, last2, last).Replace(jk.Text)
+	jk.Second = &name
+	return jk, nil
+}
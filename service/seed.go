@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+)
+
+// WithSeed makes the random choices of the service repeatable: the joke
+// source and the name source picked, and the jokes picked by the local
+// providers that use Intn.  The names and jokes of the upstream services
+// are theirs to choose, so only a service with local sources is fully
+// repeatable, and the cache workers share the seed, picking in whatever
+// order they run, so a request's own seed is the surer way, see Seed.
+func WithSeed(seed int64) Option {
+	return func(ls *LaffService) {
+		ls.rng = newLockedRand(seed)
+	}
+}
+
+// seedKey is the context key for the random source of a request.
+type seedKey struct{}
+
+// Seed returns a context making the random choices for a request
+// repeatable, like WithSeed, overriding the service's seed.  The jokes
+// cached weren't picked with the seed, so a seeded request gets a fresh
+// one.
+func Seed(ctx context.Context, seed int64) context.Context {
+	return context.WithValue(ctx, seedKey{}, newLockedRand(seed))
+}
+
+// Seeded reports whether the random choices for the context are made
+// from a seed, see Seed and WithSeed.
+func Seeded(ctx context.Context) bool {
+	_, ok := ctx.Value(seedKey{}).(*lockedRand)
+	return ok
+}
+
+// Intn returns a random number in [0,n) for the context, from its seed
+// if it has one.  The local providers use it to pick their jokes, so the
+// picks can be repeated.
+func Intn(ctx context.Context, n int) int {
+	if lr, ok := ctx.Value(seedKey{}).(*lockedRand); ok {
+		return lr.intn(n)
+	}
+	return rand.Intn(n)
+}
+
+// withSeed returns a context with the service's random source, unless it
+// has none or the request has its own.
+func (ls *LaffService) withSeed(ctx context.Context) context.Context {
+	if ls.rng == nil || Seeded(ctx) {
+		return ctx
+	}
+	return context.WithValue(ctx, seedKey{}, ls.rng)
+}
+
+// lockedRand is a seeded random source safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (lr *lockedRand) intn(n int) int {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.Intn(n)
+}
@@ -0,0 +1,42 @@
+package service
+
+import "context"
+
+// semaphore bounds the calls in flight to an upstream service.  A nil
+// semaphore doesn't limit anything.
+type semaphore chan struct{}
+
+// newSemaphore creates a semaphore for n calls at once, or nil for no
+// limit.
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits for a slot, or for the context to be done.  The slot must
+// be given back with release.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives back a slot taken with acquire.
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// inFlight returns the number of calls in flight.
+func (s semaphore) inFlight() int {
+	return len(s)
+}
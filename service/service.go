@@ -5,34 +5,49 @@ package service
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/gdotgordon/laff/logging"
 	pkgerr "github.com/pkg/errors"
-	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 const (
 	nameURL = "http://uinames.com/api/"
 	jokeURL = "http://api.icndb.com/jokes/random?"
 
+	// randomUserURL asks randomuser.me for just the fields we use.
+	randomUserURL = "https://randomuser.me/api/?inc=gender,name,location&noinfo"
+
+	// catalogURL lists all the jokes of the joke service.
+	catalogURL = "http://api.icndb.com/jokes?"
+
 	maxErrs = 50 // if the cache is erroring out consistently, shut it down.
 
 	dfltRetry = 90 // wait this many seconds to retry if retry header not parsed
+
+	maxRefetch = 5 // attempts at a joke that passes the filter, per name
 )
 
+// ErrNoJokes is returned by a JokeProvider that has no jokes to give,
+// in which case the joke service is used instead.
+var ErrNoJokes = errors.New("the provider has no jokes")
+
+// ErrFiltered means every joke fetched for a name was rejected by the
+// filter.
+var ErrFiltered = errors.New("no joke passed the filter")
+
 // RateLimitError signifies an HTTP 429 (too many requests) occurred, due
 // to the stingy limit of the name service.  We capture the value of the
 // retry wait from the HTTP Retry-After response header and delay that
-// amnount of time, plus some slop.
+// amnount of time, plus some slop.  The joke service's 429s and either
+// service's 503s are handled the same way.
 type RateLimitError struct {
 	retry int
 }
@@ -41,18 +56,98 @@ func (rle RateLimitError) Error() string {
 	return fmt.Sprintf("rate limit exceeded, retry in %d seconds", rle.retry)
 }
 
+// CacheUnavailable means a joke couldn't be served, as the caches were
+// empty and the name service had asked us to wait, or its breaker was
+// open, with no other source of names, so none was fetched.  Retry is
+// how long is left of the wait.
+type CacheUnavailable struct {
+	Retry time.Duration
+}
+
+func (cu CacheUnavailable) Error() string {
+	return fmt.Sprintf("no jokes cached and the name service is unavailable, retry in %v",
+		cu.Retry.Round(time.Second))
+}
+
 // LaffService is the implmentation of the service that returns the jokes.
 type LaffService struct {
 	client     *http.Client
-	nameChan   chan *NameResp
-	jokeChan   chan string
+	nameCache  *ring[*NameResp]
+	jokeCache  *ring[Joke]
 	numWorkers int
 	bufLen     int
 	nameErrs   int64
 	jokeErrs   int64
-	log        *zap.SugaredLogger
-	nameURL    string // Make this a member so we can override
-	jokeURL    string // Make this a member so we can override
+	counters   counters
+	log        logging.Logger
+	nameURL    string // the name service, see WithNameURL
+	jokeURL    string // the joke service, see WithJokeURL
+	catalogURL string // the joke service's catalog, see WithCatalogURL
+
+	userAgent   string        // sent to the upstream services, if set
+	nameHeaders http.Header   // added to the name service requests
+	jokeHeaders http.Header   // added to the joke service requests
+	nameCred    Credential    // authenticates us to the name service
+	jokeCred    Credential    // authenticates us to the joke service
+	nameSem     semaphore     // bounds the calls in flight to the name service
+	jokeSem     semaphore     // bounds the calls in flight to the joke service
+	nameRate    Rate          // how often the name service may be called
+	jokeRate    Rate          // how often the joke service may be called
+	nameBucket  *rate.Limiter // enforces nameRate, nil if unlimited
+	jokeBucket  *rate.Limiter // enforces jokeRate, nil if unlimited
+	nameRetries retryBudget   // bounds the retries of the name service calls
+	jokeRetries retryBudget   // bounds the retries of the joke service calls
+	nameBackoff backoff       // set when the name service asks us to wait
+	jokeBackoff backoff       // set when the joke service asks us to wait
+	nameBreaker *breaker      // stops calling the name service while it fails, if set
+	jokeBreaker *breaker      // stops calling the joke service while it fails, if set
+	probe       *Probe        // how the upstream services are probed, if they are
+	nameProber  *prober       // results of the name service probes
+	jokeProber  *prober       // results of the joke service probes
+	nameLog     callLog       // the latest calls to the name service
+	jokeLog     callLog       // the latest calls to the joke service
+	strict      bool          // reject the malformed responses, see WithStrictValidation
+	translit    bool          // spell the names in ASCII for the joke service
+	maxName     int           // most characters in each part of a name
+	rng         *lockedRand   // the random choices, if seeded, see WithSeed
+	cassette    *cassette     // records or replays the upstream calls, if set
+	chaos       *injector     // injects faults into the upstream calls, if set
+	autoSize    *AutoSize     // bounds the cache size, if it is tuned
+	maxAge      time.Duration // longest a joke is cached, if set
+	cacheWait   time.Duration // longest a request waits for a joke to be cached
+	clock       Clock         // tells the time, see WithClock
+	daily       dailyJoke     // the joke of the day, see JokeOfTheDay
+
+	nameService NameService                     // built-in name service
+	nameDecode  func([]byte) (*NameResp, error) // reads its names
+	nameLimiter Limiter                         // shared budget for name fetches, if any
+	leader      Leader                          // decides who prefetches the names, if set
+	nameQueue   NameQueue                       // names the leader shares, if any
+	filter      Filter                          // screens the joke text, if set
+
+	providers  []*jokeSource  // other sources of jokes, besides the joke service
+	upstream   jokeSource     // the joke service, as a source of jokes
+	experiment *experiment    // compares two joke sources, if set
+	nameCanary *canary        // tried out on some of the name requests, if set
+	jokeCanary *canary        // tried out on some of the joke requests, if set
+	catalog    JokeProvider   // local copy of the joke service's jokes, if any
+	names      []NameProvider // other sources of names, besides the name service
+	dns        *resolver      // caches the upstream host addresses, if set
+
+	transport http.RoundTripper // for the upstream calls, see WithTransport
+	tuning    TransportConfig   // of our transport, if not given one
+	nameConns connTrace         // how the name service calls use their connections
+	jokeConns connTrace         // how the joke service calls use their connections
+	nameProxy *url.URL          // proxy for the name service, if not from the environment
+	jokeProxy *url.URL          // proxy for the joke service, if not from the environment
+
+	warmup   int           // jokes cached before we're warm
+	warm     chan struct{} // closed once the cache is warm
+	warmOnce sync.Once
+
+	mu        sync.Mutex
+	stopCache context.CancelFunc // stops the running cache workers
+	cacheDone chan struct{}      // closed when the cache workers are done
 }
 
 // NameResp is to unmarshall the lookup of the name.
@@ -80,286 +175,809 @@ type JokeValue struct {
 	Categories []string `json:"categories,omitempty"`
 }
 
+// Joke is a completed joke with the fetched name inserted.  The ID is the
+// one assigned by the joke service, so it can be used to refer back to
+// the joke later on.
+type Joke struct {
+	ID         int      `json:"id"`
+	Text       string   `json:"joke"`
+	Name       NameResp `json:"name"`
+	Categories []string `json:"categories,omitempty"`
+
+	// Second is the second person's name, in a joke about two people,
+	// see SecondName.
+	Second *NameResp `json:"second,omitempty"`
+
+	// Cache is the cache the joke, or its name, was served from, see
+	// CacheJoke and CacheName, or empty if neither.
+	Cache string `json:"-"`
+
+	cached time.Time // when it was put in the joke cache
+}
+
+// The caches a joke can be served from, see Joke.Cache.
+const (
+	CacheJoke = "joke"
+	CacheName = "name"
+)
+
 // New creates a new LaffService, which both runs the workers to populate
 // the name and joke buffers, plus offers a public API to get the joke
 // with the name inserted.
-func New(numWorkers, bufLen int, logger *zap.SugaredLogger) (*LaffService, error) {
-	// Customize the Transport to have larger connection pool
-	defaultRoundTripper := http.DefaultTransport
-	defaultTransportPointer, ok := defaultRoundTripper.(*http.Transport)
+func New(numWorkers, bufLen int, logger logging.Logger, opts ...Option) (*LaffService, error) {
+	ls := LaffService{
+		nameCache:   newRing[*NameResp](bufLen),
+		jokeCache:   newRing[Joke](bufLen),
+		numWorkers:  numWorkers,
+		bufLen:      bufLen,
+		log:         logger,
+		jokeURL:     jokeURL,
+		catalogURL:  catalogURL,
+		nameService: UINames,
+		upstream:    jokeSource{name: JokeServiceName, weight: 1},
+		nameRate:    defaultNameRate,
+		tuning:      defaultTransportConfig,
+		maxName:     defaultMaxName,
+		nameRetries: retryBudget{RetryBudget: defaultRetryBudget, upstream: "name"},
+		jokeRetries: retryBudget{RetryBudget: defaultRetryBudget, upstream: "joke"},
+		warm:        make(chan struct{}),
+		clock:       systemClock{},
+	}
+	for _, opt := range opts {
+		opt(&ls)
+	}
+	ls.nameRetries.clock, ls.jokeRetries.clock = ls.clock, ls.clock
+	api, ok := nameAPIs[ls.nameService]
 	if !ok {
-		panic("defaultRoundTripper not an *http.Transport")
+		return nil, fmt.Errorf("unknown name service %q", ls.nameService)
 	}
-
-	// Increase the number of pooled connections per host (the default is 2).
-	// See: http://tleyden.github.io/blog/2016/11/21/tuning-the-go-http-client-library-for-load-testing/
-	defaultTransport := defaultTransportPointer // dereference it to get a copy of the struct that the pointer points to
-	defaultTransport.MaxIdleConns = 100
-	defaultTransport.MaxIdleConnsPerHost = 100
-
-	c := &http.Client{Transport: defaultTransport}
-	ls := LaffService{
-		client:     c,
-		nameChan:   make(chan *NameResp, bufLen),
-		jokeChan:   make(chan string, bufLen),
-		numWorkers: numWorkers,
-		bufLen:     bufLen,
-		log:        logger,
-		nameURL:    nameURL,
-		jokeURL:    jokeURL,
+	for i, src := range ls.providers {
+		if src.name == "" {
+			src.name = fmt.Sprintf("provider%d", i+1)
+		}
+	}
+	if err := ls.checkSources(); err != nil {
+		return nil, err
+	}
+	if err := ls.setupExperiment(); err != nil {
+		return nil, err
+	}
+	if ls.nameURL == "" {
+		ls.nameURL = api.url
+	}
+	ls.nameDecode = api.decode
+	if err := ls.setupTransport(); err != nil {
+		return nil, err
+	}
+	if err := ls.setupCassette(); err != nil {
+		return nil, err
+	}
+	if err := ls.setupChaos(); err != nil {
+		return nil, err
+	}
+	if err := ls.setupCanaries(); err != nil {
+		return nil, err
+	}
+	if err := ls.setupAutoSize(); err != nil {
+		return nil, err
+	}
+	if err := ls.setupBreakers(); err != nil {
+		return nil, err
+	}
+	if err := ls.setupProbes(); err != nil {
+		return nil, err
+	}
+	var err error
+	if ls.nameBucket, err = ls.nameRate.limiter(); err != nil {
+		return nil, pkgerr.Wrap(err, "name service")
+	}
+	if ls.jokeBucket, err = ls.jokeRate.limiter(); err != nil {
+		return nil, pkgerr.Wrap(err, "joke service")
+	}
+	for _, b := range []*retryBudget{&ls.nameRetries, &ls.jokeRetries} {
+		if err := b.check(); err != nil {
+			return nil, err
+		}
+	}
+	if ls.maxName <= 0 {
+		return nil, fmt.Errorf("max name length must be positive, got %d", ls.maxName)
+	}
+	urls := []string{ls.nameURL, ls.jokeURL, ls.catalogURL}
+	for _, cn := range []*canary{ls.nameCanary, ls.jokeCanary} {
+		if cn != nil {
+			urls = append(urls, cn.URL)
+		}
+	}
+	for _, u := range urls {
+		if pu, err := url.Parse(u); err != nil || pu.Host == "" {
+			return nil, fmt.Errorf("invalid upstream url %q", u)
+		}
+	}
+	if ls.warmup > bufLen {
+		ls.warmup = bufLen
+	}
+	if ls.warmup <= 0 {
+		ls.setWarm()
 	}
 	return &ls, nil
 }
 
-// RunCache is the function that adds jokes to the buffered channel, so that
+// Warm returns a channel that is closed once the joke cache has first
+// filled up to the warm-up level.
+func (ls *LaffService) Warm() <-chan struct{} {
+	return ls.warm
+}
+
+// logFor returns the logger of the request, or cache worker, the context
+// is for, so its entries carry the request ID and the like, or the
+// service's logger if there is none.
+func (ls *LaffService) logFor(ctx context.Context) logging.Logger {
+	return logging.FromContext(ctx, ls.log)
+}
+
+// setWarm marks the cache as warm.
+func (ls *LaffService) setWarm() {
+	ls.warmOnce.Do(func() {
+		close(ls.warm)
+	})
+}
+
+// RunCache is the function that adds jokes to the joke cache, so that
 // jokes can be pre-built when the user calls in.
 func (ls *LaffService) RunCache(ctx context.Context) {
+	// Keep a way to stop the workers, for Shutdown.
+	ctx, cancel := context.WithCancel(ls.withSeed(ctx))
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	ls.mu.Lock()
+	ls.stopCache = cancel
+	ls.cacheDone = done
+	ls.mu.Unlock()
+
 	var wg sync.WaitGroup
 
-	// Due to the name service rate limiter shutting us down, we'll sleep in
-	// between name accesses such that we do at most 6 accesses/minute total
-	// among all goroutines.
-	sleepInterval := time.Duration((60 / (6 / ls.numWorkers))) * time.Second
+	// Due to the name service rate limiter shutting us down, the workers
+	// wait their turn to call the upstream services, rather than being
+	// refused, see WithNameRate.
+	ctx = waitForRate(ctx)
 
 	for i := 0; i < ls.numWorkers; i++ {
 		// Capture loop index so each goruotine has correct value.
 		i := i
 
-		// Goroutine that fetches names and writes them to the name channel cache.
+		// Goroutine that fetches names and writes them to the name cache.
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			// The calls the worker makes log which worker they were for.
+			log := ls.log.With("worker", i, "cache", "names")
+			ctx := logging.NewContext(ctx, log)
 
 			for {
 			Loop:
 				// First try to get a name from the service.
-				name, err := ls.fetchName(ctx)
+				name, err := ls.prefetchName(ctx)
 				if err != nil {
 					// If we got an error, handle a rate limit error
 					// with a long delay.  For all other errors, increment
 					// the total error count.
 					switch v := err.(type) {
 					case RateLimitError:
-						ls.log.Errorw("Fetch name rate limit error",
-							"goroutine", i, "error", err)
-						ticker := time.NewTicker(time.Duration(v.retry+5) * time.Second)
-						select {
-						case <-ctx.Done():
-							ticker.Stop()
+						log.Errorw("Fetch name rate limit error", "error", err)
+						if !sleep(ctx, ls.clock, time.Duration(v.retry+5)*time.Second) {
 							return
-						case <-ticker.C:
-							ticker.Stop()
-							goto Loop
 						}
+						goto Loop
+					case BreakerOpenError:
+						// Wait for the breaker to let a probe through.
+						if !sleep(ctx, ls.clock, v.Retry) {
+							return
+						}
+						goto Loop
 					default:
-						ls.log.Errorw("Fetch name error",
-							"goroutine", i, "error", err)
-						atomic.AddInt64(&ls.nameErrs, 1)
-						if ls.nameErrs == maxErrs {
-							ls.log.Errorw("Too many errors on name fetch, shutting cache",
+						// Errors due to being shut down aren't counted.
+						if ctx.Err() != nil {
+							return
+						}
+						log.Errorw("Fetch name error", "error", err)
+						if atomic.AddInt64(&ls.nameErrs, 1) >= maxErrs {
+							log.Errorw("Too many errors on name fetch, shutting cache",
 								"count", maxErrs)
 							return
 						}
+						if !ls.waitToRetry(ctx, err) || !ls.nameRetries.wait(ctx, log.Warnw) {
+							return
+						}
 						goto Loop
 					}
 				}
 
-				// Write the name to the channel cache when not blocked.
-				select {
-				case <-ctx.Done():
+				// Write the name to the cache when there's room.
+				if ls.nameCache.Push(ctx, name) != nil {
 					return
-				case ls.nameChan <- name:
-					ls.log.Debugw("Wrote name to channel", "gorouitne", i, "name", name)
-				}
-
-				// Calculated delay due to rate limiter.
-				{
-					ticker := time.NewTicker(sleepInterval)
-					select {
-					case <-ctx.Done():
-						ticker.Stop()
-						return
-					case <-ticker.C:
-						ticker.Stop()
-					}
 				}
+				log.Debugw("Wrote name to cache", "name", name)
 			}
 		}()
 
 		// Goroutine that reads names from the name cache, gets a joke and composes
-		// the final joke and writes that to the joke channel cache.
+		// the final joke and writes that to the joke cache.
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			log := ls.log.With("worker", i, "cache", "jokes")
+			ctx := logging.NewContext(ctx, log)
 
 			var name *NameResp
 			var err error
+		Names:
 			for {
-				select {
-				case <-ctx.Done():
+				if name, err = ls.nameCache.Pop(ctx); err != nil {
 					return
-				case name = <-ls.nameChan:
-					ls.log.Debugw("Read name from channel", "gorouitne", i, "name", name)
 				}
+				log.Debugw("Read name from cache", "name", name)
 
-				var joke string
+				var joke Joke
 				for {
-					if joke, err = ls.fetchJoke(ctx, name); err != nil {
-						ls.log.Errorw("Fetch joke error", "gorouitne", i, "error", err)
+					if joke, err = ls.nextJoke(ctx, name); err != nil {
+						if ctx.Err() != nil {
+							return
+						}
+						if err == ErrFiltered {
+							log.Warnw("Dropping name, no joke passed the filter", "name", name)
+							continue Names
+						}
+						// Wait as long as the joke service asked, and
+						// try again with the same name.
+						if v, ok := err.(RateLimitError); ok {
+							log.Errorw("Fetch joke rate limit error", "error", err)
+							if !sleep(ctx, ls.clock, time.Duration(v.retry)*time.Second) {
+								return
+							}
+							continue
+						}
+						if v, ok := err.(BreakerOpenError); ok {
+							if !sleep(ctx, ls.clock, v.Retry) {
+								return
+							}
+							continue
+						}
+						log.Errorw("Fetch joke error", "error", err)
 						fmt.Println(i, ": fetch joke error", err)
 						atomic.AddInt64(&ls.jokeErrs, 1)
-						if ls.nameErrs == maxErrs {
+						if ls.nameErrs == maxErrs || !ls.waitToRetry(ctx, err) ||
+							!ls.jokeRetries.wait(ctx, log.Warnw) {
 							return
 						}
 						continue
 					}
 					break
 				}
-				select {
-				case <-ctx.Done():
+				joke.cached = ls.clock.Now()
+				if ls.jokeCache.Push(ctx, joke) != nil {
 					return
-				case ls.jokeChan <- joke:
-					ls.log.Debugw("Wrote joke to channel", "gorouitne", i, "joke", joke)
+				}
+				log.Debugw("Wrote joke to cache", "joke", joke)
+				// The caches may have shrunk below the warm-up level.
+				if ls.jokeCache.Len() >= min(ls.warmup, ls.jokeCache.Cap()) {
+					ls.setWarm()
 				}
 			}
 		}()
 	}
 
+	if ls.maxAge > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls.refreshJokes(ctx)
+		}()
+	}
+	if ls.autoSize != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls.tuneCache(ctx)
+		}()
+	}
+	if ls.probe != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls.runProbes(ctx)
+		}()
+	}
+
 	wg.Wait()
 	ls.log.Debugw("cache done, returning.")
 }
 
+// Shutdown stops the cache workers started by RunCache, and waits for them
+// to finish, or for the context to be done.
+func (ls *LaffService) Shutdown(ctx context.Context) error {
+	ls.mu.Lock()
+	cancel, done := ls.stopCache, ls.cacheDone
+	ls.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CloseIdleConnections closes the idle connections to the upstream
+// services.
+func (ls *LaffService) CloseIdleConnections() {
+	ls.client.CloseIdleConnections()
+}
+
+// CacheDepths returns the number of names and jokes currently cached.
+func (ls *LaffService) CacheDepths() (names, jokes int) {
+	return ls.nameCache.Len(), ls.jokeCache.Len()
+}
+
+// CacheSize returns the most names, and the most jokes, the caches hold.
+func (ls *LaffService) CacheSize() int {
+	return ls.jokeCache.Cap()
+}
+
+// ResizeCaches changes the most names, and the most jokes, the caches
+// hold, to at least one, while the service is running.  When they shrink,
+// the oldest entries over the new size are dropped.
+func (ls *LaffService) ResizeCaches(size int) {
+	names := ls.nameCache.Resize(size)
+	jokes := ls.jokeCache.Resize(size)
+	ls.log.Infow("Resized caches", "size", max(size, 1), "names dropped", names, "jokes dropped", jokes)
+}
+
 // Joke is the function invoked from the user's HTTP request.  It attempts
-// to pull a joke out of the channel (cache) first.  If there is nothing
+// to pull a joke out of the joke cache first.  If there is nothing
 // in the joke cache, it then tries to pull a name from the name cache, and
 // use that to invoke the joke fetch.  If the name cache is also empty, then
 // the call simply makes the HTTP calls to fetch the name, and uses that name
-// to plug into the joke fetch HTTP call.
-func (ls *LaffService) Joke(ctx context.Context) (string, error) {
-	select {
-	case <-ctx.Done():
+// to plug into the joke fetch HTTP call.  The requests taking part in an
+// experiment are handled separately, see WithExperiment.
+func (ls *LaffService) Joke(ctx context.Context) (Joke, error) {
+	seeded := Seeded(ctx)
+	ctx = ls.withSeed(ctx)
+	if id := RequestID(ctx); ls.experiment != nil && id != "" {
+		return ls.experimentJoke(ctx, id)
+	}
+
+	if ctx.Err() != nil {
 		// Cancel was invoked.
-		return "", context.Canceled
-	case jk := <-ls.jokeChan:
-		// A joke is available in the joke cache.
-		ls.log.Debugw("Got joke from channel", "joke", jk)
-		return jk, nil
-	default:
-		// Joke is not available from the cache.
-		select {
-		case nm := <-ls.nameChan:
-			// Got the next name from the cache.
-			return ls.fetchJoke(ctx, nm)
-		default:
-			// Nothing in the name cache, so fetch the name and cache directly.
-			ls.log.Debugw("Fetch name and joke directly")
-			name, err := ls.fetchName(ctx)
-			if err != nil {
-				return "", err
+		return Joke{}, context.Canceled
+	}
+
+	// A share of the jokes may come from a provider the request prefers.
+	if jk, err := ls.preferredJoke(ctx); !errors.Is(err, ErrNoJokes) {
+		return jk, err
+	}
+
+	// The cached jokes were made with the service's transliteration
+	// setting, and not from the request's seed, so a request asking
+	// otherwise skips the joke cache.
+	useCache := ls.transliterates(ctx) == ls.translit && !seeded
+	if useCache {
+		if jk, ok := ls.popAllowed(ctx); ok {
+			// A joke is available in the joke cache.
+			ls.logFor(ctx).Debugw("Got joke from cache", "joke", jk)
+			atomic.AddInt64(&ls.counters.jokeHits, 1)
+			jk.Cache = CacheJoke
+			return jk, nil
+		}
+	}
+
+	// A joke for the caller's own name is fetched with it.
+	if own, ok := ownName(ctx); ok {
+		return ls.nextJoke(ctx, &own)
+	}
+
+	// Joke is not available from the cache.
+	if nm, ok := ls.nameCache.TryPop(); ok {
+		// Got the next name from the cache.
+		atomic.AddInt64(&ls.counters.nameHits, 1)
+		jk, err := ls.nextJoke(ctx, nm)
+		jk.Cache = CacheName
+		return jk, err
+	}
+
+	// Nothing is cached, so wait for the workers to cache a joke, if
+	// asked to, before fetching one.  The joke they cache may not be in
+	// the categories or within the length allowed, so those requests
+	// don't wait.
+	if useCache && ls.cacheWait > 0 && !limitsJokes(ctx) {
+		if jk, ok := ls.waitForJoke(ctx); ok {
+			atomic.AddInt64(&ls.counters.jokeHits, 1)
+			jk.Cache = CacheJoke
+			return jk, nil
+		}
+		if ctx.Err() != nil {
+			return Joke{}, ctx.Err()
+		}
+	}
+
+	// Nothing in the name cache either, so a name would have to be
+	// fetched, which is doomed while the name service has us backing off,
+	// or its breaker is open.
+	now := ls.clock.Now()
+	if left := max(ls.nameBackoff.left(now), ls.nameBreaker.left(now)); left > 0 && len(ls.names) == 0 {
+		atomic.AddInt64(&ls.counters.refused, 1)
+		return Joke{}, CacheUnavailable{Retry: left}
+	}
+
+	// Fetch the name and joke directly.
+	ls.logFor(ctx).Debugw("Fetch name and joke directly")
+	atomic.AddInt64(&ls.counters.misses, 1)
+	name, err := ls.nextName(ctx)
+	if err != nil {
+		return Joke{}, err
+	}
+	return ls.nextJoke(ctx, name)
+}
+
+// nextName gets a name from one of the name sources, chosen at random,
+// with the name service being one of them.  A malformed name from the
+// name service is refetched, in strict mode.
+func (ls *LaffService) nextName(ctx context.Context) (*NameResp, error) {
+	// The other name sources aren't subject to the name service budget.
+	if n := Intn(ctx, len(ls.names)+1); n < len(ls.names) {
+		name, err := ls.names[n].Name(ctx)
+		if err == nil {
+			err = ls.normalizeName(ctx, name)
+		}
+		return name, err
+	}
+	var name *NameResp
+	var err error
+	for i := 0; i < maxRefetch; i++ {
+		if name, err = ls.upstreamName(ctx); !errors.Is(err, ErrInvalidResponse) {
+			break
+		}
+	}
+	return name, err
+}
+
+// upstreamName gets a name from the name service, if the shared name
+// budget allows it.  When the limiter can't be consulted, we go ahead
+// anyway, as the name service will still refuse us if we're over its
+// limit.
+func (ls *LaffService) upstreamName(ctx context.Context) (*NameResp, error) {
+	if err := takeRate(ctx, ls.clock, ls.nameBucket); err != nil {
+		return nil, err
+	}
+	if ls.nameLimiter != nil {
+		wait, err := ls.nameLimiter.Reserve(ctx)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
 			}
-			return ls.fetchJoke(ctx, name)
+			ls.logFor(ctx).Warnw("name limiter error, fetching anyway", "error", err)
+		case wait > 0:
+			return nil, RateLimitError{retry: int((wait + time.Second - 1) / time.Second)}
 		}
 	}
+	return ls.fetchName(ctx)
 }
 
 // fetchName invokes the HTTP call to get a name repsonse.
-func (ls *LaffService) fetchName(ctx context.Context) (*NameResp, error) {
-	req, err := http.NewRequest("GET", ls.nameURL, nil)
+func (ls *LaffService) fetchName(ctx context.Context) (_ *NameResp, err error) {
+	// Some of the requests may go to the canary instead, which is judged
+	// on its own rather than by the breaker.
+	nameURL, headers, cred, decode := ls.nameURL, ls.nameHeaders, ls.nameCred, ls.nameDecode
+	brk := ls.nameBreaker
+	cn := ls.nameCanary.pick()
+	if cn != nil {
+		nameURL, headers, cred, decode = cn.URL, cn.Headers, cn.Credential, cn.decode
+		brk = nil
+	}
+	start := ls.clock.Now()
+	defer func() {
+		ls.counters.noteError(ctx, "name", err)
+		cn.note(ctx, err)
+		if cn == nil {
+			ls.nameLog.note(ctx, err, ls.clock.Now().Sub(start), ls.clock.Now())
+		}
+	}()
+
+	if err := ls.nameBackoff.check(ls.clock.Now()); err != nil {
+		return nil, err
+	}
+	if err := brk.allow(ls.clock.Now()); err != nil {
+		return nil, err
+	}
+	defer func() { brk.record(ctx, err, ls.clock.Now()) }()
+	ls.nameRetries.call()
+	rctx := ls.nameConns.trace(withProxy(ctx, ls.nameProxy))
+	req, err := ls.newRequest(rctx, nameURL, headers, cred)
 	if err != nil {
 		return nil, err
 	}
-	req = req.WithContext(ctx)
-	req.Header.Add("Accept", "application/json")
+	if err := ls.nameSem.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer ls.nameSem.release()
 	resp, err := ls.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.Body == nil {
-		ls.log.Errorw("empty body for name fetch")
+		ls.logFor(ctx).Errorw("empty body for name fetch")
 		return nil, errors.New("unexpected empty body")
 	}
 
 	defer resp.Body.Close()
-	b, err := io.ReadAll(resp.Body)
+	buf, err := readBody(resp.Body)
 	if err != nil {
 		return nil, err
 	}
+	defer releaseBody(buf)
 	if resp.StatusCode != http.StatusOK {
 
 		// Workaround for the regretful state of the rate limiter for the
 		// name service.
-		if resp.StatusCode == http.StatusTooManyRequests {
-			retry := resp.Header.Get("Retry-After")
-			ls.log.Debugw("rate limit", "retry after", retry)
-			var delay int = dfltRetry
-			v, err := strconv.Atoi(retry)
-			if err == nil {
-				delay = v
-			}
+		if isBackoffStatus(resp.StatusCode) {
+			delay := retryAfter(resp.Header, ls.clock.Now())
+			ls.logFor(ctx).Debugw("rate limit", "retry after", delay)
+			ls.nameBackoff.set(ls.clock.Now(), delay)
 			return nil, RateLimitError{retry: delay}
 		}
 
 		invErr := fmt.Errorf("invoking name fetch got HTTP status %d (%s)",
 			resp.StatusCode, http.StatusText(resp.StatusCode))
-		ls.log.Errorw("Fetch name error", "error", invErr)
+		ls.logFor(ctx).Errorw("Fetch name error", "error", invErr)
 		return nil, invErr
 
 	}
 
 	// The call succeeded, so unmarshal the response.
-	var nameResp NameResp
-	if err := json.Unmarshal(b, &nameResp); err != nil {
-		ls.log.Errorw("Fetch name json unmarshal error", "error", err)
-		return nil, pkgerr.Wrap(err, "unmarshaling request body")
+	nameResp, err := decode(buf.Bytes())
+	if err != nil {
+		ls.logFor(ctx).Errorw("Fetch name json unmarshal error", "error", err)
+		return nil, err
+	}
+	if err := ls.normalizeName(ctx, nameResp); err != nil {
+		return nil, err
+	}
+	if err := ls.checkResponse(ctx, "name", checkName(nameResp)); err != nil {
+		return nil, err
+	}
+	return nameResp, nil
+}
+
+// nextJoke fetches a joke for the name that passes the filter, if there
+// is one.  The rejected jokes are discarded, and another is fetched, as
+// are the malformed ones in strict mode.
+func (ls *LaffService) nextJoke(ctx context.Context, name *NameResp) (Joke, error) {
+	return ls.nextJokeFrom(ctx, name, nil)
+}
+
+// nextJokeFrom is nextJoke with the jokes coming from the source given,
+// or from one picked at random each time if it is nil.
+func (ls *LaffService) nextJokeFrom(ctx context.Context, name *NameResp, src *jokeSource) (Joke, error) {
+	err := ErrFiltered
+	var repeat *Joke // the last joke tried that the caller has seen
+	for i := 0; i < maxRefetch; i++ {
+		from := src
+		if from == nil {
+			from = ls.pickSource(ctx)
+		}
+		var jk Joke
+		jk, err = ls.jokeFrom(ctx, name, from)
+		if err == nil {
+			jk, err = ls.fillSecond(ctx, jk)
+		}
+
+		// A malformed joke is refetched, in strict mode.
+		if errors.Is(err, ErrInvalidResponse) {
+			continue
+		}
+		if err != nil {
+			return jk, err
+		}
+		if ls.filter != nil && !ls.filter.Allowed(jk.Text) {
+			err = ErrFiltered
+			atomic.AddInt64(&ls.counters.filtered, 1)
+			ls.logFor(ctx).Debugw("Joke rejected by filter", "id", jk.ID)
+			continue
+		}
+
+		// A joke outside the categories allowed for the request is
+		// cached for the others.
+		if !allowed(ctx, jk) {
+			err = ErrNoCategory
+			ls.stashJoke(ctx, jk)
+			continue
+		}
+		// Likewise a joke too long for the request.
+		if !withinLength(ctx, jk) {
+			err = ErrTooLong
+			ls.stashJoke(ctx, jk)
+			continue
+		}
+		// A joke the caller has seen is kept back, in case every one
+		// tried has been.
+		if isRepeat(ctx, jk) {
+			if repeat != nil {
+				ls.stashJoke(ctx, *repeat)
+			}
+			repeat = &jk
+			continue
+		}
+		if repeat != nil {
+			ls.stashJoke(ctx, *repeat)
+		}
+		return jk, nil
+	}
+	if repeat != nil {
+		return *repeat, nil
 	}
-	return &nameResp, nil
+	return Joke{}, err
 }
 
 // fetchJoke fetches a joke, given a first and last name.
-func (ls *LaffService) fetchJoke(ctx context.Context, name *NameResp) (string, error) {
-	invURL := ls.encodeJokeURL(name.Name, name.Surname)
-	req, err := http.NewRequest("GET", invURL, nil)
+func (ls *LaffService) fetchJoke(ctx context.Context, name *NameResp) (_ Joke, err error) {
+	// Some of the requests may go to the canary instead, which is judged
+	// on its own rather than by the breaker.
+	jokeURL, headers, cred := ls.jokeURL, ls.jokeHeaders, ls.jokeCred
+	brk := ls.jokeBreaker
+	cn := ls.jokeCanary.pick()
+	if cn != nil {
+		jokeURL, headers, cred = cn.URL, cn.Headers, cn.Credential
+		brk = nil
+	}
+	start := ls.clock.Now()
+	defer func() {
+		ls.counters.noteError(ctx, "joke", err)
+		cn.note(ctx, err)
+		if cn == nil {
+			ls.jokeLog.note(ctx, err, ls.clock.Now().Sub(start), ls.clock.Now())
+		}
+	}()
+
+	if err := ls.jokeBackoff.check(ls.clock.Now()); err != nil {
+		return Joke{}, err
+	}
+	if err := brk.allow(ls.clock.Now()); err != nil {
+		return Joke{}, err
+	}
+	defer func() { brk.record(ctx, err, ls.clock.Now()) }()
+	if err := takeRate(ctx, ls.clock, ls.jokeBucket); err != nil {
+		return Joke{}, err
+	}
+	ls.jokeRetries.call()
+	first, last := name.Name, name.Surname
+	if ls.transliterates(ctx) {
+		first, last = transliterate(first), transliterate(last)
+	}
+	invURL := encodeJokeURL(jokeURL, first, last)
+	rctx := ls.jokeConns.trace(withProxy(ctx, ls.jokeProxy))
+	req, err := ls.newRequest(rctx, invURL, headers, cred)
 	if err != nil {
-		return "", err
+		return Joke{}, err
 	}
-	req = req.WithContext(ctx)
-	req.Header.Add("Accept", "application/json")
+	if err := ls.jokeSem.acquire(ctx); err != nil {
+		return Joke{}, err
+	}
+	defer ls.jokeSem.release()
 	resp, err := ls.client.Do(req)
 	if err != nil {
-		return "", err
+		return Joke{}, err
 	}
 	if resp.Body == nil {
-		ls.log.Errorw("empty body for joke fetch")
-		return "", errors.New("unexpected empty body")
+		ls.logFor(ctx).Errorw("empty body for joke fetch")
+		return Joke{}, errors.New("unexpected empty body")
 	}
 
 	defer resp.Body.Close()
-	b, err := io.ReadAll(resp.Body)
+	buf, err := readBody(resp.Body)
 	if err != nil {
-		return "", err
+		return Joke{}, err
 	}
+	defer releaseBody(buf)
 
+	if isBackoffStatus(resp.StatusCode) {
+		delay := retryAfter(resp.Header, ls.clock.Now())
+		ls.logFor(ctx).Debugw("joke service rate limit", "retry after", delay)
+		ls.jokeBackoff.set(ls.clock.Now(), delay)
+		return Joke{}, RateLimitError{retry: delay}
+	}
 	if resp.StatusCode != http.StatusOK {
 		invErr := fmt.Errorf("invoking joke fetch got HTTP status %d (%s)",
 			resp.StatusCode, http.StatusText(resp.StatusCode))
-		ls.log.Errorw("Fetch joke error", "error", invErr)
-		return "", invErr
+		ls.logFor(ctx).Errorw("Fetch joke error", "error", invErr)
+		return Joke{}, invErr
 
 	}
 
 	// The call succeeded, so unmarshal the response.
-	var jokeResp JokeResp
-	if err := json.Unmarshal(b, &jokeResp); err != nil {
-		ls.log.Errorw("Fetch joke json unmarshal error", "error", err)
-		return "", pkgerr.Wrap(err, "unmarshaling request body")
+	jokeResp, err := decodeJoke(buf.Bytes())
+	if err != nil {
+		ls.logFor(ctx).Errorw("Fetch joke json unmarshal error", "error", err)
+		return Joke{}, err
+	}
+	if err := ls.checkResponse(ctx, "joke", checkJoke(jokeResp)); err != nil {
+		return Joke{}, err
+	}
+	return Joke{
+		ID:         jokeResp.Value.ID,
+		Text:       jokeResp.Value.Joke,
+		Name:       *name,
+		Categories: jokeResp.Value.Categories,
+	}, nil
+}
+
+// Catalog fetches all the jokes of the joke service.  The name in the
+// jokes is given as the placeholders {first} and {last}, to be filled in
+// when they are served.
+func (ls *LaffService) Catalog(ctx context.Context) ([]JokeValue, error) {
+	curl, err := url.Parse(ls.catalogURL)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "invalid catalog url")
+	}
+	parameters := url.Values{}
+	parameters.Set("firstName", "{first}")
+	parameters.Set("lastName", "{last}")
+	parameters.Set("escape", "javascript")
+	curl.RawQuery = parameters.Encode()
+
+	rctx := ls.jokeConns.trace(withProxy(ctx, ls.jokeProxy))
+	req, err := ls.newRequest(rctx, curl.String(), ls.jokeHeaders, ls.jokeCred)
+	if err != nil {
+		return nil, err
+	}
+	if err := ls.jokeSem.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer ls.jokeSem.release()
+	resp, err := ls.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := readBody(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseBody(buf)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invoking catalog fetch got HTTP status %d (%s)",
+			resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return decodeCatalog(buf.Bytes())
+}
+
+// newRequest creates a GET request to an upstream service, with the
+// User-Agent, the extra headers and the credential configured for it.
+func (ls *LaffService) newRequest(ctx context.Context, rawURL string, headers http.Header, cred Credential) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if ls.userAgent != "" {
+		req.Header.Set("User-Agent", ls.userAgent)
+	}
+	for k, v := range headers {
+		req.Header[k] = v
 	}
-	return jokeResp.Value.Joke, nil
+	cred.set(req.Header)
+	return req, nil
 }
 
 // encodeJokeURL escapes the query paramerters.  This is important
 // as a name could contain a character that needs escaping.
-func (ls *LaffService) encodeJokeURL(firstName, lastName string) string {
-	jurl, err := url.Parse(ls.jokeURL)
+func encodeJokeURL(jokeURL, firstName, lastName string) string {
+	jurl, err := url.Parse(jokeURL)
 	if err != nil {
 		panic("invalid joke url")
 	}
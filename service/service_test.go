@@ -1,19 +1,28 @@
 package service
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gdotgordon/laff/laffmock"
+	"github.com/gdotgordon/laff/logging"
 	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // The unit tests use a test HTTP server with mock name and joke services.
@@ -27,12 +36,12 @@ func TestFetchJoke(t *testing.T) {
 		t.Fatal("error creating service", err)
 	}
 
-	tstSrv := NewTestServer()
-	svc.nameURL = tstSrv.srv.URL + "/name"
-	svc.jokeURL = tstSrv.srv.URL + "/jokes?"
-	defer tstSrv.Shutdown()
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
 
-	str, err := svc.fetchJoke(context.Background(),
+	jk, err := svc.fetchJoke(context.Background(),
 		&NameResp{
 			Name:    "Ryan",
 			Surname: "Gonzalez",
@@ -44,8 +53,11 @@ func TestFetchJoke(t *testing.T) {
 	}
 
 	exp := "Ryan Gonzalez made joke 0"
-	if str != exp {
-		t.Fatal("Expected joke:", exp, ", got:", str)
+	if jk.Text != exp {
+		t.Fatal("Expected joke:", exp, ", got:", jk.Text)
+	}
+	if jk.ID != 0 {
+		t.Fatal("Expected joke id: 0, got:", jk.ID)
 	}
 }
 
@@ -56,10 +68,10 @@ func TestFetchName(t *testing.T) {
 		t.Fatal("error creating service", err)
 	}
 
-	tstSrv := NewTestServer()
-	svc.nameURL = tstSrv.srv.URL + "/name"
-	svc.jokeURL = tstSrv.srv.URL + "/jokes?"
-	defer tstSrv.Shutdown()
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
 
 	name, err := svc.fetchName(context.Background())
 	if err != nil {
@@ -83,14 +95,15 @@ func TestFetchName(t *testing.T) {
 // name and joke sequence numbers are the same due to random ordering of goroutine
 // execution and there being separate channels for name and joke items.
 func TestRunLoop(t *testing.T) {
-	svc, err := New(3, 10, newNoopLogger())
+	// The mock name service has no rate limit.
+	svc, err := New(3, 10, newNoopLogger(), WithNameRate(Rate{}))
 	if err != nil {
 		t.Fatal("error creating service", err)
 	}
-	tstSrv := NewTestServer()
-	svc.nameURL = tstSrv.srv.URL + "/name"
-	svc.jokeURL = tstSrv.srv.URL + "/jokes?"
-	defer tstSrv.Shutdown()
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
@@ -111,13 +124,13 @@ func TestRunLoop(t *testing.T) {
 		go func() {
 			defer lwg.Done()
 			for i := 0; i < 3; i++ {
-				str, err := svc.Joke(ctx)
+				jk, err := svc.Joke(ctx)
 				if err != nil {
 					t.Errorf("error reading joke: %v", err)
 				}
-				fmt.Printf("read joke: %s\n", str)
+				fmt.Printf("read joke: %s\n", jk.Text)
 				mu.Lock()
-				jokes = append(jokes, str)
+				jokes = append(jokes, jk.Text)
 				mu.Unlock()
 			}
 		}()
@@ -136,100 +149,2223 @@ func TestRunLoop(t *testing.T) {
 	}
 }
 
-// TestNameJokeServer has mock name and joke generator services.  By using this,
-// we can verify the correctness of the code by avoiding the rate limiter issue.
-type TestNameJokeServer struct {
-	srv      *httptest.Server
-	nextName int
-	nextJoke int
-	sync.Mutex
+// TestShutdown verifies Shutdown stops the cache workers.
+func TestShutdown(t *testing.T) {
+	svc, err := New(2, 5, newNoopLogger())
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
+
+	// Shutting down before the cache is running is fine.
+	if err := svc.Shutdown(context.Background()); err != nil {
+		t.Fatal("error shutting down idle service", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		svc.RunCache(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.Shutdown(ctx); err != nil {
+		t.Fatal("error shutting down", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("cache still running after shutdown")
+	}
+}
+
+// TestWarm verifies the cache is reported as warm once enough jokes are
+// cached.
+func TestWarm(t *testing.T) {
+	svc, err := New(3, 5, newNoopLogger(), WithWarmup(3))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
+
+	select {
+	case <-svc.Warm():
+		t.Fatal("cache warm before it ran")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.RunCache(ctx)
+	select {
+	case <-svc.Warm():
+	case <-time.After(30 * time.Second):
+		t.Fatal("cache never became warm")
+	}
+	if _, jokes := svc.CacheDepths(); jokes < 3 {
+		t.Fatal("expected at least 3 cached jokes, got:", jokes)
+	}
+}
+
+// TestShareJokes verifies only the jokes beyond half the cache are given
+// to the peers, and the jokes from the peers warm the cache.
+func TestShareJokes(t *testing.T) {
+	giver, err := New(2, 4, newNoopLogger())
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	for _, text := range []string{"one", "two", "three"} {
+		giver.jokeCache.TryPush(Joke{Text: text})
+	}
+	if n := giver.Surplus(); n != 1 {
+		t.Fatal("expected a surplus of 1, got:", n)
+	}
+	jokes := giver.GiveJokes(3)
+	if len(jokes) != 1 || jokes[0].Text != "one" || giver.Surplus() != 0 {
+		t.Fatal("expected the oldest joke given, got:", jokes)
+	}
+
+	clock := newFakeClock()
+	taker, err := New(2, 2, newNoopLogger(), WithClock(clock), WithWarmup(2))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	jokes = append(jokes, Joke{Text: "four"}, Joke{Text: "five"})
+	if n := taker.WarmJokes(jokes); n != 2 {
+		t.Fatal("expected 2 jokes cached, got:", n)
+	}
+	select {
+	case <-taker.Warm():
+	default:
+		t.Fatal("expected the cache warm")
+	}
+	if jk, _ := taker.jokeCache.Peek(); !jk.cached.Equal(clock.Now()) {
+		t.Fatal("expected the jokes cached now, got:", jk.cached)
+	}
+	if st := taker.Stats(); st.Received != 2 || giver.Stats().Given != 1 {
+		t.Fatal("expected the shared jokes counted, got:", st.Received, giver.Stats().Given)
+	}
+}
+
+// TestShareJokesScreened verifies the jokes from the peers are screened as
+// the fetched ones are: by the filter, and for malformed ones in strict
+// mode.
+func TestShareJokesScreened(t *testing.T) {
+	taker, err := New(2, 5, newNoopLogger(), WithFilter(&fakeFilter{reject: 1}), WithStrictValidation())
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	ann := NameResp{Name: "Ann", Surname: "Lee"}
+	jokes := []Joke{
+		{Text: "filtered", Name: ann},
+		{Text: "  ", Name: ann},
+		{Text: "no surname", Name: NameResp{Name: "Ann"}},
+		{Text: "bad name", Name: NameResp{Name: "Ann\x00", Surname: "Lee"}},
+		{Text: "kept", Name: NameResp{Name: " Ann ", Surname: "Lee"}},
+	}
+	if n := taker.WarmJokes(jokes); n != 1 {
+		t.Fatal("expected 1 joke cached, got:", n)
+	}
+	if jk, _ := taker.jokeCache.Peek(); jk.Text != "kept" || jk.Name.Name != "Ann" {
+		t.Fatal("expected the good joke cached with its name tidied, got:", jk)
+	}
+	if st := taker.Stats(); st.Filtered != 1 || st.Invalid["peer"] != 3 {
+		t.Fatal("expected the rejected jokes counted, got:", st.Filtered, st.Invalid)
+	}
+}
+
+// TestSeedNames verifies the operator's names are tidied and cached while
+// there is room, and jokes made for them.
+func TestSeedNames(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 3, newNoopLogger(), WithNameURL(tstSrv.URL+"/name"), WithJokeURL(tstSrv.URL+"/jokes?"),
+		WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	names := []NameResp{{Name: " Ann ", Surname: "Lee"}, {Name: "Bob"}, {Name: "Cat", Surname: "Day"}, {Name: "Dan"}}
+	if _, err := svc.SeedNames(append(names, NameResp{Surname: "Eve"})); err == nil {
+		t.Fatal("expected an error for a name without a first name")
+	}
+	if n, _ := svc.CacheDepths(); n != 0 {
+		t.Fatal("expected no names added, got:", n)
+	}
+	added, err := svc.SeedNames(names)
+	if err != nil || added != 3 {
+		t.Fatal("expected 3 names added, got:", added, err)
+	}
+	if st := svc.Stats(); st.Seeded != 3 || st.NameCache != 3 {
+		t.Fatal("expected the names counted, got:", st.Seeded, st.NameCache)
+	}
+	jk, err := svc.Joke(context.Background())
+	if err != nil || jk.Cache != CacheName || jk.Name.Name != "Ann" {
+		t.Fatal("expected a joke for Ann, got:", jk, err)
+	}
+}
+
+// TestStats verifies how jokes were served is counted.
+func TestStats(t *testing.T) {
+	svc, err := New(2, 5, newNoopLogger(), WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
+
+	// Nothing cached, so it's a miss.
+	if _, err := svc.Joke(context.Background()); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	svc.nameCache.TryPush(&NameResp{Name: "Ryan", Surname: "Gonzalez"})
+	if _, err := svc.Joke(context.Background()); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	svc.jokeCache.TryPush(Joke{Text: "cached"})
+	if _, err := svc.Joke(context.Background()); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+
+	// Break the name service to record an error.
+	svc.nameURL = tstSrv.URL + "/bogus"
+	if _, err := svc.Joke(context.Background()); err == nil {
+		t.Fatal("expected error fetching name")
+	}
+
+	st := svc.Stats()
+	if st.Misses != 2 || st.NameHits != 1 || st.JokeHits != 1 {
+		t.Fatalf("unexpected counts: %+v", st)
+	}
+	if st.HitRatio() != 0.5 || st.CacheSize != 5 {
+		t.Fatalf("unexpected hit ratio or cache size: %v, %d", st.HitRatio(), st.CacheSize)
+	}
+	if st.LastErrors["name"].Error == "" {
+		t.Fatalf("expected name error, got: %+v", st.LastErrors)
+	}
+}
+
+// TestAutoSize verifies the caches are sized to the demand in the window,
+// within the bounds and the name service rate.
+func TestAutoSize(t *testing.T) {
+	clock := newFakeClock()
+	svc, err := New(2, 5, newNoopLogger(), WithClock(clock), WithNameRate(Rate{}),
+		WithAutoSize(AutoSize{Min: 2, Max: 20, Window: time.Minute}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.tuneCache(ctx)
+
+	// step serves the jokes, and lets the tuner run once.
+	step := func(served int64) int {
+		clock.WaitForWaiter()
+		atomic.AddInt64(&svc.counters.misses, served)
+		clock.Advance(autoSizeInterval)
+		clock.WaitForWaiter()
+		return svc.CacheSize()
+	}
+
+	// Two a second is 120 a minute, more than the most.
+	if size := step(60); size != 20 {
+		t.Fatal("expected the most, got:", size)
+	}
+	var size int
+	for i := 0; i < 20; i++ {
+		size = step(0)
+	}
+	if size != 2 {
+		t.Fatal("expected the least once idle, got:", size)
+	}
+
+	// The name service can only fill 6 a minute.
+	svc.nameRate = Rate{Requests: 6, Interval: time.Minute, Burst: 1}
+	if size := step(600); size != 6 {
+		t.Fatal("expected the name budget, got:", size)
+	}
+
+	if _, err := New(2, 5, newNoopLogger(), WithAutoSize(AutoSize{Min: 10, Max: 20})); err == nil {
+		t.Fatal("expected error for a size out of bounds")
+	}
+}
+
+// TestJokeMaxAge verifies the newest joke is served first, and the stale
+// ones are evicted, with their names cached again.
+func TestJokeMaxAge(t *testing.T) {
+	clock := newFakeClock()
+	svc, err := New(2, 5, newNoopLogger(), WithClock(clock), WithJokeMaxAge(time.Minute))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	svc.jokeCache.TryPush(Joke{Text: "old", Name: NameResp{Name: "Ann"}, cached: clock.Now()})
+	clock.Advance(30 * time.Second)
+	for _, text := range []string{"newer", "newest"} {
+		svc.jokeCache.TryPush(Joke{Text: text, cached: clock.Now()})
+	}
+	if jk, err := svc.Joke(context.Background()); err != nil || jk.Text != "newest" {
+		t.Fatal("expected the newest joke, got:", jk.Text, err)
+	}
+
+	clock.Advance(45 * time.Second)
+	svc.evictStale()
+	if jk, ok := svc.jokeCache.Peek(); !ok || jk.Text != "newer" || svc.jokeCache.Len() != 1 {
+		t.Fatal("expected only the newer joke left, got:", jk.Text, svc.jokeCache.Len())
+	}
+	if nm, ok := svc.nameCache.TryPop(); !ok || nm.Name != "Ann" {
+		t.Fatal("expected the stale joke's name cached, got:", nm)
+	}
+	if st := svc.Stats(); st.Stale != 1 {
+		t.Fatal("expected a stale joke counted, got:", st.Stale)
+	}
+}
+
+// TestCacheUnavailable verifies a request is refused, without a name
+// fetch, when nothing is cached and the name service has us backing off.
+func TestCacheUnavailable(t *testing.T) {
+	clock := newFakeClock()
+	svc, err := New(2, 5, newNoopLogger(), WithClock(clock))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc.nameURL, svc.jokeURL = tstSrv.NameURL(), tstSrv.JokeURL()
+
+	svc.nameBackoff.set(clock.Now(), 30)
+	_, err = svc.Joke(context.Background())
+	var cu CacheUnavailable
+	if !errors.As(err, &cu) || cu.Retry != 30*time.Second {
+		t.Fatal("expected the cache unavailable for 30s, got:", err)
+	}
+	if calls, _ := tstSrv.Calls(); calls != 0 {
+		t.Fatal("expected no upstream calls, got:", calls)
+	}
+
+	// A cached name can still be made into a joke.
+	svc.nameCache.TryPush(&NameResp{Name: "Ann", Surname: "Lee"})
+	if _, err := svc.Joke(context.Background()); err != nil {
+		t.Fatal("error getting joke for the cached name", err)
+	}
+	if st := svc.Stats(); st.Refused != 1 {
+		t.Fatal("expected a refused request counted, got:", st.Refused)
+	}
+}
+
+// TestCacheWait verifies a request finding the caches empty waits for a
+// joke to be cached, and fetches one itself once the wait is over.
+func TestCacheWait(t *testing.T) {
+	clock := newFakeClock()
+	svc, err := New(2, 5, newNoopLogger(), WithClock(clock), WithCacheWait(time.Second),
+		WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc.nameURL, svc.jokeURL = tstSrv.NameURL(), tstSrv.JokeURL()
+
+	type result struct {
+		jk  Joke
+		err error
+	}
+	joke := func() chan result {
+		res := make(chan result, 1)
+		go func() {
+			jk, err := svc.Joke(context.Background())
+			res <- result{jk, err}
+		}()
+		return res
+	}
+
+	res := joke()
+	clock.WaitForWaiter()
+	svc.jokeCache.TryPush(Joke{Text: "cached"})
+	if r := <-res; r.err != nil || r.jk.Text != "cached" || r.jk.Cache != CacheJoke {
+		t.Fatal("expected the joke cached while waiting, got:", r.jk, r.err)
+	}
+
+	res = joke()
+	done := make(chan bool, 1)
+	go func() {
+		r := <-res
+		res <- r
+		done <- true
+	}()
+	clock.AdvanceUntil(done, 100*time.Millisecond)
+	if r := <-res; r.err != nil || r.jk.Text != "Name0 Surname0 made joke 0" {
+		t.Fatal("expected a joke fetched after the wait, got:", r.jk, r.err)
+	}
+	if st := svc.Stats(); st.Waited != 1 || st.JokeHits != 1 || st.Misses != 1 {
+		t.Fatalf("unexpected counts: %+v", st)
+	}
+}
+
+// TestNameLimiter verifies names are only fetched while the limiter allows
+// it, and that a broken limiter doesn't stop us.
+func TestNameLimiter(t *testing.T) {
+	lim := &fakeLimiter{allow: 1}
+	svc, err := New(2, 5, newNoopLogger(), WithNameLimiter(lim), WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
+
+	ctx := context.Background()
+	if _, err := svc.Joke(ctx); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	_, err = svc.Joke(ctx)
+	rle, ok := err.(RateLimitError)
+	if !ok {
+		t.Fatal("expected rate limit error, got:", err)
+	}
+	if rle.retry != 3 {
+		t.Fatal("expected retry of 3 seconds, got:", rle.retry)
+	}
+
+	lim.err = errors.New("limiter down")
+	if _, err := svc.Joke(ctx); err != nil {
+		t.Fatal("expected joke with limiter down, got:", err)
+	}
+}
+
+// TestRandomUser gets the names from a randomuser.me lookalike.
+func TestRandomUser(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(), WithNameService(RandomUser),
+		WithNameURL(tstSrv.URL+"/randomuser"), WithJokeURL(tstSrv.URL+"/jokes?"))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	jk, err := svc.Joke(context.Background())
+	if err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	want := NameResp{Name: "First0", Surname: "Last0", Gender: "female", Region: "Norway"}
+	if jk.Name != want {
+		t.Fatal("unexpected name:", jk.Name)
+	}
+	if jk.Text != "First0 Last0 made joke 0" {
+		t.Fatal("unexpected joke:", jk.Text)
+	}
+
+	if _, err := decodeRandomUser([]byte(`{"error": "Uh oh"}`)); err == nil {
+		t.Fatal("expected error from failed lookup")
+	}
+	if _, err := New(2, 5, newNoopLogger(), WithNameService("bogus")); err == nil {
+		t.Fatal("expected error from unknown name service")
+	}
+	if _, err := New(2, 5, newNoopLogger(), WithJokeURL("not a url")); err == nil {
+		t.Fatal("expected error from invalid joke url")
+	}
 }
 
-func NewTestServer() *TestNameJokeServer {
-	ts := &TestNameJokeServer{}
+// TestHeaders verifies the User-Agent, the extra headers and the
+// credentials are sent to each upstream service.
+func TestHeaders(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string]http.Header{}
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Body != nil {
-			io.ReadAll(r.Body)
-			r.Body.Close()
-		}
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		urlStr := r.URL.String()
-		if strings.HasSuffix(urlStr, "/name") {
-			ts.Lock()
-			val := ts.nextName
-			ts.nextName++
-			ts.Unlock()
-			name := NameResp{
-				Name:    fmt.Sprintf("Name%d", val),
-				Surname: fmt.Sprintf("Surname%d", val),
-			}
+		mu.Lock()
+		got[r.URL.Path] = r.Header.Clone()
+		mu.Unlock()
+		tstSrv.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
 
-			b, err := json.Marshal(name)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.Write(b)
-			return
+	svc, err := New(2, 5, newNoopLogger(),
+		WithNameURL(srv.URL+"/name"), WithJokeURL(srv.URL+"/jokes?"),
+		WithUserAgent("laff/test"),
+		WithNameHeaders(http.Header{"X-Name-Key": {"n1"}}),
+		WithJokeHeaders(http.Header{"X-Joke-Key": {"j1"}, "User-Agent": {"joker"}}),
+		WithNameCredential(Credential{Header: "Authorization", Secret: "s3cret"}),
+		WithJokeCredential(Credential{Header: "X-Joke-Key", Secret: "j2"}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	if _, err := svc.Joke(context.Background()); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	name, joke := got["/name"], got["/jokes"]
+	if name == nil || joke == nil {
+		t.Fatal("expected both upstreams to be called, got:", got)
+	}
+	if name.Get("User-Agent") != "laff/test" || name.Get("X-Name-Key") != "n1" ||
+		name.Get("X-Joke-Key") != "" || name.Get("Authorization") != "Bearer s3cret" {
+		t.Fatal("unexpected name headers:", name)
+	}
+	if joke.Get("User-Agent") != "joker" || joke.Get("X-Joke-Key") != "j2" ||
+		joke.Get("X-Name-Key") != "" || joke.Get("Authorization") != "" {
+		t.Fatal("unexpected joke headers:", joke)
+	}
+
+	cred := Credential{Header: "Authorization", Secret: "s3cret"}
+	for _, str := range []string{fmt.Sprint(cred), fmt.Sprintf("%+v %#v", cred, cred)} {
+		if strings.Contains(str, "s3cret") {
+			t.Fatal("credential not redacted:", str)
 		}
+	}
+}
 
-		if strings.Contains(urlStr, "/jokes?") {
-			values := r.URL.Query()
-			fn := values.Get("firstName")
-			ln := values.Get("lastName")
-			if fn == "" || ln == "" {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			ts.Lock()
-			val := ts.nextJoke
-			ts.nextJoke++
-			ts.Unlock()
-
-			jv := JokeValue{
-				ID:         val,
-				Joke:       fmt.Sprintf("%s %s made joke %d", fn, ln, val),
-				Categories: []string{"nerdy"},
-			}
-			joke := JokeResp{
-				Type:  "success",
-				Value: jv,
-			}
-			b, err := json.Marshal(joke)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.Write(b)
-			return
+// TestFilter verifies rejected jokes are replaced, up to a point.
+func TestFilter(t *testing.T) {
+	flt := &fakeFilter{reject: 2}
+	svc, err := New(2, 5, newNoopLogger(), WithFilter(flt), WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
+
+	ctx := context.Background()
+	jk, err := svc.Joke(ctx)
+	if err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	if jk.ID != 2 {
+		t.Fatal("expected joke id: 2, got:", jk.ID)
+	}
+	if st := svc.Stats(); st.Filtered != 2 {
+		t.Fatal("expected 2 filtered, got:", st.Filtered)
+	}
+
+	flt.reject = maxRefetch
+	if _, err := svc.Joke(ctx); err != ErrFiltered {
+		t.Fatal("expected filtered error, got:", err)
+	}
+}
+
+// TestJokeProvider verifies jokes come from both the added provider and
+// the joke service.
+func TestJokeProvider(t *testing.T) {
+	svc, err := New(2, 5, newNoopLogger(), WithJokeProvider(fakeProvider{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	defer tstSrv.Close()
+
+	var fromProvider, fromService int
+	for i := 0; i < 50 && (fromProvider == 0 || fromService == 0); i++ {
+		jk, err := svc.jokeFor(context.Background(), &NameResp{Name: "Ann", Surname: "Lee"})
+		if err != nil {
+			t.Fatal("error getting joke", err)
 		}
+		if jk.ID == -1 {
+			fromProvider++
+		} else {
+			fromService++
+		}
+	}
+	if fromProvider == 0 || fromService == 0 {
+		t.Fatal("expected jokes from both sources, got:", fromProvider, fromService)
+	}
+}
 
-		w.WriteHeader(http.StatusBadRequest)
+// TestJokeCatalog fetches the catalog with placeholders for the names, and
+// verifies the local catalog stands in for the joke service until it runs
+// out of jokes.
+func TestJokeCatalog(t *testing.T) {
+	cat := &fakeCatalog{}
+	svc, err := New(2, 5, newNoopLogger(), WithJokeCatalog(cat))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
 
-	}))
+	tstSrv := laffmock.New()
+	svc.nameURL = tstSrv.URL + "/name"
+	svc.jokeURL = tstSrv.URL + "/jokes?"
+	svc.catalogURL = tstSrv.URL + "/catalog?"
+	defer tstSrv.Close()
 
-	ts.srv = srv
-	return ts
+	ctx := context.Background()
+	jokes, err := svc.Catalog(ctx)
+	if err != nil {
+		t.Fatal("error fetching catalog", err)
+	}
+	if len(jokes) != 3 || jokes[0].Joke != "{first} {last} made catalog joke 1" {
+		t.Fatal("unexpected catalog:", jokes)
+	}
+
+	name := &NameResp{Name: "Ann", Surname: "Lee"}
+	jk, err := svc.jokeFor(ctx, name)
+	if err != nil || jk.ID != -1 {
+		t.Fatal("expected joke from catalog, got:", jk, err)
+	}
+	cat.empty = true
+	jk, err = svc.jokeFor(ctx, name)
+	if err != nil || jk.ID != 0 {
+		t.Fatal("expected joke from joke service, got:", jk, err)
+	}
 }
 
-func (ts *TestNameJokeServer) Shutdown() {
-	ts.srv.Close()
+// fakeCatalog is a local catalog that can be emptied.
+type fakeCatalog struct {
+	empty bool
 }
 
-func newDebugLogger() *zap.SugaredLogger {
-	config := zap.NewDevelopmentConfig()
-	lg, _ := config.Build()
-	return lg.Sugar()
+func (fc *fakeCatalog) Joke(ctx context.Context, name *NameResp) (Joke, error) {
+	if fc.empty {
+		return Joke{}, ErrNoJokes
+	}
+	return Joke{ID: -1, Text: name.Name + " told a catalog joke", Name: *name}, nil
 }
 
-func newNoopLogger() *zap.SugaredLogger {
-	config := zap.NewProductionConfig()
-	config.OutputPaths = []string{"/dev/null"}
-	lg, _ := config.Build()
-	return lg.Sugar()
+// TestWeightedProviders verifies the jokes are shared out by weight, and
+// counted per source.
+func TestWeightedProviders(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	empty := &fakeCatalog{empty: true}
+	svc, err := New(2, 5, newNoopLogger(),
+		WithNameURL(tstSrv.URL+"/name"), WithJokeURL(tstSrv.URL+"/jokes?"),
+		WithJokeServiceWeight(0),
+		WithWeightedJokeProvider("local", 3, fakeProvider{}),
+		WithWeightedJokeProvider("empty", 1, empty),
+		WithWeightedJokeProvider("unused", 0, fakeProvider{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	name := &NameResp{Name: "Ann", Surname: "Lee"}
+	for i := 0; i < 400; i++ {
+		if _, err := svc.jokeFor(context.Background(), name); err != nil {
+			t.Fatal("error getting joke", err)
+		}
+	}
+	st := svc.Stats().Providers
+	local, emp, up := st["local"], st["empty"], st[JokeServiceName]
+	if local.Jokes+emp.Empty != 400 || st["unused"].Jokes != 0 {
+		t.Fatal("unexpected provider stats:", st)
+	}
+	if emp.Jokes != 0 || up.Jokes != emp.Empty || up.Weight != 0 || local.Weight != 3 {
+		t.Fatal("unexpected fallback stats:", st)
+	}
+	// The local provider should get about three quarters of the jokes.
+	if local.Jokes < 250 || local.Jokes > 350 {
+		t.Fatal("expected about 300 local jokes, got:", local.Jokes)
+	}
+
+	if _, err := New(2, 5, newNoopLogger(), WithWeightedJokeProvider("local", -1, fakeProvider{})); err == nil {
+		t.Fatal("expected error from negative weight")
+	}
+	if _, err := New(2, 5, newNoopLogger(), WithWeightedJokeProvider(JokeServiceName, 1, fakeProvider{})); err == nil {
+		t.Fatal("expected error from duplicate name")
+	}
+}
+
+// TestExperiment verifies requests with an ID are split between the arms
+// the same way every time, and the others are served as usual.
+func TestExperiment(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(),
+		WithNameURL(tstSrv.URL+"/name"), WithJokeURL(tstSrv.URL+"/jokes?"),
+		WithWeightedJokeProvider("local", 0, fakeProvider{}),
+		WithExperiment(JokeServiceName, "local"), WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	arms := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("req-%d", i%5)
+		jk, err := svc.Joke(WithRequestID(context.Background(), id))
+		if err != nil {
+			t.Fatal("error getting joke", err)
+		}
+		local := jk.ID == -1
+		if prev, ok := arms[id]; ok && prev != local {
+			t.Fatal("request moved arms:", id)
+		}
+		arms[id] = local
+	}
+	if _, err := svc.Joke(context.Background()); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+
+	ex := svc.Stats().Experiment
+	if ex == nil || ex.A.Provider != JokeServiceName || ex.B.Provider != "local" {
+		t.Fatal("unexpected experiment stats:", ex)
+	}
+	if ex.A.Requests+ex.B.Requests != 20 || ex.A.Requests == 0 || ex.B.Requests == 0 {
+		t.Fatal("expected 20 requests over both arms, got:", ex)
+	}
+	if ex.A.Errors != 0 || ex.B.Errors != 0 {
+		t.Fatal("unexpected errors:", ex)
+	}
+
+	if _, err := New(2, 5, newNoopLogger(), WithExperiment(JokeServiceName, "bogus")); err == nil {
+		t.Fatal("expected error from unknown provider")
+	}
+}
+
+// TestCanary sends some of the requests to the canaries, and verifies a
+// failing canary is rolled back.
+func TestCanary(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(),
+		WithNameURL(tstSrv.URL+"/name"), WithJokeURL(tstSrv.URL+"/jokes?"),
+		WithNameCanary(Canary{URL: tstSrv.URL + "/randomuser", NameService: RandomUser,
+			Percent: 50, MaxErrorRate: 0.1}),
+		WithJokeCanary(Canary{URL: tstSrv.URL + "/bogus?", Percent: 50, MaxErrorRate: 0.5}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	ctx := context.Background()
+	var fromCanary int
+	for i := 0; i < 100; i++ {
+		name, err := svc.fetchName(ctx)
+		if err != nil {
+			t.Fatal("error getting name", err)
+		}
+		if name.Region == "Norway" {
+			fromCanary++
+		}
+		svc.fetchJoke(ctx, name)
+	}
+	if fromCanary < 25 || fromCanary > 75 {
+		t.Fatal("expected about half the names from the canary, got:", fromCanary)
+	}
+
+	st := svc.Stats().Canaries
+	if cn := st["name"]; cn.RolledBack || cn.Errors != 0 || cn.Requests != int64(fromCanary) {
+		t.Fatal("unexpected name canary stats:", cn)
+	}
+	if cn := st["joke"]; !cn.RolledBack || cn.Requests < minCanaryRequests || cn.Requests > 50 {
+		t.Fatal("expected joke canary to be rolled back, got:", cn)
+	}
+
+	// Once rolled back, the canary gets no more requests.
+	before := st["joke"].Requests
+	for i := 0; i < 10; i++ {
+		if _, err := svc.fetchJoke(ctx, &NameResp{Name: "Ann", Surname: "Lee"}); err != nil {
+			t.Fatal("error getting joke", err)
+		}
+	}
+	if after := svc.Stats().Canaries["joke"].Requests; after != before {
+		t.Fatal("rolled back canary still used:", after)
+	}
+}
+
+// TestConcurrency verifies the calls in flight to the joke service are
+// bounded, and a call waiting its turn gives up when its context is done.
+func TestConcurrency(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	var inFlight, most int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for m := atomic.LoadInt64(&most); n > m && !atomic.CompareAndSwapInt64(&most, m, n); {
+			m = atomic.LoadInt64(&most)
+		}
+		time.Sleep(20 * time.Millisecond)
+		tstSrv.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	svc, err := New(2, 5, newNoopLogger(), WithJokeURL(srv.URL+"/jokes?"), WithConcurrency(0, 2))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	name := &NameResp{Name: "Ann", Surname: "Lee"}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := svc.fetchJoke(context.Background(), name); err != nil {
+				t.Error("error getting joke", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if most != 2 {
+		t.Fatal("expected at most 2 calls at once, got:", most)
+	}
+
+	svc.jokeSem <- struct{}{}
+	svc.jokeSem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := svc.fetchJoke(ctx, name); err != context.DeadlineExceeded {
+		t.Fatal("expected deadline error, got:", err)
+	}
+	if st := svc.Stats(); st.JokeCalls != 2 || st.NameCalls != 0 {
+		t.Fatal("unexpected calls in flight:", st.JokeCalls, st.NameCalls)
+	}
+}
+
+// TestRate verifies the requests are refused once the name and joke
+// services have been called as often as allowed, while the cache workers
+// wait their turn.
+func TestRate(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(),
+		WithNameURL(tstSrv.URL+"/name"), WithJokeURL(tstSrv.URL+"/jokes?"),
+		WithNameRate(Rate{Requests: 2, Interval: time.Minute, Burst: 2}),
+		WithJokeRate(Rate{Requests: 1, Interval: time.Minute, Burst: 1}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	ctx := context.Background()
+	if _, err := svc.Joke(ctx); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	_, err = svc.Joke(ctx)
+	if rle, ok := err.(RateLimitError); !ok || rle.retry < 55 || rle.retry > 60 {
+		t.Fatal("expected joke rate limit error, got:", err)
+	}
+	_, err = svc.Joke(ctx)
+	if rle, ok := err.(RateLimitError); !ok || rle.retry < 25 || rle.retry > 30 {
+		t.Fatal("expected name rate limit error, got:", err)
+	}
+
+	wctx, cancel := context.WithTimeout(waitForRate(ctx), 50*time.Millisecond)
+	defer cancel()
+	if _, err := svc.nextName(wctx); err == nil || errors.As(err, new(RateLimitError)) {
+		t.Fatal("expected waiting for the name rate to time out, got:", err)
+	}
+
+	// A caller waiting its turn gets it once the time comes.
+	clock := newFakeClock()
+	svc, err = New(2, 5, newNoopLogger(), WithNameURL(tstSrv.URL+"/name"),
+		WithNameRate(Rate{Requests: 1, Interval: time.Minute, Burst: 1}), WithClock(clock))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	if _, err := svc.nextName(ctx); err != nil {
+		t.Fatal("error getting name", err)
+	}
+	done := make(chan bool, 1)
+	go func() {
+		_, err := svc.nextName(waitForRate(ctx))
+		done <- err == nil
+	}()
+	clock.AdvanceUntil(done, 10*time.Second)
+	if !<-done || clock.Now().Sub(clock.start) < time.Minute {
+		t.Fatal("expected the name after waiting a minute, waited:", clock.Now().Sub(clock.start))
+	}
+
+	if _, err := New(2, 5, newNoopLogger(), WithJokeRate(Rate{Requests: 1})); err == nil {
+		t.Fatal("expected error from rate without interval")
+	}
+}
+
+// TestDNSCache verifies the upstream hosts are looked up once, until
+// their TTL runs out, and the failed lookups back off, using the
+// addresses we had if there are any.
+func TestDNSCache(t *testing.T) {
+	clock := newFakeClock()
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	u, _ := url.Parse(tstSrv.URL)
+	port := u.Port()
+	svc, err := New(2, 5, newNoopLogger(),
+		WithNameURL(fmt.Sprintf("http://laff.test:%s/name", port)),
+		WithJokeURL(fmt.Sprintf("http://laff.test:%s/jokes?", port)),
+		WithNameRate(Rate{}), WithDNSCache(DNSCache{MaxTTL: time.Minute}), WithClock(clock))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	var lookups int
+	var lookupErr error
+	svc.dns.lookup = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		lookups++
+		if host != "laff.test" {
+			t.Error("unexpected host:", host)
+		}
+		if lookupErr != nil {
+			return nil, 0, lookupErr
+		}
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, 30 * time.Second, nil
+	}
+
+	// Without keep-alives, each call dials the host.
+	svc.client.Transport.(*http.Transport).DisableKeepAlives = true
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := svc.Joke(ctx); err != nil {
+			t.Fatal("error getting joke", err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatal("expected one lookup, got:", lookups)
+	}
+	clock.Advance(31 * time.Second)
+	lookupErr = errors.New("server misbehaving")
+	if _, err := svc.Joke(ctx); err != nil {
+		t.Fatal("expected the stale address to be used, got:", err)
+	}
+	if _, err := svc.Joke(ctx); err != nil || lookups != 2 {
+		t.Fatal("expected no lookup while backing off, got:", err, lookups)
+	}
+	if st := svc.Stats(); st.DNS == nil || st.DNS.Failures != 1 || st.DNS.Hosts != 1 {
+		t.Fatal("unexpected DNS stats:", st.DNS)
+	}
+
+	// A missing host is remembered, and the error says when to retry.
+	r := &resolver{DNSCache: DNSCache{NegativeTTL: time.Minute}}
+	r.setup(svc)
+	r.lookup = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		lookups++
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	lookups = 0
+	for i := 0; i < 2; i++ {
+		_, err := r.resolve(ctx, "missing.test")
+		var le *lookupError
+		if !errors.As(err, &le) || le.retry.Sub(clock.Now()) != time.Minute {
+			t.Fatal("expected lookup error with retry time, got:", err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatal("expected one lookup of missing host, got:", lookups)
+	}
+	// The lowest TTL of the answers is kept.
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartAnswers()
+	for _, ttl := range []uint32{300, 60} {
+		b.AResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("laff.test."),
+			Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal("error building DNS answer", err)
+	}
+	var ttls ttlRecorder
+	ttls.note(msg)
+	if ttls.ttl() != time.Minute {
+		t.Fatal("expected TTL of a minute, got:", ttls.ttl())
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if svc.waitToRetry(cctx, &lookupError{err: lookupErr, retry: clock.Now().Add(time.Minute)}) {
+		t.Fatal("expected waiting to retry to stop with the context")
+	}
+}
+
+// TestTransport verifies the upstream calls go through the proxies set
+// for each service, or through the transport given, and our transport
+// is tuned as asked.
+func TestTransport(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	var proxied []string
+	var mu sync.Mutex
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.Host)
+		mu.Unlock()
+		tstSrv.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	pu, _ := url.Parse(proxy.URL)
+
+	svc, err := New(2, 5, newNoopLogger(), WithNameRate(Rate{}),
+		WithNameURL("http://names.test/name"), WithJokeURL("http://jokes.test/jokes?"),
+		WithNameProxy(pu), WithJokeProxy(pu))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	if _, err := svc.Joke(context.Background()); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	if len(proxied) != 2 || proxied[0] != "names.test" || proxied[1] != "jokes.test" {
+		t.Fatal("expected both calls through the proxy, got:", proxied)
+	}
+
+	var calls int64
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt64(&calls, 1)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	svc, err = New(2, 5, newNoopLogger(), WithNameRate(Rate{}), WithTransport(rt),
+		WithNameURL(tstSrv.URL+"/name"), WithJokeURL(tstSrv.URL+"/jokes?"))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	if _, err := svc.Joke(context.Background()); err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	if calls != 2 {
+		t.Fatal("expected both calls through the transport, got:", calls)
+	}
+
+	if _, err := New(2, 5, newNoopLogger(), WithTransport(rt), WithNameProxy(pu)); err == nil {
+		t.Fatal("expected error combining transport and proxy")
+	}
+	if _, err := New(2, 5, newNoopLogger(), WithJokeProxy(&url.URL{Scheme: "ftp", Host: "proxy"})); err == nil {
+		t.Fatal("expected error for ftp proxy")
+	}
+
+	svc, err = New(2, 5, newNoopLogger(), WithTransportConfig(TransportConfig{MaxIdleConnsPerHost: 4}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	if tr := svc.client.Transport.(*http.Transport); tr.MaxIdleConnsPerHost != 4 || tr.ForceAttemptHTTP2 {
+		t.Fatal("expected the transport settings given, got:", tr.MaxIdleConnsPerHost, tr.ForceAttemptHTTP2)
+	}
+	if _, err := New(2, 5, newNoopLogger(), WithTransportConfig(TransportConfig{IdleConnTimeout: -1})); err == nil {
+		t.Fatal("expected error for negative idle timeout")
+	}
+}
+
+// TestConnStats verifies the calls to the upstream services are traced,
+// reusing the pooled connections.
+func TestConnStats(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(), WithNameRate(Rate{}),
+		WithNameURL(tstSrv.URL+"/name"), WithJokeURL(tstSrv.URL+"/jokes?"))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := svc.Joke(context.Background()); err != nil {
+			t.Fatal("error getting joke", err)
+		}
+	}
+	st := svc.Stats().Connections
+	for _, up := range []string{"name", "joke"} {
+		cs := st[up]
+		if cs.Requests != 3 || cs.Reused < 2 || cs.TTFBMs <= 0 {
+			t.Fatalf("unexpected %s connection stats: %+v", up, cs)
+		}
+	}
+	if st["name"].ConnectMs+st["joke"].ConnectMs <= 0 {
+		t.Fatal("expected connect times, got:", st)
+	}
+}
+
+// TestRetryBudget verifies the retries are held to their share of the
+// calls over the window, apart from the few always allowed.
+func TestRetryBudget(t *testing.T) {
+	clock := newFakeClock()
+	b := retryBudget{RetryBudget: RetryBudget{Percent: 20, Window: time.Minute, MinRetries: 2}, clock: clock}
+	if !b.take() || !b.take() || b.take() {
+		t.Fatal("expected only the minimum retries without calls")
+	}
+	for i := 0; i < 20; i++ {
+		b.call()
+	}
+	if !b.take() || !b.take() || b.take() {
+		t.Fatal("expected retries up to 20% of the calls")
+	}
+	if st := b.stats(); st.Retries != 4 || st.Denied != 2 {
+		t.Fatal("unexpected retry stats:", st)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if b.wait(ctx, newNoopLogger().Warnw) {
+		t.Fatal("expected waiting for a retry to stop with the context")
+	}
+
+	// The retries leave the window in time.
+	done := make(chan bool, 1)
+	go func() {
+		done <- b.wait(context.Background(), newNoopLogger().Warnw)
+	}()
+	clock.AdvanceUntil(done, b.Window/retryBuckets)
+	if !<-done {
+		t.Fatal("expected a retry once the window moved on")
+	}
+	if now := clock.Now(); now.Before(clock.start.Add(b.Window)) {
+		t.Fatal("expected to wait for the window, waited:", now.Sub(clock.start))
+	}
+
+	if _, err := New(2, 5, newNoopLogger(), WithRetryBudget(RetryBudget{Percent: 120, Window: time.Minute})); err == nil {
+		t.Fatal("expected error for retry budget over 100%")
+	}
+}
+
+// TestRetryAfter verifies the joke service's 429s and 503s are honored,
+// with the Retry-After in seconds or as a date, and the joke service
+// isn't called again until then.
+func TestRetryAfter(t *testing.T) {
+	var calls int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Header().Set("Retry-After", time.Now().Add(30*time.Second).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	clock := newFakeClock()
+	svc, err := New(2, 5, newNoopLogger(), WithJokeURL(srv.URL+"/jokes?"), WithClock(clock))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	name := &NameResp{Name: "Ann", Surname: "Lee"}
+	for i := 0; i < 2; i++ {
+		_, err := svc.fetchJoke(context.Background(), name)
+		if rle, ok := err.(RateLimitError); !ok || rle.retry < 28 || rle.retry > 30 {
+			t.Fatal("expected rate limit error, got:", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatal("expected the joke service called once, got:", calls)
+	}
+	clock.Advance(31 * time.Second)
+	if svc.fetchJoke(context.Background(), name); calls != 2 {
+		t.Fatal("expected the joke service called again after the backoff, got:", calls)
+	}
+
+	for v, want := range map[string]int{"7": 7, "": dfltRetry, "soon": dfltRetry,
+		"Mon, 02 Jan 2006 15:04:05 GMT": 0} {
+		if got := retryAfter(http.Header{"Retry-After": {v}}, time.Now()); got != want {
+			t.Errorf("expected %d for Retry-After %q, got: %d", want, v, got)
+		}
+	}
+}
+
+// TestBreaker verifies the joke service isn't called while its breaker is
+// open, is probed once the cooldown is over, and that the breaker can be
+// forced open and closed.
+func TestBreaker(t *testing.T) {
+	var calls, failing int64 = 0, 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if atomic.LoadInt64(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"type": "success", "value": {"id": 1, "joke": "Ann Lee laughs."}}`)
+	}))
+	defer srv.Close()
+	clock := newFakeClock()
+	svc, err := New(2, 5, newNoopLogger(), WithJokeURL(srv.URL+"/jokes?"), WithClock(clock),
+		WithBreakers(Breaker{Failures: 3, Cooldown: 30 * time.Second}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	name := &NameResp{Name: "Ann", Surname: "Lee"}
+	for i := 0; i < 5; i++ {
+		svc.fetchJoke(context.Background(), name)
+	}
+	if calls != 3 {
+		t.Fatal("expected the joke service called until the breaker opened, got:", calls)
+	}
+	st := svc.Breakers()["joke"]
+	if st.State != BreakerOpen || st.Trips != 1 || st.NextProbe == nil {
+		t.Fatal("expected the joke breaker open, got:", st)
+	}
+	_, err = svc.fetchJoke(context.Background(), name)
+	var boe BreakerOpenError
+	if !errors.As(err, &boe) || boe.Upstream != "joke" || boe.Retry != 30*time.Second {
+		t.Fatal("expected the breaker open for 30s, got:", err)
+	}
+
+	// A failed probe opens it again, and a good one closes it.
+	clock.Advance(30 * time.Second)
+	svc.fetchJoke(context.Background(), name)
+	if st := svc.Breakers()["joke"]; calls != 4 || st.State != BreakerOpen || st.Trips != 2 {
+		t.Fatal("expected a failed probe to reopen the breaker, got:", calls, st)
+	}
+	atomic.StoreInt64(&failing, 0)
+	clock.Advance(30 * time.Second)
+	if _, err := svc.fetchJoke(context.Background(), name); err != nil {
+		t.Fatal("error probing the joke service", err)
+	}
+	if st := svc.Breakers()["joke"]; st.State != BreakerClosed || st.Failures != 0 {
+		t.Fatal("expected the breaker closed after a good probe, got:", st)
+	}
+
+	if _, err := svc.ForceBreaker("joke", BreakerOpen); err != nil {
+		t.Fatal("error forcing the breaker open", err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := svc.fetchJoke(context.Background(), name); !errors.As(err, &boe) {
+		t.Fatal("expected the forced breaker to stay open, got:", err)
+	}
+	if _, err := svc.ForceBreaker("joke", BreakerClosed); err != nil {
+		t.Fatal("error forcing the breaker closed", err)
+	}
+	if _, err := svc.fetchJoke(context.Background(), name); err != nil {
+		t.Fatal("error after closing the breaker", err)
+	}
+	if _, err := svc.ForceBreaker("dns", BreakerOpen); err != ErrNoBreaker {
+		t.Fatal("expected no such breaker, got:", err)
+	}
+	if _, err := svc.ForceBreaker("name", BreakerHalfOpen); err == nil {
+		t.Fatal("expected an error forcing the breaker half-open")
+	}
+}
+
+// TestProbes verifies the upstream services are probed with HEAD requests
+// without the query, and are taken as down after failing a few in a row.
+func TestProbes(t *testing.T) {
+	var failing int64 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.RawQuery != "" {
+			t.Errorf("expected a HEAD request without a query, got: %s %s", r.Method, r.URL)
+		}
+		if atomic.LoadInt64(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	svc, err := New(2, 5, newNoopLogger(), WithJokeURL(srv.URL+"/jokes?limitTo=nerdy"),
+		WithProbes(Probe{Interval: time.Minute}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	probe := func() {
+		svc.probeOnce(context.Background(), svc.jokeProber, svc.jokeURL, nil, Credential{}, svc.jokeBreaker)
+	}
+	for i := 0; i < probeDownAfter; i++ {
+		if down := svc.Down(); len(down) != 0 {
+			t.Fatal("expected nothing down yet, got:", down)
+		}
+		probe()
+	}
+	if down := svc.Down(); len(down) != 1 || down[0] != "joke" {
+		t.Fatal("expected the joke service down, got:", down)
+	}
+	atomic.StoreInt64(&failing, 0)
+	probe()
+	st := svc.Probes()["joke"]
+	if st.Down || st.Probes != 4 || st.Failures != 3 || st.Availability != 0.25 || st.LastSuccess == nil {
+		t.Fatal("unexpected probe stats:", st)
+	}
+	if st := svc.Probes()["name"]; st.Probes != 0 {
+		t.Fatal("expected the name service not probed, got:", st)
+	}
+}
+
+// TestUpstreams verifies the report of the upstream services counts the
+// calls made to them, and not those refused by the backoff, and that the
+// status check goes by it without calling them.
+func TestUpstreams(t *testing.T) {
+	var failing int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt64(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"type": "success", "value": {"id": 1, "joke": "Ann Lee laughs."}}`)
+	}))
+	defer srv.Close()
+	clock := newFakeClock()
+	svc, err := New(2, 5, newNoopLogger(), WithJokeURL(srv.URL+"/jokes?"), WithClock(clock))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	name := &NameResp{Name: "Ann", Surname: "Lee"}
+	for i := 0; i < 3; i++ {
+		svc.fetchJoke(context.Background(), name)
+	}
+	atomic.StoreInt64(&failing, 1)
+	svc.fetchJoke(context.Background(), name)
+	svc.jokeBackoff.set(clock.Now(), 30)
+	svc.fetchJoke(context.Background(), name)
+
+	rep := svc.Upstreams()["joke"]
+	if rep.Calls != 4 || rep.SuccessRate != 0.75 || rep.MedianLatency != "0s" {
+		t.Fatal("unexpected joke service report:", rep)
+	}
+	if rep.LastSuccess == nil || rep.LastError == nil || rep.Backoff != "30s" || rep.Breaker != nil {
+		t.Fatal("unexpected joke service state:", rep)
+	}
+	if rep := svc.Upstreams()["name"]; rep.Calls != 0 || rep.LastSuccess != nil {
+		t.Fatal("expected no name service calls, got:", rep)
+	}
+
+	us := svc.CheckUpstreams()
+	if len(us) != 2 || us[0].Checked || us[0].Reachable || !us[1].Checked || us[1].Reachable || us[1].Error == "" {
+		t.Fatal("unexpected upstream statuses:", us)
+	}
+	if rep := svc.Upstreams()["joke"]; rep.Calls != 4 {
+		t.Fatal("expected the status check not to call the joke service, got:", rep.Calls)
+	}
+	atomic.StoreInt64(&failing, 0)
+	clock.Advance(time.Minute)
+	svc.fetchJoke(context.Background(), name)
+	if us := svc.CheckUpstreams(); !us[1].Reachable || us[1].Error != "" {
+		t.Fatal("expected the joke service reachable again, got:", us)
+	}
+}
+
+// TestJokeOfTheDay verifies the joke of the day is picked once a day, and
+// that the daily source gives the same one.
+func TestJokeOfTheDay(t *testing.T) {
+	clock := newFakeClock()
+	svc, err := New(2, 5, newNoopLogger(), WithClock(clock), WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc.nameURL, svc.jokeURL = tstSrv.NameURL(), tstSrv.JokeURL()
+
+	ctx := context.Background()
+	jk, day, picked, err := svc.JokeOfTheDay(ctx)
+	if err != nil {
+		t.Fatal("error getting the joke of the day", err)
+	}
+	if want := clock.Now().UTC().Format(time.DateOnly); day != want || !picked.Equal(clock.Now()) {
+		t.Fatal("unexpected day or time picked:", day, picked)
+	}
+	clock.Advance(time.Minute)
+	again, _, at, err := svc.JokeOfTheDay(ctx)
+	if err != nil || again.ID != jk.ID || !at.Equal(picked) {
+		t.Fatal("expected the same joke later in the day, got:", again, at, err)
+	}
+	if daily, err := svc.Daily().Joke(ctx); err != nil || daily.ID != jk.ID {
+		t.Fatal("expected the daily source to give the joke of the day, got:", daily, err)
+	}
+	calls, _ := tstSrv.Calls()
+
+	clock.Advance(24 * time.Hour)
+	next, nextDay, _, err := svc.JokeOfTheDay(ctx)
+	if err != nil || nextDay == day || next.ID == jk.ID {
+		t.Fatal("expected a new joke the next day, got:", next, nextDay, err)
+	}
+	if more, _ := tstSrv.Calls(); more == calls {
+		t.Fatal("expected the next day's joke fetched")
+	}
+
+	// The caller's context, cancelled and limited to a category no joke
+	// has, doesn't decide the pick.
+	clock.Advance(24 * time.Hour)
+	tenant, cancel := context.WithCancel(AllowCategories(ctx, []string{"nosuch"}))
+	cancel()
+	if _, _, _, err := svc.JokeOfTheDay(tenant); err != nil {
+		t.Fatal("expected the joke of the day picked regardless of the caller's context, got:", err)
+	}
+}
+
+// TestCategories verifies a request limited to some categories gets a
+// joke in one of them, the others being cached for the other requests,
+// and that a preferred provider serves its share.
+func TestCategories(t *testing.T) {
+	var calls int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cat := "nerdy"
+		if atomic.AddInt64(&calls, 1)%2 == 0 {
+			cat = "explicit"
+		}
+		fmt.Fprintf(w, `{"type": "success", "value": {"id": %d, "joke": "Ann Lee laughs.", "categories": [%q]}}`,
+			atomic.LoadInt64(&calls), cat)
+	}))
+	defer srv.Close()
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(), WithNameURL(tstSrv.URL+"/name"), WithJokeURL(srv.URL+"/jokes?"),
+		WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	ctx := AllowCategories(context.Background(), []string{"explicit"})
+	for i := 1; i <= 2; i++ {
+		jk, err := svc.Joke(ctx)
+		if err != nil || jk.Categories[0] != "explicit" {
+			t.Fatal("expected an explicit joke, got:", jk, err)
+		}
+		if _, jokes := svc.CacheDepths(); jokes != i {
+			t.Fatalf("expected %d jokes cached, got: %d", i, jokes)
+		}
+	}
+	jk, err := svc.Joke(context.Background())
+	if err != nil || jk.Cache != CacheJoke || jk.Categories[0] != "nerdy" {
+		t.Fatal("expected a cached nerdy joke, got:", jk, err)
+	}
+	if _, err := svc.Joke(AllowCategories(ctx, []string{"dev"})); err != ErrNoCategory {
+		t.Fatal("expected no joke in the category, got:", err)
+	}
+
+	// The preferred provider's jokes aren't in the category.
+	jk, err = svc.Joke(PreferJokes(context.Background(), fakeProvider{}, 100))
+	if err != nil || jk.ID != -1 {
+		t.Fatal("expected the preferred provider's joke, got:", jk, err)
+	}
+	jk, err = svc.Joke(PreferJokes(ctx, fakeProvider{}, 100))
+	if err != nil || jk.ID == -1 {
+		t.Fatal("expected an explicit joke instead, got:", jk, err)
+	}
+}
+
+// TestMaxLength verifies a request limited to short jokes gets one within
+// the limit, the longer ones being cached for the other requests.
+func TestMaxLength(t *testing.T) {
+	var calls int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		text := "Ann Lee laughs and laughs and laughs."
+		if atomic.AddInt64(&calls, 1)%2 == 0 {
+			text = "Ann Lee laughs."
+		}
+		fmt.Fprintf(w, `{"type": "success", "value": {"id": %d, "joke": %q}}`, atomic.LoadInt64(&calls), text)
+	}))
+	defer srv.Close()
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(), WithNameURL(tstSrv.URL+"/name"), WithJokeURL(srv.URL+"/jokes?"),
+		WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	ctx := MaxLength(context.Background(), 20)
+	for i := 1; i <= 2; i++ {
+		jk, err := svc.Joke(ctx)
+		if err != nil || jk.Text != "Ann Lee laughs." {
+			t.Fatal("expected a short joke, got:", jk, err)
+		}
+		if _, jokes := svc.CacheDepths(); jokes != i {
+			t.Fatalf("expected %d jokes cached, got: %d", i, jokes)
+		}
+	}
+	jk, err := svc.Joke(context.Background())
+	if err != nil || jk.Cache != CacheJoke || len(jk.Text) <= 20 {
+		t.Fatal("expected a cached long joke, got:", jk, err)
+	}
+	if _, err := svc.Joke(MaxLength(ctx, 10)); err != ErrTooLong {
+		t.Fatal("expected no joke short enough, got:", err)
+	}
+}
+
+// TestSecondName verifies a joke about two people is made out to a second
+// name, the caller's if given, and that the others' cached jokes aren't
+// served to a caller giving one.
+func TestSecondName(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(), WithNameURL(tstSrv.URL+"/name"), WithNameRate(Rate{}),
+		WithJokeServiceWeight(0), WithJokeProvider(twoProvider{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	jk, err := svc.Joke(context.Background())
+	if err != nil || jk.Second == nil || strings.Contains(jk.Text, "{") {
+		t.Fatal("expected a joke with a fetched second name, got:", jk, err)
+	}
+	if !strings.HasSuffix(jk.Text, " and "+jk.Second.Name+" "+jk.Second.Surname+" laugh.") {
+		t.Fatal("expected the second name filled in, got:", jk.Text)
+	}
+	svc.stashJoke(context.Background(), jk)
+
+	bob, err := svc.CheckName(NameResp{Name: " Bob ", Surname: "Ray"})
+	if err != nil || bob.Name != "Bob" {
+		t.Fatal("expected the name tidied, got:", bob, err)
+	}
+	jk, err = svc.Joke(SecondName(context.Background(), bob))
+	if err != nil || jk.Cache == CacheJoke || *jk.Second != bob || !strings.HasSuffix(jk.Text, " and Bob Ray laugh.") {
+		t.Fatal("expected a joke made out to Bob Ray, got:", jk, err)
+	}
+	if _, jokes := svc.CacheDepths(); jokes != 1 {
+		t.Fatal("expected the other joke still cached, got:", jokes)
+	}
+	jk, err = svc.Joke(SecondName(context.Background(), NameResp{Name: "Bob"}))
+	if err != nil || !strings.HasSuffix(jk.Text, " and Bob laugh.") {
+		t.Fatal("expected a joke made out to Bob, got:", jk, err)
+	}
+	if _, err := svc.CheckName(NameResp{Surname: "Ray"}); err == nil {
+		t.Fatal("expected an error for no first name")
+	}
+	if _, err := svc.CheckName(NameResp{Name: "Bob\x00"}); err == nil {
+		t.Fatal("expected an error for a control character")
+	}
+}
+
+// TestOwnName verifies a joke asked for with the caller's own name is made
+// out to it, rather than served from the cache or cached for the others.
+func TestOwnName(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(), WithNameURL(tstSrv.URL+"/name"),
+		WithJokeURL(tstSrv.URL+"/jokes?"), WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	jk, err := svc.Joke(context.Background())
+	if err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	svc.stashJoke(context.Background(), jk)
+	ann := NameResp{Name: "Ann", Surname: "Lee"}
+	ctx := OwnName(context.Background(), ann)
+	jk, err = svc.Joke(ctx)
+	if err != nil || jk.Cache == CacheJoke || jk.Name != ann || !strings.HasPrefix(jk.Text, "Ann Lee ") {
+		t.Fatal("expected a joke made out to Ann Lee, got:", jk, err)
+	}
+	svc.stashJoke(ctx, jk)
+	if _, jokes := svc.CacheDepths(); jokes != 1 {
+		t.Fatal("expected only the other joke cached, got:", jokes)
+	}
+
+	// The categories asked for narrow those allowed, never widen them.
+	ctx = AllowCategories(AllowCategories(ctx, []string{"nerdy", "explicit"}), []string{"explicit", "dev"})
+	if allowed(ctx, Joke{Categories: []string{"nerdy"}}) || !allowed(ctx, Joke{Categories: []string{"explicit"}}) {
+		t.Fatal("expected only the explicit jokes allowed")
+	}
+	if _, err := svc.Joke(AllowCategories(ctx, []string{"nerdy"})); err != ErrNoCategory {
+		t.Fatal("expected no category allowed, got:", err)
+	}
+}
+
+// TestAvoidRepeats verifies a joke the caller has seen is skipped in the
+// cache, and a fetched one kept back, unless every joke tried was seen.
+func TestAvoidRepeats(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc, err := New(2, 5, newNoopLogger(), WithNameURL(tstSrv.URL+"/name"),
+		WithJokeURL(tstSrv.URL+"/jokes?"), WithNameRate(Rate{}))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	seen, err := svc.Joke(context.Background())
+	if err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	svc.stashJoke(context.Background(), seen)
+	ctx := AvoidRepeats(context.Background(), func(id int) bool { return id == seen.ID })
+	jk, err := svc.Joke(ctx)
+	if err != nil || jk.ID == seen.ID || jk.Cache == CacheJoke {
+		t.Fatal("expected a fetched joke not seen, got:", jk, err)
+	}
+	if _, jokes := svc.CacheDepths(); jokes != 1 {
+		t.Fatal("expected the seen joke still cached, got:", jokes)
+	}
+
+	// Having seen them all, the caller gets the last one fetched, the
+	// others being cached.
+	jk, err = svc.Joke(AvoidRepeats(context.Background(), func(int) bool { return true }))
+	if err != nil || jk.ID == seen.ID {
+		t.Fatal("expected a repeat rather than an error, got:", jk, err)
+	}
+	if _, jokes := svc.CacheDepths(); jokes != maxRefetch {
+		t.Fatalf("expected %d jokes cached, got: %d", maxRefetch, jokes)
+	}
+}
+
+// twoProvider tells jokes about two people.
+type twoProvider struct{}
+
+func (twoProvider) Joke(ctx context.Context, name *NameResp) (Joke, error) {
+	return Joke{ID: 2, Text: name.Name + " " + name.Surname + " and {first2} {last2} laugh.", Name: *name}, nil
+}
+
+// fakeLeader leads while told to.
+type fakeLeader struct{ leading int32 }
+
+func (fl *fakeLeader) IsLeader() bool { return atomic.LoadInt32(&fl.leading) == 1 }
+
+// memQueue is a name queue of a fixed size.
+type memQueue struct {
+	mu    sync.Mutex
+	names []NameResp
+	size  int
+}
+
+func (mq *memQueue) Offer(_ context.Context, name NameResp) (bool, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if len(mq.names) >= mq.size {
+		return false, nil
+	}
+	mq.names = append(mq.names, name)
+	return true, nil
+}
+
+func (mq *memQueue) Take(context.Context) (*NameResp, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if len(mq.names) == 0 {
+		return nil, nil
+	}
+	name := mq.names[0]
+	mq.names = mq.names[1:]
+	return &name, nil
+}
+
+// TestLeader verifies the leader fetches the names for the shared queue
+// first, and the followers take theirs from it, waiting while it's empty.
+func TestLeader(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	ldr, q := &fakeLeader{leading: 1}, &memQueue{size: 1}
+	svc, err := New(1, 5, newNoopLogger(), WithNameURL(tstSrv.URL+"/name"), WithJokeURL(tstSrv.URL+"/jokes?"),
+		WithNameRate(Rate{}), WithLeader(ldr, q))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+
+	ctx := context.Background()
+	name, err := svc.prefetchName(ctx)
+	if err != nil || name == nil || len(q.names) != 1 {
+		t.Fatal("expected a name fetched and one shared, got:", name, err, q.names)
+	}
+	atomic.StoreInt32(&ldr.leading, 0)
+	shared := q.names[0]
+	if name, err := svc.prefetchName(ctx); err != nil || *name != shared {
+		t.Fatal("expected the shared name, got:", name, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if name, err := svc.prefetchName(ctx); err == nil {
+		t.Fatal("expected to wait for a shared name, got:", name)
+	}
+	want := LeaderStats{Leader: false, Shared: 1, Taken: 1}
+	if st := svc.Stats().Leadership; st == nil || *st != want {
+		t.Fatal("expected", want, "got:", st)
+	}
+}
+
+// TestStrictValidation verifies the malformed names and jokes are counted,
+// and refetched in strict mode rather than served.
+func TestStrictValidation(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	var names, jokes int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first name and joke are malformed.
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/name") && atomic.AddInt64(&names, 1) == 1:
+			fmt.Fprint(w, `{"name": "Ann", "surname": " "}`)
+		case strings.HasSuffix(r.URL.Path, "/jokes") && atomic.AddInt64(&jokes, 1) == 1:
+			fmt.Fprint(w, `{"type": "success", "value": {"id": 1, "joke": " "}}`)
+		default:
+			tstSrv.ServeHTTP(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, strict := range []bool{false, true} {
+		opts := []Option{WithNameRate(Rate{}), WithNameURL(srv.URL + "/name"), WithJokeURL(srv.URL + "/jokes?")}
+		if strict {
+			opts = append(opts, WithStrictValidation())
+		}
+		svc, err := New(2, 5, newNoopLogger(), opts...)
+		if err != nil {
+			t.Fatal("error creating service", err)
+		}
+		atomic.StoreInt64(&names, 0)
+		atomic.StoreInt64(&jokes, 0)
+		jk, err := svc.Joke(context.Background())
+		if err != nil {
+			t.Fatal("error getting joke", err)
+		}
+		if strict && (strings.TrimSpace(jk.Name.Surname) == "" || strings.TrimSpace(jk.Text) == "") {
+			t.Fatal("expected a complete joke in strict mode, got:", jk)
+		}
+		if !strict && jk.Name.Surname != "" {
+			t.Fatal("expected the malformed name to be let through, got:", jk.Name)
+		}
+		if inv := svc.Stats().Invalid; inv["name"] != 1 || inv["joke"] != 1 {
+			t.Fatal("unexpected invalid counts:", inv)
+		}
+	}
+}
+
+// TestTransliteration verifies the names are sent to the joke service in
+// ASCII if asked, by the service or the request, while the joke keeps the
+// original name.
+func TestTransliteration(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	for in, want := range map[string]string{"Łukasz": "Lukasz", "Zoë Ørsted": "Zoe Orsted",
+		"Straße": "Strasse", "Иван": "Иван", "Ann": "Ann"} {
+		if got := transliterate(in); got != want {
+			t.Errorf("expected %q for %q, got: %q", want, in, got)
+		}
+	}
+
+	svc, err := New(2, 5, newNoopLogger(), WithJokeURL(tstSrv.URL+"/jokes?"), WithTransliteration())
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	name := &NameResp{Name: "Łukasz", Surname: "Wójcik"}
+	jk, err := svc.fetchJoke(context.Background(), name)
+	if err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	if !strings.HasPrefix(jk.Text, "Lukasz Wojcik ") || jk.Name.Name != "Łukasz" {
+		t.Fatal("expected transliterated joke with the original name, got:", jk)
+	}
+	jk, err = svc.fetchJoke(Transliterate(context.Background(), false), name)
+	if err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	if !strings.HasPrefix(jk.Text, "Łukasz Wójcik ") {
+		t.Fatal("expected the name as is when the request asks, got:", jk.Text)
+	}
+}
+
+// TestNormalizeName verifies the fetched names are tidied up, and the
+// ones that can't be used are rejected.
+func TestNormalizeName(t *testing.T) {
+	svc, err := New(2, 5, newNoopLogger(), WithMaxNameLength(10))
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	name := &NameResp{Name: "  Mary \t Ann ", Surname: "Zoe\u0308", Region: "New  York"}
+	if err := svc.normalizeName(context.Background(), name); err != nil {
+		t.Fatal("error normalizing name", err)
+	}
+	if name.Name != "Mary Ann" || name.Surname != "Zoë" || len(name.Surname) != 4 || name.Region != "New York" {
+		t.Fatal("unexpected normalized name:", *name)
+	}
+	for _, bad := range []NameResp{{Name: "Ann\x00", Surname: "Lee"}, {Name: "Ann", Surname: "Leeeeeeeeeeeee"}} {
+		if err := svc.normalizeName(context.Background(), &bad); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("expected invalid name for %q, got: %v", bad, err)
+		}
+	}
+	if inv := svc.Stats().Invalid; inv["name"] != 2 {
+		t.Fatal("expected the rejected names counted, got:", inv)
+	}
+}
+
+// TestSeed verifies the seeded picks of the joke sources and the local
+// jokes are repeated, for the service and for a request.
+func TestSeed(t *testing.T) {
+	newSvc := func(opts ...Option) *LaffService {
+		opts = append(opts, WithJokeServiceWeight(0),
+			WithWeightedJokeProvider("a", 1, pickProvider("a")),
+			WithWeightedJokeProvider("b", 1, pickProvider("b")))
+		svc, err := New(2, 5, newNoopLogger(), opts...)
+		if err != nil {
+			t.Fatal("error creating service", err)
+		}
+		return svc
+	}
+	picks := func(svc *LaffService, ctx context.Context) string {
+		var b strings.Builder
+		name := &NameResp{Name: "Ann", Surname: "Lee"}
+		for i := 0; i < 20; i++ {
+			jk, err := svc.nextJoke(ctx, name)
+			if err != nil {
+				t.Fatal("error getting joke", err)
+			}
+			b.WriteString(jk.Text)
+		}
+		return b.String()
+	}
+
+	one, two := newSvc(WithSeed(7)), newSvc(WithSeed(7))
+	p1 := picks(one, one.withSeed(context.Background()))
+	if p2 := picks(two, two.withSeed(context.Background())); p1 != p2 {
+		t.Fatalf("expected the same picks for the same seed, got: %s and %s", p1, p2)
+	}
+	other := newSvc(WithSeed(8))
+	if p3 := picks(other, other.withSeed(context.Background())); p3 == p1 {
+		t.Fatal("expected other picks for another seed, got:", p3)
+	}
+
+	// A request's seed overrides the service's.
+	p1 = picks(one, one.withSeed(Seed(context.Background(), 42)))
+	if p2 := picks(newSvc(), Seed(context.Background(), 42)); p1 != p2 {
+		t.Fatalf("expected the same picks for the request seed, got: %s and %s", p1, p2)
+	}
+	if !Seeded(Seed(context.Background(), 1)) || Seeded(context.Background()) {
+		t.Fatal("unexpected Seeded result")
+	}
+}
+
+// TestVCR verifies the upstream calls recorded to a cassette are replayed
+// without the services.
+func TestVCR(t *testing.T) {
+	tstSrv := laffmock.New()
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	urls := []Option{WithNameURL(tstSrv.URL + "/name"), WithJokeURL(tstSrv.URL + "/jokes?"),
+		WithCatalogURL(tstSrv.URL + "/catalog?"), WithNameRate(Rate{})}
+	rec, err := New(2, 5, newNoopLogger(), append(urls, WithRecording(path))...)
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	var want []string
+	for i := 0; i < 2; i++ {
+		name, err := rec.fetchName(context.Background())
+		if err != nil {
+			t.Fatal("error fetching name", err)
+		}
+		jk, err := rec.fetchJoke(context.Background(), name)
+		if err != nil {
+			t.Fatal("error fetching joke", err)
+		}
+		want = append(want, name.Name, jk.Text)
+	}
+	tstSrv.Close()
+
+	play, err := New(2, 5, newNoopLogger(), append(urls, WithReplay(path))...)
+	if err != nil {
+		t.Fatal("error creating service", err)
+	}
+	var got []string
+	for i := 0; i < 2; i++ {
+		name, err := play.fetchName(context.Background())
+		if err != nil {
+			t.Fatal("error replaying name", err)
+		}
+		jk, err := play.fetchJoke(context.Background(), name)
+		if err != nil {
+			t.Fatal("error replaying joke", err)
+		}
+		got = append(got, name.Name, jk.Text)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the recorded calls %q, got: %q", want, got)
+	}
+
+	// A joke for a name not recorded comes from those for the path.
+	if _, err := play.fetchJoke(context.Background(), &NameResp{Name: "Ann", Surname: "Lee"}); err != nil {
+		t.Fatal("error replaying joke for another name", err)
+	}
+	if _, err := play.Catalog(context.Background()); err == nil {
+		t.Fatal("expected error for a call not recorded")
+	}
+	if _, err := New(2, 5, newNoopLogger(), WithReplay(filepath.Join(t.TempDir(), "none.json"))); err == nil {
+		t.Fatal("expected error for a missing cassette")
+	}
+}
+
+// TestChaos verifies the faults injected reach the upstream calls as
+// asked, and are counted.
+func TestChaos(t *testing.T) {
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	newSvc := func(c Chaos) *LaffService {
+		svc, err := New(2, 5, newNoopLogger(), WithJokeURL(tstSrv.URL+"/jokes?"), WithChaos(c))
+		if err != nil {
+			t.Fatal("error creating service", err)
+		}
+		return svc
+	}
+	name := &NameResp{Name: "Ann", Surname: "Lee"}
+
+	svc := newSvc(Chaos{RateLimitPct: 100})
+	if _, err := svc.fetchJoke(context.Background(), name); !errors.As(err, &RateLimitError{}) {
+		t.Fatal("expected rate limit error, got:", err)
+	}
+	svc = newSvc(Chaos{ErrorPct: 100})
+	if _, err := svc.fetchJoke(context.Background(), name); err == nil {
+		t.Fatal("expected error from injected 500")
+	}
+	svc = newSvc(Chaos{MalformedPct: 100, Latency: 10 * time.Millisecond, LatencyPct: 100})
+	start := time.Now()
+	if _, err := svc.fetchJoke(context.Background(), name); err == nil {
+		t.Fatal("expected error from garbled joke")
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("expected the call delayed")
+	}
+	if st := svc.Stats().Chaos; st == nil || st.Delayed != 1 || st.Malformed != 1 || st.Errors != 0 {
+		t.Fatal("unexpected chaos stats:", st)
+	}
+
+	svc = newSvc(Chaos{})
+	if _, err := svc.fetchJoke(context.Background(), name); err != nil {
+		t.Fatal("error getting joke with no faults", err)
+	}
+	if _, err := New(2, 5, newNoopLogger(), WithChaos(Chaos{RateLimitPct: 60, ErrorPct: 60})); err == nil {
+		t.Fatal("expected error for more than 100% of faults")
+	}
+}
+
+// TestDecode verifies the upstream responses are read whatever the shape
+// of their JSON: arrays or single values, IDs as numbers or strings, and
+// extra fields.
+func TestDecode(t *testing.T) {
+	for _, in := range []string{
+		`{"name": "Ann", "surname": "Lee", "extra": [1, 2]}`,
+		`[{"name": "Ann", "surname": "Lee"}, {"name": "Bo", "surname": "Ek"}]`,
+	} {
+		nm, err := decodeUINames([]byte(in))
+		if err != nil || nm.Name != "Ann" || nm.Surname != "Lee" {
+			t.Errorf("unexpected name for %s: %v, %v", in, nm, err)
+		}
+	}
+	if _, err := decodeUINames([]byte(`[]`)); err == nil {
+		t.Error("expected error for no names")
+	}
+
+	for _, in := range []string{
+		`{"type": "success", "value": {"id": 7, "joke": "funny", "categories": ["nerdy"]}}`,
+		`{"type": "success", "value": {"id": "7", "joke": "funny", "rating": 5}}`,
+		`{"type": "success", "value": [{"id": 7, "joke": "funny"}, {"id": 8, "joke": "not"}]}`,
+		`[{"type": "success", "value": {"id": 7, "joke": "funny"}}]`,
+	} {
+		jr, err := decodeJoke([]byte(in))
+		if err != nil || jr.Type != "success" || jr.Value.ID != 7 || jr.Value.Joke != "funny" {
+			t.Errorf("unexpected joke for %s: %+v, %v", in, jr, err)
+		}
+	}
+	for _, in := range []string{`{"type": "success", "value": {"id": "seven"}}`, `{"value": 7}`} {
+		if _, err := decodeJoke([]byte(in)); err == nil {
+			t.Errorf("expected error for %s", in)
+		}
+	}
+	jr, err := decodeJoke([]byte(`{"type": "NoSuchQuoteException", "value": null}`))
+	if err != nil || checkJoke(jr) == nil {
+		t.Error("expected a failed joke to decode but not pass the check, got:", jr, err)
+	}
+
+	for in, want := range map[string]int{
+		`{"type": "success", "value": [{"id": 1, "joke": "a"}, {"id": "2", "joke": "b"}]}`: 2,
+		`{"type": "success", "value": {"id": 1, "joke": "a"}}`:                             1,
+		`{"type": "success", "value": null}`:                                               0,
+	} {
+		if jokes, err := decodeCatalog([]byte(in)); err != nil || len(jokes) != want {
+			t.Errorf("expected %d jokes for %s, got: %v, %v", want, in, jokes, err)
+		}
+	}
+}
+
+// TestRing verifies the ring cache keeps its entries in order as it wraps
+// around, is resized and has entries evicted, and that Pop and Push wait.
+func TestRing(t *testing.T) {
+	r := newRing[int](3)
+	for i := 1; i <= 3; i++ {
+		if !r.TryPush(i) {
+			t.Fatal("expected room for", i)
+		}
+	}
+	if r.TryPush(4) {
+		t.Fatal("expected the ring full")
+	}
+	if v, ok := r.TryPop(); !ok || v != 1 {
+		t.Fatal("expected 1, got:", v, ok)
+	}
+	r.TryPush(4)
+	if v, ok := r.Peek(); !ok || v != 2 || r.Len() != 3 {
+		t.Fatal("expected 2 to be next of 3, got:", v, ok, r.Len())
+	}
+
+	// Growing keeps the entries, and shrinking drops the oldest.
+	r.Resize(5)
+	r.TryPush(5)
+	if dropped := r.Resize(2); dropped != 2 || r.Cap() != 2 {
+		t.Fatal("expected 2 dropped and room for 2, got:", dropped, r.Cap())
+	}
+	if v, _ := r.Peek(); v != 4 {
+		t.Fatal("expected 4 to be next, got:", v)
+	}
+	if n := r.Evict(func(v int) bool { return v == 4 }); n != 1 || r.Len() != 1 {
+		t.Fatal("expected 4 evicted, got:", n, r.Len())
+	}
+	if v, _ := r.TryPop(); v != 5 {
+		t.Fatal("expected 5, got:", v)
+	}
+
+	// Popping a match keeps the order of the rest.
+	r.TryPush(9)
+	r.TryPush(10)
+	if v, ok := r.TryPopMatch(func(v int) bool { return v%2 == 0 }, false); !ok || v != 10 {
+		t.Fatal("expected 10, got:", v, ok)
+	}
+	if _, ok := r.TryPopMatch(func(v int) bool { return v > 10 }, true); ok {
+		t.Fatal("expected no match")
+	}
+	if v, _ := r.TryPop(); v != 9 {
+		t.Fatal("expected 9, got:", v)
+	}
+	if _, ok := r.TryPop(); ok {
+		t.Fatal("expected the ring empty")
+	}
+
+	// Pop waits for an entry, and Push for room.
+	got := make(chan int, 1)
+	go func() {
+		v, _ := r.Pop(context.Background())
+		got <- v
+	}()
+	r.Push(context.Background(), 6)
+	if v := <-got; v != 6 {
+		t.Fatal("expected 6, got:", v)
+	}
+	r.Resize(1)
+	r.TryPush(7)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.Push(ctx, 8); err != context.DeadlineExceeded {
+		t.Fatal("expected the push to time out, got:", err)
+	}
+}
+
+// FuzzDecodeName makes sure no name service response makes the decoding
+// panic.
+func FuzzDecodeName(f *testing.F) {
+	for _, seed := range []string{
+		`{"name": "Ann", "surname": "Lee", "gender": "female", "region": "Norway"}`,
+		`[{"name": "Ann", "surname": "Lee"}]`,
+		`[]`,
+		`{"results": [{"gender": "female", "name": {"first": "Ann", "last": "Lee"}}]}`,
+		`{"error": "Uh oh"}`,
+		`null`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, decode := range []func([]byte) (*NameResp, error){decodeUINames, decodeRandomUser} {
+			if nm, err := decode(b); err == nil && nm == nil {
+				t.Fatalf("no name and no error for %q", b)
+			}
+		}
+	})
+}
+
+// FuzzDecodeJoke makes sure no joke service response makes the decoding
+// panic.
+func FuzzDecodeJoke(f *testing.F) {
+	for _, seed := range []string{
+		`{"type": "success", "value": {"id": 7, "joke": "funny", "categories": ["nerdy"]}}`,
+		`{"type": "success", "value": {"id": "7", "joke": "funny"}}`,
+		`{"type": "success", "value": [{"id": 1, "joke": "a"}, {"id": "2", "joke": "b"}]}`,
+		`[{"type": "success", "value": {"id": ""}}]`,
+		`{"type": "success", "value": null}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if jr, err := decodeJoke(b); err == nil {
+			if jr == nil {
+				t.Fatalf("no joke and no error for %q", b)
+			}
+			checkJoke(jr)
+		}
+		decodeCatalog(b)
+	})
+}
+
+// BenchmarkReadBody compares reading a joke response into a buffer from
+// the pool, as the fetches do, with io.ReadAll, as they used to.
+func BenchmarkReadBody(b *testing.B) {
+	body := []byte(`{"type": "success", "value": {"id": 7, "joke": "` +
+		strings.Repeat("Ryan Gonzalez made a joke. ", 20) + `", "categories": ["nerdy"]}}`)
+	b.Run("ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rb, err := io.ReadAll(bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := decodeJoke(rb); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, err := readBody(bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := decodeJoke(buf.Bytes()); err != nil {
+				b.Fatal(err)
+			}
+			releaseBody(buf)
+		}
+	})
+}
+
+// BenchmarkFirstOf decodes the first of an array of names, as uinames
+// returns when asked for several.
+func BenchmarkFirstOf(b *testing.B) {
+	nm := `{"name": "Ann", "surname": "Lee", "gender": "female", "region": "Norway"}`
+	body := []byte("[" + strings.Repeat(nm+",", 9) + nm + "]")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeUINames(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFetchJoke fetches jokes from the mock service, end to end.
+func BenchmarkFetchJoke(b *testing.B) {
+	svc, err := New(2, 5, newNoopLogger())
+	if err != nil {
+		b.Fatal("error creating service", err)
+	}
+	tstSrv := laffmock.New()
+	defer tstSrv.Close()
+	svc.jokeURL = tstSrv.JokeURL()
+
+	name := &NameResp{Name: "Ryan", Surname: "Gonzalez"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := svc.fetchJoke(context.Background(), name); err != nil {
+			b.Fatal("error fetching joke", err)
+		}
+	}
+}
+
+// fakeClock is a Clock whose time only moves on when told.
+type fakeClock struct {
+	start time.Time
+
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	start := time.Now()
+	return &fakeClock{start: start, now: start}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- fc.now
+		return c
+	}
+	fc.waiters = append(fc.waiters, fakeWaiter{at: fc.now.Add(d), c: c})
+	return c
+}
+
+// Advance moves the time on, waking the waiters whose time has come.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+	waiting := fc.waiters[:0]
+	for _, w := range fc.waiters {
+		if w.at.After(fc.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- fc.now
+		}
+	}
+	fc.waiters = waiting
+}
+
+// AdvanceUntil moves the time on in steps, once there is a waiter, until
+// the buffered channel is ready to be read.
+func (fc *fakeClock) AdvanceUntil(ready <-chan bool, step time.Duration) {
+	for len(ready) == 0 {
+		fc.mu.Lock()
+		n := len(fc.waiters)
+		fc.mu.Unlock()
+		if n > 0 {
+			fc.Advance(step)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// WaitForWaiter returns once something is waiting on the clock.
+func (fc *fakeClock) WaitForWaiter() {
+	for {
+		fc.mu.Lock()
+		n := len(fc.waiters)
+		fc.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling the function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// fakeProvider returns a joke with an ID the test service doesn't use.
+type fakeProvider struct{}
+
+func (fakeProvider) Joke(ctx context.Context, name *NameResp) (Joke, error) {
+	return Joke{ID: -1, Text: name.Name + " told a local joke", Name: *name}, nil
+}
+
+// fakeFilter rejects a number of jokes, then allows the rest.
+// pickProvider picks one of ten jokes tagged with its name, with Intn.
+type pickProvider string
+
+func (pp pickProvider) Joke(ctx context.Context, name *NameResp) (Joke, error) {
+	n := Intn(ctx, 10)
+	return Joke{ID: n, Text: fmt.Sprintf("%s%d ", pp, n), Name: *name}, nil
+}
+
+type fakeFilter struct {
+	reject int
+}
+
+func (ff *fakeFilter) Allowed(text string) bool {
+	if ff.reject > 0 {
+		ff.reject--
+		return false
+	}
+	return true
+}
+
+// fakeLimiter allows a fixed number of calls, then asks for a wait.
+type fakeLimiter struct {
+	allow int
+	err   error
+}
+
+func (fl *fakeLimiter) Reserve(ctx context.Context) (time.Duration, error) {
+	if fl.err != nil {
+		return 0, fl.err
+	}
+	if fl.allow > 0 {
+		fl.allow--
+		return 0, nil
+	}
+	return 2500 * time.Millisecond, nil
+}
+
+func newDebugLogger() logging.Logger {
+	config := zap.NewDevelopmentConfig()
+	lg, _ := config.Build()
+	return logging.NewZap(lg.Sugar())
+}
+
+func newNoopLogger() logging.Logger {
+	return logging.Nop()
 }
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// Surplus returns how many of the cached jokes this replica can spare for
+// its peers: those beyond half the joke cache, so it keeps enough to
+// serve its own requests.
+func (ls *LaffService) Surplus() int {
+	return max(ls.jokeCache.Len()-ls.jokeCache.Cap()/2, 0)
+}
+
+// GiveJokes takes up to n of the spare jokes from the joke cache, oldest
+// first, for a peer warming its cache, see Surplus.  The cache workers
+// refill the cache behind them.
+func (ls *LaffService) GiveJokes(n int) []Joke {
+	n = min(n, ls.Surplus())
+	var jokes []Joke
+	for len(jokes) < n {
+		jk, ok := ls.jokeCache.TryPop()
+		if !ok {
+			break
+		}
+		jk.Cache = ""
+		jokes = append(jokes, jk)
+	}
+	atomic.AddInt64(&ls.counters.given, int64(len(jokes)))
+	return jokes
+}
+
+// WarmJokes adds the jokes given by a peer to the joke cache, while it has
+// room, returning how many were added.  They count as cached now, so they
+// last as long as the jokes we fetch ourselves, and the service is warm
+// once they fill the cache to the warm-up level, as if fetched.  They are
+// screened as the fetched jokes are: those the filter rejects are dropped,
+// as are the malformed ones, see peerJoke.
+func (ls *LaffService) WarmJokes(jokes []Joke) int {
+	ctx := context.Background()
+	now := ls.clock.Now()
+	added := 0
+	for _, jk := range jokes {
+		if err := ls.peerJoke(&jk); err != nil {
+			ls.badResponse(ctx, "peer", err)
+			continue
+		}
+		if ls.filter != nil && !ls.filter.Allowed(jk.Text) {
+			atomic.AddInt64(&ls.counters.filtered, 1)
+			ls.logFor(ctx).Debugw("Joke from a peer rejected by filter", "id", jk.ID)
+			continue
+		}
+		jk.Cache, jk.cached = "", now
+		if !ls.jokeCache.TryPush(jk) {
+			break
+		}
+		added++
+	}
+	atomic.AddInt64(&ls.counters.received, int64(added))
+	if ls.jokeCache.Len() >= min(ls.warmup, ls.jokeCache.Cap()) {
+		ls.setWarm()
+	}
+	return added
+}
+
+// peerJoke checks a joke given by a peer as the fetched ones are, as a
+// peer is trusted no more than the upstream services: the names are
+// tidied, and rejected if they can't be used, and in strict mode a joke
+// without its text or a surname is rejected too.
+func (ls *LaffService) peerJoke(jk *Joke) error {
+	for _, n := range []*NameResp{&jk.Name, jk.Second} {
+		if n == nil {
+			continue
+		}
+		if err := tidyName(n, ls.maxName); err != nil {
+			return err
+		}
+	}
+	if !ls.strict {
+		return nil
+	}
+	if strings.TrimSpace(jk.Text) == "" {
+		return errors.New("empty joke")
+	}
+	return checkName(&jk.Name)
+}
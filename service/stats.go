@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counters tracks how requests are satisfied, and the most recent upstream
+// errors.
+type counters struct {
+	jokeHits int64 // jokes served from the joke cache
+	nameHits int64 // jokes made from a cached name
+	misses   int64 // jokes needing both a name and joke fetch
+	filtered int64 // jokes discarded by the filter
+	stale    int64 // jokes evicted from the joke cache as too old
+	refused  int64 // requests refused as nothing was cached while backing off
+	waited   int64 // jokes served from the joke cache after waiting
+	badNames int64 // malformed names from the name service
+	badJokes int64 // malformed jokes from the joke service
+	badPeer  int64 // malformed jokes from the peers, see WarmJokes
+	shared   int64 // names the leader fetched for the followers
+	taken    int64 // names taken from the leader's queue
+	given    int64 // jokes given to the peers warming their caches
+	received int64 // jokes from the peers, warming our cache
+	seeded   int64 // names added by the operator
+
+	mu         sync.Mutex
+	lastErrors map[string]UpstreamError
+}
+
+// UpstreamError is the most recent error from an upstream service.
+type UpstreamError struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// Stats is a snapshot of the service activity.
+type Stats struct {
+	NameCache  int                      `json:"nameCache"`
+	JokeCache  int                      `json:"jokeCache"`
+	CacheSize  int                      `json:"cacheSize"` // most of each cached
+	JokeHits   int64                    `json:"jokeHits"`
+	NameHits   int64                    `json:"nameHits"`
+	Misses     int64                    `json:"misses"`
+	NameErrors int64                    `json:"nameErrors"`
+	JokeErrors int64                    `json:"jokeErrors"`
+	Filtered   int64                    `json:"filtered"`
+	Stale      int64                    `json:"stale"`     // jokes evicted as too old
+	Refused    int64                    `json:"refused"`   // nothing cached while backing off, see CacheUnavailable
+	Waited     int64                    `json:"waited"`    // joke hits after waiting, see WithCacheWait
+	Given      int64                    `json:"given"`     // jokes given to the peers, see GiveJokes
+	Received   int64                    `json:"received"`  // jokes from the peers, see WarmJokes
+	Seeded     int64                    `json:"seeded"`    // names added by the operator, see SeedNames
+	NameCalls  int                      `json:"nameCalls"` // in flight, if limited
+	JokeCalls  int                      `json:"jokeCalls"` // in flight, if limited
+	LastErrors map[string]UpstreamError `json:"lastErrors,omitempty"`
+
+	// Providers is how each source of jokes has done, keyed by name.
+	Providers map[string]ProviderStats `json:"providers"`
+
+	// Experiment compares the sides of the running experiment, if any.
+	Experiment *ExperimentStats `json:"experiment,omitempty"`
+
+	// Canaries is how the canary of each upstream service has done, if
+	// it has one.
+	Canaries map[string]CanaryStats `json:"canaries,omitempty"`
+
+	// Connections is how the calls to each upstream service have used
+	// their connections, keyed by upstream.
+	Connections map[string]ConnStats `json:"connections"`
+
+	// Invalid counts the malformed responses of each upstream service,
+	// and the malformed jokes given by the peers, see WithStrictValidation.
+	Invalid map[string]int64 `json:"invalid"`
+
+	// Retries is how each upstream service's retry budget has been used.
+	Retries map[string]RetryStats `json:"retries"`
+
+	// DNS is how the cache of the upstream addresses has done, if there
+	// is one.
+	DNS *DNSStats `json:"dns,omitempty"`
+
+	// Chaos is how many faults have been injected, see WithChaos.
+	Chaos *ChaosStats `json:"chaos,omitempty"`
+
+	// Breakers is the state of each upstream service's circuit breaker,
+	// if they have them, see WithBreakers.
+	Breakers map[string]BreakerStatus `json:"breakers,omitempty"`
+
+	// Probes is how the probes of each upstream service have done, if
+	// they are probed, see WithProbes.
+	Probes map[string]ProbeStats `json:"probes,omitempty"`
+
+	// Leadership is how the prefetching of the names is shared among
+	// the replicas, if it is, see WithLeader.
+	Leadership *LeaderStats `json:"leadership,omitempty"`
+}
+
+// HitRatio returns the share of the jokes served that came from the
+// joke cache or were made for a cached name, so needed no name fetch,
+// or 0 if none have been served.  A ratio falling over time means the
+// workers aren't keeping up with the requests.
+func (st Stats) HitRatio() float64 {
+	total := st.JokeHits + st.NameHits + st.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(st.JokeHits+st.NameHits) / float64(total)
+}
+
+// noteError records a failed fetch from the upstream.  Errors caused by
+// the context being done are our doing, so they aren't recorded.
+func (c *counters) noteError(ctx context.Context, upstream string, err error) {
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastErrors == nil {
+		c.lastErrors = make(map[string]UpstreamError)
+	}
+	c.lastErrors[upstream] = UpstreamError{Error: err.Error(), Time: time.Now().UTC()}
+}
+
+// Stats returns a snapshot of the cache depths, the counts of how jokes
+// were served, the upstream errors and how each joke source has done.
+func (ls *LaffService) Stats() Stats {
+	st := Stats{
+		JokeHits:   atomic.LoadInt64(&ls.counters.jokeHits),
+		NameHits:   atomic.LoadInt64(&ls.counters.nameHits),
+		Misses:     atomic.LoadInt64(&ls.counters.misses),
+		NameErrors: atomic.LoadInt64(&ls.nameErrs),
+		JokeErrors: atomic.LoadInt64(&ls.jokeErrs),
+		Filtered:   atomic.LoadInt64(&ls.counters.filtered),
+		Stale:      atomic.LoadInt64(&ls.counters.stale),
+		Refused:    atomic.LoadInt64(&ls.counters.refused),
+		Waited:     atomic.LoadInt64(&ls.counters.waited),
+		Given:      atomic.LoadInt64(&ls.counters.given),
+		Received:   atomic.LoadInt64(&ls.counters.received),
+		Seeded:     atomic.LoadInt64(&ls.counters.seeded),
+	}
+	st.NameCache, st.JokeCache = ls.CacheDepths()
+	st.CacheSize = ls.CacheSize()
+	st.NameCalls, st.JokeCalls = ls.nameSem.inFlight(), ls.jokeSem.inFlight()
+	st.Providers = map[string]ProviderStats{JokeServiceName: ls.upstream.stats()}
+	for _, src := range ls.providers {
+		st.Providers[src.name] = src.stats()
+	}
+	if ex := ls.experiment; ex != nil {
+		st.Experiment = &ExperimentStats{A: ex.arms[0].stats(), B: ex.arms[1].stats()}
+	}
+	for _, cn := range []*canary{ls.nameCanary, ls.jokeCanary} {
+		if cn == nil {
+			continue
+		}
+		if st.Canaries == nil {
+			st.Canaries = make(map[string]CanaryStats)
+		}
+		st.Canaries[cn.upstream] = cn.stats()
+	}
+	st.Invalid = map[string]int64{
+		"name": atomic.LoadInt64(&ls.counters.badNames),
+		"joke": atomic.LoadInt64(&ls.counters.badJokes),
+		"peer": atomic.LoadInt64(&ls.counters.badPeer),
+	}
+	st.Retries = map[string]RetryStats{"name": ls.nameRetries.stats(), "joke": ls.jokeRetries.stats()}
+	st.Connections = map[string]ConnStats{"name": ls.nameConns.stats(), "joke": ls.jokeConns.stats()}
+	if ls.dns != nil {
+		dns := ls.dns.stats()
+		st.DNS = &dns
+	}
+	if ls.chaos != nil {
+		chaos := ls.chaos.stats()
+		st.Chaos = &chaos
+	}
+	st.Breakers = ls.Breakers()
+	st.Probes = ls.Probes()
+	st.Leadership = ls.leaderStats()
+
+	ls.counters.mu.Lock()
+	defer ls.counters.mu.Unlock()
+	if len(ls.counters.lastErrors) > 0 {
+		st.LastErrors = make(map[string]UpstreamError, len(ls.counters.lastErrors))
+		for k, v := range ls.counters.lastErrors {
+			st.LastErrors[k] = v
+		}
+	}
+	return st
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+)
+
+// ErrNoCategory means no joke in the categories allowed for the request
+// was found, see AllowCategories.
+var ErrNoCategory = errors.New("no joke found in the categories allowed")
+
+// categoriesKey is the context key for the categories allowed.
+type categoriesKey struct{}
+
+// preferKey is the context key for the jokes preferred.
+type preferKey struct{}
+
+// preferred is a joke provider a share of a request's jokes come from.
+type preferred struct {
+	p       JokeProvider
+	percent int
+}
+
+// AllowCategories returns a context limiting the jokes served for a
+// request to those in one of the categories, such as for a tenant that
+// only wants work-safe jokes.  The cached jokes that match are served,
+// and otherwise jokes are fetched for the name until one matches, the
+// others going in the joke cache for the other requests.  If none does,
+// the error is ErrNoCategory.  A request already limited, such as by its
+// tenant, is limited to the categories in both, which may be none.
+func AllowCategories(ctx context.Context, categories []string) context.Context {
+	if len(categories) == 0 {
+		return ctx
+	}
+	if prev, ok := ctx.Value(categoriesKey{}).([]string); ok {
+		both := []string{}
+		for _, c := range categories {
+			if slices.Contains(prev, c) {
+				both = append(both, c)
+			}
+		}
+		categories = both
+	}
+	return context.WithValue(ctx, categoriesKey{}, categories)
+}
+
+// PreferJokes returns a context having the percent of a request's jokes
+// come from the provider, such as a tenant's own joke packs, before the
+// usual sources.  When the provider has no jokes, they come from the
+// usual sources.
+func PreferJokes(ctx context.Context, p JokeProvider, percent int) context.Context {
+	return context.WithValue(ctx, preferKey{}, preferred{p: p, percent: percent})
+}
+
+// allowed reports whether the joke is in one of the categories allowed
+// for the request, which it is if they aren't limited.
+func allowed(ctx context.Context, jk Joke) bool {
+	cats, ok := ctx.Value(categoriesKey{}).([]string)
+	if !ok {
+		return true
+	}
+	for _, c := range jk.Categories {
+		if slices.Contains(cats, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitsCategories reports whether the request is limited to some
+// categories.
+func limitsCategories(ctx context.Context) bool {
+	_, ok := ctx.Value(categoriesKey{}).([]string)
+	return ok
+}
+
+// preferredJoke gets a joke from the provider preferred for the request,
+// if it has one and the request falls in its share, made with the
+// caller's own name, or else a cached name or, failing that, a fetched
+// one.  It returns ErrNoJokes when the joke is to come from the usual
+// sources.
+func (ls *LaffService) preferredJoke(ctx context.Context) (Joke, error) {
+	pr, ok := ctx.Value(preferKey{}).(preferred)
+	if !ok || Intn(ctx, 100) >= pr.percent {
+		return Joke{}, ErrNoJokes
+	}
+	own, isOwn := ownName(ctx)
+	name, cached := &own, false
+	if !isOwn {
+		name, cached = ls.nameCache.TryPop()
+	}
+	switch {
+	case cached:
+		atomic.AddInt64(&ls.counters.nameHits, 1)
+	case !isOwn:
+		var err error
+		if name, err = ls.nextName(ctx); err != nil {
+			return Joke{}, err
+		}
+		atomic.AddInt64(&ls.counters.misses, 1)
+	}
+	jk, err := pr.p.Joke(ctx, name)
+	if err == nil {
+		jk, err = ls.fillSecond(ctx, jk)
+	}
+	if err == nil && !suits(ctx, jk) {
+		err = ErrNoJokes
+	}
+	if err != nil {
+		// The name can still be used for another joke, unless it is the
+		// caller's.
+		if !isOwn {
+			ls.nameCache.TryPush(name)
+		}
+		return Joke{}, err
+	}
+	if cached {
+		jk.Cache = CacheName
+	}
+	return jk, nil
+}
+
+// popAllowed pops a cached joke in the categories and within the length
+// allowed for the request, the same way as popJoke.
+func (ls *LaffService) popAllowed(ctx context.Context) (Joke, bool) {
+	if !limitsJokes(ctx) {
+		return ls.popJoke()
+	}
+	return ls.jokeCache.TryPopMatch(func(jk Joke) bool { return suits(ctx, jk) }, ls.maxAge > 0)
+}
+
+// stashJoke caches a joke fetched for a request that couldn't use it, if
+// there is room and it was made the way the cached jokes are.  A joke made
+// out to the caller's own name, or second name, isn't served to the
+// others.
+func (ls *LaffService) stashJoke(ctx context.Context, jk Joke) {
+	if _, ok := ownName(ctx); ok {
+		return
+	}
+	if _, ok := secondName(ctx); ok && jk.Second != nil {
+		return
+	}
+	if ls.transliterates(ctx) != ls.translit {
+		return
+	}
+	jk.cached = ls.clock.Now()
+	ls.jokeCache.TryPush(jk)
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is how the connections to an upstream service have been used,
+// with the mean time of each step of the calls.  The DNS, connect and TLS
+// times are only for the calls that needed a new connection.
+type ConnStats struct {
+	Requests  int64   `json:"requests"`
+	Reused    int64   `json:"reused"` // requests on an idle connection from the pool
+	DNSMs     float64 `json:"dnsMs"`
+	ConnectMs float64 `json:"connectMs"`
+	TLSMs     float64 `json:"tlsMs"`
+	TTFBMs    float64 `json:"ttfbMs"` // from sending the request to the first byte back
+}
+
+// connTrace records how the calls to an upstream service use their
+// connections, with httptrace.
+type connTrace struct {
+	requests int64
+	reused   int64
+	dns      timing
+	connect  timing
+	tls      timing
+	ttfb     timing
+}
+
+// timing adds up the times taken by a step of the calls.
+type timing struct {
+	total int64 // nanoseconds
+	count int64
+}
+
+func (t *timing) add(d time.Duration) {
+	atomic.AddInt64(&t.total, int64(d))
+	atomic.AddInt64(&t.count, 1)
+}
+
+// meanMs returns the mean time taken, in milliseconds.
+func (t *timing) meanMs() float64 {
+	n := atomic.LoadInt64(&t.count)
+	if n == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&t.total)) / float64(n) / 1e6
+}
+
+// trace returns a context recording the call made with it.  The dials
+// may be made at once on several addresses, so the start times are kept
+// under a lock.
+func (ct *connTrace) trace(ctx context.Context) context.Context {
+	var mu sync.Mutex
+	var dnsStart, connStart, tlsStart, wrote time.Time
+	since := func(t *time.Time, tm *timing) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !t.IsZero() {
+			tm.add(time.Since(*t))
+		}
+	}
+	mark := func(t *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*t = time.Now()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			atomic.AddInt64(&ct.requests, 1)
+			if info.Reused {
+				atomic.AddInt64(&ct.reused, 1)
+			}
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { since(&dnsStart, &ct.dns) },
+		ConnectStart:         func(network, addr string) { mark(&connStart) },
+		ConnectDone:          func(network, addr string, err error) { since(&connStart, &ct.connect) },
+		TLSHandshakeStart:    func() { mark(&tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { since(&tlsStart, &ct.tls) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&wrote) },
+		GotFirstResponseByte: func() { since(&wrote, &ct.ttfb) },
+	})
+}
+
+// stats returns how the connections have been used.
+func (ct *connTrace) stats() ConnStats {
+	return ConnStats{
+		Requests:  atomic.LoadInt64(&ct.requests),
+		Reused:    atomic.LoadInt64(&ct.reused),
+		DNSMs:     ct.dns.meanMs(),
+		ConnectMs: ct.connect.meanMs(),
+		TLSMs:     ct.tls.meanMs(),
+		TTFBMs:    ct.ttfb.meanMs(),
+	}
+}
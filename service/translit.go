@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// latinFold spells the Latin letters that aren't accented forms of ASCII
+// ones, so they don't decompose, with ASCII letters.
+var latinFold = map[rune]string{
+	'Ł': "L", 'ł': "l", 'Ø': "O", 'ø': "o", 'Đ': "D", 'đ': "d", 'Ð': "D", 'ð': "d",
+	'Ħ': "H", 'ħ': "h", 'ı': "i", 'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe",
+	'Þ': "Th", 'þ': "th",
+}
+
+// WithTransliteration spells the names sent to the joke service in ASCII,
+// such as "Łukasz" as "Lukasz", as it mangles the others.  The jokes keep
+// the original name, and a request can ask otherwise, see Transliterate.
+func WithTransliteration() Option {
+	return func(ls *LaffService) {
+		ls.translit = true
+	}
+}
+
+// translitKey is the context key for whether to transliterate the name.
+type translitKey struct{}
+
+// Transliterate returns a context asking for the name in the joke to be
+// transliterated, or not, overriding WithTransliteration for a request.
+// The jokes cached were made the service's way, so a request asking
+// otherwise gets a fresh one.
+func Transliterate(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, translitKey{}, on)
+}
+
+// transliterates reports whether the name is to be transliterated for
+// the context.
+func (ls *LaffService) transliterates(ctx context.Context) bool {
+	if on, ok := ctx.Value(translitKey{}).(bool); ok {
+		return on
+	}
+	return ls.translit
+}
+
+// transliterate spells the Latin letters of the string in ASCII, dropping
+// the accents.  The letters of other scripts are left as they are.
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case latinFold[r] != "":
+			b.WriteString(latinFold[r])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return norm.NFC.String(b.String())
+}
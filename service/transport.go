@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultTransportConfig is the tuning of our transport unless set with
+// WithTransportConfig.  The pool is bigger than the default of 2 idle
+// connections per host, as the cache workers and the requests call the
+// same few hosts.
+// See: http://tleyden.github.io/blog/2016/11/21/tuning-the-go-http-client-library-for-load-testing/
+var defaultTransportConfig = TransportConfig{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 100,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	HTTP2:               true,
+}
+
+// TransportConfig tunes the connection pool and protocols of the transport
+// for the upstream calls.
+type TransportConfig struct {
+	MaxIdleConns        int           // idle connections kept, 0 for no limit
+	MaxIdleConnsPerHost int           // idle connections kept for each host, 0 for 2
+	IdleConnTimeout     time.Duration // how long an idle connection is kept, 0 for ever
+	TLSHandshakeTimeout time.Duration // limit on the TLS handshake, 0 for none
+	HTTP2               bool          // whether to try HTTP/2 with the hosts
+}
+
+// WithTransportConfig tunes our transport for the upstream calls.  It
+// doesn't apply to a transport given with WithTransport.
+func WithTransportConfig(tc TransportConfig) Option {
+	return func(ls *LaffService) {
+		ls.tuning = tc
+	}
+}
+
+// WithTransport sets the transport for the calls to the upstream services,
+// such as one going through a corporate gateway, or one intercepting the
+// calls in a test.  The proxies and the DNS cache are then up to the
+// transport, so it can't be combined with WithNameProxy, WithJokeProxy or
+// WithDNSCache.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(ls *LaffService) {
+		ls.transport = rt
+	}
+}
+
+// WithNameProxy sends the calls to the name service through the proxy.
+// Otherwise the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables, as for the other calls.
+func WithNameProxy(u *url.URL) Option {
+	return func(ls *LaffService) {
+		ls.nameProxy = u
+	}
+}
+
+// WithJokeProxy sends the calls to the joke service, including those for
+// its catalog, through the proxy, like WithNameProxy.
+func WithJokeProxy(u *url.URL) Option {
+	return func(ls *LaffService) {
+		ls.jokeProxy = u
+	}
+}
+
+// setupTransport creates the client for the upstream calls, with the
+// transport given or else our own.
+func (ls *LaffService) setupTransport() error {
+	if ls.transport != nil {
+		if ls.dns != nil || ls.nameProxy != nil || ls.jokeProxy != nil {
+			return errors.New("a custom transport can't be combined with proxies or the DNS cache")
+		}
+		ls.client = &http.Client{Transport: ls.transport}
+		return nil
+	}
+	for _, u := range []*url.URL{ls.nameProxy, ls.jokeProxy} {
+		if u != nil && (u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5")) {
+			return fmt.Errorf("invalid proxy url %q", u.Redacted())
+		}
+	}
+
+	tc := ls.tuning
+	if tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 || tc.IdleConnTimeout < 0 || tc.TLSHandshakeTimeout < 0 {
+		return errors.New("transport settings can't be negative")
+	}
+	tr := &http.Transport{
+		Proxy:                 proxyFor,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     tc.HTTP2,
+		MaxIdleConns:          tc.MaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		IdleConnTimeout:       tc.IdleConnTimeout,
+		TLSHandshakeTimeout:   tc.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if ls.dns != nil {
+		ls.dns.setup(ls)
+		tr.DialContext = ls.dns.dialContext
+	}
+	ls.client = &http.Client{Transport: tr}
+	return nil
+}
+
+// proxyKey is the context key for the proxy of an upstream call.
+type proxyKey struct{}
+
+// withProxy returns a context sending the upstream call through the
+// proxy, or the context as is if there is no proxy.
+func withProxy(ctx context.Context, u *url.URL) context.Context {
+	if u == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, proxyKey{}, u)
+}
+
+// proxyFor returns the proxy for the request, see withProxy, or else the
+// one from the environment.
+func proxyFor(req *http.Request) (*url.URL, error) {
+	if u, ok := req.Context().Value(proxyKey{}).(*url.URL); ok {
+		return u, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// callWindow is the number of the latest calls to an upstream service,
+// or joke provider, its success rate and latency are taken over.
+const callWindow = 100
+
+// UpstreamReport is how an upstream service, or joke provider, is doing,
+// going by the latest calls to it.  The backoff, breaker and probe are
+// only for the upstream services, when they apply.
+type UpstreamReport struct {
+	Calls         int            `json:"calls"`       // of the latest 100
+	SuccessRate   float64        `json:"successRate"` // of the calls
+	MedianLatency string         `json:"medianLatency"`
+	LastSuccess   *time.Time     `json:"lastSuccess,omitempty"`
+	LastError     *UpstreamError `json:"lastError,omitempty"`
+	Backoff       string         `json:"backoff,omitempty"` // left of the wait it asked for
+	Breaker       *BreakerStatus `json:"breaker,omitempty"`
+	Probe         *ProbeStats    `json:"probe,omitempty"`
+}
+
+// callLog keeps the outcome of the latest calls to an upstream service.
+type callLog struct {
+	mu          sync.Mutex
+	ok          [callWindow]bool
+	latency     [callWindow]time.Duration
+	calls       int64
+	lastSuccess time.Time
+	lastError   UpstreamError
+}
+
+// note records the outcome of a call.  The calls that never reached the
+// service, as we were backing off or its breaker was open, and those
+// stopped by the caller, aren't counted.
+func (cl *callLog) note(ctx context.Context, err error, latency time.Duration, now time.Time) {
+	if ctx.Err() != nil || errors.As(err, new(RateLimitError)) || errors.As(err, new(BreakerOpenError)) {
+		return
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	i := cl.calls % callWindow
+	cl.ok[i], cl.latency[i] = err == nil, latency
+	cl.calls++
+	if err != nil {
+		cl.lastError = UpstreamError{Error: err.Error(), Time: now.UTC()}
+	} else {
+		cl.lastSuccess = now.UTC()
+	}
+}
+
+// report returns how the calls have gone.
+func (cl *callLog) report() UpstreamReport {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	n := int(min(cl.calls, callWindow))
+	rep := UpstreamReport{Calls: n}
+	if n > 0 {
+		var ok int
+		for _, o := range cl.ok[:n] {
+			if o {
+				ok++
+			}
+		}
+		rep.SuccessRate = float64(ok) / float64(n)
+		lat := append([]time.Duration(nil), cl.latency[:n]...)
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		rep.MedianLatency = lat[n/2].String()
+	}
+	if !cl.lastSuccess.IsZero() {
+		last := cl.lastSuccess
+		rep.LastSuccess = &last
+	}
+	if cl.lastError.Error != "" {
+		last := cl.lastError
+		rep.LastError = &last
+	}
+	return rep
+}
+
+// Upstreams returns how each upstream service, keyed by "name" and
+// "joke", and each other joke provider, keyed by its name, is doing.
+func (ls *LaffService) Upstreams() map[string]UpstreamReport {
+	now := ls.clock.Now()
+	reps := make(map[string]UpstreamReport, 2+len(ls.providers))
+	for _, up := range []struct {
+		name    string
+		calls   *callLog
+		backoff *backoff
+		brk     *breaker
+		probe   *prober
+	}{
+		{"name", &ls.nameLog, &ls.nameBackoff, ls.nameBreaker, ls.nameProber},
+		{"joke", &ls.jokeLog, &ls.jokeBackoff, ls.jokeBreaker, ls.jokeProber},
+	} {
+		rep := up.calls.report()
+		if left := up.backoff.left(now); left > 0 {
+			rep.Backoff = left.Round(time.Second).String()
+		}
+		if up.brk != nil {
+			st := up.brk.status()
+			rep.Breaker = &st
+		}
+		if up.probe != nil {
+			st := up.probe.stats()
+			rep.Probe = &st
+		}
+		reps[up.name] = rep
+	}
+	for _, src := range ls.providers {
+		reps[src.name] = src.calls.report()
+	}
+	return reps
+}
+
+// UpstreamStatus reports whether an upstream service can be reached.
+// Until it has been called or probed, it is not known either way, and
+// Checked is false.
+type UpstreamStatus struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Checked   bool   `json:"checked"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// CheckUpstreams reports whether the name and joke services can be
+// reached, going by what is already known of them rather than calling
+// them, so a status check costs the services nothing.  A service is
+// unreachable while its probes say it is down, its breaker is open, or,
+// without the probes, its latest call failed, and reachable only once a
+// probe or call has succeeded.  One neither called nor probed yet is
+// reported as not checked.
+func (ls *LaffService) CheckUpstreams() []UpstreamStatus {
+	reps := ls.Upstreams()
+	res := []UpstreamStatus{
+		{Name: "name", URL: ls.nameURL},
+		{Name: "joke", URL: ls.jokeURL},
+	}
+	for i := range res {
+		us, rep := &res[i], reps[res[i].Name]
+		switch {
+		case rep.Probe != nil && rep.Probe.Probes > 0:
+			us.Checked, us.Reachable = true, !rep.Probe.Down
+			us.Error = rep.Probe.LastError
+		case rep.LastError != nil:
+			us.Checked = true
+			us.Reachable = rep.LastSuccess != nil && rep.LastSuccess.After(rep.LastError.Time)
+			us.Error = rep.LastError.Error
+		case rep.LastSuccess != nil:
+			us.Checked, us.Reachable = true, true
+		}
+		if rep.Breaker != nil && rep.Breaker.State == BreakerOpen {
+			us.Checked, us.Reachable = true, false
+			if us.Error == "" {
+				us.Error = "circuit breaker open"
+			}
+		}
+		if us.Reachable {
+			us.Error = ""
+		}
+	}
+	return res
+}
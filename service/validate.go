@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultMaxName is the most characters in each part of a name, unless
+// set with WithMaxNameLength.
+const defaultMaxName = 50
+
+// ErrInvalidResponse means an upstream service sent a malformed response,
+// such as a name without a surname or a joke without text, and the service
+// is in strict mode, or a name that can't be used at all.
+var ErrInvalidResponse = errors.New("invalid upstream response")
+
+// WithStrictValidation rejects the malformed responses of the upstream
+// services, rather than caching and serving empty names and jokes.  They
+// are refetched, a few times at most.  Either way, the malformed responses
+// are counted in the stats.
+func WithStrictValidation() Option {
+	return func(ls *LaffService) {
+		ls.strict = true
+	}
+}
+
+// checkName makes sure a name from the name service is complete.
+func checkName(n *NameResp) error {
+	switch {
+	case strings.TrimSpace(n.Name) == "":
+		return errors.New("empty name")
+	case strings.TrimSpace(n.Surname) == "":
+		return errors.New("empty surname")
+	}
+	return nil
+}
+
+// checkJoke makes sure a joke from the joke service succeeded and has
+// some text.
+func checkJoke(jr *JokeResp) error {
+	switch {
+	case jr.Type != "success":
+		return fmt.Errorf("joke type %q", jr.Type)
+	case strings.TrimSpace(jr.Value.Joke) == "":
+		return errors.New("empty joke")
+	}
+	return nil
+}
+
+// checkResponse counts and logs a malformed response from the upstream
+// service, with the problem found by the check.  In strict mode, the
+// response is rejected with an ErrInvalidResponse, otherwise it is let
+// through.
+func (ls *LaffService) checkResponse(ctx context.Context, upstream string, problem error) error {
+	if problem == nil {
+		return nil
+	}
+	err := ls.badResponse(ctx, upstream, problem)
+	if !ls.strict {
+		return nil
+	}
+	return err
+}
+
+// badResponse counts and logs a malformed response from the upstream
+// service, returning the ErrInvalidResponse rejecting it.
+func (ls *LaffService) badResponse(ctx context.Context, upstream string, problem error) error {
+	switch upstream {
+	case "name":
+		atomic.AddInt64(&ls.counters.badNames, 1)
+	case "peer":
+		atomic.AddInt64(&ls.counters.badPeer, 1)
+	default:
+		atomic.AddInt64(&ls.counters.badJokes, 1)
+	}
+	ls.logFor(ctx).Warnw("Malformed upstream response", "upstream", upstream,
+		"problem", problem, "strict", ls.strict)
+	return fmt.Errorf("%w from %s service: %v", ErrInvalidResponse, upstream, problem)
+}
+
+// WithMaxNameLength sets the most characters in each part of a name,
+// which is 50 by default.  Longer names are rejected.
+func WithMaxNameLength(n int) Option {
+	return func(ls *LaffService) {
+		ls.maxName = n
+	}
+}
+
+// normalizeName tidies up a fetched name, so the joke URLs and responses
+// are well-formed: the spaces are trimmed and collapsed, and the text is
+// put in NFC form.  A name with control characters or longer than allowed
+// is rejected, whether in strict mode or not.
+func (ls *LaffService) normalizeName(ctx context.Context, n *NameResp) error {
+	if err := tidyName(n, ls.maxName); err != nil {
+		return ls.badResponse(ctx, "name", err)
+	}
+	return nil
+}
+
+// tidyName trims and collapses the spaces of each part of the name, and
+// puts it in NFC form, failing for a part with control characters or of
+// more than max characters.
+func tidyName(n *NameResp, max int) error {
+	for _, part := range []*string{&n.Name, &n.Surname, &n.Gender, &n.Region} {
+		s := norm.NFC.String(strings.Join(strings.Fields(*part), " "))
+		if strings.ContainsFunc(s, unicode.IsControl) {
+			return fmt.Errorf("control character in %q", s)
+		}
+		if utf8.RuneCountInString(s) > max {
+			return fmt.Errorf("%q is longer than %d characters", s, max)
+		}
+		*part = s
+	}
+	return nil
+}
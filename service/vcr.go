@@ -0,0 +1,195 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WithRecording records the responses of the upstream services to the
+// cassette file, as they are made, for WithReplay to play back later.  A
+// cassette already in the file is added to.  The cookies set by the
+// services aren't recorded, and neither are the calls that fail without
+// a response.
+func WithRecording(path string) Option {
+	return func(ls *LaffService) {
+		ls.cassette = &cassette{path: path}
+	}
+}
+
+// WithReplay answers the calls to the upstream services from the cassette
+// file recorded with WithRecording, without going to the network, for
+// working offline and for tests that don't depend on the live services.
+// A call is answered with the responses recorded for its URL in turn, or
+// else those for the same path with another query, such as a joke for
+// another name.  A call with neither fails.
+func WithReplay(path string) Option {
+	return func(ls *LaffService) {
+		ls.cassette = &cassette{path: path, replay: true}
+	}
+}
+
+// interaction is an upstream call recorded in a cassette.
+type interaction struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body"`
+}
+
+// cassette records or replays the upstream calls, see WithRecording and
+// WithReplay.
+type cassette struct {
+	path   string
+	replay bool
+	next   http.RoundTripper // the transport being recorded
+
+	mu    sync.Mutex
+	calls []interaction
+	seen  map[string]int // how many times each URL or path was replayed
+}
+
+// setupCassette loads the cassette, if any, and puts it in front of the
+// transport for the upstream calls.
+func (ls *LaffService) setupCassette() error {
+	cs := ls.cassette
+	if cs == nil {
+		return nil
+	}
+	if cs.replay && ls.transport != nil {
+		return errors.New("a custom transport can't be combined with replaying a cassette")
+	}
+	b, err := os.ReadFile(cs.path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &cs.calls); err != nil {
+			return fmt.Errorf("invalid cassette %s: %v", cs.path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist) || cs.replay:
+		return err
+	}
+	cs.seen = map[string]int{}
+	cs.next = ls.client.Transport
+	ls.client = &http.Client{Transport: cs}
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (cs *cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cs.replay {
+		return cs.play(req)
+	}
+	resp, err := cs.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	hdr := resp.Header.Clone()
+	hdr.Del("Set-Cookie")
+	if err := cs.record(interaction{
+		Method: req.Method,
+		URL:    req.URL.Redacted(),
+		Status: resp.StatusCode,
+		Header: hdr,
+		Body:   string(body),
+	}); err != nil {
+		return nil, fmt.Errorf("recording cassette: %v", err)
+	}
+	return resp, nil
+}
+
+// record adds the call to the cassette and saves it, replacing the file
+// in one go so a cassette being recorded can always be read.
+func (cs *cassette) record(it interaction) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.calls = append(cs.calls, it)
+	b, err := json.MarshalIndent(cs.calls, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cs.path), filepath.Base(cs.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cs.path)
+}
+
+// play answers the call from the cassette.
+func (cs *cassette) play(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	u := req.URL.Redacted()
+	it, ok := cs.match(req.Method, u, func(it interaction) string { return it.URL })
+	if !ok {
+		it, ok = cs.match(req.Method, pathOf(u), func(it interaction) string { return pathOf(it.URL) })
+	}
+	if !ok {
+		return nil, fmt.Errorf("no response recorded for %s %s", req.Method, u)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", it.Status, http.StatusText(it.Status)),
+		StatusCode:    it.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        it.Header.Clone(),
+		Body:          io.NopCloser(strings.NewReader(it.Body)),
+		ContentLength: int64(len(it.Body)),
+		Request:       req,
+	}, nil
+}
+
+// match returns the next of the calls recorded with the method whose URL,
+// as given by the function, is the one wanted, going through them in turn.
+func (cs *cassette) match(method, want string, urlOf func(interaction) string) (interaction, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var found []interaction
+	for _, it := range cs.calls {
+		if it.Method == method && urlOf(it) == want {
+			found = append(found, it)
+		}
+	}
+	if len(found) == 0 {
+		return interaction{}, false
+	}
+	key := method + " " + want
+	n := cs.seen[key]
+	cs.seen[key]++
+	return found[n%len(found)], true
+}
+
+// pathOf returns the URL without its query.
+func pathOf(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	u.RawQuery = ""
+	return u.String()
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// WithCacheWait has a request finding the caches empty wait up to the
+// duration, or until its deadline if that's sooner, for the workers to
+// cache a joke, rather than fetching the name and joke itself at once.
+// A cache that is only momentarily empty then saves the upstream calls,
+// at the cost of the latency.  The requests don't wait by default.
+func WithCacheWait(d time.Duration) Option {
+	return func(ls *LaffService) {
+		ls.cacheWait = d
+	}
+}
+
+// waitForJoke waits for a joke to be cached, returning false if none is
+// by the end of the wait.
+func (ls *LaffService) waitForJoke(ctx context.Context) (Joke, bool) {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		if sleep(wctx, ls.clock, ls.cacheWait) {
+			cancel()
+		}
+	}()
+	jk, err := ls.jokeCache.Pop(wctx)
+	if err != nil {
+		return Joke{}, false
+	}
+	atomic.AddInt64(&ls.counters.waited, 1)
+	return jk, true
+}
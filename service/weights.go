@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// JokeServiceName is the name of the joke service among the joke sources,
+// for its weight and stats.
+const JokeServiceName = "joke-service"
+
+// jokeSource is one of the places jokes come from, along with its share
+// of the jokes and how it has done.
+type jokeSource struct {
+	name   string
+	weight int
+	p      JokeProvider // nil for the joke service
+
+	jokes  int64 // jokes it has given us
+	errors int64 // failed attempts
+	empty  int64 // times it had no jokes, so the joke service stood in
+	calls  callLog
+}
+
+// ProviderStats is how a joke source has done.
+type ProviderStats struct {
+	Weight int   `json:"weight"`
+	Jokes  int64 `json:"jokes"`
+	Errors int64 `json:"errors"`
+	Empty  int64 `json:"empty,omitempty"`
+}
+
+// WithWeightedJokeProvider adds a named source of jokes, which gives a
+// share of the jokes in proportion to its weight.  The joke service has
+// a weight of 1, unless set with WithJokeServiceWeight, as do the
+// providers added with WithJokeProvider.  A weight of 0 leaves the
+// provider unused.
+func WithWeightedJokeProvider(name string, weight int, p JokeProvider) Option {
+	return func(ls *LaffService) {
+		ls.providers = append(ls.providers, &jokeSource{name: name, weight: weight, p: p})
+	}
+}
+
+// WithJokeServiceWeight sets the share of the jokes from the joke service,
+// see WithWeightedJokeProvider.  With a weight of 0, the joke service is
+// only used when a provider runs out of jokes.
+func WithJokeServiceWeight(weight int) Option {
+	return func(ls *LaffService) {
+		ls.upstream.weight = weight
+	}
+}
+
+// checkSources makes sure the joke sources can be told apart and have
+// sensible weights.
+func (ls *LaffService) checkSources() error {
+	seen := map[string]bool{JokeServiceName: true}
+	if ls.upstream.weight < 0 {
+		return fmt.Errorf("negative weight for %s", JokeServiceName)
+	}
+	for _, src := range ls.providers {
+		if seen[src.name] {
+			return fmt.Errorf("joke provider %q added twice", src.name)
+		}
+		seen[src.name] = true
+		if src.weight < 0 {
+			return fmt.Errorf("negative weight for %s", src.name)
+		}
+	}
+	return nil
+}
+
+// pickSource chooses a joke source at random, in proportion to the
+// weights.  If they are all 0, the joke service is chosen.  The pick is
+// repeatable if the context is seeded, see Seed.
+func (ls *LaffService) pickSource(ctx context.Context) *jokeSource {
+	total := ls.upstream.weight
+	for _, src := range ls.providers {
+		total += src.weight
+	}
+	if total == 0 {
+		return &ls.upstream
+	}
+	n := Intn(ctx, total)
+	for _, src := range ls.providers {
+		if n < src.weight {
+			return src
+		}
+		n -= src.weight
+	}
+	return &ls.upstream
+}
+
+// jokeFor gets a joke for the name from one of the joke sources, see
+// pickSource.
+func (ls *LaffService) jokeFor(ctx context.Context, name *NameResp) (Joke, error) {
+	return ls.jokeFrom(ctx, name, ls.pickSource(ctx))
+}
+
+// jokeFrom gets a joke for the name from the source.  If there is a local
+// copy of the joke service's catalog, it is used in place of the joke
+// service.  The joke service also stands in for a provider that has run
+// out of jokes.
+func (ls *LaffService) jokeFrom(ctx context.Context, name *NameResp, src *jokeSource) (Joke, error) {
+	if src.p != nil {
+		start := ls.clock.Now()
+		jk, err := src.p.Joke(ctx, name)
+		if !errors.Is(err, ErrNoJokes) {
+			src.note(ctx, err)
+			src.calls.note(ctx, err, ls.clock.Now().Sub(start), ls.clock.Now())
+			return jk, err
+		}
+		atomic.AddInt64(&src.empty, 1)
+	}
+	jk, err := ls.upstreamJoke(ctx, name)
+	ls.upstream.note(ctx, err)
+	return jk, err
+}
+
+// upstreamJoke gets a joke from the catalog, if we have one, or else the
+// joke service.
+func (ls *LaffService) upstreamJoke(ctx context.Context, name *NameResp) (Joke, error) {
+	if ls.catalog != nil {
+		jk, err := ls.catalog.Joke(ctx, name)
+		if !errors.Is(err, ErrNoJokes) {
+			return jk, err
+		}
+	}
+	return ls.fetchJoke(ctx, name)
+}
+
+// note counts the outcome of asking the source for a joke.  Failures due
+// to the context being done are our doing, so they aren't counted.
+func (src *jokeSource) note(ctx context.Context, err error) {
+	switch {
+	case err == nil:
+		atomic.AddInt64(&src.jokes, 1)
+	case ctx.Err() == nil:
+		atomic.AddInt64(&src.errors, 1)
+	}
+}
+
+// stats returns how the source has done.
+func (src *jokeSource) stats() ProviderStats {
+	return ProviderStats{
+		Weight: src.weight,
+		Jokes:  atomic.LoadInt64(&src.jokes),
+		Errors: atomic.LoadInt64(&src.errors),
+		Empty:  atomic.LoadInt64(&src.empty),
+	}
+}
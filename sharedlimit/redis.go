@@ -0,0 +1,54 @@
+// Package sharedlimit implements a rate limit shared by all the replicas of
+// the laff service, so that together they stay within the budget of a
+// rate-limited upstream service rather than each spending it separately.
+package sharedlimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is a fixed window limiter kept in Redis.  Each window has a counter
+// key that every replica increments for each call it wants to make, and the
+// calls beyond the limit for the window are refused until the next one.
+type Redis struct {
+	client *redis.Client
+	prefix string
+	limit  int64
+	window time.Duration
+}
+
+// NewRedis creates a limiter allowing limit calls per window, among all
+// users of the keys starting with the prefix.
+func NewRedis(client *redis.Client, prefix string, limit int, window time.Duration) *Redis {
+	return &Redis{
+		client: client,
+		prefix: prefix,
+		limit:  int64(limit),
+		window: window,
+	}
+}
+
+// Reserve takes a slot for a call in the current window if one is left,
+// returning zero.  Otherwise it returns the time until the next window.
+func (r *Redis) Reserve(ctx context.Context) (time.Duration, error) {
+	now := time.Now()
+	start := now.Truncate(r.window)
+	key := fmt.Sprintf("%s:%d", r.prefix, start.Unix())
+
+	pipe := r.client.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	// Keep the key a little past the end of the window, to allow for
+	// clock differences between the replicas.
+	pipe.Expire(ctx, key, 2*r.window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	if incr.Val() <= r.limit {
+		return 0, nil
+	}
+	return start.Add(r.window).Sub(now), nil
+}
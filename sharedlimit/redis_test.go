@@ -0,0 +1,48 @@
+package sharedlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestReserve verifies two limiters sharing the keys share the limit.
+func TestReserve(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	// Use a long window so the test doesn't cross into the next one.
+	a := NewRedis(client, "test", 3, time.Hour)
+	b := NewRedis(client, "test", 3, time.Hour)
+	other := NewRedis(client, "other", 3, time.Hour)
+
+	ctx := context.Background()
+	for i, l := range []*Redis{a, b, a} {
+		wait, err := l.Reserve(ctx)
+		if err != nil {
+			t.Fatal("error reserving", err)
+		}
+		if wait != 0 {
+			t.Fatalf("expected slot %d to be free, got wait %v", i, wait)
+		}
+	}
+	wait, err := b.Reserve(ctx)
+	if err != nil {
+		t.Fatal("error reserving", err)
+	}
+	if wait <= 0 || wait > time.Hour {
+		t.Fatal("expected wait until next window, got:", wait)
+	}
+	if wait, _ := other.Reserve(ctx); wait != 0 {
+		t.Fatal("expected separate keys to have a separate limit, got wait:", wait)
+	}
+
+	mr.Close()
+	if _, err := a.Reserve(ctx); err == nil {
+		t.Fatal("expected error with Redis down")
+	}
+}
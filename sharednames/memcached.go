@@ -0,0 +1,121 @@
+package sharednames
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gdotgordon/laff/service"
+)
+
+// claimTTL is how long a claimed slot is held, should the follower that
+// claimed it die before emptying it.
+const claimTTL = 10 * time.Second
+
+// Memcached is a queue of names kept in Memcached, which has no lists, so
+// the queue is a fixed number of slots, each a key holding a name or
+// nothing.  A name is offered by adding it to a free slot, which fails if
+// the slot is taken, and taken by swapping it for an empty claim, which
+// only one of the followers racing for it manages, before the slot is
+// freed.  The names expire after their time to live, so the followers
+// don't take stale ones after the leader is gone.
+type Memcached struct {
+	client *memcache.Client
+	keys   []string // of the slots
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// slot is what a slot holds: a name, and when it was offered, so the
+// oldest are taken first.
+type slot struct {
+	Offered int64            `json:"offered"` // Unix nanoseconds
+	Name    service.NameResp `json:"name"`
+}
+
+// NewMemcached creates a queue of size slots, in the keys starting with
+// the prefix, holding each name for the time to live.
+func NewMemcached(client *memcache.Client, prefix string, size int, ttl time.Duration) *Memcached {
+	m := &Memcached{client: client, ttl: ttl, now: time.Now}
+	for i := 0; i < size; i++ {
+		m.keys = append(m.keys, fmt.Sprintf("%s:%d", prefix, i))
+	}
+	return m
+}
+
+// Offer implements service.NameQueue.  The client has no context, and
+// relies on its own timeout.
+func (m *Memcached) Offer(ctx context.Context, name service.NameResp) (bool, error) {
+	items, err := m.client.GetMulti(m.keys)
+	if err != nil || len(items) >= len(m.keys) {
+		return false, err
+	}
+	b, err := json.Marshal(slot{Offered: m.now().UnixNano(), Name: name})
+	if err != nil {
+		return false, err
+	}
+	// Start at a random slot, so the slots wear evenly.
+	start := rand.IntN(len(m.keys))
+	for i := range m.keys {
+		key := m.keys[(start+i)%len(m.keys)]
+		if items[key] != nil {
+			continue
+		}
+		err := m.client.Add(&memcache.Item{Key: key, Value: b, Expiration: seconds(m.ttl)})
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Take implements service.NameQueue.
+func (m *Memcached) Take(ctx context.Context) (*service.NameResp, error) {
+	items, err := m.client.GetMulti(m.keys)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		item *memcache.Item
+		slot slot
+	}
+	var names []found
+	for _, item := range items {
+		var s slot
+		if len(item.Value) == 0 || json.Unmarshal(item.Value, &s) != nil {
+			continue // claimed, or not ours
+		}
+		names = append(names, found{item, s})
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].slot.Offered < names[j].slot.Offered })
+	for _, f := range names {
+		f.item.Value, f.item.Expiration = nil, seconds(claimTTL)
+		switch err := m.client.CompareAndSwap(f.item); {
+		case err == nil:
+		case errors.Is(err, memcache.ErrCASConflict), errors.Is(err, memcache.ErrNotStored),
+			errors.Is(err, memcache.ErrCacheMiss):
+			continue // another follower got there first
+		default:
+			return nil, err
+		}
+		if err := m.client.Delete(f.item.Key); err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+			return nil, err
+		}
+		return &f.slot.Name, nil
+	}
+	return nil, nil
+}
+
+// seconds is the Memcached expiration of the duration, at least a second,
+// as 0 never expires.
+func seconds(d time.Duration) int32 {
+	return int32(max(d/time.Second, 1))
+}
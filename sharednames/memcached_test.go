@@ -0,0 +1,221 @@
+package sharednames
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gdotgordon/laff/service"
+)
+
+// fakeMemcached is a Memcached server speaking enough of the text
+// protocol for the queue: gets, add, cas and delete.
+type fakeMemcached struct {
+	mu    sync.Mutex
+	items map[string]fakeItem
+	cas   uint64
+	now   time.Time
+}
+
+type fakeItem struct {
+	value   []byte
+	cas     uint64
+	expires time.Time
+}
+
+// startMemcached starts a fake server, returning it and its address.
+func startMemcached(t *testing.T) (*fakeMemcached, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	fm := &fakeMemcached{items: map[string]fakeItem{}, now: time.Now()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fm.serve(conn)
+		}
+	}()
+	return fm, l.Addr().String()
+}
+
+// get returns the item unless it is missing or expired.  The caller must
+// hold the lock.
+func (fm *fakeMemcached) get(key string) (fakeItem, bool) {
+	it, ok := fm.items[key]
+	if ok && fm.now.After(it.expires) {
+		delete(fm.items, key)
+		return it, false
+	}
+	return it, ok
+}
+
+func (fm *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		fm.mu.Lock()
+		switch args[0] {
+		case "gets":
+			for _, key := range args[1:] {
+				if it, ok := fm.get(key); ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d %d\r\n%s\r\n", key, len(it.value), it.cas, it.value)
+				}
+			}
+			fmt.Fprint(rw, "END\r\n")
+		case "add", "cas":
+			size, _ := strconv.Atoi(args[4])
+			exp, _ := strconv.Atoi(args[3])
+			value := make([]byte, size+2)
+			io.ReadFull(rw, value)
+			cur, exists := fm.get(args[1])
+			switch {
+			case args[0] == "add" && exists:
+				fmt.Fprint(rw, "NOT_STORED\r\n")
+			case args[0] == "cas" && !exists:
+				fmt.Fprint(rw, "NOT_FOUND\r\n")
+			case args[0] == "cas" && args[5] != strconv.FormatUint(cur.cas, 10):
+				fmt.Fprint(rw, "EXISTS\r\n")
+			default:
+				fm.cas++
+				fm.items[args[1]] = fakeItem{value[:size], fm.cas, fm.now.Add(time.Duration(exp) * time.Second)}
+				fmt.Fprint(rw, "STORED\r\n")
+			}
+		case "delete":
+			if _, ok := fm.get(args[1]); ok {
+				delete(fm.items, args[1])
+				fmt.Fprint(rw, "DELETED\r\n")
+			} else {
+				fmt.Fprint(rw, "NOT_FOUND\r\n")
+			}
+		default:
+			fmt.Fprint(rw, "ERROR\r\n")
+		}
+		fm.mu.Unlock()
+		rw.Flush()
+	}
+}
+
+// TestRing verifies the keys are spread over the servers, and removing a
+// server only moves its own keys.
+func TestRing(t *testing.T) {
+	servers := []string{"127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11213"}
+	three, err := NewRing(servers...)
+	if err != nil {
+		t.Fatal("error creating ring", err)
+	}
+	two, _ := NewRing(servers[:2]...)
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("laff:%d", i)
+		a, _ := three.PickServer(key)
+		b, _ := two.PickServer(key)
+		counts[a.String()]++
+		if a.String() != servers[2] && a.String() != b.String() {
+			t.Fatal("expected", key, "to stay on", a, "got:", b)
+		}
+	}
+	for _, s := range servers {
+		if counts[s] < 700 {
+			t.Fatal("expected the keys spread evenly, got:", counts)
+		}
+	}
+	if _, err := NewRing(); err == nil {
+		t.Fatal("expected an error for no servers")
+	}
+}
+
+// TestMemcached verifies the names are taken oldest first, the queue
+// holds no more than its size, each name is taken once, and the names
+// expire.
+func TestMemcached(t *testing.T) {
+	fm1, addr1 := startMemcached(t)
+	fm2, addr2 := startMemcached(t)
+	ring, err := NewRing(addr1, addr2)
+	if err != nil {
+		t.Fatal("error creating ring", err)
+	}
+	q := NewMemcached(memcache.NewFromSelector(ring), "laff:shared", 3, time.Minute)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	for i, first := range []string{"Ann", "Bob", "Cat", "Dan"} {
+		now = now.Add(time.Millisecond)
+		ok, err := q.Offer(ctx, service.NameResp{Name: first, Surname: "Lee"})
+		if err != nil || ok != (i < 3) {
+			t.Fatal("unexpected offer of", first, ok, err)
+		}
+	}
+	var wg sync.WaitGroup
+	taken := make(chan string, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name, err := q.Take(ctx)
+			if err != nil {
+				t.Error("error taking", err)
+			} else if name != nil {
+				taken <- name.Name
+			}
+		}()
+	}
+	wg.Wait()
+	close(taken)
+	seen := map[string]bool{}
+	for name := range taken {
+		if seen[name] {
+			t.Fatal("expected each name taken once, got", name, "twice")
+		}
+		seen[name] = true
+	}
+	if len(seen) > 3 {
+		t.Fatal("expected at most the three names, got:", seen)
+	}
+	for name, err := q.Take(ctx); name != nil || err != nil; name, err = q.Take(ctx) {
+		if err != nil || seen[name.Name] {
+			t.Fatal("unexpected name:", name, err)
+		}
+		seen[name.Name] = true
+	}
+	if len(seen) != 3 {
+		t.Fatal("expected all three names taken, got:", seen)
+	}
+
+	for _, first := range []string{"Eve", "Fay", "Gus"} {
+		now = now.Add(time.Millisecond)
+		q.Offer(ctx, service.NameResp{Name: first})
+	}
+	if name, _ := q.Take(ctx); name == nil || name.Name != "Eve" {
+		t.Fatal("expected Eve first, got:", name)
+	}
+	for _, fm := range []*fakeMemcached{fm1, fm2} {
+		fm.mu.Lock()
+		fm.now = fm.now.Add(2 * time.Minute)
+		fm.mu.Unlock()
+	}
+	if name, err := q.Take(ctx); name != nil || err != nil {
+		t.Fatal("expected the stale names gone, got:", name, err)
+	}
+}
@@ -0,0 +1,62 @@
+// Package sharednames is a queue of names shared by the replicas of the
+// laff service, which the leader fills for the followers, so that only
+// the leader fetches names ahead of demand from the rate limited name
+// service.
+package sharednames
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gdotgordon/laff/service"
+	"github.com/redis/go-redis/v9"
+)
+
+// offerScript adds the name to the list unless it is full.
+var offerScript = redis.NewScript(`
+if redis.call('LLEN', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('RPUSH', KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// Redis is a queue of names kept as JSON in a Redis list, holding up to
+// its size.
+type Redis struct {
+	client *redis.Client
+	key    string
+	size   int
+}
+
+// NewRedis creates a queue in the list at the key, holding up to size
+// names.
+func NewRedis(client *redis.Client, key string, size int) *Redis {
+	return &Redis{client: client, key: key, size: size}
+}
+
+// Offer implements service.NameQueue.
+func (r *Redis) Offer(ctx context.Context, name service.NameResp) (bool, error) {
+	b, err := json.Marshal(name)
+	if err != nil {
+		return false, err
+	}
+	n, err := offerScript.Run(ctx, r.client, []string{r.key}, b, r.size).Int()
+	return n == 1, err
+}
+
+// Take implements service.NameQueue.
+func (r *Redis) Take(ctx context.Context) (*service.NameResp, error) {
+	b, err := r.client.LPop(ctx, r.key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var name service.NameResp
+	if err := json.Unmarshal(b, &name); err != nil {
+		return nil, err
+	}
+	return &name, nil
+}
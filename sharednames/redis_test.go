@@ -0,0 +1,35 @@
+package sharednames
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gdotgordon/laff/service"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestQueue verifies the names are taken in order, and the queue holds
+// no more than its size.
+func TestQueue(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	ctx := context.Background()
+	q := NewRedis(client, "names", 2)
+	for i, first := range []string{"Ann", "Bob", "Cat"} {
+		ok, err := q.Offer(ctx, service.NameResp{Name: first, Surname: "Lee"})
+		if err != nil || ok != (i < 2) {
+			t.Fatal("unexpected offer of", first, ok, err)
+		}
+	}
+	for _, exp := range []string{"Ann", "Bob"} {
+		if name, err := q.Take(ctx); err != nil || name == nil || name.Name != exp || name.Surname != "Lee" {
+			t.Fatal("expected", exp, "got:", name, err)
+		}
+	}
+	if name, err := q.Take(ctx); err != nil || name != nil {
+		t.Fatal("expected no name, got:", name, err)
+	}
+}
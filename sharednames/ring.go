@@ -0,0 +1,83 @@
+package sharednames
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ringPoints is how many points each server has on the ring, as ketama
+// has, so the keys spread evenly.
+const ringPoints = 160
+
+// Ring picks the Memcached server of each key by consistent hashing, as
+// ketama does, so adding or removing a server only moves the keys of its
+// share of the ring rather than nearly all of them.  It implements
+// memcache.ServerSelector.
+type Ring struct {
+	addrs  []net.Addr
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash uint32
+	addr net.Addr
+}
+
+// NewRing creates the ring of the servers, each a host:port, or the path
+// of a Unix socket.  The host names are resolved once, here.
+func NewRing(servers ...string) (*Ring, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no Memcached servers")
+	}
+	r := &Ring{}
+	for _, server := range servers {
+		var addr net.Addr
+		var err error
+		if strings.Contains(server, "/") {
+			addr, err = net.ResolveUnixAddr("unix", server)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", server)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.addrs = append(r.addrs, addr)
+		// Each digest gives four points.  The points are placed by the
+		// server as given, so they stay put when its address changes.
+		for i := 0; i < ringPoints/4; i++ {
+			sum := md5.Sum([]byte(fmt.Sprintf("%s-%d", server, i)))
+			for j := 0; j < 4; j++ {
+				r.points = append(r.points, ringPoint{binary.LittleEndian.Uint32(sum[j*4:]), addr})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r, nil
+}
+
+// PickServer returns the server at the first point of the ring at or
+// after the key's hash.
+func (r *Ring) PickServer(key string) (net.Addr, error) {
+	sum := md5.Sum([]byte(key))
+	h := binary.LittleEndian.Uint32(sum[:4])
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].addr, nil
+}
+
+// Each calls f for each server, stopping at the first error.
+func (r *Ring) Each(f func(net.Addr) error) error {
+	for _, addr := range r.addrs {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// Shutdowner is implemented by each step of the shutdown sequence.  The
+// context carries the deadline for the whole sequence.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// ShutdownFunc adapts a function to a Shutdowner.
+type ShutdownFunc func(ctx context.Context) error
+
+// Shutdown implements Shutdowner.
+func (f ShutdownFunc) Shutdown(ctx context.Context) error {
+	return f(ctx)
+}
+
+// shutdownStep is a named step in the shutdown sequence.
+type shutdownStep struct {
+	name string
+	Shutdowner
+}
+
+// shutdown runs the steps in order.  A failed step is logged, but the
+// remaining steps are still run so the cleanup is as complete as possible.
+// The first error is returned.
+func shutdown(ctx context.Context, log *zap.SugaredLogger, steps ...shutdownStep) error {
+	var first error
+	for _, s := range steps {
+		log.Debugw("Shutdown step", "step", s.name)
+		if err := s.Shutdown(ctx); err != nil {
+			log.Errorw("Shutdown step failed", "step", s.name, "error", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/api"
+	"go.uber.org/zap"
+)
+
+// TestShutdownOrder verifies the steps run in order, and that a failure
+// doesn't prevent the later steps from running.
+func TestShutdownOrder(t *testing.T) {
+	var order []string
+	step := func(name string, err error) shutdownStep {
+		return shutdownStep{name, ShutdownFunc(func(ctx context.Context) error {
+			order = append(order, name)
+			return err
+		})}
+	}
+
+	errSvc := errors.New("service failed")
+	err := shutdown(context.Background(), zap.NewNop().Sugar(),
+		step("readiness", nil),
+		step("service", errSvc),
+		step("server", errors.New("server failed")),
+		step("logs", nil),
+	)
+	if err != errSvc {
+		t.Fatal("expected first error, got:", err)
+	}
+	exp := []string{"readiness", "service", "server", "logs"}
+	if !reflect.DeepEqual(order, exp) {
+		t.Fatal("expected order:", exp, ", got:", order)
+	}
+}
+
+// TestDrain verifies a drain request fails the readiness and shuts down
+// once the delay is over.
+func TestDrain(t *testing.T) {
+	ready := &api.Readiness{}
+	var order []string
+	done := make(chan struct{})
+	go func() {
+		waitForShutdown(context.Background(), zap.NewNop().Sugar(), ready.Draining(), 50*time.Millisecond,
+			shutdownStep{"server", ShutdownFunc(func(context.Context) error {
+				order = append(order, "server")
+				return nil
+			})})
+		close(done)
+	}()
+
+	start := time.Now()
+	ready.Drain()
+	ready.Drain()
+	if ready.Ready() {
+		t.Fatal("expected not ready once draining")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected shut down after the delay")
+	}
+	if time.Since(start) < 50*time.Millisecond || !reflect.DeepEqual(order, []string{"server"}) {
+		t.Fatal("expected the server shut down after the delay, got:", order, time.Since(start))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/gdotgordon/laff/api"
+	"github.com/gdotgordon/laff/service"
+	"github.com/gdotgordon/laff/tenant"
+	"go.uber.org/zap"
+)
+
+// dumpStatsOnSignal logs a snapshot of the runtime state each time we get
+// SIGUSR1, until the context is done.  This is handy for looking into a
+// live instance without going through the API.
+func dumpStatsOnSignal(ctx context.Context, svc *service.LaffService,
+	rl *api.RateLimiter, shed *api.ConcurrencyLimiter, slow *api.LatencyShedder, slo *api.SLOTracker,
+	bans *api.BanList, tenants *tenant.Registry, log *zap.SugaredLogger) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+			st := svc.Stats()
+			var tenantReps []tenant.Report
+			if tenants != nil {
+				tenantReps = tenants.Reports()
+			}
+			var banState *api.BanListState
+			if bans != nil {
+				s := bans.State()
+				banState = &s
+			}
+			var slowState *api.LatencyShedderState
+			if slow != nil {
+				s := slow.State()
+				slowState = &s
+			}
+			log.Infow("Runtime stats",
+				"nameCache", st.NameCache,
+				"jokeCache", st.JokeCache,
+				"cacheSize", st.CacheSize,
+				"jokeHits", st.JokeHits,
+				"nameHits", st.NameHits,
+				"misses", st.Misses,
+				"hitRatio", st.HitRatio(),
+				"nameErrors", st.NameErrors,
+				"jokeErrors", st.JokeErrors,
+				"filtered", st.Filtered,
+				"stale", st.Stale,
+				"refused", st.Refused,
+				"waited", st.Waited,
+				"given", st.Given,
+				"received", st.Received,
+				"seeded", st.Seeded,
+				"invalid", st.Invalid,
+				"nameCalls", st.NameCalls,
+				"jokeCalls", st.JokeCalls,
+				"lastErrors", st.LastErrors,
+				"providers", st.Providers,
+				"experiment", st.Experiment,
+				"canaries", st.Canaries,
+				"connections", st.Connections,
+				"retries", st.Retries,
+				"dns", st.DNS,
+				"chaos", st.Chaos,
+				"breakers", st.Breakers,
+				"probes", st.Probes,
+				"leadership", st.Leadership,
+				"goroutines", runtime.NumGoroutine(),
+				"rateLimiter", rl.State(),
+				"inFlight", shed.State(),
+				"latencyShedder", slowState,
+				"slo", slo.Report(),
+				"bans", banState,
+				"tenants", tenantReps,
+			)
+		}
+	}
+}
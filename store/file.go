@@ -0,0 +1,383 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+// FileOptions are the settings for a FileStore.
+type FileOptions struct {
+	HistorySize    int  // number of served jokes to retain
+	PersistHistory bool // write the history to the file as well
+}
+
+// usageRetention is how long the FileStore keeps the usage of each day.
+const usageRetention = 400 * 24 * time.Hour
+
+// FileStore keeps everything in memory, and if given a path, writes the
+// contents out as JSON after every change so they survive a restart.  The
+// usage, counted on every request, is the exception: it is written out
+// along with the next change, and on Close.  It implements UsageStore and
+// ProfileStore.
+type FileStore struct {
+	path  string
+	opts  FileOptions
+	mu    sync.Mutex
+	data  fileData
+	dirty bool // the usage has changed since the last save
+}
+
+// fileData is the serialized form of the store.  The history is kept
+// oldest first.
+type fileData struct {
+	Favorites map[string][]Favorite       `json:"favorites"`
+	History   []HistoryEntry              `json:"history,omitempty"`
+	Usage     map[string]map[string]int64 `json:"usage,omitempty"` // by user, then day
+	Profiles  map[string]Profile          `json:"profiles,omitempty"`
+}
+
+// NewFileStore creates a store backed by the file at path, loading any
+// existing contents.  An empty path gives a purely in-memory store.
+func NewFileStore(path string, opts FileOptions) (*FileStore, error) {
+	fs := &FileStore{
+		path: path,
+		opts: opts,
+		data: fileData{Favorites: make(map[string][]Favorite)},
+	}
+	if path == "" {
+		return fs, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fs, nil
+		}
+		return nil, pkgerr.Wrap(err, "reading store file")
+	}
+	if err := json.Unmarshal(b, &fs.data); err != nil {
+		return nil, pkgerr.Wrap(err, "unmarshaling store file")
+	}
+	if fs.data.Favorites == nil {
+		fs.data.Favorites = make(map[string][]Favorite)
+	}
+	if !opts.PersistHistory {
+		fs.data.History = nil
+	}
+	fs.trimHistory()
+	return fs, nil
+}
+
+// AddFavorite implements Store.
+func (fs *FileStore) AddFavorite(ctx context.Context, user string, jokeID int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, f := range fs.data.Favorites[user] {
+		if f.JokeID == jokeID {
+			return nil
+		}
+	}
+	fs.data.Favorites[user] = append(fs.data.Favorites[user],
+		Favorite{JokeID: jokeID, Added: time.Now().UTC()})
+	return fs.save()
+}
+
+// RemoveFavorite implements Store.
+func (fs *FileStore) RemoveFavorite(ctx context.Context, user string, jokeID int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	favs := fs.data.Favorites[user]
+	for i, f := range favs {
+		if f.JokeID == jokeID {
+			favs = append(favs[:i], favs[i+1:]...)
+			if len(favs) == 0 {
+				delete(fs.data.Favorites, user)
+			} else {
+				fs.data.Favorites[user] = favs
+			}
+			return fs.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// Favorites implements Store.
+func (fs *FileStore) Favorites(ctx context.Context, user string) ([]Favorite, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	res := make([]Favorite, len(fs.data.Favorites[user]))
+	copy(res, fs.data.Favorites[user])
+	return res, nil
+}
+
+// AddHistory implements Store.  The file is only rewritten if the history
+// is being persisted, as this is called for every joke served.
+func (fs *FileStore) AddHistory(ctx context.Context, entry HistoryEntry) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.opts.HistorySize <= 0 {
+		return nil
+	}
+	fs.data.History = append(fs.data.History, entry)
+	fs.trimHistory()
+	if !fs.opts.PersistHistory {
+		return nil
+	}
+	return fs.save()
+}
+
+// History implements Store.
+func (fs *FileStore) History(ctx context.Context, offset, limit int) ([]HistoryEntry, int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	total := len(fs.data.History)
+	var res []HistoryEntry
+	for i := total - 1 - offset; i >= 0 && len(res) < limit; i-- {
+		res = append(res, fs.data.History[i])
+	}
+	return res, total, nil
+}
+
+// SearchJokes implements Store.  The history is searched newest first.
+func (fs *FileStore) SearchJokes(ctx context.Context, query string, limit int) ([]Joke, error) {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var res []Joke
+	seen := make(map[int]bool)
+	for i := len(fs.data.History) - 1; i >= 0 && len(res) < limit; i-- {
+		e := fs.data.History[i]
+		if seen[e.JokeID] || !matchAll(e.Text, words) {
+			continue
+		}
+		seen[e.JokeID] = true
+		res = append(res, Joke{ID: e.JokeID, Text: e.Text})
+	}
+	return res, nil
+}
+
+// AddUsage implements UsageStore.  The days past the retention are
+// dropped as a new one is added.
+func (fs *FileStore) AddUsage(ctx context.Context, user string, t time.Time, limit Usage) (Usage, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	u := fs.usage(user, t)
+	if (limit.Day > 0 && u.Day >= limit.Day) || (limit.Month > 0 && u.Month >= limit.Month) {
+		return u, false, nil
+	}
+	if fs.data.Usage == nil {
+		fs.data.Usage = make(map[string]map[string]int64)
+	}
+	days := fs.data.Usage[user]
+	if days == nil {
+		days = make(map[string]int64)
+		fs.data.Usage[user] = days
+	}
+	day := t.UTC().Format(usageDay)
+	if _, ok := days[day]; !ok {
+		cutoff := t.UTC().Add(-usageRetention).Format(usageDay)
+		for d := range days {
+			if d < cutoff {
+				delete(days, d)
+			}
+		}
+	}
+	days[day]++
+	fs.dirty = true
+	u.Day++
+	u.Month++
+	return u, true, nil
+}
+
+// Usage implements UsageStore.
+func (fs *FileStore) Usage(ctx context.Context, user string, t time.Time) (Usage, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.usage(user, t), nil
+}
+
+// usage returns the user's usage on the day of the time and in its month.
+// The caller holds fs.mu.
+func (fs *FileStore) usage(user string, t time.Time) Usage {
+	day := t.UTC().Format(usageDay)
+	var u Usage
+	for d, n := range fs.data.Usage[user] {
+		if d[:7] == day[:7] && d <= day {
+			u.Month += n
+		}
+	}
+	u.Day = fs.data.Usage[user][day]
+	return u
+}
+
+// UsageRecords implements UsageStore.
+func (fs *FileStore) UsageRecords(ctx context.Context, from, to time.Time, fn func(UsageRecord) error) error {
+	first, last := usageRange(from, to)
+	fs.mu.Lock()
+	var recs []UsageRecord
+	for user, days := range fs.data.Usage {
+		for day, n := range days {
+			if day >= first && day <= last {
+				recs = append(recs, UsageRecord{User: user, Day: day, Requests: n})
+			}
+		}
+	}
+	fs.mu.Unlock()
+
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].Day != recs[j].Day {
+			return recs[i].Day < recs[j].Day
+		}
+		return recs[i].User < recs[j].User
+	})
+	for _, rec := range recs {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Profile implements ProfileStore.
+func (fs *FileStore) Profile(ctx context.Context, user string) (Profile, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p, ok := fs.data.Profiles[user]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	p.Categories = append([]string(nil), p.Categories...)
+	return p, nil
+}
+
+// SetProfile implements ProfileStore.
+func (fs *FileStore) SetProfile(ctx context.Context, user string, p Profile) (Profile, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.data.Profiles == nil {
+		fs.data.Profiles = make(map[string]Profile)
+	}
+	p.Categories = append([]string(nil), p.Categories...)
+	p.Updated = time.Now().UTC()
+	fs.data.Profiles[user] = p
+	return p, fs.save()
+}
+
+// DeleteProfile implements ProfileStore.
+func (fs *FileStore) DeleteProfile(ctx context.Context, user string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.data.Profiles[user]; !ok {
+		return ErrNotFound
+	}
+	delete(fs.data.Profiles, user)
+	return fs.save()
+}
+
+// Close implements Store, writing out the usage if it has changed.
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.dirty {
+		return nil
+	}
+	return fs.save()
+}
+
+// Snapshot implements Snapshotter, writing the contents as they would be
+// saved to the file.
+func (fs *FileStore) Snapshot(ctx context.Context, w io.Writer) error {
+	fs.mu.Lock()
+	b, err := fs.marshal()
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// marshal encodes the data for the file, without the history unless it
+// is persisted.  The caller must hold the lock.
+func (fs *FileStore) marshal() ([]byte, error) {
+	data := fs.data
+	if !fs.opts.PersistHistory {
+		data.History = nil
+	}
+	b, err := json.MarshalIndent(data, "", "  ")
+	return b, pkgerr.Wrap(err, "marshaling store")
+}
+
+// matchAll reports whether the text contains every one of the (lower case)
+// words.
+func matchAll(text string, words []string) bool {
+	text = strings.ToLower(text)
+	for _, w := range words {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// trimHistory drops the oldest entries beyond the retention size.  The
+// caller must hold the lock, or have exclusive access to the store.
+func (fs *FileStore) trimHistory() {
+	if extra := len(fs.data.History) - fs.opts.HistorySize; extra > 0 {
+		fs.data.History = append([]HistoryEntry(nil), fs.data.History[extra:]...)
+	}
+}
+
+// save writes the data to a temporary file and renames it over the real
+// one, so a crash can't leave a half-written file behind.  The caller must
+// hold the lock.
+func (fs *FileStore) save() error {
+	if fs.path == "" {
+		return nil
+	}
+	b, err := fs.marshal()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		return pkgerr.Wrap(err, "creating temporary store file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return pkgerr.Wrap(err, "writing store file")
+	}
+	if err := tmp.Close(); err != nil {
+		return pkgerr.Wrap(err, "writing store file")
+	}
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		return err
+	}
+	fs.dirty = false
+	return nil
+}
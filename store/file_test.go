@@ -0,0 +1,327 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestFavorites adds and removes favorites, and verifies they are reloaded
+// from the file by a new store.
+func TestFavorites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "laff.json")
+	fs, err := NewFileStore(path, FileOptions{})
+	if err != nil {
+		t.Fatal("error creating store", err)
+	}
+
+	ctx := context.Background()
+	for _, id := range []int{5, 7, 5, 9} {
+		if err := fs.AddFavorite(ctx, "alice", id); err != nil {
+			t.Fatal("error adding favorite", err)
+		}
+	}
+	if err := fs.AddFavorite(ctx, "bob", 1); err != nil {
+		t.Fatal("error adding favorite", err)
+	}
+	if err := fs.RemoveFavorite(ctx, "alice", 7); err != nil {
+		t.Fatal("error removing favorite", err)
+	}
+	if err := fs.RemoveFavorite(ctx, "alice", 7); err != ErrNotFound {
+		t.Fatal("expected not found, got:", err)
+	}
+
+	reloaded, err := NewFileStore(path, FileOptions{})
+	if err != nil {
+		t.Fatal("error reloading store", err)
+	}
+	favs, err := reloaded.Favorites(ctx, "alice")
+	if err != nil {
+		t.Fatal("error getting favorites", err)
+	}
+	if len(favs) != 2 || favs[0].JokeID != 5 || favs[1].JokeID != 9 {
+		t.Fatalf("unexpected favorites: %+v", favs)
+	}
+	favs, _ = reloaded.Favorites(ctx, "carol")
+	if len(favs) != 0 {
+		t.Fatalf("expected no favorites, got: %+v", favs)
+	}
+}
+
+// TestHistory verifies the retention limit and the paging of the history.
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "laff.json")
+	fs, err := NewFileStore(path, FileOptions{HistorySize: 5, PersistHistory: true})
+	if err != nil {
+		t.Fatal("error creating store", err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 8; i++ {
+		err := fs.AddHistory(ctx, HistoryEntry{JokeID: i, Text: fmt.Sprintf("joke %d", i)})
+		if err != nil {
+			t.Fatal("error adding history", err)
+		}
+	}
+
+	// Only the last five should be left, newest first.
+	entries, total, err := fs.History(ctx, 0, 3)
+	if err != nil {
+		t.Fatal("error getting history", err)
+	}
+	if total != 5 || len(entries) != 3 || entries[0].JokeID != 7 || entries[2].JokeID != 5 {
+		t.Fatalf("unexpected first page: total %d, %+v", total, entries)
+	}
+	entries, _, _ = fs.History(ctx, 3, 3)
+	if len(entries) != 2 || entries[0].JokeID != 4 || entries[1].JokeID != 3 {
+		t.Fatalf("unexpected second page: %+v", entries)
+	}
+	entries, _, _ = fs.History(ctx, 6, 3)
+	if len(entries) != 0 {
+		t.Fatalf("expected empty page, got: %+v", entries)
+	}
+
+	// A store that doesn't persist the history shouldn't load it either.
+	reloaded, err := NewFileStore(path, FileOptions{HistorySize: 5})
+	if err != nil {
+		t.Fatal("error reloading store", err)
+	}
+	if _, total, _ := reloaded.History(ctx, 0, 10); total != 0 {
+		t.Fatalf("expected no history, got %d entries", total)
+	}
+	reloaded, _ = NewFileStore(path, FileOptions{HistorySize: 2, PersistHistory: true})
+	if entries, total, _ := reloaded.History(ctx, 0, 10); total != 2 || entries[0].JokeID != 7 {
+		t.Fatalf("unexpected reloaded history: total %d, %+v", total, entries)
+	}
+}
+
+// TestSearchJokes searches the history for keywords.
+func TestSearchJokes(t *testing.T) {
+	fs, err := NewFileStore("", FileOptions{HistorySize: 10})
+	if err != nil {
+		t.Fatal("error creating store", err)
+	}
+
+	ctx := context.Background()
+	texts := []string{
+		"Chuck Norris can parse HTML with a Regex.",
+		"Chuck Norris writes code that optimizes itself.",
+		"Chuck Norris can parse HTML with a Regex.",
+		"Regex engines fear Chuck Norris's code.",
+	}
+	for i, text := range texts {
+		id := i
+		if i == 2 {
+			id = 0 // served twice
+		}
+		fs.AddHistory(ctx, HistoryEntry{JokeID: id, Text: text})
+	}
+
+	jokes, err := fs.SearchJokes(ctx, "REGEX", 10)
+	if err != nil {
+		t.Fatal("error searching", err)
+	}
+	if len(jokes) != 2 || jokes[0].ID != 3 || jokes[1].ID != 0 {
+		t.Fatalf("unexpected matches: %+v", jokes)
+	}
+	jokes, _ = fs.SearchJokes(ctx, "regex code", 10)
+	if len(jokes) != 1 || jokes[0].ID != 3 {
+		t.Fatalf("unexpected matches: %+v", jokes)
+	}
+	jokes, _ = fs.SearchJokes(ctx, "regex", 1)
+	if len(jokes) != 1 {
+		t.Fatalf("expected limit to apply, got: %+v", jokes)
+	}
+	jokes, _ = fs.SearchJokes(ctx, "unicorn", 10)
+	if len(jokes) != 0 {
+		t.Fatalf("expected no matches, got: %+v", jokes)
+	}
+}
+
+// checkUsage counts requests over the end of a month, and verifies the
+// usage of each day and month.
+func checkUsage(t *testing.T, us UsageStore) {
+	t.Helper()
+	ctx := context.Background()
+	oct31 := time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)
+	for _, tm := range []time.Time{oct31.AddDate(0, 0, -1), oct31, oct31, oct31.Add(2 * time.Hour)} {
+		if _, ok, err := us.AddUsage(ctx, "alice", tm, Usage{}); err != nil || !ok {
+			t.Fatal("error adding usage", err)
+		}
+	}
+	us.AddUsage(ctx, "bob", oct31, Usage{})
+	for _, c := range []struct {
+		t    time.Time
+		want Usage
+	}{
+		{oct31, Usage{Day: 2, Month: 3}},
+		{oct31.AddDate(0, 0, -1), Usage{Day: 1, Month: 1}},
+		{oct31.Add(2 * time.Hour), Usage{Day: 1, Month: 1}},
+		{oct31.AddDate(0, 0, 5), Usage{Day: 0, Month: 1}},
+		{oct31.AddDate(0, 1, 5), Usage{}},
+	} {
+		u, err := us.Usage(ctx, "alice", c.t)
+		if err != nil {
+			t.Fatal("error getting usage", err)
+		}
+		if u != c.want {
+			t.Fatalf("expected %+v on %v, got: %+v", c.want, c.t, u)
+		}
+	}
+
+	var recs []UsageRecord
+	collect := func(rec UsageRecord) error {
+		recs = append(recs, rec)
+		return nil
+	}
+	if err := us.UsageRecords(ctx, time.Time{}, time.Time{}, collect); err != nil {
+		t.Fatal("error getting usage records", err)
+	}
+	want := []UsageRecord{
+		{"alice", "2026-10-30", 1}, {"alice", "2026-10-31", 2}, {"bob", "2026-10-31", 1}, {"alice", "2026-11-01", 1},
+	}
+	if !reflect.DeepEqual(recs, want) {
+		t.Fatalf("expected %+v, got: %+v", want, recs)
+	}
+	recs = nil
+	if err := us.UsageRecords(ctx, oct31, oct31, collect); err != nil || len(recs) != 2 {
+		t.Fatalf("expected the records of Oct 31, got: %+v %v", recs, err)
+	}
+
+	// Of the concurrent requests, only those within the limit are counted.
+	var wg sync.WaitGroup
+	var counted atomic.Int64
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok, err := us.AddUsage(ctx, "carol", oct31, Usage{Day: 5}); err == nil && ok {
+				counted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if u, err := us.Usage(ctx, "carol", oct31); err != nil || counted.Load() != 5 || u.Day != 5 {
+		t.Fatalf("expected 5 requests counted, got %d: %+v %v", counted.Load(), u, err)
+	}
+	u, ok, err := us.AddUsage(ctx, "alice", oct31, Usage{Month: 3})
+	if err != nil || ok || u != (Usage{Day: 2, Month: 3}) {
+		t.Fatalf("expected the request over the monthly limit not counted, got: %+v %v %v", u, ok, err)
+	}
+	u, ok, err = us.AddUsage(ctx, "alice", oct31, Usage{Day: 3, Month: 4})
+	if err != nil || !ok || u != (Usage{Day: 3, Month: 4}) {
+		t.Fatalf("expected the request within the limits counted, got: %+v %v %v", u, ok, err)
+	}
+}
+
+// TestUsage counts the usage, and verifies it is written out on Close.
+func TestUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "laff.json")
+	fs, err := NewFileStore(path, FileOptions{})
+	if err != nil {
+		t.Fatal("error creating store", err)
+	}
+	checkUsage(t, fs)
+	if err := fs.Close(); err != nil {
+		t.Fatal("error closing store", err)
+	}
+	reloaded, err := NewFileStore(path, FileOptions{})
+	if err != nil {
+		t.Fatal("error reloading store", err)
+	}
+	u, _ := reloaded.Usage(context.Background(), "bob", time.Date(2026, 10, 31, 0, 0, 0, 0, time.UTC))
+	if u != (Usage{Day: 1, Month: 1}) {
+		t.Fatalf("expected bob's usage reloaded, got: %+v", u)
+	}
+}
+
+// TestProfiles verifies the profiles are kept, and reloaded from the file
+// by a new store.
+func TestProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "laff.json")
+	fs, err := NewFileStore(path, FileOptions{})
+	if err != nil {
+		t.Fatal("error creating store", err)
+	}
+	checkProfiles(t, fs, func() ProfileStore {
+		reloaded, err := NewFileStore(path, FileOptions{})
+		if err != nil {
+			t.Fatal("error reloading store", err)
+		}
+		return reloaded
+	})
+}
+
+// checkProfiles sets, replaces and deletes profiles in the store, and
+// verifies they are still there in the store reopen returns.
+func checkProfiles(t *testing.T, ps ProfileStore, reopen func() ProfileStore) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := ps.Profile(ctx, "alice"); err != ErrNotFound {
+		t.Fatal("expected not found, got:", err)
+	}
+	want := Profile{First: "Alice", Last: "Liddell", Categories: []string{"nerdy"}, Lang: "fr"}
+	if _, err := ps.SetProfile(ctx, "alice", Profile{First: "Al"}); err != nil {
+		t.Fatal("error setting profile", err)
+	}
+	got, err := ps.SetProfile(ctx, "alice", want)
+	if err != nil || got.Updated.IsZero() {
+		t.Fatal("error replacing profile", got, err)
+	}
+	if _, err := ps.SetProfile(ctx, "bob", Profile{Lang: "de"}); err != nil {
+		t.Fatal("error setting profile", err)
+	}
+	if err := ps.DeleteProfile(ctx, "bob"); err != nil {
+		t.Fatal("error deleting profile", err)
+	}
+	if err := ps.DeleteProfile(ctx, "bob"); err != ErrNotFound {
+		t.Fatal("expected not found deleting, got:", err)
+	}
+
+	ps = reopen()
+	got, err = ps.Profile(ctx, "alice")
+	if err != nil {
+		t.Fatal("error getting profile", err)
+	}
+	want.Updated = got.Updated
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got: %+v", want, got)
+	}
+	if _, err := ps.Profile(ctx, "bob"); err != ErrNotFound {
+		t.Fatal("expected the deleted profile gone, got:", err)
+	}
+}
+
+// TestSnapshot verifies a store restored from a snapshot of an in-memory
+// one holds its data, including the history when it is persisted.
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fs, _ := NewFileStore("", FileOptions{HistorySize: 5, PersistHistory: true})
+	fs.AddFavorite(ctx, "alice", 5)
+	fs.AddHistory(ctx, HistoryEntry{JokeID: 5, Text: "Joke 5"})
+	path := filepath.Join(t.TempDir(), "laff.json")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal("error creating file", err)
+	}
+	if err := fs.Snapshot(ctx, f); err != nil {
+		t.Fatal("error taking snapshot", err)
+	}
+	f.Close()
+
+	restored, err := NewFileStore(path, FileOptions{HistorySize: 5, PersistHistory: true})
+	if err != nil {
+		t.Fatal("error restoring store", err)
+	}
+	favs, _ := restored.Favorites(ctx, "alice")
+	hist, total, _ := restored.History(ctx, 0, 5)
+	if len(favs) != 1 || total != 1 || hist[0].Text != "Joke 5" {
+		t.Fatalf("unexpected restored data: %+v %+v", favs, hist)
+	}
+}
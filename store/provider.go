@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gdotgordon/laff/service"
+)
+
+// JokeProvider serves the jokes in a JokeStore through the service.  It
+// implements service.JokeProvider.
+type JokeProvider struct {
+	js JokeStore
+}
+
+// NewJokeProvider creates a provider of the jokes in the store.
+func NewJokeProvider(js JokeStore) *JokeProvider {
+	return &JokeProvider{js: js}
+}
+
+// Joke implements service.JokeProvider, returning a random stored joke
+// made out to the name.  The pick is repeatable for a seeded context, see
+// service.Seed.
+func (jp *JokeProvider) Joke(ctx context.Context, name *service.NameResp) (service.Joke, error) {
+	sj, err := jp.pick(ctx)
+	if errors.Is(err, ErrNotFound) {
+		return service.Joke{}, service.ErrNoJokes
+	}
+	if err != nil {
+		return service.Joke{}, err
+	}
+	r := strings.NewReplacer("{first}", name.Name, "{last}", name.Surname)
+	return service.Joke{
+		ID:         sj.ID,
+		Text:       r.Replace(sj.Text),
+		Name:       *name,
+		Categories: sj.Categories,
+	}, nil
+}
+
+// pick picks a stored joke at random.  The store picks it unless the
+// context is seeded, when it is picked by its place in ID order.
+func (jp *JokeProvider) pick(ctx context.Context) (StoredJoke, error) {
+	if !service.Seeded(ctx) {
+		return jp.js.RandomJoke(ctx)
+	}
+	_, total, err := jp.js.Jokes(ctx, StatusApproved, 0, 0)
+	if err != nil {
+		return StoredJoke{}, err
+	}
+	if total == 0 {
+		return StoredJoke{}, ErrNotFound
+	}
+	jks, _, err := jp.js.Jokes(ctx, StatusApproved, service.Intn(ctx, total), 1)
+	if err != nil {
+		return StoredJoke{}, err
+	}
+	if len(jks) == 0 {
+		// Deleted in between.
+		return StoredJoke{}, ErrNotFound
+	}
+	return jks[0], nil
+}
@@ -0,0 +1,619 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pkgerr "github.com/pkg/errors"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// firstJokeID is the first ID assigned to the jokes created without one.
+// It keeps them clear of the IDs from the joke service.
+const firstJokeID = 1000000
+
+// schema creates the tables, if they don't already exist.
+const schema = `
+CREATE TABLE IF NOT EXISTS jokes (
+	id         INTEGER PRIMARY KEY,
+	text       TEXT NOT NULL,
+	categories TEXT NOT NULL DEFAULT '[]',
+	source     TEXT NOT NULL,
+	created    INTEGER NOT NULL,
+	updated    INTEGER NOT NULL,
+	status     TEXT NOT NULL DEFAULT 'approved',
+	submitter  TEXT NOT NULL DEFAULT '',
+	reason     TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS favorites (
+	user    TEXT NOT NULL,
+	joke_id INTEGER NOT NULL,
+	added   INTEGER NOT NULL,
+	PRIMARY KEY (user, joke_id)
+);
+CREATE TABLE IF NOT EXISTS history (
+	seq     INTEGER PRIMARY KEY AUTOINCREMENT,
+	joke_id INTEGER NOT NULL,
+	text    TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	time    INTEGER NOT NULL,
+	client  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS usage (
+	user     TEXT NOT NULL,
+	day      TEXT NOT NULL,
+	requests INTEGER NOT NULL,
+	PRIMARY KEY (user, day)
+);
+CREATE TABLE IF NOT EXISTS profiles (
+	user       TEXT PRIMARY KEY,
+	first      TEXT NOT NULL,
+	last       TEXT NOT NULL,
+	categories TEXT NOT NULL,
+	lang       TEXT NOT NULL,
+	updated    INTEGER NOT NULL
+);
+`
+
+// SQLiteStore keeps everything in an embedded SQLite database, so unlike
+// the FileStore, the history is always durable and the data needn't fit
+// in memory.  It also implements JokeStore, UsageStore and ProfileStore.
+type SQLiteStore struct {
+	db          *sql.DB
+	historySize int
+}
+
+// NewSQLiteStore opens, or creates, the database at path, retaining the
+// given number of served jokes.
+func NewSQLiteStore(path string, historySize int) (*SQLiteStore, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "opening database")
+	}
+	// SQLite allows one writer at a time, so rather than have the
+	// connections wait on each other, we use just the one.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, pkgerr.Wrap(err, "creating tables")
+	}
+	if err := addColumns(db, "jokes", jokeAdditions); err != nil {
+		db.Close()
+		return nil, pkgerr.Wrap(err, "upgrading tables")
+	}
+	return &SQLiteStore{db: db, historySize: historySize}, nil
+}
+
+// AddFavorite implements Store.
+func (ss *SQLiteStore) AddFavorite(ctx context.Context, user string, jokeID int) error {
+	_, err := ss.db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO favorites (user, joke_id, added) VALUES (?, ?, ?)`,
+		user, jokeID, toUnix(time.Now()))
+	return pkgerr.Wrap(err, "adding favorite")
+}
+
+// RemoveFavorite implements Store.
+func (ss *SQLiteStore) RemoveFavorite(ctx context.Context, user string, jokeID int) error {
+	res, err := ss.db.ExecContext(ctx,
+		`DELETE FROM favorites WHERE user = ? AND joke_id = ?`, user, jokeID)
+	return checkAffected(res, err, "removing favorite")
+}
+
+// Favorites implements Store.
+func (ss *SQLiteStore) Favorites(ctx context.Context, user string) ([]Favorite, error) {
+	rows, err := ss.db.QueryContext(ctx,
+		`SELECT joke_id, added FROM favorites WHERE user = ? ORDER BY rowid`, user)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "getting favorites")
+	}
+	defer rows.Close()
+
+	res := []Favorite{}
+	for rows.Next() {
+		var f Favorite
+		var added int64
+		if err := rows.Scan(&f.JokeID, &added); err != nil {
+			return nil, pkgerr.Wrap(err, "getting favorites")
+		}
+		f.Added = fromUnix(added)
+		res = append(res, f)
+	}
+	return res, pkgerr.Wrap(rows.Err(), "getting favorites")
+}
+
+// AddHistory implements Store.
+func (ss *SQLiteStore) AddHistory(ctx context.Context, entry HistoryEntry) error {
+	if ss.historySize <= 0 {
+		return nil
+	}
+	_, err := ss.db.ExecContext(ctx,
+		`INSERT INTO history (joke_id, text, name, time, client) VALUES (?, ?, ?, ?, ?)`,
+		entry.JokeID, entry.Text, entry.Name, toUnix(entry.Time), entry.Client)
+	if err != nil {
+		return pkgerr.Wrap(err, "adding history")
+	}
+	_, err = ss.db.ExecContext(ctx,
+		`DELETE FROM history WHERE seq <= (SELECT MAX(seq) FROM history) - ?`, ss.historySize)
+	return pkgerr.Wrap(err, "trimming history")
+}
+
+// History implements Store.
+func (ss *SQLiteStore) History(ctx context.Context, offset, limit int) ([]HistoryEntry, int, error) {
+	var total int
+	if err := ss.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM history`).Scan(&total); err != nil {
+		return nil, 0, pkgerr.Wrap(err, "counting history")
+	}
+	rows, err := ss.db.QueryContext(ctx,
+		`SELECT joke_id, text, name, time, client FROM history
+		ORDER BY seq DESC LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, 0, pkgerr.Wrap(err, "getting history")
+	}
+	defer rows.Close()
+
+	var res []HistoryEntry
+	for rows.Next() {
+		var e HistoryEntry
+		var tm int64
+		if err := rows.Scan(&e.JokeID, &e.Text, &e.Name, &tm, &e.Client); err != nil {
+			return nil, 0, pkgerr.Wrap(err, "getting history")
+		}
+		e.Time = fromUnix(tm)
+		res = append(res, e)
+	}
+	return res, total, pkgerr.Wrap(rows.Err(), "getting history")
+}
+
+// SearchJokes implements Store.  Like the FileStore, it searches the
+// history, newest first, then the approved jokes of the database, such as
+// the synced catalog, which may not have been served yet, in ID order.  A
+// text found in both is only given once.
+func (ss *SQLiteStore) SearchJokes(ctx context.Context, query string, limit int) ([]Joke, error) {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	// LIKE ignores case, for ASCII at least.
+	var conds []string
+	var args []interface{}
+	for _, w := range words {
+		conds = append(conds, `text LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(w)+"%")
+	}
+	where := strings.Join(conds, " AND ")
+	res, err := ss.searchRows(ctx, nil, limit,
+		`SELECT joke_id, text FROM (SELECT joke_id, text, MAX(seq) AS latest FROM history
+		WHERE `+where+` GROUP BY joke_id) ORDER BY latest DESC LIMIT ?`, append(args, limit)...)
+	if err != nil || len(res) == limit {
+		return res, err
+	}
+	// Up to len(res) of these may be left out as seen already.
+	return ss.searchRows(ctx, res, limit,
+		`SELECT id, text FROM jokes WHERE status = ? AND `+where+` ORDER BY id LIMIT ?`,
+		append(append([]interface{}{StatusApproved}, args...), limit)...)
+}
+
+// searchRows adds the jokes the query finds to those found already, up to
+// limit, leaving out the texts found already.
+func (ss *SQLiteStore) searchRows(ctx context.Context, res []Joke, limit int, query string,
+	args ...interface{}) ([]Joke, error) {
+	seen := make(map[string]bool, len(res))
+	for _, jk := range res {
+		seen[jk.Text] = true
+	}
+	rows, err := ss.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "searching jokes")
+	}
+	defer rows.Close()
+
+	for rows.Next() && len(res) < limit {
+		var jk Joke
+		if err := rows.Scan(&jk.ID, &jk.Text); err != nil {
+			return nil, pkgerr.Wrap(err, "searching jokes")
+		}
+		if !seen[jk.Text] {
+			seen[jk.Text] = true
+			res = append(res, jk)
+		}
+	}
+	return res, pkgerr.Wrap(rows.Err(), "searching jokes")
+}
+
+// CreateJoke implements JokeStore.
+func (ss *SQLiteStore) CreateJoke(ctx context.Context, jk StoredJoke) (StoredJoke, error) {
+	cats, err := json.Marshal(nonNil(jk.Categories))
+	if err != nil {
+		return StoredJoke{}, err
+	}
+	now := time.Now().UTC()
+	jk.Created, jk.Updated = now, now
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StoredJoke{}, pkgerr.Wrap(err, "creating joke")
+	}
+	defer tx.Rollback()
+	if jk.Status == "" {
+		jk.Status = StatusApproved
+	}
+	if jk.ID == 0 {
+		err = tx.QueryRowContext(ctx,
+			`SELECT COALESCE(MAX(id) + 1, ?) FROM jokes WHERE id >= ?`,
+			firstJokeID, firstJokeID).Scan(&jk.ID)
+		if err != nil {
+			return StoredJoke{}, pkgerr.Wrap(err, "assigning joke ID")
+		}
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT OR IGNORE INTO jokes (id, text, categories, source, created, updated, status, submitter)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		jk.ID, jk.Text, string(cats), jk.Source, toUnix(now), toUnix(now), jk.Status, jk.Submitter)
+	if err != nil {
+		return StoredJoke{}, pkgerr.Wrap(err, "creating joke")
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return StoredJoke{}, ErrExists
+	}
+	return jk, pkgerr.Wrap(tx.Commit(), "creating joke")
+}
+
+// Joke implements JokeStore.
+func (ss *SQLiteStore) Joke(ctx context.Context, id int) (StoredJoke, error) {
+	return scanJoke(ss.db.QueryRowContext(ctx,
+		`SELECT `+jokeColumns+` FROM jokes WHERE id = ?`, id))
+}
+
+// UpdateJoke implements JokeStore.
+func (ss *SQLiteStore) UpdateJoke(ctx context.Context, jk StoredJoke) (StoredJoke, error) {
+	cats, err := json.Marshal(nonNil(jk.Categories))
+	if err != nil {
+		return StoredJoke{}, err
+	}
+	res, err := ss.db.ExecContext(ctx,
+		`UPDATE jokes SET text = ?, categories = ?, source = ?, status = COALESCE(NULLIF(?, ''), status),
+		updated = ? WHERE id = ?`,
+		jk.Text, string(cats), jk.Source, jk.Status, toUnix(time.Now()), jk.ID)
+	if err := checkAffected(res, err, "updating joke"); err != nil {
+		return StoredJoke{}, err
+	}
+	return ss.Joke(ctx, jk.ID)
+}
+
+// DeleteJoke implements JokeStore.
+func (ss *SQLiteStore) DeleteJoke(ctx context.Context, id int) error {
+	res, err := ss.db.ExecContext(ctx, `DELETE FROM jokes WHERE id = ?`, id)
+	return checkAffected(res, err, "deleting joke")
+}
+
+// ModerateJoke implements JokeStore.  Only a pending joke is updated, so
+// of two moderators deciding at once, the second gets ErrNotPending rather
+// than overruling the first.
+func (ss *SQLiteStore) ModerateJoke(ctx context.Context, id int, status, reason string) (StoredJoke, error) {
+	res, err := ss.db.ExecContext(ctx,
+		`UPDATE jokes SET status = ?, reason = ?, updated = ? WHERE id = ? AND status = ?`,
+		status, reason, toUnix(time.Now()), id, StatusPending)
+	err = checkAffected(res, err, "moderating joke")
+	if err == ErrNotFound {
+		if _, err := ss.Joke(ctx, id); err != nil {
+			return StoredJoke{}, err
+		}
+		return StoredJoke{}, ErrNotPending
+	}
+	if err != nil {
+		return StoredJoke{}, err
+	}
+	return ss.Joke(ctx, id)
+}
+
+// Jokes implements JokeStore.
+func (ss *SQLiteStore) Jokes(ctx context.Context, status string, offset, limit int) ([]StoredJoke, int, error) {
+	var total int
+	if err := ss.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM jokes WHERE ? IN ('', status)`, status).Scan(&total); err != nil {
+		return nil, 0, pkgerr.Wrap(err, "counting jokes")
+	}
+	rows, err := ss.db.QueryContext(ctx,
+		`SELECT `+jokeColumns+` FROM jokes WHERE ? IN ('', status) ORDER BY id LIMIT ? OFFSET ?`,
+		status, limit, offset)
+	if err != nil {
+		return nil, 0, pkgerr.Wrap(err, "listing jokes")
+	}
+	defer rows.Close()
+
+	var res []StoredJoke
+	for rows.Next() {
+		jk, err := scanJoke(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		res = append(res, jk)
+	}
+	return res, total, pkgerr.Wrap(rows.Err(), "listing jokes")
+}
+
+// RandomJoke implements JokeStore.  Picking a random offset avoids sorting
+// the whole table, as ORDER BY RANDOM() would.
+func (ss *SQLiteStore) RandomJoke(ctx context.Context) (StoredJoke, error) {
+	return scanJoke(ss.db.QueryRowContext(ctx,
+		`SELECT `+jokeColumns+` FROM jokes WHERE status = ?
+		LIMIT 1 OFFSET ABS(RANDOM()) % MAX((SELECT COUNT(*) FROM jokes WHERE status = ?), 1)`,
+		StatusApproved, StatusApproved))
+}
+
+// AddUsage implements UsageStore.  The usage is read and added to in a
+// transaction, on the one connection, so no other request comes between.
+func (ss *SQLiteStore) AddUsage(ctx context.Context, user string, t time.Time, limit Usage) (Usage, bool, error) {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Usage{}, false, pkgerr.Wrap(err, "adding usage")
+	}
+	defer tx.Rollback()
+	u, err := usageOf(ctx, tx.QueryRowContext, user, t)
+	if err != nil {
+		return Usage{}, false, err
+	}
+	if (limit.Day > 0 && u.Day >= limit.Day) || (limit.Month > 0 && u.Month >= limit.Month) {
+		return u, false, nil
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO usage (user, day, requests) VALUES (?, ?, 1)
+		ON CONFLICT (user, day) DO UPDATE SET requests = requests + 1`,
+		user, t.UTC().Format(usageDay))
+	if err != nil {
+		return Usage{}, false, pkgerr.Wrap(err, "adding usage")
+	}
+	if err := tx.Commit(); err != nil {
+		return Usage{}, false, pkgerr.Wrap(err, "adding usage")
+	}
+	u.Day++
+	u.Month++
+	return u, true, nil
+}
+
+// Usage implements UsageStore.
+func (ss *SQLiteStore) Usage(ctx context.Context, user string, t time.Time) (Usage, error) {
+	return usageOf(ctx, ss.db.QueryRowContext, user, t)
+}
+
+// usageOf returns the user's usage on the day of the time and in its
+// month, queried with query, of the database or of a transaction.
+func usageOf(ctx context.Context, query func(context.Context, string, ...any) *sql.Row, user string,
+	t time.Time) (Usage, error) {
+	day := t.UTC().Format(usageDay)
+	var u Usage
+	err := query(ctx,
+		`SELECT COALESCE(SUM(CASE WHEN day = ? THEN requests END), 0), COALESCE(SUM(requests), 0)
+		FROM usage WHERE user = ? AND day BETWEEN ? AND ?`,
+		day, user, day[:7]+"-01", day).Scan(&u.Day, &u.Month)
+	return u, pkgerr.Wrap(err, "getting usage")
+}
+
+// Profile implements ProfileStore.
+func (ss *SQLiteStore) Profile(ctx context.Context, user string) (Profile, error) {
+	var p Profile
+	var cats string
+	var updated int64
+	err := ss.db.QueryRowContext(ctx,
+		`SELECT first, last, categories, lang, updated FROM profiles WHERE user = ?`, user).
+		Scan(&p.First, &p.Last, &cats, &p.Lang, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Profile{}, ErrNotFound
+	}
+	if err != nil {
+		return Profile{}, pkgerr.Wrap(err, "getting profile")
+	}
+	if err := json.Unmarshal([]byte(cats), &p.Categories); err != nil {
+		return Profile{}, pkgerr.Wrap(err, "decoding profile categories")
+	}
+	p.Updated = fromUnix(updated)
+	return p, nil
+}
+
+// SetProfile implements ProfileStore.
+func (ss *SQLiteStore) SetProfile(ctx context.Context, user string, p Profile) (Profile, error) {
+	cats, err := json.Marshal(p.Categories)
+	if err != nil {
+		return Profile{}, err
+	}
+	now := time.Now()
+	_, err = ss.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO profiles (user, first, last, categories, lang, updated)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		user, p.First, p.Last, string(cats), p.Lang, toUnix(now))
+	if err != nil {
+		return Profile{}, pkgerr.Wrap(err, "setting profile")
+	}
+	p.Updated = fromUnix(toUnix(now))
+	return p, nil
+}
+
+// DeleteProfile implements ProfileStore.
+func (ss *SQLiteStore) DeleteProfile(ctx context.Context, user string) error {
+	res, err := ss.db.ExecContext(ctx, `DELETE FROM profiles WHERE user = ?`, user)
+	return checkAffected(res, err, "deleting profile")
+}
+
+// usagePage is the number of usage records read at a time, so the
+// database isn't held while they are handled.
+const usagePage = 1000
+
+// UsageRecords implements UsageStore.
+func (ss *SQLiteStore) UsageRecords(ctx context.Context, from, to time.Time, fn func(UsageRecord) error) error {
+	first, last := usageRange(from, to)
+	after := UsageRecord{Day: first}
+	for {
+		recs, err := ss.usagePage(ctx, after, last)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if len(recs) < usagePage {
+			return nil
+		}
+		after = recs[len(recs)-1]
+	}
+}
+
+// usagePage reads the page of usage records following the one given, up
+// to the last day.
+func (ss *SQLiteStore) usagePage(ctx context.Context, after UsageRecord, last string) ([]UsageRecord, error) {
+	rows, err := ss.db.QueryContext(ctx,
+		`SELECT user, day, requests FROM usage
+		WHERE (day, user) > (?, ?) AND day <= ?
+		ORDER BY day, user LIMIT ?`, after.Day, after.User, last, usagePage)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "getting usage records")
+	}
+	defer rows.Close()
+
+	var recs []UsageRecord
+	for rows.Next() {
+		var rec UsageRecord
+		if err := rows.Scan(&rec.User, &rec.Day, &rec.Requests); err != nil {
+			return nil, pkgerr.Wrap(err, "getting usage records")
+		}
+		recs = append(recs, rec)
+	}
+	return recs, pkgerr.Wrap(rows.Err(), "getting usage records")
+}
+
+// Close implements Store.
+func (ss *SQLiteStore) Close() error {
+	return ss.db.Close()
+}
+
+// Snapshot implements Snapshotter, writing a copy of the database made
+// with VACUUM INTO, which is consistent while the writes go on.
+func (ss *SQLiteStore) Snapshot(ctx context.Context, w io.Writer) error {
+	dir, err := os.MkdirTemp("", "laff-snapshot")
+	if err != nil {
+		return pkgerr.Wrap(err, "creating snapshot directory")
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "laff.db")
+	if _, err := ss.db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		return pkgerr.Wrap(err, "copying database")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// jokeColumns are the columns read by scanJoke.
+const jokeColumns = `id, text, categories, source, created, updated, status, submitter, reason`
+
+// scanJoke reads a joke from a row of jokeColumns.
+func scanJoke(row interface{ Scan(...interface{}) error }) (StoredJoke, error) {
+	var jk StoredJoke
+	var cats string
+	var created, updated int64
+	err := row.Scan(&jk.ID, &jk.Text, &cats, &jk.Source, &created, &updated, &jk.Status, &jk.Submitter, &jk.Reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredJoke{}, ErrNotFound
+	}
+	if err != nil {
+		return StoredJoke{}, pkgerr.Wrap(err, "reading joke")
+	}
+	if err := json.Unmarshal([]byte(cats), &jk.Categories); err != nil {
+		return StoredJoke{}, pkgerr.Wrap(err, "reading joke categories")
+	}
+	if len(jk.Categories) == 0 {
+		jk.Categories = nil
+	}
+	jk.Created, jk.Updated = fromUnix(created), fromUnix(updated)
+	return jk, nil
+}
+
+// jokeAdditions are the columns added to the jokes table since it was
+// first created, with their definitions, for the databases created
+// before.
+var jokeAdditions = [][2]string{
+	{"status", "TEXT NOT NULL DEFAULT 'approved'"},
+	{"submitter", "TEXT NOT NULL DEFAULT ''"},
+	{"reason", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// addColumns adds the columns missing from the table, which SQLite can't
+// do with IF NOT EXISTS.
+func addColumns(db *sql.DB, table string, columns [][2]string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, col := range columns {
+		if !have[col[0]] {
+			if _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + col[0] + ` ` + col[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkAffected turns a change that affected no rows into ErrNotFound.
+func checkAffected(res sql.Result, err error, what string) error {
+	if err != nil {
+		return pkgerr.Wrap(err, what)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return pkgerr.Wrap(err, what)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// escapeLike escapes the LIKE wildcards in a search word.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// nonNil gives an empty list for nil, so it is stored as [] not null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// The times are stored as Unix nanoseconds, in UTC.
+func toUnix(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+func fromUnix(ns int64) time.Time {
+	return time.Unix(0, ns).UTC()
+}
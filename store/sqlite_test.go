@@ -0,0 +1,325 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSQLite creates a store in a temporary directory.
+func newTestSQLite(t *testing.T, historySize int) (*SQLiteStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "laff.db")
+	ss, err := NewSQLiteStore(path, historySize)
+	if err != nil {
+		t.Fatal("error creating store", err)
+	}
+	t.Cleanup(func() { ss.Close() })
+	return ss, path
+}
+
+// TestSQLiteFavorites adds and removes favorites, and verifies they are
+// still there when the database is reopened.
+func TestSQLiteFavorites(t *testing.T) {
+	ss, path := newTestSQLite(t, 0)
+	ctx := context.Background()
+	for _, id := range []int{5, 7, 5, 9} {
+		if err := ss.AddFavorite(ctx, "alice", id); err != nil {
+			t.Fatal("error adding favorite", err)
+		}
+	}
+	if err := ss.RemoveFavorite(ctx, "alice", 7); err != nil {
+		t.Fatal("error removing favorite", err)
+	}
+	if err := ss.RemoveFavorite(ctx, "alice", 7); err != ErrNotFound {
+		t.Fatal("expected not found, got:", err)
+	}
+	ss.Close()
+
+	reopened, err := NewSQLiteStore(path, 0)
+	if err != nil {
+		t.Fatal("error reopening store", err)
+	}
+	defer reopened.Close()
+	favs, err := reopened.Favorites(ctx, "alice")
+	if err != nil {
+		t.Fatal("error getting favorites", err)
+	}
+	if len(favs) != 2 || favs[0].JokeID != 5 || favs[1].JokeID != 9 {
+		t.Fatalf("unexpected favorites: %+v", favs)
+	}
+}
+
+// TestSQLiteHistory verifies the retention limit, paging and search.
+func TestSQLiteHistory(t *testing.T) {
+	ss, _ := newTestSQLite(t, 5)
+	ctx := context.Background()
+	for i := 0; i < 8; i++ {
+		err := ss.AddHistory(ctx, HistoryEntry{JokeID: i % 6, Text: fmt.Sprintf("Joke %d_x", i%6)})
+		if err != nil {
+			t.Fatal("error adding history", err)
+		}
+	}
+
+	// Only the last five should be left, newest first.
+	entries, total, err := ss.History(ctx, 0, 3)
+	if err != nil {
+		t.Fatal("error getting history", err)
+	}
+	if total != 5 || len(entries) != 3 || entries[0].JokeID != 1 || entries[2].JokeID != 5 {
+		t.Fatalf("unexpected first page: total %d, %+v", total, entries)
+	}
+	entries, _, _ = ss.History(ctx, 3, 3)
+	if len(entries) != 2 || entries[0].JokeID != 4 || entries[1].JokeID != 3 {
+		t.Fatalf("unexpected second page: %+v", entries)
+	}
+
+	jokes, err := ss.SearchJokes(ctx, "JOKE", 10)
+	if err != nil {
+		t.Fatal("error searching", err)
+	}
+	if len(jokes) != 5 || jokes[0].ID != 1 || jokes[4].ID != 3 {
+		t.Fatalf("unexpected matches: %+v", jokes)
+	}
+	// The underscore must match itself, not any character.
+	jokes, _ = ss.SearchJokes(ctx, "joke 4_x", 10)
+	if len(jokes) != 1 || jokes[0].ID != 4 {
+		t.Fatalf("unexpected matches: %+v", jokes)
+	}
+	if jokes, _ = ss.SearchJokes(ctx, "4x", 10); len(jokes) != 0 {
+		t.Fatalf("expected no matches, got: %+v", jokes)
+	}
+}
+
+// TestSQLiteSearchStored verifies the search finds the approved jokes of
+// the database after the history, each text only once.
+func TestSQLiteSearchStored(t *testing.T) {
+	ss, _ := newTestSQLite(t, 10)
+	ctx := context.Background()
+	if err := ss.AddHistory(ctx, HistoryEntry{JokeID: 9, Text: "Ann Lee counts to infinity."}); err != nil {
+		t.Fatal("error adding history", err)
+	}
+	for _, jk := range []StoredJoke{
+		{ID: 3, Text: "Ann Lee counts to infinity.", Source: SourceSynced},
+		{ID: 4, Text: "{first} {last} counts backwards from infinity.", Source: SourceSynced},
+		{ID: 5, Text: "{first} {last} counts sheep.", Source: SourceUser, Status: StatusPending},
+		{ID: 6, Text: "{first} {last} counts the stars.", Source: SourceBuiltin},
+	} {
+		if _, err := ss.CreateJoke(ctx, jk); err != nil {
+			t.Fatal("error creating joke", err)
+		}
+	}
+
+	jokes, err := ss.SearchJokes(ctx, "COUNTS", 10)
+	if err != nil {
+		t.Fatal("error searching", err)
+	}
+	if len(jokes) != 3 || jokes[0].ID != 9 || jokes[1].ID != 4 || jokes[2].ID != 6 {
+		t.Fatalf("unexpected matches: %+v", jokes)
+	}
+	if jokes, _ = ss.SearchJokes(ctx, "counts", 2); len(jokes) != 2 || jokes[1].ID != 4 {
+		t.Fatalf("unexpected limited matches: %+v", jokes)
+	}
+	if jokes, _ = ss.SearchJokes(ctx, "sheep", 10); len(jokes) != 0 {
+		t.Fatalf("expected the pending joke not found, got: %+v", jokes)
+	}
+}
+
+// TestSQLiteJokes creates, reads, updates and deletes jokes.
+func TestSQLiteJokes(t *testing.T) {
+	ss, _ := newTestSQLite(t, 0)
+	ctx := context.Background()
+
+	if _, err := ss.RandomJoke(ctx); err != ErrNotFound {
+		t.Fatal("expected not found with no jokes, got:", err)
+	}
+
+	a, err := ss.CreateJoke(ctx, StoredJoke{Text: "{first} wins", Source: SourceUser})
+	if err != nil {
+		t.Fatal("error creating joke", err)
+	}
+	b, err := ss.CreateJoke(ctx, StoredJoke{Text: "{last} loses", Source: SourceUser,
+		Categories: []string{"nerdy"}})
+	if err != nil {
+		t.Fatal("error creating joke", err)
+	}
+	if a.ID != firstJokeID || b.ID != firstJokeID+1 {
+		t.Fatal("unexpected assigned IDs:", a.ID, b.ID)
+	}
+	if _, err := ss.CreateJoke(ctx, StoredJoke{ID: 42, Text: "builtin", Source: SourceBuiltin}); err != nil {
+		t.Fatal("error creating joke with ID", err)
+	}
+	if _, err := ss.CreateJoke(ctx, StoredJoke{ID: 42, Text: "again", Source: SourceUser}); err != ErrExists {
+		t.Fatal("expected exists error, got:", err)
+	}
+
+	got, err := ss.Joke(ctx, b.ID)
+	if err != nil {
+		t.Fatal("error getting joke", err)
+	}
+	if got.Text != b.Text || len(got.Categories) != 1 || !got.Created.Equal(b.Created) {
+		t.Fatalf("unexpected joke: %+v", got)
+	}
+
+	b.Text = "{last} loses again"
+	b.Categories = nil
+	upd, err := ss.UpdateJoke(ctx, b)
+	if err != nil {
+		t.Fatal("error updating joke", err)
+	}
+	if upd.Text != b.Text || upd.Categories != nil || upd.Updated.Before(upd.Created) {
+		t.Fatalf("unexpected updated joke: %+v", upd)
+	}
+	if _, err := ss.UpdateJoke(ctx, StoredJoke{ID: 7, Text: "x"}); err != ErrNotFound {
+		t.Fatal("expected not found updating, got:", err)
+	}
+
+	if err := ss.DeleteJoke(ctx, a.ID); err != nil {
+		t.Fatal("error deleting joke", err)
+	}
+	if err := ss.DeleteJoke(ctx, a.ID); err != ErrNotFound {
+		t.Fatal("expected not found deleting, got:", err)
+	}
+
+	jokes, total, err := ss.Jokes(ctx, "", 0, 10)
+	if err != nil {
+		t.Fatal("error listing jokes", err)
+	}
+	if total != 2 || len(jokes) != 2 || jokes[0].ID != 42 || jokes[1].ID != b.ID {
+		t.Fatalf("unexpected jokes: total %d, %+v", total, jokes)
+	}
+	if jk, err := ss.RandomJoke(ctx); err != nil || (jk.ID != 42 && jk.ID != b.ID) {
+		t.Fatal("unexpected random joke:", jk, err)
+	}
+}
+
+// TestSQLiteSubmissions verifies the jokes pending approval are listed
+// but not served until approved, nor once rejected, and a database from before the jokes
+// had a status is upgraded, its jokes approved.
+func TestSQLiteSubmissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal("error opening database", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE jokes (id INTEGER PRIMARY KEY, text TEXT NOT NULL,
+		categories TEXT NOT NULL, source TEXT NOT NULL, created INTEGER NOT NULL,
+		updated INTEGER NOT NULL);
+		INSERT INTO jokes VALUES (1, '{first} is old', '[]', 'builtin', 0, 0)`); err != nil {
+		t.Fatal("error creating old table", err)
+	}
+	db.Close()
+	ss, err := NewSQLiteStore(path, 0)
+	if err != nil {
+		t.Fatal("error upgrading store", err)
+	}
+	defer ss.Close()
+	ctx := context.Background()
+
+	old, err := ss.Joke(ctx, 1)
+	if err != nil || old.Status != StatusApproved {
+		t.Fatal("expected the old joke approved, got:", old, err)
+	}
+	sub, err := ss.CreateJoke(ctx, StoredJoke{Text: "{first} submits", Source: SourceUser,
+		Status: StatusPending, Submitter: "ann"})
+	if err != nil {
+		t.Fatal("error creating joke", err)
+	}
+	for i := 0; i < 10; i++ {
+		if jk, err := ss.RandomJoke(ctx); err != nil || jk.ID != 1 {
+			t.Fatal("expected only the approved joke served, got:", jk, err)
+		}
+	}
+	pending, total, err := ss.Jokes(ctx, StatusPending, 0, 10)
+	if err != nil || total != 1 || len(pending) != 1 || pending[0].Submitter != "ann" {
+		t.Fatalf("unexpected pending jokes: total %d, %+v, %v", total, pending, err)
+	}
+
+	sub.Text = "{first} submits again"
+	sub.Status = ""
+	if upd, err := ss.UpdateJoke(ctx, sub); err != nil || upd.Status != StatusPending {
+		t.Fatal("expected the status kept, got:", upd, err)
+	}
+	sub.Status = StatusApproved
+	if _, err := ss.UpdateJoke(ctx, sub); err != nil {
+		t.Fatal("error approving joke", err)
+	}
+	if _, total, _ := ss.Jokes(ctx, StatusApproved, 0, 10); total != 2 {
+		t.Fatal("expected 2 approved jokes, got:", total)
+	}
+
+	if _, err := ss.ModerateJoke(ctx, sub.ID, StatusRejected, "not funny"); err != ErrNotPending {
+		t.Fatal("expected the approved joke not moderated, got:", err)
+	}
+	sub.Status = StatusPending
+	if _, err := ss.UpdateJoke(ctx, sub); err != nil {
+		t.Fatal("error resubmitting joke", err)
+	}
+	rej, err := ss.ModerateJoke(ctx, sub.ID, StatusRejected, "not funny")
+	if err != nil || rej.Status != StatusRejected || rej.Reason != "not funny" || rej.Text != sub.Text {
+		t.Fatal("unexpected rejected joke:", rej, err)
+	}
+	if jk, err := ss.RandomJoke(ctx); err != nil || jk.ID != 1 {
+		t.Fatal("expected the rejected joke not served, got:", jk, err)
+	}
+	if _, err := ss.ModerateJoke(ctx, sub.ID, StatusApproved, ""); err != ErrNotPending {
+		t.Fatal("expected the decided joke not moderated again, got:", err)
+	}
+	if jk, _ := ss.Joke(ctx, sub.ID); jk.Status != StatusRejected || jk.Reason != "not funny" {
+		t.Fatal("expected the rejection kept, got:", jk)
+	}
+	if _, err := ss.ModerateJoke(ctx, 7, StatusApproved, ""); err != ErrNotFound {
+		t.Fatal("expected not found moderating, got:", err)
+	}
+}
+
+// TestSQLiteProfiles verifies the profiles are kept, and still there when
+// the database is reopened.
+func TestSQLiteProfiles(t *testing.T) {
+	ss, path := newTestSQLite(t, 0)
+	checkProfiles(t, ss, func() ProfileStore {
+		reopened, err := NewSQLiteStore(path, 0)
+		if err != nil {
+			t.Fatal("error reopening store", err)
+		}
+		t.Cleanup(func() { reopened.Close() })
+		return reopened
+	})
+}
+
+// TestSQLiteUsage counts the usage of each day and month.
+func TestSQLiteUsage(t *testing.T) {
+	ss, _ := newTestSQLite(t, 0)
+	checkUsage(t, ss)
+}
+
+// TestSQLiteSnapshot verifies a snapshot is a database holding the data.
+func TestSQLiteSnapshot(t *testing.T) {
+	ss, _ := newTestSQLite(t, 5)
+	ctx := context.Background()
+	ss.AddFavorite(ctx, "alice", 5)
+	ss.AddHistory(ctx, HistoryEntry{JokeID: 5, Text: "Joke 5"})
+	path := filepath.Join(t.TempDir(), "restored.db")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal("error creating file", err)
+	}
+	if err := ss.Snapshot(ctx, f); err != nil {
+		t.Fatal("error taking snapshot", err)
+	}
+	f.Close()
+
+	restored, err := NewSQLiteStore(path, 5)
+	if err != nil {
+		t.Fatal("error opening snapshot", err)
+	}
+	defer restored.Close()
+	favs, _ := restored.Favorites(ctx, "alice")
+	hist, total, _ := restored.History(ctx, 0, 5)
+	if len(favs) != 1 || total != 1 || hist[0].Text != "Joke 5" {
+		t.Fatalf("unexpected restored data: %+v %+v", favs, hist)
+	}
+}
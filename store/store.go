@@ -0,0 +1,222 @@
+// Package store is the persistence layer for the laff service.  It holds
+// the data that outlives a single request, such as favorite jokes and the
+// history of jokes served.
+// The Store interface decouples the api layer from the actual storage, so
+// different backends can be plugged in.
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the requested item does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is returned when creating an item that already exists.
+var ErrExists = errors.New("already exists")
+
+// ErrNotPending is returned when moderating a joke that has been decided
+// already.
+var ErrNotPending = errors.New("not pending")
+
+// Favorite is a joke a user has marked as a favorite.
+type Favorite struct {
+	JokeID int       `json:"id"`
+	Added  time.Time `json:"added"`
+}
+
+// HistoryEntry records a joke that was served to a client.
+type HistoryEntry struct {
+	JokeID int       `json:"id"`
+	Text   string    `json:"joke"`
+	Name   string    `json:"name"`
+	Time   time.Time `json:"timestamp"`
+	Client string    `json:"client,omitempty"` // ID of the API key, if any
+}
+
+// Joke is a joke known to the store, as found by a search.
+type Joke struct {
+	ID   int    `json:"id"`
+	Text string `json:"joke"`
+}
+
+// Store is the interface implemented by the persistence backends.  The user
+// is an opaque identifier supplied by the caller.
+type Store interface {
+	// AddFavorite adds the joke to the user's favorites.  Adding a joke that
+	// is already a favorite is not an error.
+	AddFavorite(ctx context.Context, user string, jokeID int) error
+
+	// RemoveFavorite removes the joke from the user's favorites, returning
+	// ErrNotFound if it was not there.
+	RemoveFavorite(ctx context.Context, user string, jokeID int) error
+
+	// Favorites returns the user's favorites in the order they were added.
+	Favorites(ctx context.Context, user string) ([]Favorite, error)
+
+	// AddHistory records a served joke.  Only a bounded number of entries
+	// are retained, with the oldest ones dropped first.
+	AddHistory(ctx context.Context, entry HistoryEntry) error
+
+	// History returns up to limit entries, newest first, after skipping
+	// offset entries.  The total number of entries retained is also
+	// returned, for pagination.
+	History(ctx context.Context, offset, limit int) ([]HistoryEntry, int, error)
+
+	// SearchJokes returns up to limit distinct jokes containing all the
+	// words of the query, ignoring case, from the history and, with a
+	// JokeStore, its approved jokes.
+	SearchJokes(ctx context.Context, query string, limit int) ([]Joke, error)
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// Snapshotter is implemented by the backends that can write a consistent
+// copy of their data, in the form of their file, so they can be restored
+// by putting the copy in place of the file.
+type Snapshotter interface {
+	// Snapshot writes a copy of the data to w.
+	Snapshot(ctx context.Context, w io.Writer) error
+}
+
+// Where the stored jokes came from.
+const (
+	SourceBuiltin = "builtin" // shipped with laff
+	SourceSynced  = "synced"  // copied from an upstream catalog
+	SourceUser    = "user"    // added by the users or operators
+)
+
+// The moderation states of the stored jokes.  Only the approved jokes are
+// served.
+const (
+	StatusApproved = "approved"
+	StatusPending  = "pending" // submitted by a user, awaiting moderation
+	StatusRejected = "rejected"
+)
+
+// StoredJoke is a joke kept in a JokeStore.  The text may contain {first}
+// and {last} placeholders for the name, and {first2} and {last2} for a
+// second person's.
+type StoredJoke struct {
+	ID         int       `json:"id"`
+	Text       string    `json:"joke"`
+	Categories []string  `json:"categories,omitempty"`
+	Source     string    `json:"source"`
+	Status     string    `json:"status"`              // approved unless set
+	Submitter  string    `json:"submitter,omitempty"` // ID of the user who submitted it
+	Reason     string    `json:"reason,omitempty"`    // given by the moderator
+	Created    time.Time `json:"created"`
+	Updated    time.Time `json:"updated"`
+}
+
+// JokeStore is implemented by the backends that can hold jokes as well.
+type JokeStore interface {
+	// CreateJoke adds a joke, returning it as stored.  If the ID is zero,
+	// one is assigned, otherwise ErrExists is returned if it is taken.
+	// Without a status, the joke is approved.
+	CreateJoke(ctx context.Context, jk StoredJoke) (StoredJoke, error)
+
+	// Joke returns the joke with the ID, or ErrNotFound.
+	Joke(ctx context.Context, id int) (StoredJoke, error)
+
+	// UpdateJoke replaces the text, categories and source of a joke, and
+	// its status if given, returning it as stored, or ErrNotFound.
+	UpdateJoke(ctx context.Context, jk StoredJoke) (StoredJoke, error)
+
+	// DeleteJoke removes a joke, returning ErrNotFound if it wasn't there.
+	DeleteJoke(ctx context.Context, id int) error
+
+	// ModerateJoke sets the status of a pending joke, with the moderator's
+	// reason, returning it as stored, or ErrNotFound, or ErrNotPending if
+	// it has been decided already.
+	ModerateJoke(ctx context.Context, id int, status, reason string) (StoredJoke, error)
+
+	// Jokes returns up to limit jokes with the status, or of any status
+	// if it is empty, in ID order after skipping offset jokes, along with
+	// the total number of them.
+	Jokes(ctx context.Context, status string, offset, limit int) ([]StoredJoke, int, error)
+
+	// RandomJoke returns an approved joke chosen at random, or ErrNotFound
+	// if there are none.
+	RandomJoke(ctx context.Context) (StoredJoke, error)
+}
+
+// Usage is the number of requests a user made on a day, and in its month
+// up to and including that day, by UTC.
+type Usage struct {
+	Day   int64 `json:"day"`
+	Month int64 `json:"month"`
+}
+
+// UsageStore is implemented by the backends that count the requests of
+// each user, for the quotas.
+type UsageStore interface {
+	// AddUsage counts a request by the user at the time, unless it would
+	// take the user over the limit on the day or in the month, where a
+	// zero limit is none.  It returns the user's usage, with the request
+	// if it was counted, and whether it was, deciding as one operation
+	// so concurrent requests can't both take the last one left.
+	AddUsage(ctx context.Context, user string, t time.Time, limit Usage) (Usage, bool, error)
+
+	// Usage returns the user's requests on the day of the time, and in its
+	// month.
+	Usage(ctx context.Context, user string, t time.Time) (Usage, error)
+
+	// UsageRecords calls fn with the requests of each user on each day
+	// from the day of from to that of to, inclusive, in order of the day
+	// and then the user, stopping at the first error fn returns.  A zero
+	// from or to leaves that end open.
+	UsageRecords(ctx context.Context, from, to time.Time, fn func(UsageRecord) error) error
+}
+
+// Profile is a user's defaults for the jokes served to them, used when a
+// request doesn't say otherwise.
+type Profile struct {
+	First      string    `json:"first,omitempty"`
+	Last       string    `json:"last,omitempty"`
+	Categories []string  `json:"categories,omitempty"`
+	Lang       string    `json:"lang,omitempty"`
+	Updated    time.Time `json:"updated"`
+}
+
+// ProfileStore is implemented by the backends that keep the users'
+// profiles.
+type ProfileStore interface {
+	// Profile returns the user's profile, or ErrNotFound if they have
+	// none.
+	Profile(ctx context.Context, user string) (Profile, error)
+
+	// SetProfile replaces the user's profile, returning it as stored.
+	SetProfile(ctx context.Context, user string, p Profile) (Profile, error)
+
+	// DeleteProfile removes the user's profile, returning ErrNotFound if
+	// they had none.
+	DeleteProfile(ctx context.Context, user string) error
+}
+
+// UsageRecord is the number of requests a user made on a day, in UTC.
+type UsageRecord struct {
+	User     string `json:"user"`
+	Day      string `json:"day"` // as 2006-01-02
+	Requests int64  `json:"requests"`
+}
+
+// usageRange returns the first and last days of the range, as strings
+// that compare in order, with the zero times open.
+func usageRange(from, to time.Time) (string, string) {
+	first, last := "0000-00-00", "9999-99-99"
+	if !from.IsZero() {
+		first = from.UTC().Format(usageDay)
+	}
+	if !to.IsZero() {
+		last = to.UTC().Format(usageDay)
+	}
+	return first, last
+}
+
+// usageDay is the layout of the days the usage is kept by, in UTC.
+const usageDay = "2006-01-02"
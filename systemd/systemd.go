@@ -0,0 +1,109 @@
+// Package systemd implements the parts of the systemd service protocol the
+// laff service uses: socket activation, readiness notification and the
+// watchdog.  They are all simple enough that we don't need a library.  When
+// not run by systemd, the functions do nothing.
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// Notification states sent to systemd.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Listeners returns the sockets passed in by systemd socket activation,
+// or nil if there are none.  The environment variables are unset, so the
+// sockets are not inherited by any child processes.
+func Listeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var res []net.Listener
+	for i := 0; i < nfds; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range res {
+				l.Close()
+			}
+			return nil, err
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
+
+// Notify sends the state to systemd.  It returns false if we are not run
+// by systemd with notification enabled.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	// A leading @ denotes an abstract socket.
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which systemd expects to
+// hear from us, or zero if the watchdog is not enabled for this process.
+// Pinging at half the interval is recommended.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		p, err := strconv.Atoi(pid)
+		if err != nil {
+			return 0, errors.New("invalid WATCHDOG_PID")
+		}
+		if p != os.Getpid() {
+			return 0, nil
+		}
+	}
+	v, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC")
+	}
+	return time.Duration(v) * time.Microsecond, nil
+}
@@ -0,0 +1,75 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestNotify sends a notification to a socket standing in for systemd.
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Fatal("expected no notification without a socket, got:", sent, err)
+	}
+
+	addr := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal("error creating socket", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", addr)
+	if sent, err := Notify(Ready); !sent || err != nil {
+		t.Fatal("expected notification, got:", sent, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("error reading notification", err)
+	}
+	if string(buf[:n]) != Ready {
+		t.Fatal("expected:", Ready, ", got:", string(buf[:n]))
+	}
+}
+
+// TestWatchdogInterval parses the watchdog settings.
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if d, err := WatchdogInterval(); d != 0 || err != nil {
+		t.Fatal("expected no watchdog, got:", d, err)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "3000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d, err := WatchdogInterval(); d != 3*time.Second || err != nil {
+		t.Fatal("expected 3s, got:", d, err)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d, err := WatchdogInterval(); d != 0 || err != nil {
+		t.Fatal("expected no watchdog for another process, got:", d, err)
+	}
+
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "bogus")
+	if _, err := WatchdogInterval(); err == nil {
+		t.Fatal("expected error for invalid interval")
+	}
+}
+
+// TestListenersNotActivated verifies nothing is returned when the sockets
+// are meant for another process.
+func TestListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	ls, err := Listeners()
+	if ls != nil || err != nil {
+		t.Fatal("expected no listeners, got:", ls, err)
+	}
+}
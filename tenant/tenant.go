@@ -0,0 +1,281 @@
+// Package tenant tells apart the teams sharing a laff deployment, giving
+// each its own rate limit, joke categories and joke packs, and keeping
+// count of its usage.
+//
+// The tenants are configured in a JSON or YAML file like this:
+//
+//	tenants:
+//	  - name: payments
+//	    keys: [3f9c2e71d0]
+//	    rateLimit: 5
+//	    burst: 10
+//	    categories: [nerdy]
+//	  - name: support
+//	    packs: /etc/laff/packs/support
+//	    packShare: 75
+//
+// A request is from a tenant when it carries one of the tenant's keys, in
+// the X-API-Key header or as a bearer token.  A tenant without keys is
+// picked with the X-Laff-Tenant header instead, which is only as good as
+// the callers' word, so keys are best for the tenants that are limited.
+package tenant
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gdotgordon/laff/jokepack"
+	"github.com/gdotgordon/laff/service"
+	pkgerr "github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPackShare is the percent of a tenant's jokes that come from its
+// packs, if not set.
+const defaultPackShare = 50
+
+// Config is the configuration of a tenant.
+type Config struct {
+	Name       string   `json:"name" yaml:"name"`
+	Keys       []string `json:"keys,omitempty" yaml:"keys,omitempty"`
+	RateLimit  float64  `json:"rateLimit,omitempty" yaml:"rateLimit,omitempty"` // requests/second, none if 0
+	Burst      int      `json:"burst,omitempty" yaml:"burst,omitempty"`         // 1 if 0
+	Categories []string `json:"categories,omitempty" yaml:"categories,omitempty"`
+	Packs      string   `json:"packs,omitempty" yaml:"packs,omitempty"`         // directory of joke packs
+	PackShare  int      `json:"packShare,omitempty" yaml:"packShare,omitempty"` // percent, 50 if 0
+}
+
+// File is the contents of a tenants file.
+type File struct {
+	Tenants []Config `json:"tenants" yaml:"tenants"`
+}
+
+// Usage is a tenant's usage since the start.
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Served   int64 `json:"served"`  // answered with a 2xx or 3xx
+	Limited  int64 `json:"limited"` // refused by its rate limit
+	Errors   int64 `json:"errors"`  // answered with a 5xx
+}
+
+// Report is a tenant's settings, less its keys, and usage.
+type Report struct {
+	Name       string   `json:"name"`
+	Keyed      bool     `json:"keyed"` // identified by key, not header
+	RateLimit  float64  `json:"rateLimit,omitempty"`
+	Burst      int      `json:"burst,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+	PackJokes  int      `json:"packJokes,omitempty"`
+	PackShare  int      `json:"packShare,omitempty"`
+	Usage      Usage    `json:"usage"`
+}
+
+// Tenant is one of the teams served.
+type Tenant struct {
+	cfg     Config
+	packs   *jokepack.Provider
+	limiter *rate.Limiter
+
+	requests int64
+	served   int64
+	limited  int64
+	errors   int64
+}
+
+// Name returns the name of the tenant.
+func (t *Tenant) Name() string {
+	return t.cfg.Name
+}
+
+// Allow reports whether the tenant's rate limit lets a request through
+// at the time given, and if not, how long until it would.
+func (t *Tenant) Allow(now time.Time) (bool, time.Duration) {
+	atomic.AddInt64(&t.requests, 1)
+	if t.limiter == nil {
+		return true, 0
+	}
+	res := t.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		atomic.AddInt64(&t.limited, 1)
+		return false, delay
+	}
+	return true, 0
+}
+
+// Context returns the context for a request from the tenant, limiting the
+// jokes to its categories and serving its share of them from its packs.
+func (t *Tenant) Context(ctx context.Context) context.Context {
+	if len(t.cfg.Categories) > 0 {
+		ctx = service.AllowCategories(ctx, t.cfg.Categories)
+	}
+	if t.packs != nil {
+		ctx = service.PreferJokes(ctx, t.packs, t.cfg.PackShare)
+	}
+	return ctx
+}
+
+// Done counts a request from the tenant by the status code answered.
+// The requests refused by its rate limit are counted by Allow.
+func (t *Tenant) Done(code int) {
+	switch {
+	case code >= 500:
+		atomic.AddInt64(&t.errors, 1)
+	case code < 400:
+		atomic.AddInt64(&t.served, 1)
+	}
+}
+
+// Usage returns the tenant's usage.
+func (t *Tenant) Usage() Usage {
+	return Usage{
+		Requests: atomic.LoadInt64(&t.requests),
+		Served:   atomic.LoadInt64(&t.served),
+		Limited:  atomic.LoadInt64(&t.limited),
+		Errors:   atomic.LoadInt64(&t.errors),
+	}
+}
+
+// Report returns the tenant's settings and usage.
+func (t *Tenant) Report() Report {
+	rep := Report{
+		Name:       t.cfg.Name,
+		Keyed:      len(t.cfg.Keys) > 0,
+		RateLimit:  t.cfg.RateLimit,
+		Categories: t.cfg.Categories,
+		Usage:      t.Usage(),
+	}
+	if t.limiter != nil {
+		rep.Burst = t.limiter.Burst()
+	}
+	if t.packs != nil {
+		rep.PackJokes, rep.PackShare = t.packs.Len(), t.cfg.PackShare
+	}
+	return rep
+}
+
+// Registry holds the tenants.
+type Registry struct {
+	tenants []*Tenant
+}
+
+// Load reads the tenants file, JSON or YAML by its extension, and creates
+// the registry of its tenants.
+func Load(path string) (*Registry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, pkgerr.Wrap(err, "reading tenants file")
+	}
+	var f File
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(b, &f)
+	} else {
+		err = yaml.Unmarshal(b, &f)
+	}
+	if err != nil {
+		return nil, pkgerr.Wrapf(err, "parsing tenants file %s", path)
+	}
+	return New(f.Tenants)
+}
+
+// New creates the registry of the tenants, loading their joke packs.  The
+// names and keys must be unique.
+func New(cfgs []Config) (*Registry, error) {
+	reg := &Registry{}
+	names := make(map[string]bool)
+	keys := make(map[string]string)
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("tenant %d has no name", len(reg.tenants)+1)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("tenant %q is given twice", cfg.Name)
+		}
+		names[cfg.Name] = true
+		for _, k := range cfg.Keys {
+			if k == "" {
+				return nil, fmt.Errorf("tenant %q has an empty key", cfg.Name)
+			}
+			if prev, ok := keys[k]; ok {
+				return nil, fmt.Errorf("tenant %q has a key of tenant %q", cfg.Name, prev)
+			}
+			keys[k] = cfg.Name
+		}
+		if cfg.RateLimit < 0 || cfg.Burst < 0 || math.IsNaN(cfg.RateLimit) {
+			return nil, fmt.Errorf("tenant %q has an invalid rate limit %v or burst %d",
+				cfg.Name, cfg.RateLimit, cfg.Burst)
+		}
+		if cfg.PackShare < 0 || cfg.PackShare > 100 {
+			return nil, fmt.Errorf("tenant %q has a pack share %d outside 0-100", cfg.Name, cfg.PackShare)
+		}
+
+		t := &Tenant{cfg: cfg}
+		if cfg.RateLimit > 0 {
+			t.limiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), max(cfg.Burst, 1))
+		}
+		if cfg.Packs != "" {
+			packs, err := jokepack.Load(cfg.Packs)
+			if err != nil {
+				return nil, pkgerr.Wrapf(err, "loading the packs of tenant %q", cfg.Name)
+			}
+			t.packs = packs
+			if t.cfg.PackShare == 0 {
+				t.cfg.PackShare = defaultPackShare
+			}
+		}
+		reg.tenants = append(reg.tenants, t)
+	}
+	return reg, nil
+}
+
+// Len returns the number of tenants.
+func (reg *Registry) Len() int {
+	return len(reg.tenants)
+}
+
+// Identify returns the tenant a request is from, by its key, if it has
+// one, or else by the tenant named, which must have no keys.  It returns
+// nil if the request names no tenant, and an error if it names one that
+// doesn't exist or needs a key.  The key is checked against them all in
+// constant time.
+func (reg *Registry) Identify(key, name string) (*Tenant, error) {
+	var found *Tenant
+	if key != "" {
+		for _, t := range reg.tenants {
+			for _, k := range t.cfg.Keys {
+				if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+					found = t
+				}
+			}
+		}
+	}
+	if found != nil || name == "" {
+		return found, nil
+	}
+	for _, t := range reg.tenants {
+		if t.cfg.Name == name && len(t.cfg.Keys) == 0 {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown tenant %q, or it needs its key", name)
+}
+
+// Reports returns the settings and usage of the tenants, by name.
+func (reg *Registry) Reports() []Report {
+	reps := make([]Report, 0, len(reg.tenants))
+	for _, t := range reg.tenants {
+		reps = append(reps, t.Report())
+	}
+	sort.Slice(reps, func(i, j int) bool { return reps[i].Name < reps[j].Name })
+	return reps
+}
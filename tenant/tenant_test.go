@@ -0,0 +1,106 @@
+package tenant
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tenantsYAML = `tenants:
+  - name: payments
+    keys: [pay-key]
+    rateLimit: 1
+    burst: 2
+    categories: [nerdy]
+  - name: support
+    packs: PACKS
+`
+
+// TestLoad reads the tenants and their packs, and tells the tenants apart
+// by key or header.
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	packs := filepath.Join(dir, "packs")
+	if err := os.Mkdir(packs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(packs, "support.yaml"), "name: support\njokes:\n  - text: \"{first} laughs.\"\n")
+	path := filepath.Join(dir, "tenants.yaml")
+	writeFile(t, path, strings.Replace(tenantsYAML, "PACKS", packs, 1))
+
+	reg, err := Load(path)
+	if err != nil {
+		t.Fatal("error loading", err)
+	}
+	if reg.Len() != 2 {
+		t.Fatal("expected 2 tenants, got:", reg.Len())
+	}
+	if tn, err := reg.Identify("pay-key", "support"); err != nil || tn.Name() != "payments" {
+		t.Fatal("expected the key to win, got:", tn, err)
+	}
+	if tn, err := reg.Identify("", "support"); err != nil || tn.Name() != "support" {
+		t.Fatal("expected support, got:", tn, err)
+	}
+	if tn, err := reg.Identify("other-key", ""); err != nil || tn != nil {
+		t.Fatal("expected no tenant, got:", tn, err)
+	}
+	if _, err := reg.Identify("", "payments"); err == nil {
+		t.Fatal("expected payments to need its key")
+	}
+
+	reps := reg.Reports()
+	if !reps[0].Keyed || reps[0].Burst != 2 || reps[1].PackJokes != 1 || reps[1].PackShare != defaultPackShare {
+		t.Fatal("unexpected reports:", reps)
+	}
+}
+
+// TestNew rejects tenants sharing a name or key.
+func TestNew(t *testing.T) {
+	for _, cfgs := range [][]Config{
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a", Keys: []string{"k"}}, {Name: "b", Keys: []string{"k"}}},
+		{{}},
+		{{Name: "a", PackShare: 101}},
+		{{Name: "a", RateLimit: -1}},
+	} {
+		if _, err := New(cfgs); err == nil {
+			t.Fatal("expected an error for", cfgs)
+		}
+	}
+}
+
+// TestTenant verifies the rate limit and usage of a tenant.
+func TestTenant(t *testing.T) {
+	reg, err := New([]Config{{Name: "a", RateLimit: 1, Burst: 2}})
+	if err != nil {
+		t.Fatal("error creating", err)
+	}
+	tn, _ := reg.Identify("", "a")
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := tn.Allow(now); !ok {
+			t.Fatal("expected the burst allowed")
+		}
+		tn.Done(200)
+	}
+	if ok, wait := tn.Allow(now); ok || wait <= 0 || wait > time.Second {
+		t.Fatal("expected to wait up to a second, got:", ok, wait)
+	}
+	if ok, _ := tn.Allow(now.Add(time.Second)); !ok {
+		t.Fatal("expected allowed a second later")
+	}
+	tn.Done(503)
+	want := Usage{Requests: 4, Served: 2, Limited: 1, Errors: 1}
+	if u := tn.Usage(); u != want {
+		t.Fatal("expected", want, "got:", u)
+	}
+}
+
+func writeFile(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gdotgordon/laff/api"
+	"github.com/gdotgordon/laff/service"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\033[H\033[2J"
+
+// runTop shows a dashboard of a running server's stats in the terminal,
+// refreshed until interrupted.
+func runTop(args []string) error {
+	var cfg clientConfig
+	var interval time.Duration
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	cfg.register(fs)
+	fs.DurationVar(&interval, "interval", time.Second, "how often the dashboard is refreshed")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prev *api.StatsResponse
+	for {
+		cur, err := cfg.stats()
+		var b strings.Builder
+		b.WriteString(clearScreen)
+		if err != nil {
+			// The server may be restarting, so keep trying.
+			fmt.Fprintf(&b, "laff top: %s\n\nError: %v\n", cfg.addr, err)
+			prev = nil
+		} else {
+			renderTop(&b, cfg.addr, prev, cur)
+			prev = cur
+		}
+		os.Stdout.WriteString(b.String())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// stats gets the stats of the server.
+func (c *clientConfig) stats() (*api.StatsResponse, error) {
+	b, err := c.get("/v1/stats")
+	if err != nil {
+		return nil, err
+	}
+	var sr api.StatsResponse
+	if err := json.Unmarshal(b, &sr); err != nil {
+		return nil, fmt.Errorf("invalid stats response: %v", err)
+	}
+	return &sr, nil
+}
+
+// renderTop writes the dashboard of the stats.  The rates are the change
+// since the previous stats, so are left out without them.
+func renderTop(w io.Writer, addr string, prev, cur *api.StatsResponse) error {
+	st := cur.Service
+	rate := func(count func(*api.StatsResponse) int64) string {
+		if prev == nil {
+			return "-"
+		}
+		secs := cur.Time.Sub(prev.Time).Seconds()
+		if secs <= 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f/s", float64(count(cur)-count(prev))/secs)
+	}
+	served := func(sr *api.StatsResponse) int64 {
+		return sr.Service.JokeHits + sr.Service.NameHits + sr.Service.Misses
+	}
+
+	fmt.Fprintf(w, "laff top: %s, up %s, at %s\n\n", addr, cur.Uptime, cur.Time.Local().Format(time.TimeOnly))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	requests := func(sr *api.StatsResponse) int64 { return sr.Requests }
+	fmt.Fprintf(tw, "Requests:\t%s (%d in all)\n", rate(requests), cur.Requests)
+	fmt.Fprintf(tw, "Jokes:\t%s (%.1f%% cache hits: %d jokes, %d names, %d misses)\n",
+		rate(served), 100*st.HitRatio(), st.JokeHits, st.NameHits, st.Misses)
+	if lat := cur.Latency; lat != nil && lat.Requests > 0 {
+		fmt.Fprintf(tw, "Latency:\tp50 %s, p90 %s, p99 %s, %.2f%% available (last 5m)\n",
+			lat.P50, lat.P90, lat.P99, 100*lat.Availability)
+	} else {
+		fmt.Fprintf(tw, "Latency:\t-\n")
+	}
+	fmt.Fprintf(tw, "Cache:\t%d/%d jokes, %d/%d names\n", st.JokeCache, st.CacheSize, st.NameCache, st.CacheSize)
+	fmt.Fprintf(tw, "Errors:\t%d name, %d joke\n", st.NameErrors, st.JokeErrors)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "UPSTREAM\tCALLS\tSUCCESS\tMEDIAN\tHEALTH\n")
+	names := make([]string, 0, len(cur.Upstreams))
+	for name := range cur.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rep := cur.Upstreams[name]
+		median := rep.MedianLatency
+		if median == "" {
+			median = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%s\t%s\n", name, rep.Calls, 100*rep.SuccessRate, median, health(rep))
+	}
+	return tw.Flush()
+}
+
+// health sums up how an upstream is doing, worst first.
+func health(rep service.UpstreamReport) string {
+	switch {
+	case rep.Breaker != nil && rep.Breaker.State != service.BreakerClosed:
+		return "breaker " + rep.Breaker.State
+	case rep.Probe != nil && rep.Probe.Down:
+		return "down: " + rep.Probe.LastError
+	case rep.Backoff != "":
+		return "backing off " + rep.Backoff
+	case rep.Calls > 0 && rep.SuccessRate < 0.9 && rep.LastError != nil:
+		return "failing: " + rep.LastError.Error
+	case rep.Calls == 0:
+		return "no calls"
+	}
+	return "ok"
+}
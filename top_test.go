@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/laff/api"
+	"github.com/gdotgordon/laff/service"
+)
+
+// TestRenderTop verifies the rates are taken from the change since the
+// previous stats, and the unhealthy upstreams stand out.
+func TestRenderTop(t *testing.T) {
+	now := time.Now()
+	prev := &api.StatsResponse{
+		Time:     now,
+		Requests: 100,
+		Service:  service.Stats{JokeHits: 40, NameHits: 5, Misses: 5},
+	}
+	cur := &api.StatsResponse{
+		Time:     now.Add(2 * time.Second),
+		Uptime:   "1h0m0s",
+		Requests: 150,
+		Latency:  &api.SLOSummary{Requests: 50, Availability: 1, P50: "5ms", P90: "10ms", P99: "100ms"},
+		Service:  service.Stats{JokeHits: 60, NameHits: 5, Misses: 5, JokeCache: 7, NameCache: 3, CacheSize: 10},
+		Upstreams: map[string]service.UpstreamReport{
+			"joke": {Calls: 10, SuccessRate: 1, MedianLatency: "80ms"},
+			"name": {Calls: 10, SuccessRate: 0.5, Breaker: &service.BreakerStatus{State: service.BreakerOpen}},
+		},
+	}
+
+	var b strings.Builder
+	if err := renderTop(&b, "localhost:5000", prev, cur); err != nil {
+		t.Fatal("error rendering", err)
+	}
+	for _, want := range []string{"25.0/s (150 in all)", "10.0/s", "p99 100ms", "7/10 jokes",
+		"breaker open", "80ms", "ok"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("expected %q in the dashboard, got:\n%s", want, b.String())
+		}
+	}
+
+	b.Reset()
+	renderTop(&b, "localhost:5000", nil, cur)
+	if !strings.Contains(b.String(), "Requests:  - (150 in all)") {
+		t.Error("expected no rate without previous stats, got:\n", b.String())
+	}
+}
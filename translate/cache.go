@@ -0,0 +1,68 @@
+package translate
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Cached wraps a Translator to remember the most recent translations.
+type Cached struct {
+	tr   Translator
+	size int
+
+	mu    sync.Mutex
+	order *list.List // of *cacheEntry, most recently used first
+	items map[cacheKey]*list.Element
+}
+
+type cacheKey struct {
+	text, target string
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	text string
+}
+
+// NewCached creates a cache of up to size translations in front of tr.
+func NewCached(tr Translator, size int) *Cached {
+	return &Cached{
+		tr:    tr,
+		size:  size,
+		order: list.New(),
+		items: make(map[cacheKey]*list.Element),
+	}
+}
+
+// Translate implements Translator.  Failures aren't cached, so they are
+// retried the next time around.
+func (c *Cached) Translate(ctx context.Context, text, target string) (string, error) {
+	key := cacheKey{text, target}
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry).text, nil
+	}
+	c.mu.Unlock()
+
+	res, err := c.tr.Translate(ctx, text, target)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		return res, nil
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, text: res})
+	for c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.items, el.Value.(*cacheEntry).key)
+	}
+	return res, nil
+}
@@ -0,0 +1,119 @@
+package translate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+// LibreTranslate uses a LibreTranslate server, which may be self-hosted.
+type LibreTranslate struct {
+	client *http.Client
+	url    string
+	key    string
+}
+
+// NewLibreTranslate creates a translator using the server at baseURL.  The
+// API key is only needed by the servers that require one.
+func NewLibreTranslate(client *http.Client, baseURL, key string) *LibreTranslate {
+	return &LibreTranslate{
+		client: client,
+		url:    strings.TrimSuffix(baseURL, "/") + "/translate",
+		key:    key,
+	}
+}
+
+// Translate implements Translator.
+func (lt *LibreTranslate) Translate(ctx context.Context, text, target string) (string, error) {
+	req := struct {
+		Q      string `json:"q"`
+		Source string `json:"source"`
+		Target string `json:"target"`
+		Format string `json:"format"`
+		APIKey string `json:"api_key,omitempty"`
+	}{text, Source, target, "text", lt.key}
+	var resp struct {
+		TranslatedText string `json:"translatedText"`
+	}
+	if err := postJSON(ctx, lt.client, lt.url, nil, req, &resp); err != nil {
+		return "", pkgerr.Wrap(err, "calling LibreTranslate")
+	}
+	return resp.TranslatedText, nil
+}
+
+// DeepL uses the DeepL API.
+type DeepL struct {
+	client *http.Client
+	url    string
+	key    string
+}
+
+// NewDeepL creates a translator using the DeepL API at baseURL, which is
+// https://api-free.deepl.com for the free plan and https://api.deepl.com
+// for the paid one.
+func NewDeepL(client *http.Client, baseURL, key string) *DeepL {
+	return &DeepL{
+		client: client,
+		url:    strings.TrimSuffix(baseURL, "/") + "/v2/translate",
+		key:    key,
+	}
+}
+
+// Translate implements Translator.
+func (d *DeepL) Translate(ctx context.Context, text, target string) (string, error) {
+	req := struct {
+		Text       []string `json:"text"`
+		SourceLang string   `json:"source_lang"`
+		TargetLang string   `json:"target_lang"`
+	}{[]string{text}, strings.ToUpper(Source), strings.ToUpper(target)}
+	var resp struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	hdr := http.Header{"Authorization": {"DeepL-Auth-Key " + d.key}}
+	if err := postJSON(ctx, d.client, d.url, hdr, req, &resp); err != nil {
+		return "", pkgerr.Wrap(err, "calling DeepL")
+	}
+	if len(resp.Translations) == 0 {
+		return "", pkgerr.New("DeepL returned no translation")
+	}
+	return resp.Translations[0].Text, nil
+}
+
+// postJSON posts the request body as JSON and decodes the JSON response.
+func postJSON(ctx context.Context, client *http.Client, url string, hdr http.Header, body, res interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP status %d (%s)",
+			resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return json.Unmarshal(rb, res)
+}
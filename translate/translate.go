@@ -0,0 +1,79 @@
+// Package translate translates the jokes, which come to us in English, to
+// other languages.  The translation services are pluggable, and the
+// results are cached, as the same jokes come around again.
+package translate
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Source is the language of the jokes from the upstream services.
+const Source = "en"
+
+// Translator translates English text to the target language, given as a
+// lower case ISO 639-1 code such as "de".
+type Translator interface {
+	Translate(ctx context.Context, text, target string) (string, error)
+}
+
+// Language returns the language a caller asked for, from the lang
+// parameter if given, otherwise the Accept-Language header.  It returns
+// the lower case primary language, so "fr" for "fr-CA", or Source if
+// nothing else was asked for.
+func Language(param, acceptLanguage string) string {
+	if lang := primary(param); lang != "" {
+		return lang
+	}
+	if lang := preferred(acceptLanguage); lang != "" {
+		return lang
+	}
+	return Source
+}
+
+// preferred picks the language with the highest quality value from an
+// Accept-Language header.  Among equal values, the first listed wins.
+func preferred(header string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lang := primary(fields[0])
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{lang, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i].q > choices[j].q
+	})
+	if len(choices) == 0 {
+		return ""
+	}
+	return choices[0].lang
+}
+
+// primary returns the lower case primary subtag of a language tag.
+func primary(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	return tag
+}
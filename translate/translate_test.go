@@ -0,0 +1,114 @@
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestLanguage verifies the language picked from the parameter and header.
+func TestLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		param, header, exp string
+	}{
+		{"", "", "en"},
+		{"de", "fr", "de"},
+		{"pt-BR", "", "pt"},
+		{"", "fr-CA, fr;q=0.9, en;q=0.8", "fr"},
+		{"", "en;q=0.5, es;q=0.9", "es"},
+		{"", "*, de;q=0.1", "de"},
+		{"", "de;q=0", "en"},
+	} {
+		if got := Language(tc.param, tc.header); got != tc.exp {
+			t.Errorf("Language(%q, %q): expected %q, got %q", tc.param, tc.header, tc.exp, got)
+		}
+	}
+}
+
+// TestBackends verifies the requests to and responses from the translation
+// services.
+func TestBackends(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/translate":
+			if req["target"] != "de" || req["api_key"] != "lk" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"translatedText": "Hallo"})
+		case "/v2/translate":
+			if req["target_lang"] != "DE" || r.Header.Get("Authorization") != "DeepL-Auth-Key dk" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"translations":[{"detected_source_language":"EN","text":"Servus"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	res, err := NewLibreTranslate(srv.Client(), srv.URL+"/", "lk").Translate(ctx, "Hello", "de")
+	if err != nil || res != "Hallo" {
+		t.Fatal("LibreTranslate: expected Hallo, got:", res, err)
+	}
+	res, err = NewDeepL(srv.Client(), srv.URL, "dk").Translate(ctx, "Hello", "de")
+	if err != nil || res != "Servus" {
+		t.Fatal("DeepL: expected Servus, got:", res, err)
+	}
+	if _, err := NewDeepL(srv.Client(), srv.URL, "wrong").Translate(ctx, "Hello", "de"); err == nil {
+		t.Fatal("expected error for bad key")
+	}
+}
+
+// TestCached verifies translations are cached, and the oldest dropped.
+func TestCached(t *testing.T) {
+	ct := &countingTranslator{}
+	c := NewCached(ct, 2)
+	ctx := context.Background()
+
+	for _, text := range []string{"a", "b", "a", "c", "a", "b"} {
+		res, err := c.Translate(ctx, text, "de")
+		if err != nil {
+			t.Fatal("error translating", err)
+		}
+		if res != "de:"+text {
+			t.Fatal("expected de:"+text+", got:", res)
+		}
+	}
+	// "b" was dropped when "c" was added, as "a" was used more recently.
+	if ct.calls != 4 {
+		t.Fatal("expected 4 calls, got:", ct.calls)
+	}
+
+	ct.err = errors.New("down")
+	if _, err := c.Translate(ctx, "d", "de"); err == nil {
+		t.Fatal("expected error")
+	}
+	ct.err = nil
+	if _, err := c.Translate(ctx, "d", "de"); err != nil || ct.calls != 6 {
+		t.Fatal("expected failure not to be cached, calls:", ct.calls, err)
+	}
+}
+
+type countingTranslator struct {
+	calls int
+	err   error
+}
+
+func (ct *countingTranslator) Translate(ctx context.Context, text, target string) (string, error) {
+	ct.calls++
+	if ct.err != nil {
+		return "", ct.err
+	}
+	return target + ":" + text, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// runUsage runs the usage subcommand, of which there is only export for
+// now.
+func runUsage(args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Fprintf(os.Stderr, "Usage: laff usage export [flags]\n")
+		return errors.New("usage needs the export subcommand")
+	}
+	return runUsageExport(args[1:])
+}
+
+// runUsageExport streams the per-key, per-day usage of a running server,
+// as CSV or NDJSON, to a file or stdout.  The API key must be an admin
+// key.
+func runUsageExport(args []string) error {
+	var cfg clientConfig
+	var format, from, to, out string
+	fs := flag.NewFlagSet("usage export", flag.ExitOnError)
+	cfg.register(fs)
+	fs.StringVar(&format, "format", "csv", "format of the records: csv or ndjson")
+	fs.StringVar(&from, "from", "", "first day exported, like 2006-01-02 (from the start if empty)")
+	fs.StringVar(&to, "to", "", "last day exported, like 2006-01-02 (to the end if empty)")
+	fs.StringVar(&out, "o", "", "file to write the records to (stdout if empty)")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	q := url.Values{"format": {format}}
+	if from != "" {
+		q.Set("from", from)
+	}
+	if to != "" {
+		q.Set("to", to)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.timeout)*time.Second)
+	defer cancel()
+	req, err := cfg.newRequest(ctx, "/v1/admin/usage?"+q.Encode())
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return statusError(resp.StatusCode, b)
+	}
+
+	w := io.Writer(os.Stdout)
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("export cut short: %v", err)
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+// secretFlags are the settings whose values aren't printed.
+var secretFlags = map[string]bool{
+	"apikeys":        true,
+	"admin-keys":     true,
+	"limit-exempt":   true,
+	"sign-secret":    true,
+	"register-token": true,
+	"vault-token":    true,
+	"redis-password": true,
+	"gossip-key":     true,
+	"translate-key":  true,
+	"name-token":     true,
+	"joke-token":     true,
+	"smtp-password":  true,
+	"slo-alert-key":  true,
+	"slo-alert-urls": true,
+}
+
+// proxyFlags are the settings whose URLs may carry a password, which isn't
+// printed.
+var proxyFlags = map[string]bool{
+	"name-proxy": true,
+	"joke-proxy": true,
+}
+
+// runValidateConfig parses the serve settings from the flags, environment
+// and config file the same way serve does, prints the effective settings
+// and where each came from, and reports any invalid ones.  Nothing is
+// started, so it is safe to run anywhere.
+func runValidateConfig(args []string) error {
+	var cfg serveConfig
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	cfg.register(fs)
+	sources, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if _, err := loadSecrets(context.Background(), &cfg, fs, sources); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "SETTING\tVALUE\tSOURCE\n")
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if (secretFlags[f.Name] || sources[f.Name] == fromVault || sources[f.Name] == fromAWS) && v != "" {
+			v = "<redacted>"
+		}
+		if u, err := url.Parse(v); proxyFlags[f.Name] && err == nil {
+			v = u.Redacted()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Name, v, sources[f.Name])
+	})
+	tw.Flush()
+
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%v", err)
+	}
+	fmt.Println("\nConfiguration is valid.")
+	return nil
+}